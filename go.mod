@@ -3,8 +3,9 @@ module gitlab.com/postmarketOS/postmarketos-mkinitfs
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/cavaliercoder/go-cpio v0.0.0-20180626203310-925f9528c45e
-	github.com/klauspost/compress v1.13.3 // indirect
+	github.com/klauspost/compress v1.13.3
 	github.com/klauspost/pgzip v1.2.5
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
 )
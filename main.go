@@ -5,7 +5,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"debug/elf"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,606 +17,3761 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/archive"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/bootconf"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/bootscr"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/colorlog"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/coreboot"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/depthcharge"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/digest"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/elfutil"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/executor"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/fit"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/history"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/hook"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/hooktest"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/luks"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/misc"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/owner"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/plan"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/policy"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/snapshot"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/state"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/verity"
 )
 
+// Build profiles
+const (
+	profileDefault = "default"
+	// smallest possible initramfs, without splash images, FDE support and
+	// other optional content
+	profileMinimal = "minimal"
+)
+
+// Options that change how the initramfs archives are generated
+type generateOpts struct {
+	// only warn about issues found by lintFiles
+	allowInsecure bool
+	profile       string
+	verbose       bool
+	// used instead of the apk database to look up package owners
+	ownersFile string
+	// only warn about deviceinfo modules that can't be found
+	allowMissingModules bool
+	// LUKS header (or device) used for picking the crypto modules
+	luksHeader string
+	// building without root, e.g. in a user namespace or with fakeroot, so
+	// files on the system aren't expected to be owned by root
+	unprivileged bool
+	// rough limit for the memory used when generating the archives, in
+	// bytes, 0 for no limit
+	maxMemory int64
+	// algorithm for the manifest of files embedded in each archive
+	manifestHash digest.Algorithm
+	compression  archive.Compression
+	// compression level, 0 for the default of the compression
+	compressionLevel int
+	// 0 for the pgzip default
+	gzipBlockSize int
+	// extra files for the initramfs given on the command line, by path in
+	// the archive
+	addFiles map[string]string
+	// extra kernel modules for the initramfs given on the command line
+	addModules []string
+	// don't include splash images, e.g. for devices without a display
+	noSplash bool
+	// names of the splash images to include, all of them if empty
+	splashes []string
+	// include audio feedback for the unlock screen, see
+	// getAccessibilityFiles
+	accessibility bool
+	// text to speech engine for accessibility, espeak-ng if empty
+	tts string
+	// include locale data and fonts for the unlock screen, see
+	// getLocaleFiles
+	locale bool
+	// timestamp for everything in the archives, from SOURCE_DATE_EPOCH
+	sourceDateEpoch time.Time
+	// keep the modification times of files in the archives
+	preserveModTimes bool
+	// write the archives as tarballs for inspecting them instead of
+	// booting, see archive.FormatTar
+	tar bool
+	// directory to stage the contents of the archives in before writing
+	// them, see stageArchive
+	stageDir string
+}
+
+func (opts generateOpts) minimal() bool {
+	return opts.profile == profileMinimal
+}
+
+// Run by fatal before exiting, since deferred functions aren't, e.g. for
+// removing the temporary work dir
+var cleanups []func()
+
+// Log an error and exit. The "ERROR: " prefix makes errors stand out in long
+// build logs (and colored red, see pkgs/colorlog).
+func fatal(v ...interface{}) {
+	log.Print(append([]interface{}{"ERROR: "}, v...)...)
+	exit()
+}
+
+func fatalf(format string, v ...interface{}) {
+	log.Printf("ERROR: "+format, v...)
+	exit()
+}
+
+func exit() {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	os.Exit(1)
+}
+
 func timeFunc(start time.Time, name string) {
 	elapsed := time.Since(start)
 	log.Printf("%s completed in: %s", name, elapsed)
 }
 
+// Value of a flag that can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Subcommands, given as the first argument before any flags. Without one,
+// the archives are generated and deployed.
+var subcommands = map[string]string{
+	"analyze":    "Show what takes up space in the archives, with suggestions for making them smaller, without building them",
+	"doctor":     "Check that everything needed for generating and deploying the archives is available",
+	"list":       "List the contents of an archive (the initramfs in the output directory, or the one given as argument)",
+	"plan":       "Print what would be included in the archives (as JSON) without building them",
+	"restore":    "Copy the files of a snapshot (the newest one, or the one given as argument) back to the output directory",
+	"snapshot":   "Copy the files in the output directory to a new snapshot, for restoring them later",
+	"stats":      "Show the sizes of the archives over the last builds (the number given as argument, all by default), for noticing when they grow",
+	"test-hooks": "Check the hook scripts, init and init_functions.sh for syntax errors and missing commands by running the shell of the initramfs on them (with proot or qemu-user), without booting it",
+}
+
+// Remove the subcommand, if there is one, from the arguments and return it
+func getSubcommand() string {
+	if len(os.Args) < 2 {
+		return ""
+	}
+	cmd := os.Args[1]
+	if _, ok := subcommands[cmd]; !ok {
+		return ""
+	}
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	return cmd
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [command] [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	var names []string
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n    \t%s\n", name, subcommands[name])
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	cmd := getSubcommand()
+	flag.Usage = usage
+
 	deviceinfoFile := "/etc/deviceinfo"
-	if !exists(deviceinfoFile) {
+	// these don't generate anything, so they don't need deviceinfo
+	needsDeviceinfo := cmd != "doctor" && cmd != "snapshot" && cmd != "restore" && cmd != "stats" && cmd != "list"
+	if !exists(deviceinfoFile) && needsDeviceinfo {
 		log.Print("NOTE: deviceinfo (from device package) not installed yet, " +
 			"not building the initramfs now (it should get built later " +
 			"automatically.)")
 		return
 	}
 
+	// doctor reports problems with deviceinfo itself
 	devinfo, err := deviceinfo.ReadDeviceinfo(deviceinfoFile)
-	if err != nil {
-		log.Fatal(err)
+	if err != nil && needsDeviceinfo {
+		fatal(err)
 	}
 
 	outDir := flag.String("d", "/boot", "Directory to output initfs(-extra) and other boot files")
+	allowInsecure := flag.Bool("allow-insecure", false, "Only warn about setuid, world-writable or non-root owned files instead of failing")
+	profile := flag.String("profile", devinfo.MkinitfsProfile, "Build profile, one of: default, minimal (no splash, FDE or other optional content)")
+	maxSize := flag.String("max-size", devinfo.InitfsMaxSize, "Fail if the initramfs is larger than this size (e.g. 8M)")
+	maxMemory := flag.String("max-memory", "", "Keep memory usage roughly below this size (e.g. 64M) by compressing the archives with less parallelism, for devices with little RAM")
+	verbose := flag.Bool("v", false, "Verbose output")
+	splash := flag.Bool("splash", devinfo.MkinitfsSplash != "false", "Include splash images, set deviceinfo_mkinitfs_splash=\"false\" to skip them by default (e.g. for devices without a display)")
+	accessibility := flag.Bool("accessibility", devinfo.MkinitfsAccessibility == "true", "Include a text to speech engine (deviceinfo_mkinitfs_tts, espeak-ng by default) and sounds for audio feedback on the unlock screen, for visually impaired users. Makes initramfs-extra a lot larger, set deviceinfo_mkinitfs_accessibility=\"true\" to include them by default")
+	locale := flag.Bool("locale", devinfo.MkinitfsLocale == "true", "Include the locale data and fontconfig configuration of the system for rendering non-ASCII text (e.g. passphrase hints) on the unlock screen. Includes all of /etc/fonts, set deviceinfo_mkinitfs_locale=\"true\" to include them by default")
+	flag.BoolVar(&ignoreElfErrors, "ignore-elf-errors", false, "Include ELF files that can't be parsed without their dependencies, instead of failing")
+	ownersFile := flag.String("owners", "", "File mapping paths to packages (\"<path> <package>\" per line), used instead of the apk database to find which package owns each hook")
+	allowMissingModules := flag.Bool("allow-missing-modules", false, "Only warn about modules in deviceinfo_modules_initfs that can't be found, instead of failing")
+	luksHeader := flag.String("luks-header", "", "Encrypted root partition or LUKS header backup, used for only including the crypto modules needed for unlocking it")
+	unprivileged := flag.Bool("unprivileged", false, "Build without root (e.g. with fakeroot or in a user namespace): don't require files to be owned by root, and copy the archives to the output directory instead of running boot-deploy")
+	color := flag.String("color", "auto", "Color the output, one of: auto (if the output is a terminal and NO_COLOR isn't set), always, never")
+	trigger := flag.String("trigger", "", "What triggered this run, one of: deviceinfo (only rebuild if inputs used by mkinitfs changed since the last build)")
+	stateFile := flag.String("state", state.DefaultPath, "File recording the inputs of the last successful build")
+	historyFile := flag.String("history", history.DefaultPath, "File recording statistics (sizes, duration, file counts) of past builds, shown by the stats command")
+	snapshotDir := flag.String("snapshot-dir", snapshot.DefaultDir, "Directory for snapshots of the output directory, used by the snapshot and restore commands")
+	compression := flag.String("compression", "", "Compression of the archives, one of: gzip, zstd, none (uncompressed cpio), with an optional level: a number, or one of fast, default, best (e.g. gzip:best, the default is gzip:fast). Overrides deviceinfo_initfs_compression")
+	gzipBlockSize := flag.String("gzip-block-size", "", "Size of the blocks compressed in parallel with gzip (e.g. 512K), larger blocks compress slightly better but use more memory")
+	manifestHash := flag.String("manifest-hash", string(digest.SHA256), "Checksum algorithm for the manifest embedded in the archives, one of: sha256 (can be checked with busybox), sha512, blake2b, xxh64 (fastest, but only detects corruption)")
+	releaseNames := flag.Bool("release-names", false, "Name the initramfs initramfs-<kernel release> (e.g. initramfs-6.1.0-postmarketos-qcom), like bootloader configs of other distributions expect, instead of initramfs. initramfs-extra keeps its name, since the initramfs loads it by name")
+	preserveModTimes := flag.Bool("preserve-mtimes", false, "Keep the modification times of files in the archives, e.g. for finding out where they come from when debugging, instead of setting all of them to 0 (or SOURCE_DATE_EPOCH) for reproducible builds")
+	growthWarning := flag.String("growth-warning", "10%", "Warn if an archive grew by more than this since the last recorded build, a percentage (e.g. 10%) or a size (e.g. 512K), 0 to disable")
+	checksum := flag.String("checksum", devinfo.MkinitfsChecksum, "Checksum algorithm for the files written next to the archives (e.g. initramfs.sha256, in the format of sha256sum) for verifying them after deploying or flashing, one of: sha256 (the default), sha512, blake2b, xxh64, none. Overrides deviceinfo_mkinitfs_checksum")
+	stageDir := flag.String("stage-dir", "", "Stage the contents of each archive as a directory tree in <dir>/<archive name> (replacing a previous one) and write the archive from it, e.g. for inspecting exactly what's in it or for testing hooks with chroot")
+	fromDir := flag.String("from-dir", "", "Generate the archives from the directory trees in <dir>/initramfs and <dir>/initramfs-extra (e.g. prepared by other tooling, or with -stage-dir), instead of from the files on the system, and deploy them as usual")
+	outputFormat := flag.String("output-format", "cpio", "Format of the archives, one of: cpio, tar (for inspecting or comparing the files in CI, not for booting: the archives are only written to the output directory as <name>.tar(.gz, ...), without deploying them)")
+	cleanStale := flag.String("clean-stale", "", "Clean up initramfs, kernel and other files of kernels that aren't installed anymore from the output directory after deploying, one of: list (only print them), remove")
+	var addFiles, addModules stringList
+	flag.Var(&addFiles, "add-file", "Add a file to the initramfs, as <path>[:<path in the archive>], with its dependencies, for one-off builds (e.g. for debugging). Can be given multiple times")
+	flag.Var(&addModules, "add-module", "Add a kernel module to the initramfs, by name, with its dependencies, for one-off builds. Can be given multiple times")
 	flag.Parse()
 
-	defer timeFunc(time.Now(), "mkinitfs")
+	if err := i18n.Load(i18n.DefaultDir, i18n.Language()); err != nil {
+		log.Print("WARNING: ", err)
+	}
 
-	kernVer, err := getKernelVersion()
-	if err != nil {
-		log.Fatal(err)
+	switch *color {
+	case "auto":
+		if colorlog.Enabled(os.Stderr) {
+			log.SetOutput(colorlog.NewWriter(os.Stderr))
+		}
+	case "always":
+		log.SetOutput(colorlog.NewWriter(os.Stderr))
+	case "never":
+	default:
+		fatal(i18n.Sprintf(i18n.UnknownColorMode, *color))
 	}
 
-	// temporary working dir
-	workDir, err := ioutil.TempDir("", "mkinitfs")
-	if err != nil {
-		log.Fatal("Unable to create temporary work directory:", err)
+	switch cmd {
+	case "snapshot":
+		path, err := snapshot.Create(*outDir, *snapshotDir, time.Now())
+		if err != nil {
+			fatal("Unable to create snapshot: ", err)
+		}
+		log.Print("Created snapshot of ", *outDir, ": ", path)
+		return
+	case "restore":
+		name := flag.Arg(0)
+		if name == "" {
+			if name, err = snapshot.Latest(*snapshotDir); err != nil {
+				fatal(err)
+			}
+		}
+		if err := snapshot.Restore(*snapshotDir, name, *outDir); err != nil {
+			fatal("Unable to restore snapshot: ", err)
+		}
+		log.Print("Restored snapshot ", name, " to ", *outDir)
+		return
+	case "stats":
+		n := 0
+		if flag.Arg(0) != "" {
+			if n, err = strconv.Atoi(flag.Arg(0)); err != nil || n < 1 {
+				fatalf("Invalid number of builds: %q", flag.Arg(0))
+			}
+		}
+		builds, err := history.Read(*historyFile)
+		if err != nil {
+			fatal(err)
+		}
+		history.Plot(os.Stdout, builds, n)
+		return
+	case "list":
+		path := flag.Arg(0)
+		if path == "" {
+			path = filepath.Join(*outDir, "initramfs")
+		}
+		entries, err := archive.List(path)
+		if err != nil {
+			fatal("Unable to read archive: ", err)
+		}
+		printEntries(os.Stdout, entries)
+		return
 	}
-	defer os.RemoveAll(workDir)
 
-	log.Print("Generating for kernel version: ", kernVer)
-	log.Print("Output directory: ", *outDir)
+	opts := generateOpts{
+		allowInsecure: *allowInsecure,
+		profile:       *profile,
+		verbose:       *verbose,
+		ownersFile:    *ownersFile,
+
+		allowMissingModules: *allowMissingModules,
+		luksHeader:          *luksHeader,
+		unprivileged:        *unprivileged,
+		noSplash:            !*splash,
+		splashes:            strings.Fields(devinfo.MkinitfsSplashes),
+		accessibility:       *accessibility,
+		tts:                 devinfo.MkinitfsTts,
+		locale:              *locale,
+		preserveModTimes:    *preserveModTimes,
+		stageDir:            *stageDir,
+	}
+	if opts.profile == "" {
+		opts.profile = profileDefault
+	}
+	switch *outputFormat {
+	case "cpio":
+	case "tar":
+		opts.tar = true
+	default:
+		fatalf("Unknown output format: %q", *outputFormat)
+	}
+
+	opts.compression, opts.compressionLevel, err = getCompression(devinfo, *compression)
+	if err != nil {
+		fatal(err)
+	}
+	if *gzipBlockSize != "" {
+		size, err := misc.ParseSize(*gzipBlockSize)
+		if err != nil {
+			fatal("Invalid gzip block size: ", err)
+		}
+		opts.gzipBlockSize = int(size)
+	}
+	opts.addFiles, err = parseAddFiles(addFiles)
+	if err != nil {
+		fatal(err)
+	}
+	opts.addModules = addModules
 
-	if err := generateInitfs("initramfs", workDir, kernVer, devinfo); err != nil {
-		log.Fatal("generateInitfs: ", err)
+	// before validating the options, which may come from deviceinfo
+	if cmd == "doctor" {
+		if failed := printDoctorReport(os.Stdout, doctor(deviceinfoFile, *outDir, opts)); failed > 0 {
+			fatal(i18n.Sprintf(i18n.DoctorFailed, failed))
+		}
+		return
 	}
 
-	if err := generateInitfsExtra("initramfs-extra", workDir, devinfo); err != nil {
-		log.Fatal("generateInitfsExtra: ", err)
+	if opts.profile != profileDefault && opts.profile != profileMinimal {
+		fatal(i18n.Sprintf(i18n.UnknownProfile, opts.profile))
 	}
 
-	// Final processing of initramfs / kernel is done by boot-deploy
-	if err := bootDeploy(workDir, *outDir); err != nil {
-		log.Fatal("bootDeploy: ", err)
+	var maxSizeBytes int64
+	if *maxSize != "" {
+		maxSizeBytes, err = misc.ParseSize(*maxSize)
+		if err != nil {
+			fatal(i18n.Sprintf(i18n.InvalidMaxSize, err))
+		}
 	}
 
-}
+	checksumAlg, err := getChecksumAlgorithm(*checksum)
+	if err != nil {
+		fatal(err)
+	}
 
-func bootDeploy(workDir string, outDir string) error {
-	// boot-deploy expects the kernel to be in the same dir as initramfs.
-	// Assume that the kernel is in the output dir...
-	log.Print("== Using boot-deploy to finalize/install files ==")
-	kernels, _ := filepath.Glob(filepath.Join(outDir, "vmlinuz*"))
-	if len(kernels) == 0 {
-		return errors.New("Unable to find any kernels at " + filepath.Join(outDir, "vmlinuz*"))
+	growthThreshold, err := history.ParseThreshold(*growthWarning)
+	if err != nil {
+		fatal("Invalid growth warning threshold: ", err)
 	}
 
-	// Pick a kernel that does not have suffixes added by boot-deploy
-	var kernFile string
-	for _, f := range kernels {
-		if strings.HasSuffix(f, "-dtb") || strings.HasSuffix(f, "-mtk") {
-			continue
+	if *maxMemory != "" {
+		opts.maxMemory, err = misc.ParseSize(*maxMemory)
+		if err != nil {
+			fatal(i18n.Sprintf(i18n.InvalidMaxMemory, err))
 		}
-		kernFile = f
-		break
+		// collect garbage more often, so the heap stays closer to what is in
+		// use
+		debug.SetGCPercent(20)
 	}
 
-	kernFd, err := os.Open(kernFile)
+	opts.manifestHash, err = digest.Parse(*manifestHash)
 	if err != nil {
-		return err
+		fatal(err)
 	}
-	defer kernFd.Close()
 
-	kernFileCopy, err := os.Create(filepath.Join(workDir, "vmlinuz"))
+	opts.sourceDateEpoch, err = getSourceDateEpoch(os.Getenv("SOURCE_DATE_EPOCH"))
 	if err != nil {
-		return err
+		fatal(err)
 	}
 
-	if _, err = io.Copy(kernFileCopy, kernFd); err != nil {
-		return err
+	if *fromDir != "" {
+		switch {
+		case cmd == "plan" || cmd == "analyze":
+			fatalf("%s can't be used with -from-dir", cmd)
+		case opts.stageDir != "":
+			fatal("-stage-dir can't be used with -from-dir")
+		}
 	}
-	kernFileCopy.Close()
 
-	// boot-deploy -i initramfs -k vmlinuz-postmarketos-rockchip -d /tmp/cpio -o /tmp/foo initramfs-extra
-	cmd := exec.Command("boot-deploy",
-		"-i", "initramfs",
-		"-k", "vmlinuz",
-		"-d", workDir,
-		"-o", outDir,
-		"initramfs-extra")
-	if !exists(cmd.Path) {
-		return errors.New("boot-deploy command not found")
+	switch *cleanStale {
+	case "", "list", "remove":
+	default:
+		fatal(i18n.Sprintf(i18n.UnknownCleanStaleMode, *cleanStale))
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Print("'boot-deploy' command failed")
-		return err
+	start := time.Now()
+	defer timeFunc(start, "mkinitfs")
+
+	kernVer, err := getKernelVersion()
+	if err != nil {
+		fatal(err)
 	}
 
-	return nil
-}
+	flavor, err := getKernelFlavor()
+	if err != nil {
+		fatal(err)
+	}
 
-func exists(file string) bool {
-	if _, err := os.Stat(file); err == nil {
-		return true
+	// the kernel may not be installed yet, bootDeploy fails later if so
+	kernel, _ := findKernel(*outDir)
+	if err := checkArchConsistency(devinfo, "/bin/busybox", kernel); err != nil {
+		fatal(err)
 	}
-	return false
-}
 
-func getHookFiles(filesdir string) misc.StringSet {
-	fileInfo, err := ioutil.ReadDir(filesdir)
+	inputs, err := getBuildState(devinfo, kernVer, flavor, *outDir)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Unable to get build inputs: ", err)
 	}
-	files := make(misc.StringSet)
-	for _, file := range fileInfo {
-		path := filepath.Join(filesdir, file.Name())
-		f, err := os.Open(path)
+	switch *trigger {
+	case "":
+	case "deviceinfo":
+		last, err := state.Read(*stateFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal(i18n.Sprintf(i18n.UnreadableState, err))
 		}
-		defer f.Close()
-		s := bufio.NewScanner(f)
-		for s.Scan() {
-			if !exists(s.Text()) {
-				log.Fatalf("Unable to find file %q required by %q", s.Text(), path)
-			}
-			files[s.Text()] = false
+		if len(last) == 0 {
+			log.Print(i18n.Sprintf(i18n.NoPreviousBuild))
+			break
 		}
-		if err := s.Err(); err != nil {
-			log.Fatal(err)
+		changes := inputs.Diff(last)
+		if len(changes) == 0 {
+			log.Print(i18n.Sprintf(i18n.NoRebuildNeeded))
+			return
 		}
+		log.Print(i18n.Sprintf(i18n.RebuildNeeded))
+		for _, c := range changes {
+			log.Print("- ", explainChange(c))
+		}
+	default:
+		fatal(i18n.Sprintf(i18n.UnknownTrigger, *trigger))
 	}
-	return files
-}
 
-// Recursively list all dependencies for a given ELF binary
-func getBinaryDeps(files misc.StringSet, file string) error {
-	// if file is a symlink, resolve dependencies for target
-	fileStat, err := os.Lstat(file)
+	// stops generating and deploying when mkinitfs is asked to stop, e.g.
+	// during a package upgrade that is interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// temporary working dir
+	workDir, err := ioutil.TempDir("", "mkinitfs")
 	if err != nil {
-		log.Print("getBinaryDeps: failed to stat file")
-		return err
+		fatal("Unable to create temporary work directory:", err)
 	}
+	defer os.RemoveAll(workDir)
+	cleanups = append(cleanups, func() { os.RemoveAll(workDir) })
 
-	// Symlink: write symlink to archive then set 'file' to link target
-	if fileStat.Mode()&os.ModeSymlink != 0 {
-		target, err := os.Readlink(file)
+	log.Print("Generating for kernel version: ", kernVer)
+	log.Print("Kernel flavor: ", flavor)
+	log.Print("Output directory: ", *outDir)
+
+	// the files from the system, none with -from-dir
+	initfsFiles := make(misc.StringSet)
+	initfsExtraFiles := make(misc.StringSet)
+	if *fromDir == "" {
+		initfsFiles, err = getInitfsFileSet(ctx, kernVer, flavor, devinfo, opts)
 		if err != nil {
-			log.Print("getBinaryDeps: unable to read symlink: ", file)
-			return err
+			fatal("getInitfsFileSet: ", err)
 		}
-		if !filepath.IsAbs(target) {
-			target, err = misc.RelativeSymlinkTargetToDir(target, filepath.Dir(file))
-			if err != nil {
-				return err
-			}
-		}
-		if err := getBinaryDeps(files, target); err != nil {
-			return err
+
+		initfsExtraFiles, err = getInitfsExtraFileSet(ctx, initfsFiles, flavor, devinfo, opts)
+		if err != nil {
+			fatal("getInitfsExtraFileSet: ", err)
 		}
-		return err
 	}
 
-	// get dependencies for binaries
-	fd, err := elf.Open(file)
-	if err != nil {
-		log.Fatal(err)
+	// files in workDir, in addition to the initramfs, to install with boot-deploy
+	deployFiles := getDeployFiles(devinfo)
+
+	if cmd == "plan" {
+		p := getPlan(kernVer, flavor, initfsFiles, initfsExtraFiles, devinfo, opts)
+		p.Deploy = plan.Deploy{OutDir: *outDir, Files: deployFiles}
+		if err := p.WriteJSON(os.Stdout); err != nil {
+			fatal(err)
+		}
+		return
 	}
-	libs, _ := fd.ImportedLibraries()
-	fd.Close()
-	files[file] = false
 
-	if len(libs) == 0 {
-		return err
+	if cmd == "analyze" {
+		p := getPlan(kernVer, flavor, initfsFiles, initfsExtraFiles, devinfo, opts)
+		for _, a := range p.Archives {
+			printAnalysis(os.Stdout, a, getFileSizes(a), devinfo, opts)
+		}
+		return
 	}
 
-	libdirs := []string{"/usr/lib", "/lib"}
-	for _, lib := range libs {
-		found := false
-		for _, libdir := range libdirs {
-			path := filepath.Join(libdir, lib)
-			if _, err := os.Stat(path); err == nil {
-				err := getBinaryDeps(files, path)
-				if err != nil {
-					return err
-				}
-				files[path] = false
-				found = true
-				break
+	if cmd == "test-hooks" {
+		tree := filepath.Join(*fromDir, "initramfs")
+		if *fromDir == "" {
+			if opts.stageDir == "" {
+				opts.stageDir = filepath.Join(workDir, "stage")
+			}
+			if err := generateArchives(ctx, workDir, initfsFiles, initfsExtraFiles, flavor, devinfo, opts); err != nil {
+				fatal(err)
 			}
+			tree = filepath.Join(opts.stageDir, "initramfs")
 		}
-		if !found {
-			log.Fatalf("Unable to locate dependency for %q: %s", file, lib)
+		problems, err := testHooks(ctx, tree, devinfo)
+		if err != nil {
+			fatal("testHooks: ", err)
 		}
+		for _, p := range problems {
+			log.Print("- ", p)
+		}
+		if len(problems) > 0 {
+			fatalf("%d problem(s) found in the scripts of the initramfs", len(problems))
+		}
+		log.Print("No problems found in the scripts of the initramfs")
+		return
 	}
 
-	return nil
-}
+	if *fromDir != "" {
+		if err := generateFromDir(ctx, workDir, *fromDir, devinfo, opts); err != nil {
+			fatal("generateFromDir: ", err)
+		}
+	} else if err := generateArchives(ctx, workDir, initfsFiles, initfsExtraFiles, flavor, devinfo, opts); err != nil {
+		fatal(err)
+	}
 
-func getFiles(files misc.StringSet, newFiles misc.StringSet, required bool) error {
-	for file := range newFiles {
-		err := getFile(files, file, required)
+	if opts.tar {
+		var names []string
+		for _, name := range []string{"initramfs", "initramfs-extra"} {
+			tarName := getTarName(name, opts.compression)
+			if err := os.Rename(filepath.Join(workDir, name), filepath.Join(workDir, tarName)); err != nil {
+				fatal(err)
+			}
+			names = append(names, tarName)
+		}
+		sums, err := writeChecksums(workDir, names, checksumAlg)
 		if err != nil {
-			return err
+			fatal("writeChecksums: ", err)
+		}
+		if err := copyArtifacts(workDir, *outDir, append(names, sums...)); err != nil {
+			fatal("copyArtifacts: ", err)
 		}
+		return
 	}
-	return nil
-}
 
-func getFile(files misc.StringSet, file string, required bool) error {
-	if !exists(file) {
-		if required {
-			return errors.New("getFile: File does not exist :" + file)
+	initfsName := getInitfsName(kernVer, *releaseNames)
+	if initfsName != "initramfs" {
+		if err := os.Rename(filepath.Join(workDir, "initramfs"), filepath.Join(workDir, initfsName)); err != nil {
+			fatal(err)
 		}
-		return nil
 	}
 
-	files[file] = false
-
-	// get dependencies for binaries
-	if _, err := elf.Open(file); err != nil {
-		// file is not an elf, so don't resolve lib dependencies
-		return nil
+	if err := sizeReport(workDir, initfsName, "initramfs-extra", maxSizeBytes); err != nil {
+		fatal("sizeReport: ", err)
 	}
 
-	err := getBinaryDeps(files, file)
-	if err != nil {
-		return err
+	// the archives of the last build are still in the output directory,
+	// for comparing
+	if builds, err := history.Read(*historyFile); err != nil {
+		log.Print("WARNING: unable to read build statistics: ", err)
+	} else {
+		for _, w := range getGrowthWarnings(workDir, *outDir, []string{initfsName, "initramfs-extra"}, builds, growthThreshold, opts.manifestHash) {
+			log.Print("WARNING: ", w)
+		}
 	}
 
-	return nil
-}
+	if len(elfErrors) > 0 {
+		log.Printf("WARNING: %d ELF file(s) could not be parsed, their dependencies may be missing:", len(elfErrors))
+		for _, err := range elfErrors {
+			log.Print("- ", err)
+		}
+	}
 
-func getOskConfFontPath(oskConfPath string) (string, error) {
-	var path string
-	f, err := os.Open(oskConfPath)
+	sums, err := writeChecksums(workDir, []string{initfsName, "initramfs-extra"}, checksumAlg)
 	if err != nil {
-		return path, err
+		fatal("writeChecksums: ", err)
 	}
-	defer f.Close()
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		fields := strings.Fields(s.Text())
-		// "key = val" is 3 fields
-		if len(fields) > 2 && fields[0] == "keyboard-font" {
-			path = fields[2]
+	deployFiles = append(deployFiles, sums...)
+
+	for _, img := range bootImages {
+		if !img.enabled(devinfo) {
+			continue
+		}
+		if err := img.generate(ctx, img.name, workDir, *outDir, initfsName, devinfo, opts); err != nil {
+			fatalf("Unable to generate %s: %s", img.name, err)
 		}
-	}
-	if !exists(path) {
-		return path, errors.New("Unable to find font: " + path)
 	}
 
-	return path, nil
-}
+	if opts.unprivileged {
+		// boot-deploy needs root for flashing or installing to /boot
+		if err := copyArtifacts(workDir, *outDir, append([]string{initfsName}, deployFiles...)); err != nil {
+			fatal("copyArtifacts: ", err)
+		}
+	} else {
+		// Final processing of initramfs / kernel is done by boot-deploy
+		if err := bootDeploy(ctx, executor.NewHost(), workDir, *outDir, initfsName, deployFiles); err != nil {
+			fatal("bootDeploy: ", err)
+		}
+	}
 
-// Get a list of files and their dependencies related to supporting rootfs full
-// disk (d)encryption
-func getFdeFiles(files misc.StringSet, devinfo deviceinfo.DeviceInfo) error {
-	confFiles := misc.StringSet{
-		"/etc/osk.conf":   false,
-		"/etc/ts.conf":    false,
-		"/etc/pointercal": false,
-		"/etc/fb.modes":   false,
-		"/etc/directfbrc": false,
+	if err := writeBootConfigs(*outDir, initfsName, devinfo); err != nil {
+		fatal("writeBootConfigs: ", err)
 	}
-	// TODO: this shouldn't be false? though some files (pointercal) don't always exist...
-	if err := getFiles(files, confFiles, false); err != nil {
-		return err
+
+	if *cleanStale != "" {
+		if err := cleanStaleArtifacts(*outDir, *cleanStale == "list"); err != nil {
+			fatal("cleanStaleArtifacts: ", err)
+		}
 	}
 
-	// osk-sdl
-	oskFiles := misc.StringSet{
-		"/usr/bin/osk-sdl":    false,
-		"/sbin/cryptsetup":    false,
-		"/usr/lib/libGL.so.1": false}
-	if err := getFiles(files, oskFiles, true); err != nil {
-		return err
+	// the archives from -from-dir don't depend on the inputs, so the next
+	// build triggered by deviceinfo still has to regenerate them
+	if *fromDir == "" {
+		if err := inputs.Write(*stateFile); err != nil {
+			log.Print(i18n.Sprintf(i18n.UnsavedBuildState, err))
+		}
 	}
 
-	fontFile, err := getOskConfFontPath("/etc/osk.conf")
+	build, err := getBuildStats(workDir, kernVer, start, map[string]misc.StringSet{
+		initfsName:        initfsFiles,
+		"initramfs-extra": initfsExtraFiles,
+	})
+	if err == nil {
+		err = history.Append(*historyFile, build)
+	}
 	if err != nil {
-		return err
+		log.Print("WARNING: unable to record build statistics: ", err)
 	}
-	files[fontFile] = false
+}
+
+// Print the entries of an archive like ls -l does, in the order they are in
+// the archive
+func printEntries(w io.Writer, entries []archive.Entry) {
+	for _, e := range entries {
+		line := fmt.Sprintf("%s %8s %s", e.FileMode(), misc.FormatSize(e.Size), e.Name)
+		if e.IsSymlink() {
+			line += " -> " + e.Linkname
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// Get the statistics of a build started at the given time, for the history.
+// archives has the files from the system in each archive in workDir, by name.
+func getBuildStats(workDir string, kernVer string, start time.Time, archives map[string]misc.StringSet) (history.Build, error) {
+	build := history.Build{
+		Time:          start.UTC(),
+		KernelVersion: kernVer,
+		Duration:      time.Since(start).Seconds(),
+	}
+
+	var names []string
+	for name := range archives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(workDir, name))
+		if err != nil {
+			return build, err
+		}
+		build.Archives = append(build.Archives, history.Archive{Name: name, Size: info.Size(), Files: len(archives[name])})
+	}
+
+	return build, nil
+}
+
+// Number of files listed when an archive grew more than the threshold
+const maxGrowthChanges = 10
+
+// Compare the size of the archives in workDir with the last recorded build,
+// and explain the archives that grew more than the threshold. The archives
+// written by the last build in outDir are compared with the new ones to list
+// the files that grew the most, the manifest is pointed at if they can't be
+// read.
+func getGrowthWarnings(workDir string, outDir string, names []string, builds []history.Build, t history.Threshold, alg digest.Algorithm) []string {
+	var warnings []string
+	for _, name := range names {
+		last, old, ok := history.Last(builds, name)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(workDir, name))
+		if err != nil || !t.Exceeded(old.Size, info.Size()) {
+			continue
+		}
+		growth := fmt.Sprintf("%s -> %s", misc.FormatSize(old.Size), misc.FormatSize(info.Size()))
+		if old.Size > 0 {
+			growth += fmt.Sprintf(" (%+.1f%%)", float64(info.Size()-old.Size)*100/float64(old.Size))
+		}
+		warnings = append(warnings, fmt.Sprintf("%s grew more than %s since the last build (%s, kernel %s): %s",
+			name, t, last.Time.Local().Format("2006-01-02 15:04"), last.KernelVersion, growth))
+
+		changes, err := getFileGrowth(filepath.Join(outDir, name), filepath.Join(workDir, name))
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("compare %s in the previous and the new %s to find out what was added", manifestPath(name, alg), name))
+			continue
+		}
+		if len(changes) > maxGrowthChanges {
+			changes = changes[:maxGrowthChanges]
+		}
+		warnings = append(warnings, fmt.Sprintf("files that grew the most in %s (see %s):", name, manifestPath(name, alg)))
+		for _, c := range changes {
+			warnings = append(warnings, "- "+c)
+		}
+	}
+	return warnings
+}
+
+// Compare the entries of two archives, and describe the files that are new
+// or larger in the new one, largest growth first
+func getFileGrowth(oldPath string, newPath string) ([]string, error) {
+	oldEntries, err := archive.ReadEntries(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := archive.ReadEntries(newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	type change struct {
+		path   string
+		growth int64
+		added  bool
+	}
+	var changes []change
+	for path, e := range newEntries {
+		o, ok := oldEntries[path]
+		if e.Size > o.Size {
+			changes = append(changes, change{path, e.Size - o.Size, !ok})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].growth != changes[j].growth {
+			return changes[i].growth > changes[j].growth
+		}
+		return changes[i].path < changes[j].path
+	})
+
+	var lines []string
+	for _, c := range changes {
+		line := fmt.Sprintf("%s: +%s", c.path, misc.FormatSize(c.growth))
+		if c.added {
+			line += " (new)"
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// Returns the inputs that, when changed, require the initramfs to be
+// regenerated. deviceinfo variables that aren't used by mkinitfs (or
+// boot-deploy) are not part of the state, so changing them doesn't cause a
+// rebuild. Hook files are recorded by their sha256.
+func getBuildState(devinfo deviceinfo.DeviceInfo, kernVer string, flavor string, outDir string) (state.State, error) {
+	s := state.State{
+		"kernel_version": kernVer,
+		"output_dir":     outDir,
+	}
+	for name, val := range devinfo.Fields() {
+		s[name] = val
+	}
+	inputFiles := getAllHookFiles(flavor)
+	if exists(requiredModulesConf) {
+		inputFiles = append(inputFiles, requiredModulesConf)
+	}
+	for _, src := range getOverlayFiles(overlayDir) {
+		inputFiles = append(inputFiles, src)
+	}
+	for _, file := range inputFiles {
+		hash, err := state.HashFile(file)
+		if err != nil {
+			return s, err
+		}
+		s["file:"+file] = hash
+	}
+	return s, nil
+}
+
+// Describe a change in the build inputs, for explaining why a rebuild is
+// needed
+func explainChange(c state.Change) string {
+	var what string
+	switch {
+	case strings.HasPrefix(c.Name, "deviceinfo_"):
+		what = "deviceinfo field " + c.Name
+	case strings.HasPrefix(c.Name, "file:"):
+		path := strings.TrimPrefix(c.Name, "file:")
+		if strings.HasSuffix(path, ".modules") || path == requiredModulesConf {
+			what = "module file " + path
+		} else {
+			what = "hook " + path
+		}
+		// the values are hashes, which aren't useful to show
+		switch {
+		case c.Old == "":
+			return what + " was added"
+		case c.New == "":
+			return what + " was removed"
+		default:
+			return what + " was modified"
+		}
+	case c.Name == "kernel_version":
+		what = "kernel version"
+	case c.Name == "output_dir":
+		what = "output directory"
+	default:
+		what = c.Name
+	}
+
+	return fmt.Sprintf("%s changed: %q -> %q", what, c.Old, c.New)
+}
+
+// Get the name of the initramfs in the output directory, initramfs-<kernel
+// release> with releaseNames
+func getInitfsName(kernVer string, releaseNames bool) string {
+	if releaseNames {
+		return "initramfs-" + kernVer
+	}
+	return "initramfs"
+}
+
+// Get the files, in addition to the initramfs, that are installed with
+// boot-deploy
+func getDeployFiles(devinfo deviceinfo.DeviceInfo) []string {
+	files := []string{"initramfs-extra"}
+	if devinfo.InitfsExtraVerity == "true" {
+		files = append(files, "initramfs-extra.verity")
+	}
+	for _, img := range bootImages {
+		if img.enabled(devinfo) {
+			files = append(files, img.name)
+		}
+	}
+	return files
+}
+
+// Get the plan for generating the archives with the given files, without
+// building them
+func getPlan(kernVer string, flavor string, initfsFiles misc.StringSet, initfsExtraFiles misc.StringSet, devinfo deviceinfo.DeviceInfo, opts generateOpts) plan.Plan {
+	initfs := plan.NewArchive("initramfs", initfsFiles)
+	initfs.Entries = getInitfsEntries(flavor, opts)
+	initfs.Generated = []string{manifestPath("initramfs", opts.manifestHash), "/etc/mkinitfs/hooks"}
+	if devinfo.InitfsExtraVerity == "true" {
+		initfs.Generated = append(initfs.Generated, "/etc/mkinitfs/initramfs-extra.verity")
+	}
+	if exists("/etc/postmarketos-mkinitfs/secrets") {
+		for secret := range getHookFiles("/etc/postmarketos-mkinitfs/secrets") {
+			initfs.Secrets = append(initfs.Secrets, secret)
+		}
+		sort.Strings(initfs.Secrets)
+	}
+
+	for dest, src := range getOverlayFiles(overlayDir) {
+		initfs.Entries[dest] = src
+	}
+
+	extra := plan.NewArchive("initramfs-extra", initfsExtraFiles)
+	extra.Generated = []string{manifestPath("initramfs-extra", opts.manifestHash)}
+
+	return plan.Plan{
+		KernelVersion: kernVer,
+		Flavor:        flavor,
+		Archives:      []plan.Archive{initfs, extra},
+	}
+}
+
+// Files at least this large are listed by the analyze subcommand
+const largeFileSize = 1 << 20
+
+// A way to make an archive smaller, and how much it would save (at most)
+type suggestion struct {
+	size int64
+	msg  string
+}
+
+// Returns the size of each regular file in the archive, by path on the
+// system. Symlinks are left out, since their size is negligible.
+func getFileSizes(a plan.Archive) map[string]int64 {
+	sizes := make(map[string]int64)
+	files := append(append([]string{}, a.Files...), a.Modules...)
+	for _, src := range a.Entries {
+		files = append(files, src)
+	}
+	for _, file := range files {
+		if stat, err := os.Lstat(file); err == nil && stat.Mode().IsRegular() {
+			sizes[file] = stat.Size()
+		}
+	}
+	return sizes
+}
+
+// Returns the binaries that depend on the library, as found when resolving
+// dependencies. Other libraries are only returned when no binary depends on
+// it directly.
+func getDependents(lib string) []string {
+	var bins, libs []string
+	for file, deps := range binaryDeps {
+		if file == lib {
+			continue
+		}
+		if _, ok := deps[lib]; !ok {
+			continue
+		}
+		if strings.Contains(filepath.Base(file), ".so") {
+			libs = append(libs, file)
+		} else {
+			bins = append(bins, file)
+		}
+	}
+	if len(bins) == 0 {
+		bins = libs
+	}
+	sort.Strings(bins)
+	return bins
+}
+
+// Look for things that take up a lot of space in the archive, and suggest how
+// to make it smaller. Suggestions are sorted by how much they would save.
+func analyzeArchive(a plan.Archive, sizes map[string]int64, devinfo deviceinfo.DeviceInfo, opts generateOpts) []suggestion {
+	var suggestions []suggestion
+
+	var crypto, firmware int64
+	for _, mod := range a.Modules {
+		if strings.Contains(mod, "/kernel/crypto/") || strings.Contains(mod, "/kernel/drivers/crypto/") {
+			crypto += sizes[mod]
+		}
+	}
+	for _, file := range a.Files {
+		if strings.HasPrefix(file, "/lib/firmware/") {
+			firmware += sizes[file]
+		}
+	}
+	if crypto > 0 && devinfo.InitfsCryptoAlgorithms == "" && opts.luksHeader == "" {
+		suggestions = append(suggestions, suggestion{crypto, fmt.Sprintf(
+			"crypto modules account for %s; set deviceinfo_initfs_crypto_algorithms or use -luks-header to only include the ones needed",
+			misc.FormatSize(crypto))})
+	}
+	if firmware > 0 && a.Name == "initramfs" {
+		suggestions = append(suggestions, suggestion{firmware, fmt.Sprintf(
+			"firmware accounts for %s; only firmware needed before initramfs-extra is loaded has to be in the initramfs",
+			misc.FormatSize(firmware))})
+	}
+
+	for _, file := range a.Files {
+		size := sizes[file]
+		if size < largeFileSize {
+			continue
+		}
+		msg := fmt.Sprintf("%s: %s", file, misc.FormatSize(size))
+		if dependents := getDependents(file); len(dependents) > 0 {
+			if len(dependents) > 3 {
+				dependents = append(dependents[:3], "...")
+			}
+			msg = fmt.Sprintf("%s pulled in via %s: %s", file, strings.Join(dependents, ", "), misc.FormatSize(size))
+		}
+		if a.Name == "initramfs" {
+			msg += "; move the hook that needs it to initramfs-extra if it isn't needed for mounting it"
+		}
+		suggestions = append(suggestions, suggestion{size, msg})
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].size > suggestions[j].size
+	})
+	return suggestions
+}
+
+// Print the size of the archive contents, and suggestions for making it
+// smaller
+func printAnalysis(w io.Writer, a plan.Archive, sizes map[string]int64, devinfo deviceinfo.DeviceInfo, opts generateOpts) {
+	var files, modules int64
+	for _, file := range a.Files {
+		files += sizes[file]
+	}
+	for _, src := range a.Entries {
+		files += sizes[src]
+	}
+	for _, mod := range a.Modules {
+		modules += sizes[mod]
+	}
+	fmt.Fprintf(w, "%s: %s uncompressed (files: %s, modules: %s)\n", a.Name,
+		misc.FormatSize(files+modules), misc.FormatSize(files), misc.FormatSize(modules))
+	for _, s := range analyzeArchive(a, sizes, devinfo, opts) {
+		fmt.Fprintf(w, "- %s\n", s.msg)
+	}
+}
+
+// Find the kernel in the output dir
+func findKernel(outDir string) (string, error) {
+	kernels, _ := filepath.Glob(filepath.Join(outDir, "vmlinuz*"))
+	if len(kernels) == 0 {
+		return "", errors.New("Unable to find any kernels at " + filepath.Join(outDir, "vmlinuz*"))
+	}
+
+	// Pick a kernel that does not have suffixes added by boot-deploy
+	var kernFile string
+	for _, f := range kernels {
+		if strings.HasSuffix(f, "-dtb") || strings.HasSuffix(f, "-mtk") || strings.HasSuffix(f, ".kpart") {
+			continue
+		}
+		kernFile = f
+		break
+	}
+
+	return kernFile, nil
+}
+
+// Check that deviceinfo_arch, userspace (busybox) and the kernel are all for
+// the same architecture. When they aren't, it's usually because mkinitfs is
+// running in a chroot for another arch without the right setup, and the
+// resulting initramfs would not boot.
+func checkArchConsistency(devinfo deviceinfo.DeviceInfo, busybox string, kernel string) error {
+	if devinfo.Arch == "" {
+		return nil
+	}
+	target, err := elfutil.TargetForArch(devinfo.Arch)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	if fd, err := elf.Open(busybox); err != nil {
+		log.Printf("- Unable to read %s, skipping userspace architecture check: %s", busybox, err)
+	} else {
+		if !target.Matches(fd) {
+			problems = append(problems, fmt.Sprintf("%s is built for %s", busybox, elfutil.Target{Machine: fd.Machine, Class: fd.Class}))
+		}
+		fd.Close()
+	}
+
+	if kernel == "" {
+		log.Print("- No kernel found, skipping kernel architecture check")
+	} else if kernTarget, err := elfutil.KernelTarget(kernel); err != nil {
+		log.Printf("- Unable to get architecture of kernel %s, skipping kernel architecture check: %s", kernel, err)
+	} else if kernTarget != target {
+		problems = append(problems, fmt.Sprintf("kernel %s is built for %s", kernel, kernTarget))
+	}
+
+	if len(problems) > 0 {
+		return i18n.Errorf(i18n.ArchMismatch, devinfo.Arch, target, strings.Join(problems, ", and "))
+	}
+
+	return nil
+}
+
+// Copy the generated files from the work dir to the output dir, for builds
+// that don't use boot-deploy
+func copyArtifacts(workDir string, outDir string, files []string) error {
+	log.Print("== Copying files to: ", outDir, " ==")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := copyArtifact(filepath.Join(workDir, file), filepath.Join(outDir, file)); err != nil {
+			return err
+		}
+		log.Print("- ", file)
+	}
+
+	return nil
+}
+
+// Copy the file at src to path, and read the copy back to check it
+func copyArtifact(src string, path string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dest, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	h := digest.XXH64.New()
+	if _, err := io.Copy(io.MultiWriter(dest, h), in); err != nil {
+		return err
+	}
+	if err := dest.Sync(); err != nil {
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	// like archives, copies are read back to catch storage corruption
+	sum, err := digest.XXH64.StoredFile(path)
+	if err != nil {
+		return err
+	}
+	if sum != hex.EncodeToString(h.Sum(nil)) {
+		return fmt.Errorf("%s: %w", path, archive.ErrReadBack)
+	}
+	return nil
+}
+
+func bootDeploy(ctx context.Context, e executor.Executor, workDir string, outDir string, initfs string, files []string) error {
+	// boot-deploy expects the kernel to be in the same dir as initramfs.
+	// Assume that the kernel is in the output dir...
+	log.Print("== Using boot-deploy to finalize/install files ==")
+	kernFile, err := findKernel(outDir)
+	if err != nil {
+		return err
+	}
+
+	kernFd, err := os.Open(kernFile)
+	if err != nil {
+		return err
+	}
+	defer kernFd.Close()
+
+	kernFileCopy, err := os.Create(filepath.Join(workDir, "vmlinuz"))
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(kernFileCopy, kernFd); err != nil {
+		return err
+	}
+	kernFileCopy.Close()
+
+	// boot-deploy -i initramfs -k vmlinuz-postmarketos-rockchip -d /tmp/cpio -o /tmp/foo initramfs-extra
+	args := []string{
+		"-i", initfs,
+		"-k", "vmlinuz",
+		"-d", workDir,
+		"-o", outDir,
+	}
+	if err := e.Run(ctx, "boot-deploy", append(args, files...)...); err != nil {
+		log.Print("'boot-deploy' command failed")
+		return err
+	}
+
+	return nil
+}
+
+// Prefixes of files that are installed in the output dir for a kernel
+// flavor (or version), by kernel packages, boot-deploy or older versions of
+// mkinitfs
+var flavorArtifactPrefixes = []string{
+	"vmlinuz", "initramfs", "config", "System.map", "uInitrd", "uImage",
+}
+
+// Suffixes that boot-deploy (and older versions of mkinitfs) add after the
+// flavor
+var flavorArtifactSuffixes = []string{"-extra", "-dtb", "-mtk"}
+
+// Extensions of the checksum files of the archives, see writeChecksums
+var checksumExtensions = []string{".sha256", ".sha512", ".blake2b", ".xxh64"}
+
+// Extensions of files generated for the archives, in addition to the
+// checksum files: the dm-verity hash tree of initramfs-extra and its
+// parameters, see generateVerity. Longer ones go first, since they're
+// trimmed in order.
+var artifactExtensions = []string{".verity.params", ".verity"}
+
+// Returns the flavors and versions of the kernels that are installed
+func getInstalledKernels() misc.StringSet {
+	kernels := make(misc.StringSet)
+	files, _ := filepath.Glob("/usr/share/kernel/*/kernel.release")
+	for _, f := range files {
+		kernels[filepath.Base(filepath.Dir(f))] = false
+		if contents, err := os.ReadFile(f); err == nil {
+			kernels[strings.TrimSpace(string(contents))] = false
+		}
+	}
+	return kernels
+}
+
+// Returns the files in outDir for kernel flavors or versions that aren't
+// installed anymore, e.g. after the kernel was removed or renamed. Files
+// without a flavor (like "initramfs" and "initramfs-extra") are never stale.
+func findStaleArtifacts(outDir string, installed misc.StringSet) ([]string, error) {
+	// without any kernel, everything would be stale
+	if len(installed) == 0 {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		for _, prefix := range flavorArtifactPrefixes {
+			if !strings.HasPrefix(name, prefix+"-") {
+				continue
+			}
+			rest := name[len(prefix):]
+			// e.g. "initramfs-extra.verity.sha256" -> "-extra"
+			for _, ext := range checksumExtensions {
+				rest = strings.TrimSuffix(rest, ext)
+			}
+			for _, ext := range artifactExtensions {
+				rest = strings.TrimSuffix(rest, ext)
+			}
+			for _, suffix := range flavorArtifactSuffixes {
+				rest = strings.TrimSuffix(rest, suffix)
+			}
+			// rest is empty for files without a flavor, e.g. "initramfs-extra"
+			if _, ok := installed[strings.TrimPrefix(rest, "-")]; rest != "" && !ok {
+				stale = append(stale, filepath.Join(outDir, name))
+			}
+			break
+		}
+	}
+
+	return stale, nil
+}
+
+// Remove (or with dryRun, only list) artifacts in outDir for kernels that
+// aren't installed anymore
+func cleanStaleArtifacts(outDir string, dryRun bool) error {
+	log.Print("== Cleaning up stale artifacts in: ", outDir, " ==")
+	stale, err := findStaleArtifacts(outDir, getInstalledKernels())
+	if err != nil {
+		return err
+	}
+	for _, file := range stale {
+		if dryRun {
+			log.Print("- ", file, " (not removed, dry run)")
+			continue
+		}
+		log.Print("- ", file)
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Result of one of the checks run by the doctor subcommand. A check is
+// skipped when it can't be done, e.g. because an earlier check failed.
+type doctorCheck struct {
+	name    string
+	err     error
+	skipped string
+}
+
+// Busybox applets used by the init script
+var requiredApplets = []string{
+	"sh", "mount", "umount", "switch_root", "mkdir", "mknod", "modprobe",
+}
+
+// Kernel config options needed for unpacking an initramfs with the given
+// compression
+var kernelCompressionConfig = map[archive.Compression]string{
+	archive.CompressionGzip: "CONFIG_RD_GZIP",
+	archive.CompressionNone: "",
+	archive.CompressionZstd: "CONFIG_RD_ZSTD",
+}
+
+// Run checks for everything mkinitfs needs on the host to generate and deploy
+// the archives
+func doctor(deviceinfoFile string, outDir string, opts generateOpts) []doctorCheck {
+	var checks []doctorCheck
+
+	devinfo, err := deviceinfo.ReadDeviceinfo(deviceinfoFile)
+	if err == nil {
+		err = checkDeviceinfo(devinfo)
+	}
+	checks = append(checks, doctorCheck{name: "deviceinfo " + deviceinfoFile, err: err})
+
+	var out bytes.Buffer
+	busybox := executor.Host{Stdout: &out, Stderr: ioutil.Discard}
+	if err := busybox.Run(context.Background(), "/bin/busybox", "--list"); err != nil {
+		checks = append(checks, doctorCheck{name: "busybox applets", err: err})
+	} else {
+		checks = append(checks, doctorCheck{name: "busybox applets", err: checkBusyboxApplets(strings.Fields(out.String()))})
+	}
+
+	if opts.unprivileged {
+		checks = append(checks, doctorCheck{name: "boot-deploy", skipped: "not used with -unprivileged"})
+	} else {
+		_, err := exec.LookPath("boot-deploy")
+		checks = append(checks, doctorCheck{name: "boot-deploy", err: err})
+	}
+
+	kernVer, err := getKernelVersion()
+	if err == nil && !exists(filepath.Join("/lib/modules", kernVer)) {
+		err = fmt.Errorf("no modules for kernel version %q in /lib/modules", kernVer)
+	}
+	checks = append(checks, doctorCheck{name: "kernel release", err: err})
+
+	checks = append(checks, doctorCheck{name: "output directory " + outDir, err: checkWritable(outDir)})
+
+	check := doctorCheck{name: "kernel initramfs compression support"}
+	flavor, err := getKernelFlavor()
+	if err != nil {
+		check.skipped = "kernel flavor not found"
+	} else if config := findKernelConfig(outDir, flavor, kernVer); config == "" {
+		check.skipped = "kernel config not found"
+	} else {
+		check.err = checkKernelCompression(config, opts.compression)
+	}
+	checks = append(checks, check)
+
+	_, err = policy.ReadDir(policyDir)
+	checks = append(checks, doctorCheck{name: "policies in " + policyDir, err: err})
+
+	return checks
+}
+
+// Print a pass/fail line for each check, and return the number of checks that
+// failed
+func printDoctorReport(w io.Writer, checks []doctorCheck) int {
+	failed := 0
+	for _, c := range checks {
+		switch {
+		case c.err != nil:
+			failed++
+			fmt.Fprintf(w, "[FAIL] %s: %s\n", c.name, c.err)
+		case c.skipped != "":
+			fmt.Fprintf(w, "[SKIP] %s: %s\n", c.name, c.skipped)
+		default:
+			fmt.Fprintf(w, "[PASS] %s\n", c.name)
+		}
+	}
+	return failed
+}
+
+// Check deviceinfo variables used by mkinitfs for values it can't handle
+func checkDeviceinfo(devinfo deviceinfo.DeviceInfo) error {
+	var problems []string
+	if devinfo.Arch == "" {
+		problems = append(problems, "deviceinfo_arch is not set")
+	} else if _, err := elfutil.TargetForArch(devinfo.Arch); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if devinfo.InitfsCpioFormat != "" {
+		if _, err := archive.ParseFormat(devinfo.InitfsCpioFormat); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if devinfo.InitfsMaxSize != "" {
+		if _, err := misc.ParseSize(devinfo.InitfsMaxSize); err != nil {
+			problems = append(problems, i18n.Sprintf(i18n.InvalidMaxSize, err))
+		}
+	}
+	switch devinfo.MkinitfsSplash {
+	case "", "true", "false":
+	default:
+		problems = append(problems, fmt.Sprintf("deviceinfo_mkinitfs_splash must be \"true\" or \"false\", got: %q", devinfo.MkinitfsSplash))
+	}
+	if _, err := getChecksumAlgorithm(devinfo.MkinitfsChecksum); err != nil {
+		problems = append(problems, "deviceinfo_mkinitfs_checksum: "+err.Error())
+	}
+	switch devinfo.MkinitfsAccessibility {
+	case "", "true", "false":
+	default:
+		problems = append(problems, fmt.Sprintf("deviceinfo_mkinitfs_accessibility must be \"true\" or \"false\", got: %q", devinfo.MkinitfsAccessibility))
+	}
+	switch devinfo.MkinitfsLocale {
+	case "", "true", "false":
+	default:
+		problems = append(problems, fmt.Sprintf("deviceinfo_mkinitfs_locale must be \"true\" or \"false\", got: %q", devinfo.MkinitfsLocale))
+	}
+	if devinfo.GenerateFitImage == "true" {
+		if err := fit.CheckArch(devinfo.Arch); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err := fit.ParseHash(devinfo.FitHash); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if devinfo.GenerateCorebootPayload == "true" {
+		if err := coreboot.CheckArch(devinfo.Arch); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if devinfo.GenerateDepthchargeImage == "true" {
+		if err := depthcharge.CheckArch(devinfo.Arch); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	switch devinfo.MkinitfsProfile {
+	case "", profileDefault, profileMinimal:
+	default:
+		problems = append(problems, i18n.Sprintf(i18n.UnknownProfile, devinfo.MkinitfsProfile))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Check that busybox, with the given applets, has everything the init script
+// uses
+func checkBusyboxApplets(applets []string) error {
+	have := make(misc.StringSet)
+	for _, a := range applets {
+		have[a] = true
+	}
+	var missing []string
+	for _, a := range requiredApplets {
+		if !have[a] {
+			missing = append(missing, a)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing applet(s): %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Check that files can be created in the dir
+func checkWritable(dir string) error {
+	fd, err := ioutil.TempFile(dir, ".mkinitfs-doctor")
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
+
+// Returns the path of the config of the kernel that mkinitfs generates the
+// initramfs for, or "" if it isn't installed
+func findKernelConfig(outDir string, flavor string, kernVer string) string {
+	for _, config := range []string{
+		filepath.Join(outDir, "config-"+flavor),
+		filepath.Join("/boot", "config-"+kernVer),
+	} {
+		if exists(config) {
+			return config
+		}
+	}
+	return ""
+}
+
+// Check that the kernel with the given config can boot with an initramfs
+// using the compression
+func checkKernelCompression(config string, compression archive.Compression) error {
+	option, ok := kernelCompressionConfig[compression]
+	if !ok {
+		return fmt.Errorf("unknown compression: %s", compression)
+	}
+
+	fd, err := os.Open(config)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enabled := make(misc.StringSet)
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		if name := strings.TrimSuffix(s.Text(), "=y"); name != s.Text() {
+			enabled[name] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range []string{"CONFIG_BLK_DEV_INITRD", option} {
+		if o != "" && !enabled[o] {
+			return fmt.Errorf("%s is not enabled in %s", o, config)
+		}
+	}
+	return nil
+}
+
+func exists(file string) bool {
+	if _, err := os.Stat(file); err == nil {
+		return true
+	}
+	return false
+}
+
+func getHookFiles(filesdir string) misc.StringSet {
+	fileInfo, err := ioutil.ReadDir(filesdir)
+	if err != nil {
+		fatal(err)
+	}
+	files := make(misc.StringSet)
+	for _, file := range fileInfo {
+		path := filepath.Join(filesdir, file.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if !exists(s.Text()) {
+				fatalf("Unable to find file %q required by %q", s.Text(), path)
+			}
+			files[s.Text()] = false
+		}
+		if err := s.Err(); err != nil {
+			fatal(err)
+		}
+	}
+	return files
+}
+
+// Dependencies resolved by getBinaryDeps, as a map of file -> the file and
+// all of its dependencies. This is shared by all archives generated in a run,
+// so libraries used by many binaries (and binaries in both archives) are only
+// opened and resolved once.
+var binaryDeps = make(map[string]misc.StringSet)
+
+// Recursively list all dependencies for a given ELF binary
+func getBinaryDeps(ctx context.Context, files misc.StringSet, file string) error {
+	deps, ok := binaryDeps[file]
+	if !ok {
+		deps = make(misc.StringSet)
+		if err := resolveBinaryDeps(ctx, deps, file, nil); err != nil {
+			return err
+		}
+		binaryDeps[file] = deps
+	}
+	for dep := range deps {
+		files[dep] = false
+	}
+
+	return nil
+}
+
+// Resolve the dependencies of file, chain is the symlinks followed to get to it
+func resolveBinaryDeps(ctx context.Context, files misc.StringSet, file string, chain []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// if file is a symlink, resolve dependencies for target
+	fileStat, err := os.Lstat(file)
+	if err != nil {
+		log.Print("getBinaryDeps: failed to stat file")
+		return err
+	}
+
+	// Symlink: write symlink to archive then set 'file' to link target
+	if fileStat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(file)
+		if err != nil {
+			log.Print("getBinaryDeps: unable to read symlink: ", file)
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target, err = misc.RelativeSymlinkTargetToDir(target, filepath.Dir(file))
+			if err != nil {
+				return err
+			}
+		}
+		chain = append(chain, file)
+		if err := misc.CheckSymlinkChain(chain, target); err != nil {
+			return fmt.Errorf("getBinaryDeps: %w", err)
+		}
+		return resolveBinaryDeps(ctx, files, target, chain)
+	}
+
+	// get dependencies for binaries
+	fd, err := elf.Open(file)
+	if err != nil {
+		return handleElfError(files, file, err)
+	}
+	if elfutil.IsStatic(fd) {
+		// nothing to resolve
+		fd.Close()
+		files[file] = false
+		staticBinaries[file] = false
+		return nil
+	}
+	libs, err := fd.ImportedLibraries()
+	// binary-specific search paths are used before the default ones
+	libdirs := append(elfutil.RunPaths(fd, filepath.Dir(file)), getLibDirs()...)
+	fd.Close()
+	if err != nil {
+		return handleElfError(files, file, err)
+	}
+	files[file] = false
+
+	if len(libs) == 0 {
+		return err
+	}
+
+	for _, lib := range libs {
+		found := false
+		for _, libdir := range libdirs {
+			// path is often a symlink to the versioned library (e.g.
+			// libstdc++.so.6 -> libstdc++.so.6.0.29), the whole chain of
+			// links is included by getBinaryDeps and the archive
+			path := filepath.Join(libdir, lib)
+			if _, err := os.Stat(path); err == nil {
+				err := getBinaryDeps(ctx, files, path)
+				if err != nil {
+					return err
+				}
+				files[path] = false
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unable to locate library %q needed by %q, is the package providing it installed? (searched: %s)",
+				lib, file, strings.Join(libdirs, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Default library search paths, read once by getLibDirs
+var libDirs []string
+
+// Get the default library search paths, from the musl dynamic linker config
+// if there is one
+func getLibDirs() []string {
+	if libDirs == nil {
+		libDirs = readLibDirs()
+	}
+	return libDirs
+}
+
+// Config files of the musl dynamic linker, there is one for each arch
+var muslPathFiles = "/etc/ld-musl-*.path"
+
+func readLibDirs() []string {
+	libdirs := []string{"/usr/lib", "/lib", "/usr/local/lib"}
+
+	pathFiles, _ := filepath.Glob(muslPathFiles)
+	if len(pathFiles) == 0 {
+		return libdirs
+	}
+	contents, err := os.ReadFile(pathFiles[0])
+	if err != nil {
+		return libdirs
+	}
+	// entries are separated by newlines, spaces and/or colons
+	dirs := strings.FieldsFunc(string(contents), func(r rune) bool {
+		return r == ':' || r == '\n' || r == ' '
+	})
+	if len(dirs) == 0 {
+		return libdirs
+	}
+
+	return dirs
+}
+
+func getFiles(ctx context.Context, files misc.StringSet, newFiles misc.StringSet, required bool) error {
+	for file := range newFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := getFile(ctx, files, file, required)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getFile(ctx context.Context, files misc.StringSet, file string, required bool) error {
+	if !exists(file) {
+		if required {
+			return errors.New("getFile: File does not exist :" + file)
+		}
+		return nil
+	}
+
+	files[file] = false
+
+	// already resolved for this or another archive
+	if _, ok := binaryDeps[file]; ok {
+		return getBinaryDeps(ctx, files, file)
+	}
+
+	// get dependencies for binaries
+	isElf, err := elfutil.IsELF(file)
+	if err != nil {
+		return err
+	}
+	if !isElf {
+		// file is not an elf, so don't resolve lib dependencies
+		return nil
+	}
+
+	return getBinaryDeps(ctx, files, file)
+}
+
+// elfError is returned when an ELF file can't be parsed, e.g. because it is
+// damaged
+type elfError struct {
+	path string
+	err  error
+}
+
+func (e *elfError) Error() string {
+	return fmt.Sprintf("unable to parse ELF file %q: %s", e.path, e.err)
+}
+
+func (e *elfError) Unwrap() error {
+	return e.err
+}
+
+// When ignoreElfErrors is set, files that fail to parse as ELF are included
+// without their dependencies, and the errors are collected in elfErrors so
+// they can be summarized at the end, instead of failing the whole build
+// because of one damaged file.
+var (
+	ignoreElfErrors bool
+	elfErrors       []error
+)
+
+// Statically linked binaries found while resolving dependencies, for the
+// size report
+var staticBinaries = make(misc.StringSet)
+
+func handleElfError(files misc.StringSet, file string, err error) error {
+	elfErr := &elfError{path: file, err: err}
+	if !ignoreElfErrors {
+		return elfErr
+	}
+	log.Print("WARNING: ", elfErr)
+	elfErrors = append(elfErrors, elfErr)
+	files[file] = false
+	return nil
+}
+
+// Returns true if the file is a GNU-style split debug file, or another debug
+// artifact that is never needed at boot
+func isDebugFile(file string) bool {
+	if strings.HasPrefix(file, "/usr/lib/debug/") {
+		return true
+	}
+	switch filepath.Ext(file) {
+	case ".debug", ".dwo", ".dwp":
+		return true
+	}
+	return false
+}
+
+// Remove debug files from the set, which may have been picked up by
+// collecting all files in a directory or matching a glob
+func filterDebugFiles(files misc.StringSet) {
+	var removed int
+	for file := range files {
+		if isDebugFile(file) {
+			delete(files, file)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("- Excluded %d debug file(s)", removed)
+	}
+}
+
+// Check that all ELF files in the given set were built for the arch set in
+// deviceinfo. A mismatch usually means something is broken in the chroot or
+// rootfs the initramfs is generated in, and the result would not boot.
+func checkElfArch(files misc.StringSet, devinfo deviceinfo.DeviceInfo) error {
+	if devinfo.Arch == "" {
+		log.Print("- deviceinfo_arch is not set, skipping ELF architecture check")
+		return nil
+	}
+
+	target, err := elfutil.TargetForArch(devinfo.Arch)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for file := range files {
+		fd, err := elf.Open(file)
+		if err != nil {
+			// not an ELF
+			continue
+		}
+		if !target.Matches(fd) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s (%s)", file, fd.Machine, fd.Class))
+		}
+		fd.Close()
+	}
+
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		for _, m := range mismatches {
+			log.Print("Wrong architecture: ", m)
+		}
+		return fmt.Errorf("found %d file(s) not built for %s: %s", len(mismatches), devinfo.Arch, target)
+	}
+
+	return nil
+}
+
+// Look for files that are surprising to find in the initramfs, where
+// everything runs as root: setuid/setgid binaries, world-writable files, and
+// files not owned by root.
+func lintFiles(files misc.StringSet, opts generateOpts) error {
+	var issues []string
+	for file := range files {
+		// symlinks always have 0777 perms, so check the target instead
+		fileStat, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		mode := fileStat.Mode()
+		if mode&os.ModeSetuid != 0 {
+			issues = append(issues, file+": setuid")
+		}
+		if mode&os.ModeSetgid != 0 {
+			issues = append(issues, file+": setgid")
+		}
+		if mode.Perm()&0002 != 0 {
+			issues = append(issues, file+": world-writable")
+		}
+		// owners on the system don't matter for unprivileged builds,
+		// everything in the archive is owned by root anyway
+		if st, ok := fileStat.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && !opts.unprivileged {
+			issues = append(issues, fmt.Sprintf("%s: owned by uid %d", file, st.Uid))
+		}
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+
+	sort.Strings(issues)
+	for _, issue := range issues {
+		log.Print("Insecure file: ", issue)
+	}
+	if opts.allowInsecure {
+		log.Printf("WARNING: including %d insecure file(s) in the archive", len(issues))
+		return nil
+	}
+
+	return fmt.Errorf("found %d insecure file(s), use -allow-insecure to include them anyway", len(issues))
+}
+
+// Get the files that the osk-sdl config references: the font, and the theme
+// assets (any other setting with an absolute path as the value, e.g. images).
+// osk-sdl falls back to its defaults or fails to start when one is missing,
+// so they must all exist.
+func getOskConfFiles(oskConfPath string) ([]string, error) {
+	f, err := os.Open(oskConfPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var font string
+	var assets []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		// "key = val"
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case key == "keyboard-font":
+			font = val
+		case filepath.IsAbs(val):
+			if !exists(val) {
+				return nil, fmt.Errorf("Unable to find %s (%s) from %s", key, val, oskConfPath)
+			}
+			assets = append(assets, val)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if !exists(font) {
+		return nil, errors.New("Unable to find font: " + font)
+	}
+
+	return append([]string{font}, assets...), nil
+}
+
+// Get a list of files and their dependencies related to supporting rootfs full
+// disk (d)encryption
+func getFdeFiles(ctx context.Context, files misc.StringSet, devinfo deviceinfo.DeviceInfo) error {
+	confFiles := misc.StringSet{
+		"/etc/osk.conf":   false,
+		"/etc/ts.conf":    false,
+		"/etc/pointercal": false,
+		"/etc/fb.modes":   false,
+		"/etc/directfbrc": false,
+	}
+	// TODO: this shouldn't be false? though some files (pointercal) don't always exist...
+	if err := getFiles(ctx, files, confFiles, false); err != nil {
+		return err
+	}
+
+	// osk-sdl
+	oskFiles := misc.StringSet{
+		"/usr/bin/osk-sdl":    false,
+		"/sbin/cryptsetup":    false,
+		"/usr/lib/libGL.so.1": false}
+	if err := getFiles(ctx, files, oskFiles, true); err != nil {
+		return err
+	}
+
+	oskConfFiles, err := getOskConfFiles("/etc/osk.conf")
+	if err != nil {
+		return err
+	}
+	for _, file := range oskConfFiles {
+		files[file] = false
+	}
+
+	// Directfb
+	dfbFiles := make(misc.StringSet)
+	err = filepath.Walk("/usr/lib/directfb-1.7-7", func(path string, f os.FileInfo, err error) error {
+		if filepath.Ext(path) == ".so" {
+			dfbFiles[path] = false
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print("getBinaryDeps: failed to stat file")
+		return err
+	}
+	if err := getFiles(ctx, files, dfbFiles, true); err != nil {
+		return err
+	}
+
+	// tslib
+	tslibFiles := make(misc.StringSet)
+	err = filepath.Walk("/usr/lib/ts", func(path string, f os.FileInfo, err error) error {
+		if filepath.Ext(path) == ".so" {
+			tslibFiles[path] = false
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print("getBinaryDeps: failed to stat file")
+		return err
+	}
+	libts, _ := filepath.Glob("/usr/lib/libts*")
+	for _, file := range libts {
+		tslibFiles[file] = false
+	}
+	if err = getFiles(ctx, files, tslibFiles, true); err != nil {
+		return err
+	}
+
+	// mesa hw accel
+	if devinfo.MesaDriver != "" {
+		mesaFiles := misc.StringSet{
+			"/usr/lib/libEGL.so.1":    false,
+			"/usr/lib/libGLESv2.so.2": false,
+			"/usr/lib/libgbm.so.1":    false,
+			"/usr/lib/libudev.so.1":   false,
+			"/usr/lib/xorg/modules/dri/" + devinfo.MesaDriver + "_dri.so": false,
+		}
+		if err := getFiles(ctx, files, mesaFiles, true); err != nil {
+			return err
+		}
+	}
+
+	if err := getKeymapFiles(ctx, files, devinfo); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Directories with the busybox keymaps included by getKeymapFiles
+var (
+	// keymaps configured with setup-keymap
+	systemKeymapDir = "/etc/keymap"
+	// keymaps in deviceinfo_keymaps are relative to this
+	bkeymapsDir = "/usr/share/bkeymaps"
+)
+
+// Get busybox keymaps (for loadkmap) so that physical keyboards with non-US
+// layouts can be used to type the passphrase. This includes the keymap
+// configured on the system with setup-keymap, and any listed in
+// deviceinfo_keymaps, e.g. "de/de-latin1 fr/fr"
+func getKeymapFiles(ctx context.Context, files misc.StringSet, devinfo deviceinfo.DeviceInfo) error {
+	keymaps, _ := filepath.Glob(filepath.Join(systemKeymapDir, "*.bmap.gz"))
+	keymapFiles := make(misc.StringSet)
+	for _, file := range keymaps {
+		keymapFiles[file] = false
+	}
+
+	for _, keymap := range strings.Fields(devinfo.Keymaps) {
+		keymapFiles[filepath.Join(bkeymapsDir, keymap+".bmap.gz")] = false
+	}
+
+	if len(keymapFiles) > 0 {
+		log.Printf("-- Including %d keymap(s)", len(keymapFiles))
+	}
+
+	// keymaps from deviceinfo must exist, there's no point in continuing
+	// without them if the user needs them to unlock
+	return getFiles(ctx, files, keymapFiles, true)
+}
+
+// Get the system locale from /etc/locale.conf, falling back to $LANG
+func getSystemLocale() string {
+	if f, err := os.Open("/etc/locale.conf"); err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if strings.HasPrefix(line, "LANG=") {
+				return strings.Trim(strings.TrimPrefix(line, "LANG="), "\"'")
+			}
+		}
+	}
+
+	return os.Getenv("LANG")
+}
+
+// Directories with the fontconfig configuration and caches, included with the
+// locale data
+var fontconfigDirs = []string{"/etc/fonts", "/var/cache/fontconfig"}
+
+// Get locale data for the given locale and fontconfig files that are needed
+// to render non-ASCII text (e.g. passphrase hints) in the unlock UI. Only
+// files that exist are included, e.g. musl has no gconv modules and only needs
+// locale data for translations.
+func getLocaleFiles(ctx context.Context, files misc.StringSet, locale string) error {
+	localeFiles := misc.StringSet{
+		"/etc/locale.conf": false,
+		// glibc
+		"/usr/lib/gconv/gconv-modules":       false,
+		"/usr/lib/gconv/gconv-modules.cache": false,
+	}
+
+	if locale != "" && locale != "C" && locale != "POSIX" {
+		log.Printf("-- Including locale data for: %q", locale)
+		// musl-locales
+		localeFiles[filepath.Join("/usr/share/i18n/locales/musl", locale)] = false
+		// glibc
+		for file := range getFilesInDir(filepath.Join("/usr/lib/locale", locale)) {
+			localeFiles[file] = false
+		}
+	}
+
+	for _, dir := range fontconfigDirs {
+		for file := range getFilesInDir(dir) {
+			localeFiles[file] = false
+		}
+	}
+
+	return getFiles(ctx, files, localeFiles, false)
+}
+
+// Recursively get all files and symlinks in the given directory, returns an
+// empty set if the directory doesn't exist.
+func getFilesInDir(dir string) misc.StringSet {
+	files := make(misc.StringSet)
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isDebugFile(path) {
+			return nil
+		}
+		if f.Mode().IsRegular() || f.Mode()&os.ModeSymlink != 0 {
+			files[path] = false
+		}
+		return nil
+	})
+	return files
+}
+
+// Add secret files to the archive. Secrets are written with 0600 permissions
+// and are left out of the manifest, so their contents can't leak through it.
+func addSecrets(a *archive.Archive, secrets misc.StringSet) error {
+	for _, secret := range secrets.Sorted() {
+		fileStat, err := os.Stat(secret)
+		if err != nil {
+			return err
+		}
+		if fileStat.Mode().Perm()&0077 != 0 {
+			log.Printf("WARNING: secret %q is readable by others on this system (mode %s), consider: chmod 600 %s",
+				secret, fileStat.Mode().Perm(), secret)
+		}
+		if err := a.AddSecret(secret, secret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get all hook files (lists of files/modules/secrets, scripts and
+// declarative hooks) for the given kernel flavor
+func getAllHookFiles(flavor string) []string {
+	patterns := []string{
+		"/etc/postmarketos-mkinitfs/files/*",
+		"/etc/postmarketos-mkinitfs/secrets/*",
+	}
+	for _, dir := range getHookDirs(hooksDir, flavor) {
+		patterns = append(patterns, filepath.Join(dir, "*.sh"),
+			filepath.Join(dir, "*.hook"), filepath.Join(dir, "*.toml"))
+	}
+
+	hookFiles := getModuleLists(moduleListDirs)
+	for _, pattern := range patterns {
+		found, _ := filepath.Glob(pattern)
+		hookFiles = append(hookFiles, found...)
+	}
+	sort.Strings(hookFiles)
+
+	return hookFiles
+}
+
+// Get the map of files to the packages that own them, from the file given in
+// opts or from the apk database
+func getOwners(opts generateOpts) (owner.Map, error) {
+	if opts.ownersFile != "" {
+		return owner.ReadMap(opts.ownersFile)
+	}
+	if exists(owner.ApkDb) {
+		return owner.ReadApkDb(owner.ApkDb)
+	}
+	return make(owner.Map), nil
+}
+
+// Get a list of all hook files used and the package that owns each of them,
+// so it's possible to find out what added something to the initramfs.
+func getHookOwners(flavor string, opts generateOpts) (string, error) {
+	owners, err := getOwners(opts)
+	if err != nil {
+		log.Print("Unable to read package ownership information")
+		return "", err
+	}
+
+	var contents strings.Builder
+	contents.WriteString("# <hook file> <package>\n")
+	for _, hookFile := range getAllHookFiles(flavor) {
+		pkg := owners.Owner(hookFile)
+		if opts.verbose {
+			log.Printf("-- hook %s is owned by: %s", hookFile, pkg)
+		}
+		fmt.Fprintf(&contents, "%s %s\n", hookFile, pkg)
+	}
+
+	return contents.String(), nil
+}
+
+// Get files, kernel modules and firmware listed in declarative hooks
+// (*.hook, *.toml) in the hook directories for the given archive, and their
+// dependencies
+func getDeclarativeHookFiles(ctx context.Context, files misc.StringSet, archiveName string, kernelVer string, flavor string, devinfo deviceinfo.DeviceInfo) error {
+	var hooks []hook.Hook
+	for _, dir := range getHookDirs(hooksDir, flavor) {
+		found, err := hook.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		hooks = append(hooks, found...)
+	}
+
+	modDir := filepath.Join("/lib/modules", kernelVer)
+	for _, h := range hooks {
+		if h.Archive != archiveName {
+			continue
+		}
+		use, err := hook.EvalCondition(h.Condition, devinfo.Get)
+		if err != nil {
+			return fmt.Errorf("%s: %w", h.Path, err)
+		}
+		if !use {
+			log.Printf("- *NOT* including hook: %s (condition is false: %s)", filepath.Base(h.Path), h.Condition)
+			continue
+		}
+		if h.Description != "" {
+			log.Printf("- Including hook: %s (%s)", filepath.Base(h.Path), h.Description)
+		} else {
+			log.Printf("- Including hook: %s", filepath.Base(h.Path))
+		}
+
+		required := make(misc.StringSet)
+		for _, file := range h.Files {
+			required[file] = false
+		}
+		for _, fw := range h.Firmware {
+			required[filepath.Join("/lib/firmware", fw)] = false
+		}
+		if err := getFiles(ctx, files, required, true); err != nil {
+			log.Print("Unable to get files required by hook: ", h.Path)
+			return err
+		}
+
+		if len(h.Modules) > 0 && !exists(modDir) {
+			log.Printf("-- kernel module directory not found: %q, not including modules for hook: %s", modDir, h.Path)
+			continue
+		}
+		for _, module := range h.Modules {
+			if err := getModule(files, module, modDir); err != nil {
+				log.Printf("Unable to get module %q required by hook: %s", module, h.Path)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Directory with hook scripts and declarative hooks
+const hooksDir = "/etc/postmarketos-mkinitfs/hooks"
+
+// Get the hook directories to use for the given kernel flavor: the global
+// one (dir), and <dir>.<flavor> for hooks that only apply to that flavor
+func getHookDirs(dir string, flavor string) []string {
+	dirs := []string{dir}
+	if flavor != "" {
+		dirs = append(dirs, dir+"."+flavor)
+	}
+	return dirs
+}
+
+// Get hook scripts, as a map of path in the archive -> source path. Scripts
+// for the kernel flavor are installed next to the global ones, where init
+// looks for them, and replace any global script with the same name.
+func getHookScripts(dir string, flavor string) map[string]string {
+	scripts := make(map[string]string)
+	for _, dir := range getHookDirs(dir, flavor) {
+		found, _ := filepath.Glob(filepath.Join(dir, "*.sh"))
+		for _, script := range found {
+			scripts[filepath.Join(hooksDir, filepath.Base(script))] = script
+		}
+	}
+	return scripts
+}
+
+func getInitfsExtraFiles(ctx context.Context, files misc.StringSet, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	log.Println("== Resolving initramfs extra files ==")
+	binariesExtra := misc.StringSet{
+		"/lib/libz.so.1":        false,
+		"/sbin/dmsetup":         false,
+		"/sbin/e2fsck":          false,
+		"/usr/sbin/parted":      false,
+		"/usr/sbin/resize2fs":   false,
+		"/usr/sbin/resize.f2fs": false,
+	}
+	log.Println("- Including extra binaries")
+	if err := getFiles(ctx, files, binariesExtra, true); err != nil {
+		return err
+	}
+
+	if opts.minimal() {
+		log.Println("- *NOT* including FDE support (minimal profile)")
+	} else if exists("/usr/bin/osk-sdl") {
+		log.Println("- Including FDE support")
+		if err := getFdeFiles(ctx, files, devinfo); err != nil {
+			return err
+		}
+		if opts.locale {
+			log.Println("- Including locale data and fonts")
+			if err := getLocaleFiles(ctx, files, getSystemLocale()); err != nil {
+				return err
+			}
+		}
+		if opts.accessibility {
+			log.Println("- Including accessibility support")
+			if err := getAccessibilityFiles(ctx, files, opts.tts); err != nil {
+				return err
+			}
+		}
+	} else {
+		log.Println("- *NOT* including FDE support")
+	}
+
+	return nil
+}
+
+// Data of text to speech engines (e.g. voices), by name of the engine
+var ttsDataDirs = map[string]string{
+	"espeak-ng": "/usr/share/espeak-ng-data",
+}
+
+// ALSA use case manager (UCM2) profiles, for setting up the mixer of sound
+// cards
+const alsaUcmDir = "/usr/share/alsa/ucm2"
+
+// Directory with sounds played on the unlock screen, e.g. beeps for key
+// presses
+const accessibilitySoundsDir = "/usr/share/mkinitfs/sounds"
+
+// Get the files for audio feedback on the unlock screen, for visually
+// impaired users: the text to speech engine (a name in /usr/bin or a path,
+// espeak-ng if empty) with its data, the sounds in accessibilitySoundsDir and
+// what's needed to play them: aplay, and the alsa-lib configs and UCM
+// profiles for setting up the sound card. The sound card modules are in
+// deviceinfo_modules_audio, see getInitfsModules.
+func getAccessibilityFiles(ctx context.Context, files misc.StringSet, tts string) error {
+	if tts == "" {
+		tts = "espeak-ng"
+	}
+	ttsBinary := tts
+	if !filepath.IsAbs(ttsBinary) {
+		ttsBinary = filepath.Join("/usr/bin", tts)
+	}
+	if !exists(ttsBinary) {
+		return fmt.Errorf("text to speech engine %q not found, is the package providing it installed? (set deviceinfo_mkinitfs_tts to use another one)", ttsBinary)
+	}
+	binaries := misc.StringSet{
+		ttsBinary:        false,
+		"/usr/bin/aplay": false,
+	}
+	if err := getFiles(ctx, files, binaries, true); err != nil {
+		return err
+	}
+
+	// alsaucm sets up the mixer of the sound card with its UCM profile
+	if err := getFile(ctx, files, "/usr/bin/alsaucm", false); err != nil {
+		return err
+	}
+
+	dataFiles := misc.StringSet{
+		"/usr/share/alsa/alsa.conf": false,
+		"/etc/asound.conf":          false,
+	}
+	// Which UCM profile is used depends on the name and driver of the sound
+	// card, which are only known at runtime, so all profiles are included.
+	// Card specific alsa-lib configs are small enough to include as well.
+	dirs := []string{ttsDataDirs[filepath.Base(tts)], accessibilitySoundsDir, alsaUcmDir, "/usr/share/alsa/cards"}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				dataFiles[path] = false
+			}
+			return nil
+		})
+	}
+
+	return getFiles(ctx, files, dataFiles, false)
+}
+
+func getInitfsFiles(ctx context.Context, files misc.StringSet, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	log.Println("== Resolving initramfs files ==")
+	requiredFiles := misc.StringSet{
+		"/bin/busybox":        false,
+		"/bin/sh":             false,
+		"/bin/busybox-extras": false,
+		"/usr/sbin/telnetd":   false,
+		"/sbin/kpartx":        false,
+		"/etc/deviceinfo":     false,
+		"/usr/bin/unudhcpd":   false,
+	}
+
+	// Hook files & scripts
+	if exists("/etc/postmarketos-mkinitfs/files") {
+		log.Println("- Including hook files")
+		hookFiles := getHookFiles("/etc/postmarketos-mkinitfs/files")
+		if err := getFiles(ctx, files, hookFiles, true); err != nil {
+			return err
+		}
+	}
+	if devinfo.InitfsExtraVerity == "true" {
+		requiredFiles["/sbin/veritysetup"] = false
+	}
+
+	log.Println("- Including required binaries")
+	if err := getFiles(ctx, files, requiredFiles, true); err != nil {
+		return err
+	}
+
+	if len(opts.addFiles) > 0 {
+		log.Println("- Including files given with -add-file")
+		if err := getAddedFiles(ctx, files, opts.addFiles); err != nil {
+			return err
+		}
+	}
+
+	if opts.minimal() {
+		log.Println("- *NOT* including timezone data (minimal profile)")
+	} else {
+		log.Println("- Including timezone data")
+		if err := getTimezoneFiles(ctx, files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The system timezone and RTC configuration
+var timezoneFiles = []string{
+	// usually a symlink into /usr/share/zoneinfo, the target is included too
+	"/etc/localtime",
+	"/etc/TZ",
+	"/etc/timezone",
+	// whether the RTC is in local time or UTC
+	"/etc/adjtime",
+}
+
+// Get the system timezone and RTC configuration, so that timestamps in early
+// boot (e.g. the last mount/check times compared by fsck) are correct. None
+// of these are required, e.g. systems using UTC may not have any of them.
+func getTimezoneFiles(ctx context.Context, files misc.StringSet) error {
+	tzFiles := make(misc.StringSet)
+	for _, file := range timezoneFiles {
+		tzFiles[file] = false
+	}
+
+	return getFiles(ctx, files, tzFiles, false)
+}
+
+func getInitfsModules(files misc.StringSet, devinfo deviceinfo.DeviceInfo, kernelVer string, opts generateOpts) error {
+	log.Println("- Including kernel modules")
+
+	modDir := filepath.Join("/lib/modules", kernelVer)
+	if !exists(modDir) {
+		if len(opts.addModules) > 0 {
+			return fmt.Errorf("kernel module directory not found: %q, unable to add modules given with -add-module", modDir)
+		}
+		// dir /lib/modules/<kernel> if kernel built without module support, so just print a message
+		log.Printf("-- kernel module directory not found: %q, not including modules", modDir)
+		return nil
+	}
+
+	// modules.* required by modprobe
+	modprobeFiles, _ := filepath.Glob(filepath.Join(modDir, "modules.*"))
+	for _, file := range modprobeFiles {
+		files[file] = false
+	}
+
+	requiredModules, err := getRequiredModules(requiredModulesConf)
+	if err != nil {
+		return err
+	}
+
+	if devinfo.InitfsExtraVerity == "true" {
+		requiredModules = append(requiredModules, "dm-verity")
+	}
+
+	algs := strings.Fields(devinfo.InitfsCryptoAlgorithms)
+	if opts.luksHeader != "" {
+		header, err := luks.Read(opts.luksHeader)
+		if err != nil {
+			return fmt.Errorf("unable to read LUKS header from %q: %w", opts.luksHeader, err)
+		}
+		log.Printf("-- LUKS%d header: cipher %s, key derivation %s", header.Version, header.Cipher, strings.Join(header.KDFs, ", "))
+		algs = append(algs, header.Algorithms()...)
+		if header.Integrity != "" {
+			requiredModules = append(requiredModules, "dm-integrity")
+		}
+	}
+	if len(algs) > 0 {
+		cryptoFiles := make(misc.StringSet)
+		if err := getCryptoModules(cryptoFiles, algs, modDir); err != nil {
+			log.Print("WARNING: unable to get modules for crypto algorithms, including all crypto modules: ", err)
+		} else {
+			log.Printf("-- Including crypto modules for: %s", strings.Join(algs, ", "))
+			for file := range cryptoFiles {
+				files[file] = false
+			}
+			requiredModules = withoutCryptoDirs(requiredModules)
+		}
+	}
+
+	// whole module directories needed by the device, e.g.
+	// "kernel/drivers/gpu/drm/msm/"
+	for _, dir := range strings.Fields(devinfo.ModulesInitfsDirs) {
+		if !strings.HasSuffix(dir, "/") {
+			dir += "/"
+		}
+		requiredModules = append(requiredModules, dir)
+	}
+
+	for _, item := range requiredModules {
+		if err := getModuleEntry(files, item, modDir); err != nil {
+			return err
+		}
+	}
+
+	// deviceinfo modules
+	if err := getDeviceinfoModules(files, devinfo, modDir, opts.allowMissingModules); err != nil {
+		log.Print("Unable to get modules from deviceinfo")
+		return err
+	}
+
+	// sound card modules for accessibility, optional like the rest of it
+	if opts.accessibility && !opts.minimal() {
+		if err := getAudioModules(files, strings.Fields(devinfo.ModulesAudio), modDir); err != nil {
+			return err
+		}
+	}
+
+	// module lists from packages and the admin, see moduleListDirs
+	for _, modFile := range getModuleLists(moduleListDirs) {
+		f, err := os.Open(modFile)
+		if err != nil {
+			log.Print("getInitfsModules: unable to open mkinitfs modules file: ", modFile)
+			return err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if err := getModuleEntry(files, s.Text(), modDir); err != nil {
+				log.Print("getInitfsModules: unable to get module file: ", s.Text())
+				return err
+			}
+		}
+	}
+
+	for _, module := range opts.addModules {
+		log.Printf("-- Including module given with -add-module: %s", module)
+		if err := getModule(files, module, modDir); err != nil {
+			return fmt.Errorf("unable to get module %q given with -add-module: %w", module, err)
+		}
+	}
+
+	return nil
+}
+
+// Directories with lists of modules (<name>.modules) to include in the
+// initramfs, one module or directory of modules per line. Packages ship lists in
+// /usr/share, lists in /etc replace the ones with the same name from there.
+var moduleListDirs = []string{"/usr/share/mkinitfs/modules", "/etc/postmarketos-mkinitfs/modules"}
+
+// Get the module lists in the given directories, sorted by name. Lists in
+// later directories replace the ones with the same name in earlier ones.
+func getModuleLists(dirs []string) []string {
+	lists := make(map[string]string)
+	for _, dir := range dirs {
+		found, _ := filepath.Glob(filepath.Join(dir, "*.modules"))
+		for _, list := range found {
+			lists[filepath.Base(list)] = list
+		}
+	}
+
+	var names []string
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, lists[name])
+	}
+	return paths
+}
+
+// Directory with files that are added to the root of the initramfs as they
+// are, see archive.AddOverlay
+const overlayDir = "/etc/postmarketos-mkinitfs/overlay"
+
+// Get the regular files in the overlay directory, by path in the archive
+func getOverlayFiles(dir string) map[string]string {
+	files := make(map[string]string)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			files[filepath.Join("/", rel)] = path
+		}
+		return nil
+	})
+	return files
+}
+
+const splashDir = "/usr/share/postmarketos-splashes"
+
+// Get the splash images in dir with the given names (with or without the
+// .ppm.gz extension, e.g. "splash-charging"), or all of them if no names are
+// given. Splash images that don't exist are skipped with a warning.
+func getSplashFiles(dir string, names []string) []string {
+	if len(names) == 0 {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.ppm.gz"))
+		return files
+	}
+
+	var files []string
+	for _, name := range names {
+		file := filepath.Join(dir, strings.TrimSuffix(name, ".ppm.gz")+".ppm.gz")
+		if !exists(file) {
+			log.Printf("WARNING: splash image %q from deviceinfo_mkinitfs_splashes not found in %s", name, dir)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// Parse the values of -add-file (<path>[:<path in the archive>]), returns
+// the source paths by path in the archive
+func parseAddFiles(values []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, value := range values {
+		split := strings.SplitN(value, ":", 2)
+		src, err := filepath.Abs(split[0])
+		if err != nil || split[0] == "" {
+			return nil, fmt.Errorf("invalid -add-file %q: invalid path", value)
+		}
+		dest := src
+		if len(split) == 2 {
+			dest = split[1]
+			if !filepath.IsAbs(dest) {
+				return nil, fmt.Errorf("invalid -add-file %q: path in the archive must be absolute", value)
+			}
+			dest = filepath.Clean(dest)
+		}
+		if prev, ok := files[dest]; ok && prev != src {
+			return nil, fmt.Errorf("invalid -add-file %q: %s is already added from %s", value, dest, prev)
+		}
+		files[dest] = src
+	}
+	return files, nil
+}
+
+// Get the files given with -add-file, and their dependencies. Files that go
+// to the same path in the archive are added to files, the others are added
+// by getInitfsEntries.
+func getAddedFiles(ctx context.Context, files misc.StringSet, added map[string]string) error {
+	for dest, src := range added {
+		if dest == src {
+			if err := getFile(ctx, files, src, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if !exists(src) {
+			return fmt.Errorf("file given with -add-file does not exist: %s", src)
+		}
+		isElf, err := elfutil.IsELF(src)
+		if err != nil {
+			return err
+		}
+		if isElf {
+			if err := getBinaryDeps(ctx, files, src); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Modules always included in the initramfs, unless changed in
+// requiredModulesConf. Each entry is a module name (without extension), or
+// directory (trailing slash is important! globs OK)
+var defaultRequiredModules = []string{
+	"loop",
+	"dm-crypt",
+	"kernel/fs/overlayfs/",
+	"kernel/crypto/",
+	"kernel/arch/*/crypto/",
+}
+
+// Config file for changing the list of required modules, e.g. for images that
+// don't need FDE support. Each line is an entry to add to the list, or an
+// entry to remove from it when prefixed with '-'. Lines starting with '#' are
+// comments.
+const requiredModulesConf = "/etc/postmarketos-mkinitfs/required-modules.conf"
+
+// Get the list of required modules, from defaultRequiredModules and the
+// changes in the given config file, if it exists
+func getRequiredModules(conf string) ([]string, error) {
+	modules := append([]string{}, defaultRequiredModules...)
+
+	fd, err := os.Open(conf)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return modules, nil
+		}
+		return modules, err
+	}
+	defer fd.Close()
+
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "-") {
+			modules = append(modules, line)
+			continue
+		}
+		remove := strings.TrimSpace(strings.TrimPrefix(line, "-"))
+		var kept []string
+		for _, m := range modules {
+			if m != remove {
+				kept = append(kept, m)
+			}
+		}
+		modules = kept
+	}
+	if err := s.Err(); err != nil {
+		return modules, err
+	}
+
+	return modules, nil
+}
+
+// Get the sound card modules in deviceinfo_modules_audio, as module files,
+// aliases or builtins. They're only needed for audio feedback, so modules
+// that can't be found are skipped with a warning.
+func getAudioModules(files misc.StringSet, modules []string, modDir string) error {
+	for _, module := range modules {
+		found, err := resolveModule(files, module, modDir)
+		if err != nil {
+			return err
+		}
+		if !found {
+			log.Printf("WARNING: module %q in deviceinfo_modules_audio not found as a module file, alias or builtin in %q", module, modDir)
+		}
+	}
+	return nil
+}
+
+// Get the modules implementing the given kernel crypto algorithms (e.g.
+// "aes", "xts", "sha256"), including architecture-specific implementations,
+// using the "crypto-<algorithm>" aliases of the modules. Algorithms built into
+// the kernel need no modules. Returns an error if any algorithm can't be
+// found, so that the caller can fall back to including all crypto modules.
+func getCryptoModules(files misc.StringSet, algs []string, modDir string) error {
+	for _, alg := range algs {
+		found, err := resolveModule(files, "crypto-"+alg, modDir)
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		// some algorithms are only known by their module name
+		found, err = resolveModule(files, alg, modDir)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no module or builtin found for crypto algorithm %q", alg)
+		}
+	}
+
+	return nil
+}
+
+// Remove the entries for crypto module directories (e.g. "kernel/crypto/")
+// from the list of required modules
+func withoutCryptoDirs(modules []string) []string {
+	var kept []string
+	for _, m := range modules {
+		if !strings.HasSuffix(m, "/crypto/") {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// Get the modules for an entry in a list of required modules, which is either
+// a module name (without extension), or a directory relative to the module
+// directory (trailing slash is important! globs OK), e.g. "kernel/crypto/" or
+// "extra/" for out-of-tree modules.
+func getModuleEntry(files misc.StringSet, item string, modDir string) error {
+	dir, file := filepath.Split(item)
+	if file == "" {
+		// item is a directory
+		dir = filepath.Join(modDir, dir)
+		dirs, _ := filepath.Glob(dir)
+		for _, d := range dirs {
+			if err := getModulesInDir(files, d); err != nil {
+				log.Print("Unable to get modules in dir: ", d)
+				return err
+			}
+		}
+	} else if dir == "" {
+		// item is a module name
+		if err := getModule(files, file, modDir); err != nil {
+			log.Print("Unable to get module: ", file)
+			return err
+		}
+	} else {
+		log.Printf("Unknown module entry: %q", item)
+	}
+
+	return nil
+}
+
+func getKernelReleaseFile() (string, error) {
+	files, _ := filepath.Glob("/usr/share/kernel/*/kernel.release")
+	// only one kernel flavor supported
+	if len(files) != 1 {
+		return "", fmt.Errorf("only one kernel release/flavor is supported, found: %q", files)
+	}
+
+	return files[0], nil
+}
+
+// Get the kernel flavor, from the path of its kernel.release file
+func getKernelFlavor() (string, error) {
+	releaseFile, err := getKernelReleaseFile()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Base(filepath.Dir(releaseFile)), nil
+}
+
+func getKernelVersion() (string, error) {
+	var version string
+
+	releaseFile, err := getKernelReleaseFile()
+	if err != nil {
+		return version, err
+	}
+
+	contents, err := os.ReadFile(releaseFile)
+	if err != nil {
+		return version, err
+	}
+
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// Get the compression (and level) for the archives from the -compression
+// flag, or deviceinfo if it isn't set. deviceinfo_initfs_compression may be
+// set to formats that the kernel supports, but that can't be written yet
+// (e.g. lz4), those fall back to gzip.
+func getCompression(devinfo deviceinfo.DeviceInfo, flagValue string) (archive.Compression, int, error) {
+	if flagValue != "" {
+		return archive.ParseCompressionLevel(flagValue)
+	}
+	if devinfo.InitfsCompression == "" {
+		return archive.CompressionGzip, 0, nil
+	}
+	c, level, err := archive.ParseCompressionLevel(devinfo.InitfsCompression)
+	if errors.Is(err, archive.ErrUnsupportedCompression) {
+		log.Printf("WARNING: deviceinfo_initfs_compression %q is not supported, using gzip", devinfo.InitfsCompression)
+		return archive.CompressionGzip, 0, nil
+	}
+	if err != nil {
+		return c, level, fmt.Errorf("invalid deviceinfo_initfs_compression: %w", err)
+	}
+	return c, level, nil
+}
+
+// Parse the value of SOURCE_DATE_EPOCH (seconds since the epoch), see
+// https://reproducible-builds.org/specs/source-date-epoch/. Returns the zero
+// time if it isn't set.
+func getSourceDateEpoch(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// Create a new archive, configured based on deviceinfo and the options
+func newArchive(devinfo deviceinfo.DeviceInfo, opts generateOpts) (*archive.Archive, error) {
+	format := archive.FormatNewc
+	if devinfo.InitfsCpioFormat != "" {
+		var err error
+		if format, err = archive.ParseFormat(devinfo.InitfsCpioFormat); err != nil {
+			return nil, err
+		}
+	}
+	if opts.tar {
+		format = archive.FormatTar
+	}
+	a, err := archive.NewWithFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.maxMemory > 0 {
+		a.LimitMemory(opts.maxMemory)
+	}
+
+	a.SetCompression(opts.compression)
+	a.SetCompressionLevel(opts.compressionLevel)
+	a.SetGzipBlockSize(opts.gzipBlockSize)
+	if !opts.sourceDateEpoch.IsZero() {
+		a.SetModTime(opts.sourceDateEpoch)
+	}
+	if opts.preserveModTimes {
+		a.SetModTimes(archive.ModTimesPreserve)
+	}
+
+	return a, nil
+}
 
-	// Directfb
-	dfbFiles := make(misc.StringSet)
-	err = filepath.Walk("/usr/lib/directfb-1.7-7", func(path string, f os.FileInfo, err error) error {
-		if filepath.Ext(path) == ".so" {
-			dfbFiles[path] = false
+// Get all files for the initramfs, including kernel modules and files from
+// declarative hooks. This is done before generating any archive, since
+// initramfs-extra skips files that are already in the initramfs.
+func getInitfsFileSet(ctx context.Context, kernVer string, flavor string, devinfo deviceinfo.DeviceInfo, opts generateOpts) (misc.StringSet, error) {
+	files := make(misc.StringSet)
+
+	if err := getInitfsFiles(ctx, files, devinfo, opts); err != nil {
+		return files, err
+	}
+
+	if err := getInitfsModules(files, devinfo, kernVer, opts); err != nil {
+		return files, err
+	}
+
+	if err := getDeclarativeHookFiles(ctx, files, hook.ArchiveInitfs, kernVer, flavor, devinfo); err != nil {
+		return files, err
+	}
+
+	filterDebugFiles(files)
+
+	return files, nil
+}
+
+// Get the files that are included in the initramfs at a different path than
+// on the system, as a map of path in the archive -> path on the system
+func getInitfsEntries(flavor string, opts generateOpts) map[string]string {
+	log.Println("- Including hook scripts")
+	entries := getHookScripts(hooksDir, flavor)
+
+	entries["/init"] = "/usr/share/postmarketos-mkinitfs/init.sh"
+
+	// splash images
+	if opts.minimal() {
+		log.Println("- *NOT* including splash images (minimal profile)")
+	} else if opts.noSplash {
+		log.Println("- *NOT* including splash images (disabled)")
+	} else {
+		log.Println("- Including splash images")
+		for _, file := range getSplashFiles(splashDir, opts.splashes) {
+			// splash images are expected at /<file>
+			entries[filepath.Join("/", filepath.Base(file))] = file
 		}
-		return nil
-	})
+	}
+
+	// initfs_functions
+	entries["/init_functions.sh"] = "/usr/share/postmarketos-mkinitfs/init_functions.sh"
+
+	for dest, src := range opts.addFiles {
+		if dest != src {
+			entries[dest] = src
+		}
+	}
+
+	return entries
+}
+
+func generateInitfs(ctx context.Context, name string, path string, files misc.StringSet, flavor string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	log.Println("== Generating initramfs ==")
+	initfsArchive, err := newArchive(devinfo, opts)
 	if err != nil {
-		log.Print("getBinaryDeps: failed to stat file")
 		return err
 	}
-	if err := getFiles(files, dfbFiles, true); err != nil {
+
+	requiredDirs := []string{
+		"/bin", "/sbin", "/usr/bin", "/usr/sbin", "/proc", "/sys",
+		"/dev", "/tmp", "/lib", "/boot", "/sysroot", "/etc",
+	}
+	for _, dir := range requiredDirs {
+		initfsArchive.Dirs[dir] = false
+	}
+	if err := initfsArchive.AddStandardDevNodes(); err != nil {
 		return err
 	}
 
-	// tslib
-	tslibFiles := make(misc.StringSet)
-	err = filepath.Walk("/usr/lib/ts", func(path string, f os.FileInfo, err error) error {
-		if filepath.Ext(path) == ".so" {
-			tslibFiles[path] = false
-		}
-		return nil
-	})
-	if err != nil {
-		log.Print("getBinaryDeps: failed to stat file")
+	for file := range files {
+		initfsArchive.Files[file] = false
+	}
+
+	initfsArchive.EmbedManifest(manifestPath(name, opts.manifestHash), opts.manifestHash)
+
+	if err := checkElfArch(initfsArchive.Files, devinfo); err != nil {
 		return err
 	}
-	libts, _ := filepath.Glob("/usr/lib/libts*")
-	for _, file := range libts {
-		tslibFiles[file] = false
+
+	if err := lintFiles(initfsArchive.Files, opts); err != nil {
+		return err
+	}
+
+	hookOwners, err := getHookOwners(flavor, opts)
+	if err != nil {
+		return err
 	}
-	if err = getFiles(files, tslibFiles, true); err != nil {
+	if err := initfsArchive.AddFileFromReader("/etc/mkinitfs/hooks", strings.NewReader(hookOwners), 0644); err != nil {
 		return err
 	}
 
-	// mesa hw accel
-	if devinfo.MesaDriver != "" {
-		mesaFiles := misc.StringSet{
-			"/usr/lib/libEGL.so.1":    false,
-			"/usr/lib/libGLESv2.so.2": false,
-			"/usr/lib/libgbm.so.1":    false,
-			"/usr/lib/libudev.so.1":   false,
-			"/usr/lib/xorg/modules/dri/" + devinfo.MesaDriver + "_dri.so": false,
+	entries := getInitfsEntries(flavor, opts)
+	var dests []string
+	for dest := range entries {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	for _, dest := range dests {
+		if err := initfsArchive.AddFile(entries[dest], dest); err != nil {
+			return err
+		}
+	}
+
+	if devinfo.InitfsExtraVerity == "true" {
+		if err := initfsArchive.AddFile(filepath.Join(path, "initramfs-extra.verity.params"), "/etc/mkinitfs/initramfs-extra.verity"); err != nil {
+			return err
+		}
+	}
+
+	if exists("/etc/postmarketos-mkinitfs/secrets") {
+		log.Println("- Including hook secrets")
+		if err := addSecrets(initfsArchive, getHookFiles("/etc/postmarketos-mkinitfs/secrets")); err != nil {
+			return err
+		}
+	}
+
+	// last, so that it replaces anything else at the same paths
+	if exists(overlayDir) {
+		log.Print("- Including overlay: ", overlayDir)
+		if err := initfsArchive.AddOverlay(overlayDir); err != nil {
+			return err
 		}
-		if err := getFiles(files, mesaFiles, true); err != nil {
+	}
+
+	if opts.stageDir != "" {
+		if err := stageArchive(initfsArchive, opts.stageDir, name); err != nil {
 			return err
 		}
 	}
+	log.Println("- Writing and verifying initramfs archive")
+	if err := initfsArchive.WriteContext(ctx, filepath.Join(path, name), os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	if opts.tar {
+		return nil
+	}
+	if devinfo.InitfsCpioFormat == "odc" {
+		log.Print("- Unable to read odc archives, skipping policy checks")
+		return nil
+	}
+	if err := checkArchivePolicies(filepath.Join(path, name), policy.ArchiveInitfs, getCriticalEntries(files)); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func getHookScripts(files misc.StringSet) {
-	scripts, _ := filepath.Glob("/etc/postmarketos-mkinitfs/hooks/*.sh")
-	for _, script := range scripts {
-		files[script] = false
+// Directory with policies (*.policy) that the archives have to satisfy, see
+// policy.Policy
+const policyDir = "/etc/postmarketos-mkinitfs/policy"
+
+// Returns the built-in policy for the initramfs, with the paths that it can't
+// boot without
+func getCriticalEntries(files misc.StringSet) policy.Policy {
+	p := policy.Policy{
+		Archive: policy.ArchiveInitfs,
+		Rules: []policy.Rule{
+			{Type: policy.Require, Pattern: "/init", Executable: true},
+			{Type: policy.Require, Pattern: "/bin/busybox", Executable: true},
+		},
+	}
+	// only there if the kernel has modules
+	var modulesDeps []string
+	for file := range files {
+		if strings.HasPrefix(file, "/lib/modules/") && filepath.Base(file) == "modules.dep" {
+			modulesDeps = append(modulesDeps, file)
+		}
+	}
+	sort.Strings(modulesDeps)
+	for _, file := range modulesDeps {
+		p.Rules = append(p.Rules, policy.Rule{Type: policy.Require, Pattern: file})
 	}
+	return p
 }
 
-func getInitfsExtraFiles(files misc.StringSet, devinfo deviceinfo.DeviceInfo) error {
-	log.Println("== Generating initramfs extra ==")
-	binariesExtra := misc.StringSet{
-		"/lib/libz.so.1":        false,
-		"/sbin/dmsetup":         false,
-		"/sbin/e2fsck":          false,
-		"/usr/sbin/parted":      false,
-		"/usr/sbin/resize2fs":   false,
-		"/usr/sbin/resize.f2fs": false,
+// Get the policies from policyDir that apply to the given archive
+func getPolicies(dir string, archiveName string) ([]policy.Policy, error) {
+	policies, err := policy.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
-	log.Println("- Including extra binaries")
-	if err := getFiles(files, binariesExtra, true); err != nil {
+
+	var found []policy.Policy
+	for _, p := range policies {
+		if p.Archive == archiveName {
+			found = append(found, p)
+		}
+	}
+	return found, nil
+}
+
+// Read back the archive, and check that it satisfies the given policies
+func checkPolicies(path string, policies []policy.Policy) error {
+	entries, err := archive.ReadEntries(path)
+	if err != nil {
+		return fmt.Errorf("unable to read back archive %q: %w", path, err)
+	}
+
+	var problems []string
+	for _, p := range policies {
+		for _, v := range p.Check(entries) {
+			problems = append(problems, v.String())
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("archive %q does not satisfy the policies, it might not boot: %s", path, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Check the written archive against the policies for it, the built-in ones
+// and the ones in policyDir
+func checkArchivePolicies(path string, archiveName string, builtin ...policy.Policy) error {
+	policies, err := getPolicies(policyDir, archiveName)
+	if err != nil {
 		return err
 	}
+	policies = append(builtin, policies...)
+	if len(policies) == 0 {
+		return nil
+	}
+	return checkPolicies(path, policies)
+}
 
-	if exists("/usr/bin/osk-sdl") {
-		log.Println("- Including FDE support")
-		if err := getFdeFiles(files, devinfo); err != nil {
-			return err
+// Get all files for the initramfs-extra, except for files that are already
+// in the initramfs
+func getInitfsExtraFileSet(ctx context.Context, initfsFiles misc.StringSet, flavor string, devinfo deviceinfo.DeviceInfo, opts generateOpts) (misc.StringSet, error) {
+	files := make(misc.StringSet)
+
+	if err := getInitfsExtraFiles(ctx, files, devinfo, opts); err != nil {
+		return files, err
+	}
+
+	// modules can't be included in initramfs-extra, so no kernel version
+	if err := getDeclarativeHookFiles(ctx, files, hook.ArchiveInitfsExtra, "", flavor, devinfo); err != nil {
+		return files, err
+	}
+
+	filterDebugFiles(files)
+
+	keep := make(misc.StringSet)
+	if exists(extraDuplicatesDir) {
+		keep = getHookFiles(extraDuplicatesDir)
+	}
+	if removed := dropDuplicates(files, initfsFiles, keep); removed > 0 {
+		log.Printf("- Excluded %d file(s) already in the initramfs", removed)
+	}
+
+	return files, nil
+}
+
+// Generate the initramfs and initramfs-extra archives in workDir. When the
+// initramfs needs information about initramfs-extra (the dm-verity root
+// hash), initramfs-extra is generated first. Otherwise both are generated at
+// the same time, so that compressing one overlaps with reading the files of
+// the other, unless the memory is limited.
+func generateArchives(ctx context.Context, workDir string, initfsFiles misc.StringSet, initfsExtraFiles misc.StringSet, flavor string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	if devinfo.InitfsExtraVerity == "true" || opts.maxMemory > 0 {
+		if err := generateInitfsExtra(ctx, "initramfs-extra", workDir, initfsExtraFiles, devinfo, opts); err != nil {
+			return fmt.Errorf("generateInitfsExtra: %w", err)
 		}
-	} else {
-		log.Println("- *NOT* including FDE support")
+		if devinfo.InitfsExtraVerity == "true" {
+			if err := generateVerity("initramfs-extra", workDir); err != nil {
+				return fmt.Errorf("generateVerity: %w", err)
+			}
+		}
+		if err := generateInitfs(ctx, "initramfs", workDir, initfsFiles, flavor, devinfo, opts); err != nil {
+			return fmt.Errorf("generateInitfs: %w", err)
+		}
+		return nil
+	}
+
+	extraErr := make(chan error, 1)
+	go func() {
+		extraErr <- generateInitfsExtra(ctx, "initramfs-extra", workDir, initfsExtraFiles, devinfo, opts)
+	}()
+	initfsErr := generateInitfs(ctx, "initramfs", workDir, initfsFiles, flavor, devinfo, opts)
+	// wait for initramfs-extra even if the initramfs failed, so nothing is
+	// written to the work dir anymore once this returns
+	if err := <-extraErr; err != nil {
+		return fmt.Errorf("generateInitfsExtra: %w", err)
+	}
+	if initfsErr != nil {
+		return fmt.Errorf("generateInitfs: %w", initfsErr)
 	}
 
 	return nil
 }
 
-func getInitfsFiles(files misc.StringSet, devinfo deviceinfo.DeviceInfo) error {
-	log.Println("== Generating initramfs ==")
-	requiredFiles := misc.StringSet{
-		"/bin/busybox":        false,
-		"/bin/sh":             false,
-		"/bin/busybox-extras": false,
-		"/usr/sbin/telnetd":   false,
-		"/sbin/kpartx":        false,
-		"/etc/deviceinfo":     false,
-		"/usr/bin/unudhcpd":   false,
+func generateInitfsExtra(ctx context.Context, name string, path string, files misc.StringSet, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	log.Println("== Generating initramfs extra ==")
+	initfsExtraArchive, err := newArchive(devinfo, opts)
+	if err != nil {
+		return err
 	}
 
-	// Hook files & scripts
-	if exists("/etc/postmarketos-mkinitfs/files") {
-		log.Println("- Including hook files")
-		hookFiles := getHookFiles("/etc/postmarketos-mkinitfs/files")
-		if err := getFiles(files, hookFiles, true); err != nil {
+	for file := range files {
+		initfsExtraArchive.Files[file] = false
+	}
+
+	initfsExtraArchive.EmbedManifest(manifestPath(name, opts.manifestHash), opts.manifestHash)
+
+	if err := checkElfArch(initfsExtraArchive.Files, devinfo); err != nil {
+		return err
+	}
+
+	if err := lintFiles(initfsExtraArchive.Files, opts); err != nil {
+		return err
+	}
+
+	if opts.stageDir != "" {
+		if err := stageArchive(initfsExtraArchive, opts.stageDir, name); err != nil {
 			return err
 		}
 	}
-	log.Println("- Including hook scripts")
-	getHookScripts(files)
+	log.Println("- Writing and verifying initramfs-extra archive")
+	if err := initfsExtraArchive.WriteContext(ctx, filepath.Join(path, name), os.FileMode(0644)); err != nil {
+		return err
+	}
 
-	log.Println("- Including required binaries")
-	if err := getFiles(files, requiredFiles, true); err != nil {
+	if opts.tar {
+		return nil
+	}
+	if devinfo.InitfsCpioFormat == "odc" {
+		log.Print("- Unable to read odc archives, skipping policy checks")
+		return nil
+	}
+	if err := checkArchivePolicies(filepath.Join(path, name), policy.ArchiveInitfsExtra); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func getInitfsModules(files misc.StringSet, devinfo deviceinfo.DeviceInfo, kernelVer string) error {
-	log.Println("- Including kernel modules")
+// Files listed in this dir (in the same format as the files dir) are
+// included in initramfs-extra even when they are also in the initramfs
+const extraDuplicatesDir = "/etc/postmarketos-mkinitfs/files-extra-duplicates"
 
-	modDir := filepath.Join("/lib/modules", kernelVer)
-	if !exists(modDir) {
-		// dir /lib/modules/<kernel> if kernel built without module support, so just print a message
-		log.Printf("-- kernel module directory not found: %q, not including modules", modDir)
-		return nil
+// Remove files that are already in the initramfs from the initramfs-extra
+// files, since the initramfs-extra is extracted on top of the initramfs at
+// boot anyway. Files in keep are never removed. Returns the number of files
+// that were removed.
+func dropDuplicates(files misc.StringSet, initfsFiles misc.StringSet, keep misc.StringSet) int {
+	removed := 0
+	for file := range files {
+		if _, ok := initfsFiles[file]; !ok {
+			continue
+		}
+		if _, ok := keep[file]; ok {
+			continue
+		}
+		delete(files, file)
+		removed++
 	}
+	return removed
+}
 
-	// modules.* required by modprobe
-	modprobeFiles, _ := filepath.Glob(filepath.Join(modDir, "modules.*"))
-	for _, file := range modprobeFiles {
-		files[file] = false
+// Create a dm-verity hash tree for the archive with the given name, and a
+// file with the parameters needed to open it at boot, to be included in the
+// initramfs.
+func generateVerity(name string, path string) error {
+	log.Printf("== Generating dm-verity hash tree for %s ==", name)
+	archivePath := filepath.Join(path, name)
+	params, err := verity.Create(archivePath, archivePath+".verity")
+	if err != nil {
+		return err
 	}
+	log.Print("- Root hash: ", params.RootHash)
+
+	// the archive is padded to the verity block size, so record the original
+	// size too, in order to strip the padding before decompressing it
+	contents := fmt.Sprintf("verity_root_hash=%s\nverity_data_size=%d\n", params.RootHash, params.DataSize)
+
+	return os.WriteFile(archivePath+".verity.params", []byte(contents), 0644)
+}
 
-	// module name (without extension), or directory (trailing slash is important! globs OK)
-	requiredModules := []string{
-		"loop",
-		"dm-crypt",
-		"kernel/fs/overlayfs/",
-		"kernel/crypto/",
-		"kernel/arch/*/crypto/",
+// Write the extlinux and GRUB configs enabled in deviceinfo to the output
+// directory, referencing the kernel and the initramfs with the given name
+func writeBootConfigs(outDir string, initfsName string, devinfo deviceinfo.DeviceInfo) error {
+	configs := map[string]string{}
+	if devinfo.GenerateExtlinuxConfig == "true" {
+		configs[bootconf.ExtlinuxPath] = bootconf.Extlinux(devinfo, initfsName)
+	}
+	if devinfo.GenerateGrubConfig == "true" {
+		configs[bootconf.GrubPath] = bootconf.Grub(devinfo, initfsName)
+	}
+	if len(configs) == 0 {
+		return nil
 	}
 
-	for _, item := range requiredModules {
-		dir, file := filepath.Split(item)
-		if file == "" {
-			// item is a directory
-			dir = filepath.Join(modDir, dir)
-			dirs, _ := filepath.Glob(dir)
-			for _, d := range dirs {
-				if err := getModulesInDir(files, d); err != nil {
-					log.Print("Unable to get modules in dir: ", d)
-					return err
-				}
-			}
-		} else if dir == "" {
-			// item is a module name
-			if err := getModule(files, file, modDir); err != nil {
-				log.Print("Unable to get module: ", file)
-				return err
-			}
+	log.Println("== Updating bootloader configs ==")
+	var paths []string
+	for path := range configs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		changed, err := writeIfChanged(filepath.Join(outDir, path), []byte(configs[path]))
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Print("- ", path)
 		} else {
-			log.Printf("Unknown module entry: %q", item)
+			log.Print("- ", path, " (unchanged)")
 		}
 	}
-
-	// deviceinfo modules
-	for _, module := range strings.Fields(devinfo.ModulesInitfs) {
-		if err := getModule(files, module, modDir); err != nil {
-			log.Print("Unable to get modules from deviceinfo")
+	return nil
+}
+
+// Write the data to the file, if it doesn't have the same contents already,
+// through a temporary file so the file is never left half written. Returns
+// whether the file was written.
+func writeIfChanged(path string, data []byte) (bool, error) {
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// A boot artifact for the bootloader of the device, generated in the work
+// directory after the initramfs and installed with it
+type bootImage struct {
+	// Name of the file in the work and output directories
+	name    string
+	enabled func(devinfo deviceinfo.DeviceInfo) bool
+	// Generate the file in workDir, the kernel is in outDir and the
+	// initramfs is workDir/initfs
+	generate func(ctx context.Context, name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error
+}
+
+// The boot images that can be generated, enabled with deviceinfo variables
+var bootImages = []bootImage{
+	{
+		name:    "boot.scr",
+		enabled: func(devinfo deviceinfo.DeviceInfo) bool { return devinfo.GenerateUbootBootscr == "true" },
+		generate: func(ctx context.Context, name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+			return generateBootScr(name, workDir, devinfo, opts)
+		},
+	},
+	{
+		name:    fitImage,
+		enabled: func(devinfo deviceinfo.DeviceInfo) bool { return devinfo.GenerateFitImage == "true" },
+		generate: func(ctx context.Context, name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+			return generateFitImage(name, workDir, outDir, initfs, devinfo, opts)
+		},
+	},
+	{
+		name:    depthchargeImage,
+		enabled: func(devinfo deviceinfo.DeviceInfo) bool { return devinfo.GenerateDepthchargeImage == "true" },
+		generate: func(ctx context.Context, name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+			return generateDepthchargeImage(ctx, executor.NewHost(), name, workDir, outDir, initfs, devinfo)
+		},
+	},
+	{
+		name:    corebootConfig,
+		enabled: func(devinfo deviceinfo.DeviceInfo) bool { return devinfo.GenerateCorebootPayload == "true" },
+		generate: func(ctx context.Context, name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+			return generateCorebootConfig(name, workDir, outDir, initfs, devinfo)
+		},
+	},
+}
+
+// Name of the coreboot config fragment in the output directory
+const corebootConfig = "coreboot.config"
+
+// Generate a coreboot config fragment for building a ROM with the installed
+// kernel and initramfs as its Linux payload
+func generateCorebootConfig(name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo) error {
+	log.Println("== Generating coreboot payload config ==")
+	if err := coreboot.CheckArch(devinfo.Arch); err != nil {
+		return err
+	}
+	kernel, err := findKernel(outDir)
+	if err != nil {
+		return err
+	}
+	config := coreboot.Config(kernel, filepath.Join(outDir, initfs), devinfo.KernelCmdline)
+	return os.WriteFile(filepath.Join(workDir, name), []byte(config), 0644)
+}
+
+// Name of the FIT image in the output directory
+const fitImage = "boot.itb"
+
+// Build a FIT image with the kernel, initramfs and dtbs, for U-Boot to boot
+// with 'bootm'. The images are signed if deviceinfo_fit_signing_key is set,
+// the key name hint defaults to the name of the key file without the
+// extension, like mkimage's -k <keydir> expects.
+func generateFitImage(name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	log.Println("== Generating FIT image ==")
+	kernelFile, err := findKernel(outDir)
+	if err != nil {
+		return err
+	}
+	kernel, err := os.ReadFile(kernelFile)
+	if err != nil {
+		return err
+	}
+	initramfs, err := os.ReadFile(filepath.Join(workDir, initfs))
+	if err != nil {
+		return err
+	}
+
+	dtbFiles, err := findDtbs(outDir, devinfo.Dtb)
+	if err != nil {
+		return err
+	}
+	var dtbs []fit.Dtb
+	for _, file := range dtbFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
 			return err
 		}
+		dtbs = append(dtbs, fit.Dtb{Name: strings.TrimSuffix(filepath.Base(file), ".dtb"), Data: data})
 	}
 
-	// /etc/postmarketos-mkinitfs/modules/*.modules
-	initfsModFiles, _ := filepath.Glob("/etc/postmarketos-mkinitfs/modules/*.modules")
-	for _, modFile := range initfsModFiles {
-		f, err := os.Open(modFile)
-		if err != nil {
-			log.Print("getInitfsModules: unable to open mkinitfs modules file: ", modFile)
+	img := fit.Image{
+		Description: "postmarketOS",
+		Arch:        devinfo.Arch,
+		Kernel:      kernel,
+		Initramfs:   initramfs,
+		Dtbs:        dtbs,
+		Hash:        devinfo.FitHash,
+		KeyNameHint: devinfo.FitKeyNameHint,
+		Timestamp:   getTimestamp(opts),
+	}
+	if devinfo.FitSigningKey != "" {
+		if img.Key, err = fit.ReadKey(devinfo.FitSigningKey); err != nil {
 			return err
 		}
-		defer f.Close()
-		s := bufio.NewScanner(f)
-		for s.Scan() {
-			if err := getModule(files, s.Text(), modDir); err != nil {
-				log.Print("getInitfsModules: unable to get module file: ", s.Text())
-				return err
-			}
+		if img.KeyNameHint == "" {
+			base := filepath.Base(devinfo.FitSigningKey)
+			img.KeyNameHint = strings.TrimSuffix(base, filepath.Ext(base))
 		}
 	}
 
-	return nil
+	data, err := fit.Build(img)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(workDir, name), data, 0644)
 }
 
-func getKernelReleaseFile() (string, error) {
-	files, _ := filepath.Glob("/usr/share/kernel/*/kernel.release")
-	// only one kernel flavor supported
-	if len(files) != 1 {
-		return "", fmt.Errorf("only one kernel release/flavor is supported, found: %q", files)
+// Timestamp for the headers of the generated boot images: SOURCE_DATE_EPOCH
+// if it's set, so they are reproducible, otherwise the current time
+func getTimestamp(opts generateOpts) time.Time {
+	if !opts.sourceDateEpoch.IsZero() {
+		return opts.sourceDateEpoch
 	}
-
-	return files[0], nil
+	return time.Now()
 }
 
-func getKernelVersion() (string, error) {
-	var version string
+// Name of the ChromeOS kernel partition image in the output directory
+const depthchargeImage = "vmlinuz.kpart"
 
-	releaseFile, err := getKernelReleaseFile()
-	if err != nil {
-		return version, err
-	}
+// Directories searched for the dtbs in deviceinfo_dtb, relative ones are in
+// the output directory
+var dtbDirs = []string{"dtbs", "/usr/share/dtb"}
 
-	contents, err := os.ReadFile(releaseFile)
+// Pack the kernel, initramfs and dtbs into a signed ChromeOS kernel partition
+// image, for writing to the kernel partition of Chromebooks booting with
+// depthcharge
+func generateDepthchargeImage(ctx context.Context, e executor.Executor, name string, workDir string, outDir string, initfs string, devinfo deviceinfo.DeviceInfo) error {
+	log.Println("== Generating ChromeOS kernel partition image ==")
+	kernel, err := findKernel(outDir)
 	if err != nil {
-		return version, err
+		return err
 	}
 
-	return strings.TrimSpace(string(contents)), nil
-}
-
-func generateInitfs(name string, path string, kernVer string, devinfo deviceinfo.DeviceInfo) error {
-	initfsArchive, err := archive.New()
+	dtbs, err := findDtbs(outDir, devinfo.Dtb)
 	if err != nil {
 		return err
 	}
 
-	requiredDirs := []string{
-		"/bin", "/sbin", "/usr/bin", "/usr/sbin", "/proc", "/sys",
-		"/dev", "/tmp", "/lib", "/boot", "/sysroot", "/etc",
+	img := depthcharge.Image{
+		Arch:        devinfo.Arch,
+		Kernel:      kernel,
+		Initramfs:   filepath.Join(workDir, initfs),
+		Dtbs:        dtbs,
+		Cmdline:     devinfo.KernelCmdline,
+		Keyblock:    devinfo.DepthchargeKeyblock,
+		SignPrivate: devinfo.DepthchargeSignprivate,
 	}
-	for _, dir := range requiredDirs {
-		initfsArchive.Dirs[dir] = false
+	return depthcharge.Pack(ctx, e, img, workDir, filepath.Join(workDir, name))
+}
+
+// Find the dtbs in deviceinfo_dtb (names without the .dtb extension, e.g.
+// "rockchip/rk3399-gru-kevin") in dtbDirs
+func findDtbs(outDir string, names string) ([]string, error) {
+	var dtbs []string
+	for _, name := range strings.Fields(names) {
+		found := false
+		for _, dir := range dtbDirs {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(outDir, dir)
+			}
+			path := filepath.Join(dir, name+".dtb")
+			if exists(path) {
+				dtbs = append(dtbs, path)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unable to find dtb %q in: %s", name, strings.Join(dtbDirs, ", "))
+		}
 	}
+	return dtbs, nil
+}
 
-	if err := getInitfsFiles(initfsArchive.Files, devinfo); err != nil {
+func generateBootScr(name string, path string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	log.Println("== Generating U-Boot boot script ==")
+	script, err := bootscr.Generate(devinfo)
+	if err != nil {
 		return err
 	}
 
-	if err := getInitfsModules(initfsArchive.Files, devinfo, kernVer); err != nil {
+	// keep the plain text version around for reference/debugging
+	if err := os.WriteFile(filepath.Join(path, "boot.cmd"), []byte(script), 0644); err != nil {
 		return err
 	}
 
-	if err := initfsArchive.AddFile("/usr/share/postmarketos-mkinitfs/init.sh", "/init"); err != nil {
+	img, err := bootscr.Wrap([]byte(script), "postmarketOS boot script", devinfo.Arch, getTimestamp(opts))
+	if err != nil {
 		return err
 	}
 
-	// splash images
-	log.Println("- Including splash images")
-	splashFiles, _ := filepath.Glob("/usr/share/postmarketos-splashes/*.ppm.gz")
-	for _, file := range splashFiles {
-		// splash images are expected at /<file>
-		if err := initfsArchive.AddFile(file, filepath.Join("/", filepath.Base(file))); err != nil {
+	return os.WriteFile(filepath.Join(path, name), img, 0644)
+}
+
+// Print the size of the generated archives, and check that the initramfs fits
+// in maxSize (if it's > 0). The initramfs-extra is loaded from the boot
+// partition by the initramfs, so it isn't subject to ramdisk size limits.
+func sizeReport(path string, initfsName string, initfsExtraName string, maxSize int64) error {
+	log.Println("== Size report ==")
+	var initfsSize int64
+	for _, name := range []string{initfsName, initfsExtraName} {
+		stat, err := os.Stat(filepath.Join(path, name))
+		if err != nil {
 			return err
 		}
+		log.Printf("- %s: %s", name, misc.FormatSize(stat.Size()))
+		if name == initfsName {
+			initfsSize = stat.Size()
+		}
 	}
 
-	// initfs_functions
-	if err := initfsArchive.AddFile("/usr/share/postmarketos-mkinitfs/init_functions.sh", "/init_functions.sh"); err != nil {
-		return err
+	if len(staticBinaries) > 0 {
+		log.Printf("- %d statically linked binaries:", len(staticBinaries))
+		var static []string
+		for file := range staticBinaries {
+			static = append(static, file)
+		}
+		sort.Strings(static)
+		for _, file := range static {
+			if stat, err := os.Stat(file); err == nil {
+				log.Printf("-- %s: %s", file, misc.FormatSize(stat.Size()))
+			}
+		}
 	}
 
-	log.Println("- Writing and verifying initramfs archive")
-	if err := initfsArchive.Write(filepath.Join(path, name), os.FileMode(0644)); err != nil {
-		return err
+	if maxSize <= 0 {
+		return nil
+	}
+	if initfsSize > maxSize {
+		return i18n.Errorf(i18n.MaxSizeExceeded, initfsName,
+			misc.FormatSize(initfsSize), misc.FormatSize(maxSize), misc.FormatSize(initfsSize-maxSize))
 	}
+	log.Printf("- %s is within the max size of %s (%s free)", initfsName,
+		misc.FormatSize(maxSize), misc.FormatSize(maxSize-initfsSize))
 
 	return nil
 }
 
-func generateInitfsExtra(name string, path string, devinfo deviceinfo.DeviceInfo) error {
-	initfsExtraArchive, err := archive.New()
-	if err != nil {
-		return err
+// Get the algorithm for the checksum files of the archives, "" for none
+func getChecksumAlgorithm(name string) (digest.Algorithm, error) {
+	switch name {
+	case "":
+		return digest.SHA256, nil
+	case "none":
+		return "", nil
 	}
+	return digest.Parse(name)
+}
 
-	if err := getInitfsExtraFiles(initfsExtraArchive.Files, devinfo); err != nil {
-		return err
+// Write a checksum file for each of the given files in dir, named after the
+// file and algorithm (e.g. initramfs.sha256), that can be checked with
+// sha256sum -c and the like. Returns the names of the checksum files, none if
+// alg is "".
+func writeChecksums(dir string, files []string, alg digest.Algorithm) ([]string, error) {
+	if alg == "" {
+		return nil, nil
+	}
+	var names []string
+	for _, file := range files {
+		sum, err := alg.File(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		name := file + "." + string(alg)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(fmt.Sprintf("%s  %s\n", sum, file)), 0644); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
 	}
+	return names, nil
+}
 
-	log.Println("- Writing and verifying initramfs-extra archive")
-	if err := initfsExtraArchive.Write(filepath.Join(path, name), os.FileMode(0644)); err != nil {
+// Stage the contents of the archive with the given name in a directory in
+// stageDir, replacing the one of a previous build. The archive is then
+// written from that directory, see archive.Archive.Stage.
+func stageArchive(a *archive.Archive, stageDir string, name string) error {
+	dir := filepath.Join(stageDir, name)
+	log.Print("- Staging ", name, " in: ", dir)
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
 		return err
 	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return a.Stage(dir)
+}
+
+// Generate the initramfs and initramfs-extra archives in workDir from the
+// directory trees in dir/initramfs and dir/initramfs-extra, prepared by other
+// tooling (or staged by a previous build, see stageArchive), instead of from
+// the files on the system. The manifest and the dm-verity parameters are
+// generated again, the archives are only checked against the policies, since
+// the trees can have anything in them.
+func generateFromDir(ctx context.Context, workDir string, dir string, devinfo deviceinfo.DeviceInfo, opts generateOpts) error {
+	verityParams := "/etc/mkinitfs/initramfs-extra.verity"
+	// initramfs-extra first, the initramfs has its dm-verity root hash
+	for _, name := range []string{"initramfs-extra", "initramfs"} {
+		tree := filepath.Join(dir, name)
+		log.Print("== Generating ", name, " from: ", tree, " ==")
+		a, err := newArchive(devinfo, opts)
+		if err != nil {
+			return err
+		}
+
+		manifest := manifestPath(name, opts.manifestHash)
+		excludes := []string{strings.TrimPrefix(manifest, "/")}
+		if name == "initramfs" && devinfo.InitfsExtraVerity == "true" {
+			excludes = append(excludes, strings.TrimPrefix(verityParams, "/"))
+		}
+		if err := a.AddDirRecursive(tree, "/", excludes); err != nil {
+			return err
+		}
+		if name == "initramfs" && devinfo.InitfsExtraVerity == "true" {
+			if err := a.AddFile(filepath.Join(workDir, "initramfs-extra.verity.params"), verityParams); err != nil {
+				return err
+			}
+		}
+		a.EmbedManifest(manifest, opts.manifestHash)
+
+		log.Print("- Writing and verifying ", name, " archive")
+		out := filepath.Join(workDir, name)
+		if err := a.WriteContext(ctx, out, os.FileMode(0644)); err != nil {
+			return err
+		}
+
+		if name == "initramfs-extra" && devinfo.InitfsExtraVerity == "true" {
+			if err := generateVerity(name, workDir); err != nil {
+				return fmt.Errorf("generateVerity: %w", err)
+			}
+		}
 
+		if opts.tar {
+			continue
+		}
+		if devinfo.InitfsCpioFormat == "odc" {
+			log.Print("- Unable to read odc archives, skipping policy checks")
+			continue
+		}
+		var builtin []policy.Policy
+		archiveName := policy.ArchiveInitfsExtra
+		if name == "initramfs" {
+			archiveName = policy.ArchiveInitfs
+			// the modules in the tree aren't known
+			builtin = append(builtin, getCriticalEntries(nil))
+		}
+		if err := checkArchivePolicies(out, archiveName, builtin...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func stripExts(file string) string {
-	return strings.Split(file, ".")[0]
+// Check the scripts in the tree of the initramfs (init, init_functions.sh and
+// the hooks) by running the shell of the initramfs on them, see
+// hooktest.Tester.Check
+func testHooks(ctx context.Context, tree string, devinfo deviceinfo.DeviceInfo) ([]hooktest.Problem, error) {
+	log.Print("== Checking the scripts in: ", tree, " ==")
+	tester, err := hooktest.New(tree, devinfo.Arch)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := []string{"/init", "/init_functions.sh"}
+	hooks, err := filepath.Glob(filepath.Join(tree, hooksDir, "*.sh"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hooks)
+	for _, hook := range hooks {
+		scripts = append(scripts, filepath.Join(hooksDir, filepath.Base(hook)))
+	}
+	return tester.Check(ctx, scripts, "/init_functions.sh")
+}
+
+// Name of the tarball for the archive with the given name, see
+// generateOpts.tar
+func getTarName(name string, compression archive.Compression) string {
+	switch compression {
+	case archive.CompressionGzip:
+		return name + ".tar.gz"
+	case archive.CompressionZstd:
+		return name + ".tar.zst"
+	}
+	return name + ".tar"
+}
+
+// Path in the archive for the manifest of the archive with the given name.
+// The initramfs-extra gets extracted on top of the initramfs at boot, so
+// each archive needs a unique path.
+func manifestPath(name string, alg digest.Algorithm) string {
+	return filepath.Join("/etc/mkinitfs", name+"."+string(alg))
 }
 
 func getModulesInDir(files misc.StringSet, modPath string) error {
 	err := filepath.Walk(modPath, func(path string, f os.FileInfo, err error) error {
-		// TODO: need to support more extensions?
-		if filepath.Ext(path) != ".ko" && filepath.Ext(path) != ".xz" {
+		if !isModuleFile(path) {
 			return nil
 		}
 		files[path] = false
@@ -630,48 +3788,281 @@ func getModulesInDir(files misc.StringSet, modPath string) error {
 // file and all of its dependencies.
 // Note: it's not necessarily fatal if the module is not found, since it may
 // have been built into the kernel
-// TODO: look for it in modules.builtin, and make it fatal if it can't be found
-// anywhere
 func getModule(files misc.StringSet, modName string, modDir string) error {
 
 	modDep := filepath.Join(modDir, "modules.dep")
 	if !exists(modDep) {
-		log.Fatal("Kernel module.dep not found: ", modDir)
+		fatal("Kernel module.dep not found: ", modDir)
 	}
 
-	fd, err := os.Open(modDep)
+	deps, err := lookupModule(modName, modDir)
 	if err != nil {
-		log.Print("Unable to open modules.dep: ", modDep)
 		return err
 	}
-	defer fd.Close()
 
-	deps, err := getModuleDeps(modName, fd)
+	return addModuleFiles(files, modName, deps, modDir)
+}
+
+// Get the path of the module with the given name, followed by the paths of
+// its dependencies, relative to the module directory. Modules that aren't in
+// modules.dep are searched for in the directories for out-of-tree modules,
+// since these may have been installed without running depmod. Returns nil if
+// the module can't be found.
+func lookupModule(modName string, modDir string) ([]string, error) {
+	index, err := getModuleIndex(modDir)
 	if err != nil {
-		return err
+		log.Print("Unable to read modules.dep in: ", modDir)
+		return nil, err
+	}
+
+	if deps := index.deps(modName); deps != nil {
+		if err := index.checkDeps(modName); err != nil {
+			return nil, fmt.Errorf("inconsistent modules.dep in %q: %w", modDir, err)
+		}
+		return deps, nil
+	}
+
+	path, err := findOutOfTreeModule(modName, modDir)
+	if err != nil || path == "" {
+		return nil, err
 	}
+	log.Printf("-- module %q is not in modules.dep, including %s without any dependencies", modName, path)
 
+	return []string{path}, nil
+}
+
+func addModuleFiles(files misc.StringSet, modName string, deps []string, modDir string) error {
 	for _, dep := range deps {
 		p := filepath.Join(modDir, dep)
 		if !exists(p) {
-			log.Print(fmt.Sprintf("Tried to include a module that doesn't exist in the modules directory (%s): %s", modDir, p))
-			return err
+			return fmt.Errorf("module %q requires %q, which doesn't exist in the modules directory (%s)", modName, dep, modDir)
 		}
 		files[p] = false
 	}
 
-	return err
+	return nil
+}
+
+// Directories in the module directory with out-of-tree modules, in the order
+// that modprobe prefers them over the in-tree modules
+var outOfTreeModuleDirs = []string{"updates", "extra"}
+
+// Search for a module with the given name in the out-of-tree module
+// directories. Returns the path relative to the module directory, or an
+// empty string if it wasn't found.
+func findOutOfTreeModule(modName string, modDir string) (string, error) {
+	key := canonicalModuleName(modName)
+	for _, dir := range outOfTreeModuleDirs {
+		var found string
+		err := filepath.Walk(filepath.Join(modDir, dir), func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if found == "" && isModuleFile(path) && canonicalModuleName(moduleName(path)) == key {
+				found = path
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		if found != "" {
+			return filepath.Rel(modDir, found)
+		}
+	}
+
+	return "", nil
+}
+
+// Get the modules listed in deviceinfo_modules_initfs. Each module must be
+// either a module file in modules.dep, an alias of one in modules.alias, or
+// built into the kernel (modules.builtin). Modules that can't be found are
+// an error unless allowMissing is set, since the device probably won't boot
+// without them.
+func getDeviceinfoModules(files misc.StringSet, devinfo deviceinfo.DeviceInfo, modDir string, allowMissing bool) error {
+	var missing []string
+	for _, module := range strings.Fields(devinfo.ModulesInitfs) {
+		found, err := resolveModule(files, module, modDir)
+		if err != nil {
+			return err
+		}
+		if !found {
+			missing = append(missing, module)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err := i18n.Errorf(i18n.MissingModules, modDir, strings.Join(missing, ", "))
+	if !allowMissing {
+		return err
+	}
+	log.Print("WARNING: ", err)
+
+	return nil
+}
+
+// Resolve a module by name, as a module file (including its dependencies),
+// an alias or a module built into the kernel. Returns false if it is none of
+// these.
+func resolveModule(files misc.StringSet, modName string, modDir string) (bool, error) {
+	deps, err := lookupModule(modName, modDir)
+	if err != nil {
+		return false, err
+	}
+	if len(deps) > 0 {
+		return true, addModuleFiles(files, modName, deps, modDir)
+	}
+
+	builtin, err := isBuiltinModule(modName, modDir)
+	if err != nil || builtin {
+		return builtin, err
+	}
+
+	targets, err := getModuleAliasTargets(modName, modDir)
+	if err != nil {
+		return false, err
+	}
+	for _, target := range targets {
+		if target == modName {
+			continue
+		}
+		found, err := resolveModule(files, target, modDir)
+		if err != nil || !found {
+			return found, err
+		}
+	}
+
+	return len(targets) > 0, nil
+}
+
+// Returns true if the module is listed in modules.builtin. If there is no
+// modules.builtin, no module is considered to be builtin.
+func isBuiltinModule(modName string, modDir string) (bool, error) {
+	fd, err := os.Open(filepath.Join(modDir, "modules.builtin"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer fd.Close()
+
+	key := canonicalModuleName(modName)
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		if canonicalModuleName(moduleName(s.Text())) == key {
+			return true, nil
+		}
+	}
+
+	return false, s.Err()
+}
+
+// Get the names of the modules that the given alias refers to in
+// modules.alias, or in modules.builtin.modinfo for modules built into the
+// kernel
+func getModuleAliasTargets(alias string, modDir string) ([]string, error) {
+	var targets []string
+
+	fd, err := os.Open(filepath.Join(modDir, "modules.alias"))
+	if err == nil {
+		defer fd.Close()
+		targets, err = getModuleAliases(alias, fd)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	modinfo, err := os.ReadFile(filepath.Join(modDir, "modules.builtin.modinfo"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return targets, nil
+		}
+		return nil, err
+	}
+
+	return append(targets, getBuiltinModuleAliases(alias, modinfo)...), nil
+}
+
+// Get the names of builtin modules with the given alias from the contents of
+// modules.builtin.modinfo, which has NUL separated "<module>.<key>=<value>"
+// entries
+func getBuiltinModuleAliases(alias string, modinfo []byte) []string {
+	var targets []string
+	for _, entry := range strings.Split(string(modinfo), "\x00") {
+		parts := strings.SplitN(entry, ".alias=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if match, _ := filepath.Match(parts[1], alias); match {
+			targets = append(targets, parts[0])
+		}
+	}
+	return targets
+}
+
+// Get the module names for the alias from the given modules.alias
+// io.reader. Alias patterns in modules.alias may contain globs.
+func getModuleAliases(alias string, modulesAlias io.Reader) ([]string, error) {
+	var targets []string
+	s := bufio.NewScanner(modulesAlias)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 || fields[0] != "alias" {
+			continue
+		}
+		if match, _ := filepath.Match(fields[1], alias); !match {
+			continue
+		}
+		// several patterns may match for the same module
+		dup := false
+		for _, t := range targets {
+			dup = dup || t == fields[2]
+		}
+		if !dup {
+			targets = append(targets, fields[2])
+		}
+	}
+
+	return targets, s.Err()
 }
 
-// Get the canonicalized name for the module as represented in the given modules.dep io.reader
-func getModuleDeps(modName string, modulesDep io.Reader) ([]string, error) {
-	var deps []string
+// Index of modules.dep, as a map of canonical module name -> path of the
+// module followed by the paths of its dependencies
+type moduleIndex map[string][]string
+
+// Module indexes read by getModuleIndex, by module directory
+var moduleIndexes = make(map[string]moduleIndex)
+
+// Get the index of modules.dep in the given module directory, it is only
+// read once per run
+func getModuleIndex(modDir string) (moduleIndex, error) {
+	if index, ok := moduleIndexes[modDir]; ok {
+		return index, nil
+	}
+
+	fd, err := os.Open(filepath.Join(modDir, "modules.dep"))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	index, err := parseModuleIndex(fd)
+	if err != nil {
+		return nil, err
+	}
+	moduleIndexes[modDir] = index
 
-	// split the module name on - and/or _, build a regex for matching
-	splitRe := regexp.MustCompile("[-_]+")
-	modNameReStr := splitRe.ReplaceAllString(modName, "[-_]+")
-	re := regexp.MustCompile("^" + modNameReStr + "$")
+	return index, nil
+}
 
+func parseModuleIndex(modulesDep io.Reader) (moduleIndex, error) {
+	index := make(moduleIndex)
 	s := bufio.NewScanner(modulesDep)
 	for s.Scan() {
 		fields := strings.Fields(s.Text())
@@ -680,16 +4071,96 @@ func getModuleDeps(modName string, modulesDep io.Reader) ([]string, error) {
 		}
 		fields[0] = strings.TrimSuffix(fields[0], ":")
 
-		found := re.FindAll([]byte(filepath.Base(stripExts(fields[0]))), -1)
-		if len(found) > 0 {
-			deps = append(deps, fields...)
-			break
+		key := canonicalModuleName(moduleName(fields[0]))
+		// the first entry for a module wins, unless a later one is an
+		// out-of-tree module that is preferred over it
+		if existing, ok := index[key]; !ok || moduleDirPriority(fields[0]) > moduleDirPriority(existing[0]) {
+			index[key] = fields
 		}
 	}
 	if err := s.Err(); err != nil {
-		log.Print("Unable to get module + dependencies: ", modName)
-		return deps, err
+		return index, err
+	}
+
+	return index, nil
+}
+
+// Get the path of the module with the given name, followed by the paths of
+// its dependencies, or nil if there is no such module
+func (i moduleIndex) deps(modName string) []string {
+	return i[canonicalModuleName(modName)]
+}
+
+// Check that all dependencies of the module are in the index, and that none
+// of them depend on the module again.
+func (i moduleIndex) checkDeps(modName string) error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(key string, chain []string) error
+	visit = func(key string, chain []string) error {
+		chain = append(chain, key)
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(chain, " -> "))
+		case done:
+			return nil
+		}
+		state[key] = visiting
+
+		entry := i[key]
+		for _, dep := range entry[1:] {
+			depKey := canonicalModuleName(moduleName(dep))
+			if _, ok := i[depKey]; !ok {
+				return fmt.Errorf("module %q depends on %q, which isn't in modules.dep", entry[0], dep)
+			}
+			if err := visit(depKey, chain); err != nil {
+				return err
+			}
+		}
+		state[key] = done
+
+		return nil
+	}
+
+	return visit(canonicalModuleName(modName), nil)
+}
+
+// Modules in the out-of-tree module directories (e.g. vendor drivers) are
+// preferred over in-tree modules with the same name
+func moduleDirPriority(path string) int {
+	for i, dir := range outOfTreeModuleDirs {
+		if strings.HasPrefix(path, dir+"/") {
+			return len(outOfTreeModuleDirs) - i
+		}
+	}
+	return 0
+}
+
+// Returns true if the path is a (possibly compressed) kernel module file
+func isModuleFile(path string) bool {
+	for _, ext := range []string{".xz", ".gz", ".zst"} {
+		path = strings.TrimSuffix(path, ext)
 	}
+	return strings.HasSuffix(path, ".ko")
+}
+
+// Get the name of the module from the path of the module file, e.g.
+// "kernel/fs/nls/nls_iso8859-1.ko.xz" -> "nls_iso8859-1"
+func moduleName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".xz", ".gz", ".zst"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return strings.TrimSuffix(name, ".ko")
+}
 
-	return deps, nil
+// Module names are case-insensitive, and - and _ are interchangeable (e.g.
+// "dw-wdt" and "DW_WDT" are the same module). This returns the key used for
+// comparing module names.
+func canonicalModuleName(modName string) string {
+	return strings.ReplaceAll(strings.ToLower(modName), "-", "_")
 }
@@ -4,29 +4,72 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/cavaliercoder/go-cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/archive"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/bootconf"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/digest"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/executor"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/history"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/misc"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/plan"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/policy"
 )
 
-func TestStripExts(t *testing.T) {
+func TestModuleName(t *testing.T) {
 	tables := []struct {
 		in       string
 		expected string
 	}{
-		{"/foo/bar/bazz.tar", "/foo/bar/bazz"},
-		{"file.tar.gz.xz.zip", "file"},
-		{"another_file", "another_file"},
-		{"a.b.c.d.e.f.g.h.i", "a"},
-		{"virtio_blk.ko", "virtio_blk"},
+		{"kernel/fs/nls/nls_iso8859-1.ko.xz", "nls_iso8859-1"},
+		{"kernel/drivers/block/virtio_blk.ko", "virtio_blk"},
+		{"kernel/drivers/gpu/drm/msm/msm.ko.zst", "msm"},
+		{"extra/r8188eu.ko.gz", "r8188eu"},
+		{"kernel/drivers/misc/foo.bar.ko.xz", "foo.bar"},
+		{"virtio_blk", "virtio_blk"},
 	}
 	for _, table := range tables {
-		out := stripExts(table.in)
+		out := moduleName(table.in)
 		if out != table.expected {
 			t.Errorf("Expected: %q, got: %q", table.expected, out)
 		}
 	}
 }
 
+func TestCanonicalModuleName(t *testing.T) {
+	tables := []struct {
+		a     string
+		b     string
+		equal bool
+	}{
+		{"dw-wdt", "dw_wdt", true},
+		{"DW_WDT", "dw-wdt", true},
+		{"nls-iso8859_1", "nls_iso8859-1", true},
+		{"snd-soc-msm8916-digital", "snd_soc_msm8916_digital", true},
+		{"foo.bar", "foo_bar", false},
+		{"dw-wdt", "dwwdt", false},
+		{"gl518sm", "gl518_sm", false},
+	}
+	for _, table := range tables {
+		if out := canonicalModuleName(table.a) == canonicalModuleName(table.b); out != table.equal {
+			t.Errorf("%q == %q: expected %t, got: %t", table.a, table.b, table.equal, out)
+		}
+	}
+}
+
 func stringSlicesEqual(a []string, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -55,28 +98,1735 @@ kernel/fs/nls/nls_iso8859-1.ko.xz:
 kernel/net/vmw_vsock/vmw_vsock_virtio_transport.ko.xz: kernel/net/vmw_vsock/vmw_vsock_virtio_transport_common.ko.xz kernel/drivers/virtio/virtio.ko.xz kernel/drivers/virtio/virtio_ring.ko.xz kernel/net/vmw_vsock/vsock.ko.xz
 kernel/drivers/gpu/drm/panfrost/panfrost.ko.xz: kernel/drivers/gpu/drm/scheduler/gpu-sched.ko.xz
 kernel/drivers/gpu/drm/msm/msm.ko: kernel/drivers/gpu/drm/drm_kms_helper.ko
+kernel/drivers/misc/foo.bar.ko.xz:
 `
 
-func TestGetModuleDeps(t *testing.T) {
+func TestModuleIndex(t *testing.T) {
+	index, err := parseModuleIndex(strings.NewReader(testModuleDep))
+	if err != nil {
+		t.Fatal("unexpected error parsing modules.dep: ", err)
+	}
 	tables := []struct {
 		in       string
 		expected []string
 	}{
 		{"nls-iso8859-1", []string{"kernel/fs/nls/nls_iso8859-1.ko.xz"}},
+		{"NLS_ISO8859_1", []string{"kernel/fs/nls/nls_iso8859-1.ko.xz"}},
 		{"gpu_sched", []string{"kernel/drivers/gpu/drm/scheduler/gpu-sched.ko.xz"}},
 		{"dw-wdt", []string{"kernel/drivers/watchdog/dw_wdt.ko.xz",
 			"kernel/drivers/watchdog/watchdog.ko.xz"}},
 		{"gl518sm", []string{"kernel/drivers/hwmon/gl518sm.ko.xz"}},
 		{"msm", []string{"kernel/drivers/gpu/drm/msm/msm.ko",
 			"kernel/drivers/gpu/drm/drm_kms_helper.ko"}},
+		{"snd_soc_msm8916_digital", []string{"kernel/sound/soc/codecs/snd-soc-msm8916-digital.ko"}},
+		{"foo.bar", []string{"kernel/drivers/misc/foo.bar.ko.xz"}},
+		{"foo", nil},
+		{"msm8916", nil},
+		{"x-tables", nil},
+	}
+	for _, table := range tables {
+		out := index.deps(table.in)
+		if !stringSlicesEqual(out, table.expected) {
+			t.Errorf("%q: Expected: %q, got: %q", table.in, table.expected, out)
+		}
+	}
+}
+
+var testModuleAlias string = `
+# Aliases extracted from modules themselves.
+alias fs-overlay overlay
+alias devname:loop-control loop
+alias char-major-10-237 loop
+alias of:N*T*Cqcom,sdm845-mdss msm
+alias of:N*T*Cqcom,sdm845-mdssC* msm
+`
+
+func TestGetModuleAliases(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected []string
+	}{
+		{"fs-overlay", []string{"overlay"}},
+		{"char-major-10-237", []string{"loop"}},
+		{"of:NmdssTdisplayCqcom,sdm845-mdssCqcom,mdss", []string{"msm"}},
+		{"overlay", nil},
 	}
 	for _, table := range tables {
-		out, err := getModuleDeps(table.in, strings.NewReader(testModuleDep))
+		out, err := getModuleAliases(table.in, strings.NewReader(testModuleAlias))
 		if err != nil {
-			t.Errorf("unexpected error with input: %q, error: %q", table.expected, err)
+			t.Errorf("unexpected error with input: %q, error: %q", table.in, err)
 		}
 		if !stringSlicesEqual(out, table.expected) {
 			t.Errorf("Expected: %q, got: %q", table.expected, out)
 		}
 	}
 }
+
+func TestGetFileCorruptElf(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "corrupt")
+	if err := os.WriteFile(file, []byte("\x7fELF\x02\x01garbage"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		ignoreElfErrors = false
+		elfErrors = nil
+	}()
+
+	files := make(misc.StringSet)
+	err := getFile(context.Background(), files, file, true)
+	var elfErr *elfError
+	if !errors.As(err, &elfErr) || elfErr.path != file {
+		t.Errorf("expected elfError for %q, got: %v", file, err)
+	}
+
+	ignoreElfErrors = true
+	files = make(misc.StringSet)
+	if err := getFile(context.Background(), files, file, true); err != nil {
+		t.Errorf("unexpected error when ignoring ELF errors: %s", err)
+	}
+	if _, ok := files[file]; !ok || len(elfErrors) != 1 {
+		t.Errorf("expected file to be included and error to be recorded")
+	}
+
+	// non-ELF files are never an error
+	script := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ignoreElfErrors = false
+	if err := getFile(context.Background(), files, script, true); err != nil {
+		t.Errorf("unexpected error for non-ELF file: %s", err)
+	}
+}
+
+func TestGetFileSharedDeps(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "corrupt")
+	if err := os.WriteFile(file, []byte("\x7fELF\x02\x01garbage"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ignoreElfErrors = true
+	defer func() {
+		ignoreElfErrors = false
+		elfErrors = nil
+	}()
+
+	// resolving the same file for another archive should reuse the result
+	for i := 0; i < 2; i++ {
+		files := make(misc.StringSet)
+		if err := getFile(context.Background(), files, file, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := files[file]; !ok {
+			t.Errorf("expected file to be included")
+		}
+	}
+	if len(elfErrors) != 1 {
+		t.Errorf("expected file to be resolved once, got %d errors", len(elfErrors))
+	}
+}
+
+func TestGetBinaryDepsSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	if err := os.Symlink("b", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fmt.Sprintf("symlink loop: %s -> %s -> %s", a, b, a)
+	if err := getBinaryDeps(context.Background(), make(misc.StringSet), a); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error with %q, got: %v", expected, err)
+	}
+}
+
+func TestGetFilesCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	files := make(misc.StringSet)
+	if err := getFiles(ctx, files, misc.StringSet{"/bin/sh": false}, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected: %v, got: %v", context.Canceled, err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no files, got: %v", files)
+	}
+}
+
+func TestFilterDebugFiles(t *testing.T) {
+	files := misc.StringSet{
+		"/usr/lib/debug/usr/bin/osk-sdl.debug": false,
+		"/usr/lib/debug/.build-id/ab/cdef":     false,
+		"/usr/lib/libts.so.0.debug":            false,
+		"/usr/lib/foo.dwo":                     false,
+		"/usr/bin/osk-sdl":                     false,
+		"/usr/lib/libts.so.0":                  false,
+		"/usr/lib/debugger.so":                 false,
+	}
+	filterDebugFiles(files)
+	expected := misc.StringSet{
+		"/usr/bin/osk-sdl":     false,
+		"/usr/lib/libts.so.0":  false,
+		"/usr/lib/debugger.so": false,
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("expected %d files, got: %v", len(expected), files)
+	}
+	for file := range expected {
+		if _, ok := files[file]; !ok {
+			t.Errorf("expected %q to be kept", file)
+		}
+	}
+}
+
+func TestDropDuplicates(t *testing.T) {
+	files := misc.StringSet{
+		"/lib/libz.so.1":      false,
+		"/lib/libc.musl.so.1": false,
+		"/usr/sbin/parted":    false,
+		"/sbin/e2fsck":        false,
+	}
+	initfsFiles := misc.StringSet{
+		"/lib/libz.so.1":      false,
+		"/lib/libc.musl.so.1": false,
+		"/bin/busybox":        false,
+	}
+	keep := misc.StringSet{"/lib/libc.musl.so.1": false}
+
+	if removed := dropDuplicates(files, initfsFiles, keep); removed != 1 {
+		t.Errorf("expected 1 file to be removed, got: %d", removed)
+	}
+	expected := []string{"/lib/libc.musl.so.1", "/usr/sbin/parted", "/sbin/e2fsck"}
+	if len(files) != len(expected) {
+		t.Fatalf("expected %d files, got: %v", len(expected), files)
+	}
+	for _, file := range expected {
+		if _, ok := files[file]; !ok {
+			t.Errorf("expected %q to be kept", file)
+		}
+	}
+}
+
+func TestModuleIndexCheckDeps(t *testing.T) {
+	testBrokenModuleDep := `
+kernel/a.ko: kernel/b.ko kernel/c.ko
+kernel/b.ko: kernel/c.ko
+kernel/c.ko:
+kernel/d.ko: kernel/e.ko
+kernel/e.ko: kernel/f.ko
+kernel/f.ko: kernel/d.ko
+kernel/g.ko: kernel/missing.ko
+`
+	index, err := parseModuleIndex(strings.NewReader(testBrokenModuleDep))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []struct {
+		in       string
+		expected string
+	}{
+		{"a", ""},
+		{"c", ""},
+		{"d", "dependency cycle: d -> e -> f -> d"},
+		{"g", `module "kernel/g.ko" depends on "kernel/missing.ko", which isn't in modules.dep`},
+	}
+	for _, table := range tables {
+		err := index.checkDeps(table.in)
+		if (err == nil && table.expected != "") || (err != nil && err.Error() != table.expected) {
+			t.Errorf("%q: expected error: %q, got: %v", table.in, table.expected, err)
+		}
+	}
+}
+
+func TestModuleIndexOutOfTree(t *testing.T) {
+	modulesDep := `
+kernel/drivers/net/wireless/realtek/rtl8xxxu/rtl8xxxu.ko.xz: kernel/net/mac80211/mac80211.ko.xz
+updates/rtl8xxxu.ko: kernel/net/mac80211/mac80211.ko.xz
+kernel/net/mac80211/mac80211.ko.xz:
+extra/8188eu.ko:
+`
+	index, err := parseModuleIndex(strings.NewReader(modulesDep))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"updates/rtl8xxxu.ko", "kernel/net/mac80211/mac80211.ko.xz"}
+	if out := index.deps("rtl8xxxu"); !stringSlicesEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+	expected = []string{"extra/8188eu.ko"}
+	if out := index.deps("8188eu"); !stringSlicesEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+func TestFindOutOfTreeModule(t *testing.T) {
+	modDir := t.TempDir()
+	for _, file := range []string{"extra/vendor/touch-drv.ko.xz", "extra/wifi.ko", "updates/dkms/wifi.ko.zst", "kernel/foo.ko"} {
+		path := filepath.Join(modDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables := []struct {
+		in       string
+		expected string
+	}{
+		{"touch_drv", "extra/vendor/touch-drv.ko.xz"},
+		{"wifi", "updates/dkms/wifi.ko.zst"},
+		{"foo", ""},
+	}
+	for _, table := range tables {
+		out, err := findOutOfTreeModule(table.in, modDir)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", table.in, err)
+		}
+		if out != table.expected {
+			t.Errorf("expected: %q, got: %q", table.expected, out)
+		}
+	}
+}
+
+func TestGetRequiredModules(t *testing.T) {
+	out, err := getRequiredModules(filepath.Join(t.TempDir(), "missing.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stringSlicesEqual(out, defaultRequiredModules) {
+		t.Errorf("expected defaults: %q, got: %q", defaultRequiredModules, out)
+	}
+
+	conf := filepath.Join(t.TempDir(), "required-modules.conf")
+	contents := `# no FDE on this image
+-dm-crypt
+- kernel/crypto/
+-kernel/arch/*/crypto/
+
+kernel/drivers/input/touchscreen/
+`
+	if err := os.WriteFile(conf, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = getRequiredModules(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"loop", "kernel/fs/overlayfs/", "kernel/drivers/input/touchscreen/"}
+	if !stringSlicesEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+func TestGetAudioModules(t *testing.T) {
+	modDir := t.TempDir()
+	modulesDep := `
+kernel/sound/soc/codecs/snd-soc-wcd934x.ko.xz: kernel/sound/soc/snd-soc-core.ko.xz
+kernel/sound/soc/snd-soc-core.ko.xz:
+kernel/sound/soc/qcom/snd-soc-sdm845.ko.xz:
+`
+	modulesAlias := "alias of:N*T*Cqcom,sdm845-sndcard snd_soc_sdm845\n"
+	for file, contents := range map[string]string{
+		"modules.dep":     modulesDep,
+		"modules.alias":   modulesAlias,
+		"modules.builtin": "kernel/sound/core/snd.ko\n",
+		"kernel/sound/soc/codecs/snd-soc-wcd934x.ko.xz": "",
+		"kernel/sound/soc/snd-soc-core.ko.xz":           "",
+		"kernel/sound/soc/qcom/snd-soc-sdm845.ko.xz":    "",
+	} {
+		path := filepath.Join(modDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := []struct {
+		modules  []string
+		expected []string
+	}{
+		{nil, nil},
+		// with its dependencies
+		{[]string{"snd-soc-wcd934x"}, []string{"kernel/sound/soc/codecs/snd-soc-wcd934x.ko.xz", "kernel/sound/soc/snd-soc-core.ko.xz"}},
+		{[]string{"of:N*T*Cqcom,sdm845-sndcard"}, []string{"kernel/sound/soc/qcom/snd-soc-sdm845.ko.xz"}},
+		// builtin modules and missing ones need no files
+		{[]string{"snd", "snd-missing"}, nil},
+	}
+
+	for _, table := range tables {
+		files := make(misc.StringSet)
+		if err := getAudioModules(files, table.modules, modDir); err != nil {
+			t.Errorf("%q: %s", table.modules, err)
+			continue
+		}
+		if len(files) != len(table.expected) {
+			t.Errorf("%q: expected %d files, got: %q", table.modules, len(table.expected), files.Sorted())
+		}
+		for _, file := range table.expected {
+			if _, ok := files[filepath.Join(modDir, file)]; !ok {
+				t.Errorf("%q: expected %q to be included", table.modules, file)
+			}
+		}
+	}
+}
+
+func TestGetCryptoModules(t *testing.T) {
+	modDir := t.TempDir()
+	modulesDep := `
+kernel/crypto/aes_generic.ko.xz:
+kernel/arch/arm64/crypto/aes-ce-blk.ko.xz: kernel/crypto/aes_generic.ko.xz
+kernel/crypto/xts.ko.xz:
+kernel/crypto/serpent_generic.ko.xz:
+`
+	modulesAlias := `
+alias crypto-aes aes_generic
+alias crypto-aes aes_ce_blk
+alias crypto-xts xts
+`
+	modulesBuiltin := "kernel/crypto/sha256_generic.ko\n"
+	modulesBuiltinModinfo := "sha256_generic.license=GPL\x00sha256_generic.alias=crypto-sha256\x00sha256_generic.alias=sha256\x00"
+	for file, contents := range map[string]string{
+		"modules.dep":                               modulesDep,
+		"modules.alias":                             modulesAlias,
+		"modules.builtin":                           modulesBuiltin,
+		"modules.builtin.modinfo":                   modulesBuiltinModinfo,
+		"kernel/crypto/aes_generic.ko.xz":           "",
+		"kernel/arch/arm64/crypto/aes-ce-blk.ko.xz": "",
+		"kernel/crypto/xts.ko.xz":                   "",
+		"kernel/crypto/serpent_generic.ko.xz":       "",
+	} {
+		path := filepath.Join(modDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := make(misc.StringSet)
+	if err := getCryptoModules(files, []string{"aes", "xts", "sha256"}, modDir); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"kernel/crypto/aes_generic.ko.xz",
+		"kernel/arch/arm64/crypto/aes-ce-blk.ko.xz",
+		"kernel/crypto/xts.ko.xz",
+	}
+	if len(files) != len(expected) {
+		t.Errorf("expected %d files, got: %v", len(expected), files)
+	}
+	for _, file := range expected {
+		if _, ok := files[filepath.Join(modDir, file)]; !ok {
+			t.Errorf("expected %q to be included", file)
+		}
+	}
+
+	if err := getCryptoModules(make(misc.StringSet), []string{"twofish"}, modDir); err == nil {
+		t.Errorf("expected error for unknown algorithm")
+	}
+}
+
+func TestWithoutCryptoDirs(t *testing.T) {
+	out := withoutCryptoDirs(defaultRequiredModules)
+	expected := []string{"loop", "dm-crypt", "kernel/fs/overlayfs/"}
+	if !stringSlicesEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+func TestCheckArchConsistency(t *testing.T) {
+	// the test binary stands in for busybox
+	busybox, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostArch := map[string]string{"amd64": "x86_64", "arm64": "aarch64", "386": "x86", "riscv64": "riscv64"}[runtime.GOARCH]
+	if hostArch == "" {
+		t.Skip("no deviceinfo arch for: ", runtime.GOARCH)
+	}
+	otherArch := "aarch64"
+	if hostArch == otherArch {
+		otherArch = "x86_64"
+	}
+
+	if err := checkArchConsistency(deviceinfo.DeviceInfo{Arch: hostArch}, busybox, ""); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := checkArchConsistency(deviceinfo.DeviceInfo{Arch: otherArch}, busybox, ""); err == nil {
+		t.Errorf("expected error for %s busybox with deviceinfo_arch %q", hostArch, otherArch)
+	}
+	if err := checkArchConsistency(deviceinfo.DeviceInfo{}, busybox, ""); err != nil {
+		t.Errorf("unexpected error without deviceinfo_arch: %s", err)
+	}
+}
+
+func TestGetPlan(t *testing.T) {
+	initfsFiles := misc.StringSet{
+		"/bin/busybox": false,
+		"/lib/modules/5.14.0/kernel/fs/loop.ko.xz": false,
+	}
+	extraFiles := misc.StringSet{"/sbin/e2fsck": false}
+	devinfo := deviceinfo.DeviceInfo{InitfsExtraVerity: "true"}
+
+	p := getPlan("5.14.0", "postmarketos-allwinner", initfsFiles, extraFiles, devinfo, generateOpts{profile: profileMinimal, manifestHash: digest.SHA256})
+	if len(p.Archives) != 2 {
+		t.Fatalf("expected 2 archives, got: %d", len(p.Archives))
+	}
+	initfs, extra := p.Archives[0], p.Archives[1]
+	if !stringSlicesEqual(initfs.Files, []string{"/bin/busybox"}) {
+		t.Errorf("unexpected initramfs files: %q", initfs.Files)
+	}
+	if !stringSlicesEqual(initfs.Modules, []string{"/lib/modules/5.14.0/kernel/fs/loop.ko.xz"}) {
+		t.Errorf("unexpected initramfs modules: %q", initfs.Modules)
+	}
+	if initfs.Entries["/init"] != "/usr/share/postmarketos-mkinitfs/init.sh" {
+		t.Errorf("expected init.sh at /init, got: %q", initfs.Entries)
+	}
+	expected := []string{"/etc/mkinitfs/initramfs.sha256", "/etc/mkinitfs/hooks", "/etc/mkinitfs/initramfs-extra.verity"}
+	if !stringSlicesEqual(initfs.Generated, expected) {
+		t.Errorf("expected generated files: %q, got: %q", expected, initfs.Generated)
+	}
+	if extra.Name != "initramfs-extra" || !stringSlicesEqual(extra.Files, []string{"/sbin/e2fsck"}) {
+		t.Errorf("unexpected initramfs-extra: %+v", extra)
+	}
+
+	expected = []string{"initramfs-extra", "initramfs-extra.verity"}
+	if out := getDeployFiles(devinfo); !stringSlicesEqual(out, expected) {
+		t.Errorf("expected deploy files: %q, got: %q", expected, out)
+	}
+}
+
+func TestGetSubcommand(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	tables := []struct {
+		in       []string
+		expected string
+		args     []string
+	}{
+		{[]string{"mkinitfs", "plan", "-d", "/tmp"}, "plan", []string{"mkinitfs", "-d", "/tmp"}},
+		{[]string{"mkinitfs", "-d", "/tmp"}, "", []string{"mkinitfs", "-d", "/tmp"}},
+		{[]string{"mkinitfs", "notacommand"}, "", []string{"mkinitfs", "notacommand"}},
+		{[]string{"mkinitfs"}, "", []string{"mkinitfs"}},
+	}
+	for _, table := range tables {
+		os.Args = table.in
+		if out := getSubcommand(); out != table.expected {
+			t.Errorf("%q: expected: %q, got: %q", table.in, table.expected, out)
+		}
+		if !stringSlicesEqual(os.Args, table.args) {
+			t.Errorf("%q: expected args: %q, got: %q", table.in, table.args, os.Args)
+		}
+	}
+}
+
+func TestBootDeploy(t *testing.T) {
+	workDir := t.TempDir()
+	outDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outDir, "vmlinuz"), []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &executor.Recorder{}
+	if err := bootDeploy(context.Background(), r, workDir, outDir, "initramfs", []string{"initramfs-extra", "boot.scr"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "boot-deploy -i initramfs -k vmlinuz -d " + workDir + " -o " + outDir + " initramfs-extra boot.scr"
+	if r.String() != expected {
+		t.Errorf("expected: %q, got: %q", expected, r.String())
+	}
+
+	r = &executor.Recorder{}
+	if err := bootDeploy(context.Background(), r, workDir, outDir, getInitfsName("6.1.0-postmarketos-qcom", true), nil); err != nil {
+		t.Fatal(err)
+	}
+	expected = "boot-deploy -i initramfs-6.1.0-postmarketos-qcom -k vmlinuz -d " + workDir + " -o " + outDir
+	if r.String() != expected {
+		t.Errorf("expected: %q, got: %q", expected, r.String())
+	}
+	// the kernel is copied to the work dir for boot-deploy
+	if contents, err := os.ReadFile(filepath.Join(workDir, "vmlinuz")); err != nil || string(contents) != "kernel" {
+		t.Errorf("expected kernel to be copied to the work dir, got: %q, %v", contents, err)
+	}
+
+	r.Err = errors.New("failed")
+	if err := bootDeploy(context.Background(), r, workDir, outDir, "initramfs", nil); err == nil {
+		t.Error("expected error when boot-deploy fails")
+	}
+	if err := bootDeploy(context.Background(), r, workDir, t.TempDir(), "initramfs", nil); err == nil {
+		t.Error("expected error without a kernel")
+	}
+}
+
+func TestFindDtbs(t *testing.T) {
+	outDir := t.TempDir()
+	dtb := filepath.Join(outDir, "dtbs", "rockchip", "rk3399-gru-kevin.dtb")
+	if err := os.MkdirAll(filepath.Dir(dtb), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dtb, []byte("dtb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if dtbs, err := findDtbs(outDir, "rockchip/rk3399-gru-kevin"); err != nil || !stringSlicesEqual(dtbs, []string{dtb}) {
+		t.Errorf("expected: %q, got: %q, %v", dtb, dtbs, err)
+	}
+	if dtbs, err := findDtbs(outDir, ""); err != nil || len(dtbs) != 0 {
+		t.Errorf("expected no dtbs, got: %q, %v", dtbs, err)
+	}
+	if _, err := findDtbs(outDir, "rockchip/rk3399-gru-kevin rockchip/missing"); err == nil {
+		t.Error("expected error for missing dtb")
+	}
+}
+
+func TestGenerateFitImage(t *testing.T) {
+	workDir := t.TempDir()
+	outDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outDir, "vmlinuz"), []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "initramfs"), []byte("initramfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devinfo := deviceinfo.DeviceInfo{Arch: "aarch64"}
+	if err := generateFitImage(fitImage, workDir, outDir, "initramfs", devinfo, generateOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(workDir, fitImage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte{0xd0, 0x0d, 0xfe, 0xed}) {
+		t.Errorf("expected a device tree blob, got: %q", data[:4])
+	}
+
+	// reproducible with SOURCE_DATE_EPOCH
+	opts := generateOpts{sourceDateEpoch: time.Unix(1700000000, 0)}
+	var builds [][]byte
+	for i := 0; i < 2; i++ {
+		if err := generateFitImage(fitImage, workDir, outDir, "initramfs", devinfo, opts); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(workDir, fitImage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		builds = append(builds, data)
+		if i == 0 {
+			// the current time (in seconds) would differ in the next build
+			time.Sleep(1100 * time.Millisecond)
+		}
+	}
+	if !bytes.Equal(builds[0], builds[1]) {
+		t.Error("expected identical FIT images with SOURCE_DATE_EPOCH")
+	}
+
+	devinfo.FitSigningKey = filepath.Join(workDir, "missing.key")
+	if err := generateFitImage(fitImage, workDir, outDir, "initramfs", devinfo, generateOpts{}); err == nil {
+		t.Error("expected error for missing signing key")
+	}
+}
+
+func TestGenerateBootScr(t *testing.T) {
+	workDir := t.TempDir()
+	devinfo := deviceinfo.DeviceInfo{Arch: "aarch64"}
+	epoch := time.Unix(1700000000, 0)
+	if err := generateBootScr("boot.scr", workDir, devinfo, generateOpts{sourceDateEpoch: epoch}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := os.ReadFile(filepath.Join(workDir, "boot.scr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img) < 12 || binary.BigEndian.Uint32(img[8:12]) != uint32(epoch.Unix()) {
+		t.Errorf("expected the timestamp of SOURCE_DATE_EPOCH in the header, got: %x", img[:12])
+	}
+	if !exists(filepath.Join(workDir, "boot.cmd")) {
+		t.Error("expected the plain text boot.cmd")
+	}
+
+	devinfo.Arch = "x86_64"
+	if err := generateBootScr("boot.scr", workDir, devinfo, generateOpts{}); err == nil {
+		t.Error("expected error for unsupported arch")
+	}
+}
+
+func TestGenerateCorebootConfig(t *testing.T) {
+	workDir := t.TempDir()
+	outDir := t.TempDir()
+	kernel := filepath.Join(outDir, "vmlinuz-lts")
+	if err := os.WriteFile(kernel, []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devinfo := deviceinfo.DeviceInfo{Arch: "x86_64", KernelCmdline: "quiet", GenerateCorebootPayload: "true"}
+	if files := getDeployFiles(devinfo); !stringSlicesEqual(files, []string{"initramfs-extra", corebootConfig}) {
+		t.Errorf("unexpected deploy files: %q", files)
+	}
+	if err := generateCorebootConfig(corebootConfig, workDir, outDir, "initramfs", devinfo); err != nil {
+		t.Fatal(err)
+	}
+	config, err := os.ReadFile(filepath.Join(workDir, corebootConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("CONFIG_PAYLOAD_FILE=%q\nCONFIG_LINUX_INITRD=%q\n", kernel, filepath.Join(outDir, "initramfs"))
+	if !strings.Contains(string(config), expected) {
+		t.Errorf("expected %q in config: %q", expected, config)
+	}
+
+	devinfo.Arch = "aarch64"
+	if err := generateCorebootConfig(corebootConfig, workDir, outDir, "initramfs", devinfo); err == nil {
+		t.Error("expected error for unsupported arch")
+	}
+}
+
+func TestLintFiles(t *testing.T) {
+	dir := t.TempDir()
+	tables := []struct {
+		name     string
+		mode     os.FileMode
+		insecure bool
+	}{
+		{"plain", 0644, false},
+		{"executable", 0755, false},
+		{"setuid", 0755 | os.ModeSetuid, true},
+		{"setgid", 0755 | os.ModeSetgid, true},
+		{"world-writable", 0666, true},
+	}
+
+	for _, table := range tables {
+		file := filepath.Join(dir, table.name)
+		if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// not affected by the umask
+		if err := os.Chmod(file, table.mode); err != nil {
+			t.Fatal(err)
+		}
+		// the owner is checked by TestLintFilesUnprivileged
+		files := misc.StringSet{file: false}
+
+		err := lintFiles(files, generateOpts{unprivileged: true})
+		if table.insecure && err == nil {
+			t.Errorf("%s: expected error", table.name)
+		} else if !table.insecure && err != nil {
+			t.Errorf("%s: unexpected error: %s", table.name, err)
+		}
+		if err := lintFiles(files, generateOpts{unprivileged: true, allowInsecure: true}); err != nil {
+			t.Errorf("%s: unexpected error with allowInsecure: %s", table.name, err)
+		}
+	}
+
+	// symlinks are checked by their target
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("plain", link); err != nil {
+		t.Fatal(err)
+	}
+	if err := lintFiles(misc.StringSet{link: false}, generateOpts{unprivileged: true}); err != nil {
+		t.Errorf("unexpected error for symlink: %s", err)
+	}
+
+	missing := misc.StringSet{filepath.Join(dir, "missing"): false}
+	if err := lintFiles(missing, generateOpts{unprivileged: true, allowInsecure: true}); !os.IsNotExist(err) {
+		t.Errorf("expected error for missing file, got: %v", err)
+	}
+}
+
+func TestLintFilesUnprivileged(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() == 0 {
+		if err := os.Chown(file, 1000, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := misc.StringSet{file: false}
+
+	if err := lintFiles(files, generateOpts{}); err == nil {
+		t.Error("expected error for file not owned by root")
+	}
+	if err := lintFiles(files, generateOpts{unprivileged: true}); err != nil {
+		t.Errorf("unexpected error for unprivileged build: %s", err)
+	}
+}
+
+func TestCopyArtifacts(t *testing.T) {
+	workDir := t.TempDir()
+	outDir := filepath.Join(t.TempDir(), "out")
+	for _, file := range []string{"initramfs", "initramfs-extra"} {
+		if err := os.WriteFile(filepath.Join(workDir, file), []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := copyArtifacts(workDir, outDir, []string{"initramfs", "initramfs-extra"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"initramfs", "initramfs-extra"} {
+		contents, err := os.ReadFile(filepath.Join(outDir, file))
+		if err != nil || string(contents) != file {
+			t.Errorf("expected %s to be copied, got: %q, %v", file, contents, err)
+		}
+	}
+	if err := copyArtifacts(workDir, outDir, []string{"boot.scr"}); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestCheckDeviceinfo(t *testing.T) {
+	if err := checkDeviceinfo(deviceinfo.DeviceInfo{Arch: "aarch64", InitfsMaxSize: "8M"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	bad := deviceinfo.DeviceInfo{
+		InitfsCpioFormat: "tar",
+		InitfsMaxSize:    "lots",
+		MkinitfsProfile:  "huge",
+		MkinitfsSplash:   "no",
+		MkinitfsLocale:   "yes",
+	}
+	err := checkDeviceinfo(bad)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, s := range []string{"deviceinfo_arch", "tar", "lots", "huge", "deviceinfo_mkinitfs_splash", "deviceinfo_mkinitfs_locale"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected %q in error: %s", s, err)
+		}
+	}
+}
+
+func TestCheckBusyboxApplets(t *testing.T) {
+	if err := checkBusyboxApplets(append([]string{"ls"}, requiredApplets...)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err := checkBusyboxApplets([]string{"sh", "mount", "umount", "mkdir", "mknod"})
+	if err == nil || err.Error() != "missing applet(s): switch_root, modprobe" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckKernelCompression(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(config, []byte("CONFIG_BLK_DEV_INITRD=y\n# CONFIG_RD_XZ is not set\nCONFIG_RD_GZIP=y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKernelCompression(config, archive.CompressionGzip); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if err := os.WriteFile(config, []byte("CONFIG_BLK_DEV_INITRD=y\nCONFIG_RD_GZIP=m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKernelCompression(config, archive.CompressionGzip); err == nil {
+		t.Error("expected error when CONFIG_RD_GZIP isn't enabled")
+	}
+	if err := checkKernelCompression(config, archive.CompressionNone); err != nil {
+		t.Errorf("unexpected error for uncompressed initramfs: %s", err)
+	}
+	if err := checkKernelCompression(config, archive.Compression(-1)); err == nil {
+		t.Error("expected error for unknown compression")
+	}
+}
+
+func TestPrintDoctorReport(t *testing.T) {
+	var out bytes.Buffer
+	failed := printDoctorReport(&out, []doctorCheck{
+		{name: "a"},
+		{name: "b", err: errors.New("broken")},
+		{name: "c", skipped: "no c"},
+	})
+	if failed != 1 {
+		t.Errorf("expected 1 failed check, got: %d", failed)
+	}
+	expected := "[PASS] a\n[FAIL] b: broken\n[SKIP] c: no c\n"
+	if out.String() != expected {
+		t.Errorf("expected: %q, got: %q", expected, out.String())
+	}
+}
+
+func TestFindStaleArtifacts(t *testing.T) {
+	outDir := t.TempDir()
+	files := []string{
+		"initramfs", "initramfs-extra", "vmlinuz", "vmlinuz-dtb", "boot.scr",
+		"vmlinuz-postmarketos-qcom", "config-postmarketos-qcom", "config-6.1.0",
+		"vmlinuz-postmarketos-old", "vmlinuz-postmarketos-old-dtb",
+		"initramfs-postmarketos-old", "initramfs-postmarketos-old-extra",
+		"System.map-5.4.0", "notes-postmarketos-old",
+		"initramfs-6.1.0.sha256", "initramfs-5.4.0.sha256", "initramfs-extra.sha512",
+		"initramfs-extra.verity", "initramfs-extra.verity.sha256", "initramfs-extra.verity.params",
+		"initramfs-postmarketos-old-extra.verity",
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(outDir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	installed := misc.StringSet{"postmarketos-qcom": false, "6.1.0": false}
+	stale, err := findStaleArtifacts(outDir, installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, f := range []string{
+		"System.map-5.4.0", "initramfs-5.4.0.sha256", "initramfs-postmarketos-old", "initramfs-postmarketos-old-extra",
+		"initramfs-postmarketos-old-extra.verity", "vmlinuz-postmarketos-old", "vmlinuz-postmarketos-old-dtb",
+	} {
+		expected = append(expected, filepath.Join(outDir, f))
+	}
+	if !stringSlicesEqual(stale, expected) {
+		t.Errorf("expected: %q, got: %q", expected, stale)
+	}
+
+	if stale, err := findStaleArtifacts(outDir, misc.StringSet{}); err != nil || len(stale) != 0 {
+		t.Errorf("expected nothing to be stale without installed kernels, got: %q, %v", stale, err)
+	}
+}
+
+func TestAnalyzeArchive(t *testing.T) {
+	binaryDeps["/usr/bin/foo"] = misc.StringSet{"/usr/lib/libbig.so.1": false, "/usr/lib/libmesa.so": false}
+	binaryDeps["/usr/lib/libmesa.so"] = misc.StringSet{"/usr/lib/libbig.so.1": false}
+	defer delete(binaryDeps, "/usr/bin/foo")
+	defer delete(binaryDeps, "/usr/lib/libmesa.so")
+
+	a := plan.Archive{
+		Name:  "initramfs",
+		Files: []string{"/usr/bin/foo", "/usr/lib/libbig.so.1", "/usr/lib/libmesa.so", "/lib/firmware/fw.bin"},
+		Modules: []string{
+			"/lib/modules/1.0/kernel/crypto/aes.ko",
+			"/lib/modules/1.0/kernel/drivers/crypto/qce.ko",
+			"/lib/modules/1.0/kernel/fs/ext4.ko",
+		},
+	}
+	sizes := map[string]int64{
+		"/usr/bin/foo":                                  1000,
+		"/usr/lib/libbig.so.1":                          38 << 20,
+		"/usr/lib/libmesa.so":                           1000,
+		"/lib/firmware/fw.bin":                          3 << 20,
+		"/lib/modules/1.0/kernel/crypto/aes.ko":         4 << 20,
+		"/lib/modules/1.0/kernel/drivers/crypto/qce.ko": 2 << 20,
+		"/lib/modules/1.0/kernel/fs/ext4.ko":            1 << 20,
+	}
+
+	suggestions := analyzeArchive(a, sizes, deviceinfo.DeviceInfo{}, generateOpts{})
+	var msgs []string
+	for _, s := range suggestions {
+		msgs = append(msgs, s.msg)
+	}
+	expected := []string{
+		"/usr/lib/libbig.so.1 pulled in via /usr/bin/foo: 38.0M; move the hook that needs it to initramfs-extra if it isn't needed for mounting it",
+		"crypto modules account for 6.0M; set deviceinfo_initfs_crypto_algorithms or use -luks-header to only include the ones needed",
+		"firmware accounts for 3.0M; only firmware needed before initramfs-extra is loaded has to be in the initramfs",
+		"/lib/firmware/fw.bin: 3.0M; move the hook that needs it to initramfs-extra if it isn't needed for mounting it",
+	}
+	if !stringSlicesEqual(msgs, expected) {
+		t.Errorf("expected: %q, got: %q", expected, msgs)
+	}
+
+	// crypto modules are already pruned
+	suggestions = analyzeArchive(a, sizes, deviceinfo.DeviceInfo{InitfsCryptoAlgorithms: "aes"}, generateOpts{})
+	for _, s := range suggestions {
+		if strings.HasPrefix(s.msg, "crypto") {
+			t.Errorf("unexpected suggestion: %s", s.msg)
+		}
+	}
+}
+
+func TestGetCompression(t *testing.T) {
+	tables := []struct {
+		deviceinfo string
+		flag       string
+		expected   archive.Compression
+		level      int
+	}{
+		{"", "", archive.CompressionGzip, 0},
+		{"none", "", archive.CompressionNone, 0},
+		{"lz4", "", archive.CompressionGzip, 0},
+		{"zstd:19", "", archive.CompressionZstd, 19},
+		{"xz:6", "", archive.CompressionGzip, 0},
+		{"gzip:9", "", archive.CompressionGzip, 9},
+		{"none", "gzip", archive.CompressionGzip, 0},
+		{"gzip:9", "gzip:6", archive.CompressionGzip, 6},
+		{"gzip", "none", archive.CompressionNone, 0},
+	}
+	for _, table := range tables {
+		c, level, err := getCompression(deviceinfo.DeviceInfo{InitfsCompression: table.deviceinfo}, table.flag)
+		if err != nil || c != table.expected || level != table.level {
+			t.Errorf("%q, %q: expected %s:%d, got: %s:%d, %v", table.deviceinfo, table.flag, table.expected, table.level, c, level, err)
+		}
+	}
+	if _, _, err := getCompression(deviceinfo.DeviceInfo{}, "lz4"); err == nil {
+		t.Error("expected error for unsupported -compression")
+	}
+	for _, value := range []string{"gzip:42", "gzip:fastest", "foo"} {
+		if _, _, err := getCompression(deviceinfo.DeviceInfo{InitfsCompression: value}, ""); err == nil {
+			t.Errorf("%q: expected error for invalid deviceinfo_initfs_compression", value)
+		}
+	}
+}
+
+func TestCheckPolicies(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "init.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	busybox := filepath.Join(dir, "busybox")
+	if err := os.WriteFile(busybox, []byte("ELF"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(dir, "modules.dep")
+	if err := os.WriteFile(data, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(entries map[string]string) string {
+		a, err := archive.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for dest, src := range entries {
+			if err := a.AddFile(src, dest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out := filepath.Join(dir, "initramfs")
+		if err := a.Write(out, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	critical := getCriticalEntries(misc.StringSet{"/lib/modules/5.14.0/modules.dep": false, "/bin/sh": false})
+	expected := []policy.Rule{
+		{Type: policy.Require, Pattern: "/init", Executable: true},
+		{Type: policy.Require, Pattern: "/bin/busybox", Executable: true},
+		{Type: policy.Require, Pattern: "/lib/modules/5.14.0/modules.dep"},
+	}
+	if !reflect.DeepEqual(critical.Rules, expected) {
+		t.Errorf("expected: %v, got: %v", expected, critical.Rules)
+	}
+
+	out := write(map[string]string{
+		"/init":                           script,
+		"/bin/busybox":                    busybox,
+		"/lib/modules/5.14.0/modules.dep": data,
+	})
+	if err := checkPolicies(out, []policy.Policy{critical}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	out = write(map[string]string{"/init": data, "/lib/modules/5.14.0/modules.dep": data})
+	err := checkPolicies(out, []policy.Policy{critical})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, s := range []string{"/bin/busybox: missing", "/init: not executable"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected %q in error: %s", s, err)
+		}
+	}
+}
+
+func TestParseAddFiles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := parseAddFiles([]string{"/usr/bin/strace", "debug.sh:/hooks/99-debug.sh", "/tmp/init.sh:/init/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/usr/bin/strace":    "/usr/bin/strace",
+		"/hooks/99-debug.sh": filepath.Join(wd, "debug.sh"),
+		"/init":              "/tmp/init.sh",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected: %v, got: %v", expected, files)
+	}
+
+	tables := [][]string{
+		{""},
+		{":/init"},
+		{"/tmp/init.sh:init"},
+		{"/tmp/a.sh:/init", "/tmp/b.sh:/init"},
+	}
+	for _, table := range tables {
+		if _, err := parseAddFiles(table); err == nil {
+			t.Errorf("%q: expected error", table)
+		}
+	}
+}
+
+func TestGetSplashFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"splash-charging.ppm.gz", "splash-error.ppm.gz", "splash-loading.ppm.gz", "README"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := []struct {
+		names    []string
+		expected []string
+	}{
+		{nil, []string{"splash-charging.ppm.gz", "splash-error.ppm.gz", "splash-loading.ppm.gz"}},
+		{[]string{"splash-error", "splash-charging.ppm.gz"}, []string{"splash-error.ppm.gz", "splash-charging.ppm.gz"}},
+		{[]string{"splash-missing", "splash-loading"}, []string{"splash-loading.ppm.gz"}},
+	}
+	for _, table := range tables {
+		var expected []string
+		for _, name := range table.expected {
+			expected = append(expected, filepath.Join(dir, name))
+		}
+		if files := getSplashFiles(dir, table.names); !reflect.DeepEqual(files, expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.names, expected, files)
+		}
+	}
+}
+
+func TestGetSourceDateEpoch(t *testing.T) {
+	if epoch, err := getSourceDateEpoch(""); err != nil || !epoch.IsZero() {
+		t.Errorf("expected zero time, got: %s, %v", epoch, err)
+	}
+	if epoch, err := getSourceDateEpoch("1630000000"); err != nil || epoch.Unix() != 1630000000 {
+		t.Errorf("unexpected time: %s, %v", epoch, err)
+	}
+	for _, value := range []string{"yesterday", "-1", "1.5"} {
+		if _, err := getSourceDateEpoch(value); err == nil {
+			t.Errorf("%q: expected error", value)
+		}
+	}
+}
+
+func TestWriteBootConfigs(t *testing.T) {
+	outDir := t.TempDir()
+	if err := writeBootConfigs(outDir, "initramfs", deviceinfo.DeviceInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(outDir); len(entries) != 0 {
+		t.Errorf("expected no configs without deviceinfo_generate_*_config, got: %v", entries)
+	}
+
+	devinfo := deviceinfo.DeviceInfo{GenerateExtlinuxConfig: "true", GenerateGrubConfig: "true", KernelCmdline: "quiet"}
+	if err := writeBootConfigs(outDir, "initramfs-6.1.0-postmarketos-qcom", devinfo); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"extlinux/extlinux.conf", "grub/postmarketos.cfg"} {
+		contents, err := os.ReadFile(filepath.Join(outDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(contents), "initrd /initramfs-6.1.0-postmarketos-qcom\n") {
+			t.Errorf("%s: expected initramfs in config: %q", path, contents)
+		}
+	}
+
+	path := filepath.Join(outDir, "extlinux/extlinux.conf")
+	if changed, err := writeIfChanged(path, []byte(bootconf.Extlinux(devinfo, "initramfs-6.1.0-postmarketos-qcom"))); err != nil || changed {
+		t.Errorf("expected unchanged config to not be written, got: %t, %v", changed, err)
+	}
+	if changed, err := writeIfChanged(path, []byte("changed")); err != nil || !changed {
+		t.Errorf("expected changed config to be written, got: %t, %v", changed, err)
+	}
+}
+
+func TestGetModuleLists(t *testing.T) {
+	dir := t.TempDir()
+	vendor := filepath.Join(dir, "usr/share/mkinitfs/modules")
+	admin := filepath.Join(dir, "etc/postmarketos-mkinitfs/modules")
+	for _, file := range []string{
+		filepath.Join(vendor, "gpu.modules"),
+		filepath.Join(vendor, "usb.modules"),
+		filepath.Join(vendor, "README"),
+		filepath.Join(admin, "usb.modules"),
+		filepath.Join(admin, "local.modules"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		filepath.Join(vendor, "gpu.modules"),
+		filepath.Join(admin, "local.modules"),
+		filepath.Join(admin, "usb.modules"),
+	}
+	if lists := getModuleLists([]string{vendor, admin}); !reflect.DeepEqual(lists, expected) {
+		t.Errorf("expected: %q, got: %q", expected, lists)
+	}
+	if lists := getModuleLists([]string{filepath.Join(dir, "missing")}); lists != nil {
+		t.Errorf("expected no lists, got: %q", lists)
+	}
+}
+
+func TestGetOskConfFiles(t *testing.T) {
+	dir := t.TempDir()
+	font := filepath.Join(dir, "DejaVuSans.ttf")
+	wallpaper := filepath.Join(dir, "wallpaper.png")
+	for _, file := range []string{font, wallpaper} {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := []struct {
+		conf     string
+		expected []string
+		err      bool
+	}{
+		{"keyboard-font = " + font + "\nkeyboard-font-size = 24\nkey-foreground = #ffffff\n", []string{font}, false},
+		{"# wallpaper = /missing.png\nwallpaper = " + wallpaper + "\nkeyboard-font=" + font + "\n", []string{font, wallpaper}, false},
+		{"keyboard-font = " + font + "\nwallpaper = " + filepath.Join(dir, "missing.png") + "\n", nil, true},
+		{"keyboard-font = " + filepath.Join(dir, "missing.ttf") + "\n", nil, true},
+		{"keyboard-font-size = 24\n", nil, true},
+	}
+	for _, table := range tables {
+		conf := filepath.Join(dir, "osk.conf")
+		if err := os.WriteFile(conf, []byte(table.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := getOskConfFiles(conf)
+		if table.err != (err != nil) {
+			t.Errorf("%q: unexpected error result: %v", table.conf, err)
+		}
+		if !reflect.DeepEqual(out, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.conf, table.expected, out)
+		}
+	}
+}
+
+func TestGetAccessibilityFiles(t *testing.T) {
+	tts := filepath.Join(t.TempDir(), "missing-tts")
+	err := getAccessibilityFiles(context.Background(), make(misc.StringSet), tts)
+	if err == nil || !strings.Contains(err.Error(), tts) {
+		t.Errorf("expected error for missing text to speech engine, got: %v", err)
+	}
+}
+
+func TestGetBuildStats(t *testing.T) {
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "initramfs"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "initramfs-extra"), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	build, err := getBuildStats(workDir, "5.14.0", time.Now(), map[string]misc.StringSet{
+		"initramfs":       {"/bin/busybox": true, "/init": true},
+		"initramfs-extra": {"/usr/bin/osk-sdl": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []history.Archive{
+		{Name: "initramfs", Size: 1000, Files: 2},
+		{Name: "initramfs-extra", Size: 2000, Files: 1},
+	}
+	if build.KernelVersion != "5.14.0" || !reflect.DeepEqual(build.Archives, expected) {
+		t.Errorf("unexpected build statistics: %+v", build)
+	}
+
+	if _, err := getBuildStats(workDir, "5.14.0", time.Now(), map[string]misc.StringSet{"missing": nil}); err == nil {
+		t.Error("expected error for missing archive")
+	}
+}
+
+func TestGetGrowthWarnings(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small")
+	if err := os.WriteFile(small, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	large := filepath.Join(dir, "large")
+	if err := os.WriteFile(large, make([]byte, 3000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(outDir string, entries map[string]string) {
+		a, err := archive.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for dest, src := range entries {
+			if err := a.AddFile(src, dest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Write(filepath.Join(outDir, "initramfs"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outDir := filepath.Join(dir, "boot")
+	write(outDir, map[string]string{"/init": small, "/bin/busybox": small})
+	workDir := filepath.Join(dir, "work")
+	write(workDir, map[string]string{"/init": small, "/bin/busybox": large, "/lib/firmware/fw.bin": small})
+
+	builds := []history.Build{
+		{Time: time.Unix(1630000000, 0), KernelVersion: "5.14.0", Archives: []history.Archive{{Name: "initramfs", Size: 1}}},
+	}
+	warnings := getGrowthWarnings(workDir, outDir, []string{"initramfs", "initramfs-extra"}, builds, history.Threshold{Percent: 10}, digest.SHA256)
+	if len(warnings) != 4 || !strings.HasPrefix(warnings[0], "initramfs grew more than 10% since the last build") {
+		t.Fatalf("unexpected warnings: %q", warnings)
+	}
+	expected := []string{"- /bin/busybox: +2.8K", "- /lib/firmware/fw.bin: +100B (new)"}
+	if !reflect.DeepEqual(warnings[2:], expected) {
+		t.Errorf("expected: %q, got: %q", expected, warnings[2:])
+	}
+
+	// the previous archive isn't there anymore
+	if err := os.Remove(filepath.Join(outDir, "initramfs")); err != nil {
+		t.Fatal(err)
+	}
+	warnings = getGrowthWarnings(workDir, outDir, []string{"initramfs"}, builds, history.Threshold{Percent: 10}, digest.SHA256)
+	if len(warnings) != 2 || !strings.Contains(warnings[1], manifestPath("initramfs", digest.SHA256)) {
+		t.Errorf("expected a pointer to the manifest, got: %q", warnings)
+	}
+
+	if warnings := getGrowthWarnings(workDir, outDir, []string{"initramfs"}, builds, history.Threshold{}, digest.SHA256); len(warnings) != 0 {
+		t.Errorf("expected no warnings without a threshold, got: %q", warnings)
+	}
+}
+
+func TestGetTarName(t *testing.T) {
+	tables := []struct {
+		compression archive.Compression
+		expected    string
+	}{
+		{archive.CompressionGzip, "initramfs.tar.gz"},
+		{archive.CompressionZstd, "initramfs.tar.zst"},
+		{archive.CompressionNone, "initramfs.tar"},
+	}
+	for _, table := range tables {
+		if got := getTarName("initramfs", table.compression); got != table.expected {
+			t.Errorf("%s: expected: %q, got: %q", table.compression, table.expected, got)
+		}
+	}
+
+	a, err := newArchive(deviceinfo.DeviceInfo{InitfsCpioFormat: "crc"}, generateOpts{tar: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "initramfs.tar.gz")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// tarballs can't be read back like cpio archives
+	if _, err := archive.ReadEntries(out); err == nil {
+		t.Error("expected a tar archive")
+	}
+}
+
+func TestWriteChecksums(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "initramfs"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := writeChecksums(dir, []string{"initramfs"}, digest.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"initramfs.sha256"}) {
+		t.Errorf("unexpected checksum files: %q", names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "initramfs.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad  initramfs\n"; string(data) != expected {
+		t.Errorf("expected: %q, got: %q", expected, data)
+	}
+
+	if names, err := writeChecksums(dir, []string{"initramfs"}, ""); err != nil || names != nil {
+		t.Errorf("expected no checksum files, got: %q, %v", names, err)
+	}
+	if _, err := writeChecksums(dir, []string{"missing"}, digest.SHA512); err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	tables := map[string]digest.Algorithm{"": digest.SHA256, "none": "", "blake2b": digest.BLAKE2b}
+	for name, expected := range tables {
+		if alg, err := getChecksumAlgorithm(name); err != nil || alg != expected {
+			t.Errorf("%q: expected: %q, got: %q, %v", name, expected, alg, err)
+		}
+	}
+	if _, err := getChecksumAlgorithm("md5"); err == nil {
+		t.Error("expected error for md5")
+	}
+}
+
+func TestStageArchive(t *testing.T) {
+	stageDir := filepath.Join(t.TempDir(), "stage")
+	a, err := archive.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFileFromReader("/etc/hooks", strings.NewReader("hooks\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree of a previous build is replaced
+	if err := os.MkdirAll(filepath.Join(stageDir, "initramfs", "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := stageArchive(a, stageDir, "initramfs"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(stageDir, "initramfs", "old")) {
+		t.Error("expected the previous tree to be removed")
+	}
+	if data, err := os.ReadFile(filepath.Join(stageDir, "initramfs", "etc", "hooks")); err != nil || string(data) != "hooks\n" {
+		t.Errorf("unexpected staged file: %q, %v", data, err)
+	}
+}
+
+func TestGenerateFromDir(t *testing.T) {
+	dir := t.TempDir()
+	for path, mode := range map[string]os.FileMode{
+		"initramfs/init":                           0755,
+		"initramfs/bin/busybox":                    0755,
+		"initramfs/etc/mkinitfs/initramfs.sha256":  0644,
+		"initramfs-extra/usr/share/extra/data.txt": 0644,
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("stale\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	workDir := t.TempDir()
+	opts := generateOpts{manifestHash: digest.SHA256}
+	if err := generateFromDir(context.Background(), workDir, dir, deviceinfo.DeviceInfo{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := archive.ReadEntries(filepath.Join(workDir, "initramfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/init", "/bin/busybox", "/etc/mkinitfs/initramfs.sha256"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("%s: not found in the initramfs", name)
+		}
+	}
+	// the manifest of the tree is replaced by a generated one
+	if e := entries["/etc/mkinitfs/initramfs.sha256"]; e.Size == int64(len("stale\n")) {
+		t.Errorf("expected a generated manifest, got: %+v", e)
+	}
+	extra, err := archive.ReadEntries(filepath.Join(workDir, "initramfs-extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := extra["/usr/share/extra/data.txt"]; !ok {
+		t.Error("expected the file in initramfs-extra")
+	}
+
+	// the initramfs can't boot without these
+	if err := os.Remove(filepath.Join(dir, "initramfs/bin/busybox")); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateFromDir(context.Background(), t.TempDir(), dir, deviceinfo.DeviceInfo{}, opts); err == nil {
+		t.Error("expected error for a tree without busybox")
+	}
+}
+
+func TestPrintEntries(t *testing.T) {
+	var buf bytes.Buffer
+	printEntries(&buf, []archive.Entry{
+		{Name: "/", Mode: cpio.ModeDir | 0755},
+		{Name: "/init", Mode: cpio.ModeRegular | 0755, Size: 2048},
+		{Name: "/bin/sh", Mode: cpio.ModeSymlink | 0777, Linkname: "busybox", Size: 7},
+	})
+	expected := "drwxr-xr-x       0B /\n" +
+		"-rwxr-xr-x     2.0K /init\n" +
+		"Lrwxrwxrwx       7B /bin/sh -> busybox\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestGetLocaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	fonts := filepath.Join(dir, "fonts")
+	if err := os.MkdirAll(filepath.Join(fonts, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, file := range []string{"fonts.conf", "conf.d/10-hinting.conf"} {
+		path := filepath.Join(fonts, file)
+		if err := os.WriteFile(path, []byte("<fontconfig/>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, path)
+	}
+	defer func(dirs []string) { fontconfigDirs = dirs }(fontconfigDirs)
+	fontconfigDirs = []string{fonts, filepath.Join(dir, "missing")}
+
+	for _, locale := range []string{"", "C", "de_DE.UTF-8"} {
+		files := make(misc.StringSet)
+		if err := getLocaleFiles(context.Background(), files, locale); err != nil {
+			t.Fatalf("%q: %s", locale, err)
+		}
+		for _, file := range expected {
+			if _, ok := files[file]; !ok {
+				t.Errorf("%q: expected %s to be included, got: %q", locale, file, files.Sorted())
+			}
+		}
+	}
+}
+
+func TestGetKeymapFiles(t *testing.T) {
+	dir := t.TempDir()
+	defer func(system string, bkeymaps string) {
+		systemKeymapDir, bkeymapsDir = system, bkeymaps
+	}(systemKeymapDir, bkeymapsDir)
+	systemKeymapDir = filepath.Join(dir, "etc")
+	bkeymapsDir = filepath.Join(dir, "bkeymaps")
+
+	for _, file := range []string{"etc/us.bmap.gz", "bkeymaps/de/de-latin1.bmap.gz", "bkeymaps/fr/fr.bmap.gz"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("bkeymap"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := []struct {
+		keymaps  string
+		expected []string
+	}{
+		{"", []string{"etc/us.bmap.gz"}},
+		{"de/de-latin1", []string{"bkeymaps/de/de-latin1.bmap.gz", "etc/us.bmap.gz"}},
+		{"de/de-latin1  fr/fr", []string{"bkeymaps/de/de-latin1.bmap.gz", "bkeymaps/fr/fr.bmap.gz", "etc/us.bmap.gz"}},
+		{"xx/missing", nil},
+	}
+
+	for _, table := range tables {
+		files := make(misc.StringSet)
+		err := getKeymapFiles(context.Background(), files, deviceinfo.DeviceInfo{Keymaps: table.keymaps})
+		if table.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected error for missing keymap", table.keymaps)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", table.keymaps, err)
+			continue
+		}
+		var expected []string
+		for _, file := range table.expected {
+			expected = append(expected, filepath.Join(dir, file))
+		}
+		if got := files.Sorted(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.keymaps, expected, got)
+		}
+	}
+}
+
+func TestGetTimezoneFiles(t *testing.T) {
+	dir := t.TempDir()
+	zone := filepath.Join(dir, "zoneinfo", "Europe", "Berlin")
+	if err := os.MkdirAll(filepath.Dir(zone), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{zone, filepath.Join(dir, "adjtime")} {
+		if err := os.WriteFile(file, []byte("TZif"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(zone, filepath.Join(dir, "localtime")); err != nil {
+		t.Fatal(err)
+	}
+	defer func(files []string) { timezoneFiles = files }(timezoneFiles)
+
+	tables := []struct {
+		files    []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{"missing"}, nil},
+		{[]string{"adjtime", "missing"}, []string{"adjtime"}},
+		// the target of the symlink is added with it by the archive
+		{[]string{"localtime", "adjtime"}, []string{"adjtime", "localtime"}},
+	}
+
+	for _, table := range tables {
+		timezoneFiles = nil
+		for _, file := range table.files {
+			timezoneFiles = append(timezoneFiles, filepath.Join(dir, file))
+		}
+		files := make(misc.StringSet)
+		if err := getTimezoneFiles(context.Background(), files); err != nil {
+			t.Errorf("%q: %s", table.files, err)
+			continue
+		}
+		expected := []string{}
+		for _, file := range table.expected {
+			expected = append(expected, filepath.Join(dir, file))
+		}
+		if got := files.Sorted(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.files, expected, got)
+		}
+	}
+}
+
+func TestGetHookDirs(t *testing.T) {
+	tables := []struct {
+		flavor   string
+		expected []string
+	}{
+		{"", []string{"/hooks"}},
+		{"postmarketos-qcom-sdm845", []string{"/hooks", "/hooks.postmarketos-qcom-sdm845"}},
+	}
+
+	for _, table := range tables {
+		if got := getHookDirs("/hooks", table.flavor); !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.flavor, table.expected, got)
+		}
+	}
+}
+
+func TestGetHookScripts(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hooks")
+	for d, files := range map[string][]string{
+		dir:             {"10-global.sh", "20-both.sh", "README"},
+		dir + ".pine64": {"20-both.sh", "30-flavor.sh"},
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			if err := os.WriteFile(filepath.Join(d, file), []byte("true\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tables := []struct {
+		flavor   string
+		expected map[string]string
+	}{
+		{"", map[string]string{
+			filepath.Join(hooksDir, "10-global.sh"): filepath.Join(dir, "10-global.sh"),
+			filepath.Join(hooksDir, "20-both.sh"):   filepath.Join(dir, "20-both.sh"),
+		}},
+		// no hooks for this flavor
+		{"other", map[string]string{
+			filepath.Join(hooksDir, "10-global.sh"): filepath.Join(dir, "10-global.sh"),
+			filepath.Join(hooksDir, "20-both.sh"):   filepath.Join(dir, "20-both.sh"),
+		}},
+		{"pine64", map[string]string{
+			filepath.Join(hooksDir, "10-global.sh"): filepath.Join(dir, "10-global.sh"),
+			filepath.Join(hooksDir, "20-both.sh"):   filepath.Join(dir+".pine64", "20-both.sh"),
+			filepath.Join(hooksDir, "30-flavor.sh"): filepath.Join(dir+".pine64", "30-flavor.sh"),
+		}},
+	}
+
+	for _, table := range tables {
+		if got := getHookScripts(dir, table.flavor); !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.flavor, table.expected, got)
+		}
+	}
+}
+
+func TestReadLibDirs(t *testing.T) {
+	dir := t.TempDir()
+	defer func(pattern string) { muslPathFiles = pattern }(muslPathFiles)
+	muslPathFiles = filepath.Join(dir, "ld-musl-*.path")
+	defaults := []string{"/usr/lib", "/lib", "/usr/local/lib"}
+
+	tables := []struct {
+		contents string
+		expected []string
+	}{
+		// no config
+		{"", defaults},
+		{"\n", defaults},
+		{"/lib\n/usr/lib\n", []string{"/lib", "/usr/lib"}},
+		{"/lib:/usr/lib /opt/lib\n", []string{"/lib", "/usr/lib", "/opt/lib"}},
+	}
+
+	for _, table := range tables {
+		config := filepath.Join(dir, "ld-musl-aarch64.path")
+		os.Remove(config)
+		if table.contents != "" {
+			if err := os.WriteFile(config, []byte(table.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := readLibDirs(); !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.contents, table.expected, got)
+		}
+	}
+}
+
+func TestGenerateArchives(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tables := []struct {
+		// generated one after the other
+		maxMemory   int64
+		initfsFiles misc.StringSet
+		extraFiles  misc.StringSet
+		expected    string
+	}{
+		// initramfs-extra is written even when the initramfs fails
+		{0, misc.StringSet{missing: false}, misc.StringSet{file: false}, "generateInitfs: "},
+		{1 << 20, misc.StringSet{missing: false}, misc.StringSet{file: false}, "generateInitfs: "},
+		// errors for initramfs-extra are returned first
+		{0, misc.StringSet{missing: false}, misc.StringSet{missing: false}, "generateInitfsExtra: "},
+		{1 << 20, misc.StringSet{file: false}, misc.StringSet{missing: false}, "generateInitfsExtra: "},
+	}
+
+	for i, table := range tables {
+		workDir := t.TempDir()
+		opts := generateOpts{maxMemory: table.maxMemory, unprivileged: true, manifestHash: digest.SHA256}
+		err := generateArchives(context.Background(), workDir, table.initfsFiles, table.extraFiles, "", deviceinfo.DeviceInfo{}, opts)
+		if err == nil || !strings.HasPrefix(err.Error(), table.expected) {
+			t.Errorf("%d: expected error starting with %q, got: %v", i, table.expected, err)
+			continue
+		}
+		if table.expected != "generateInitfs: " {
+			continue
+		}
+		entries, err := archive.ReadEntries(filepath.Join(workDir, "initramfs-extra"))
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if _, ok := entries[file]; !ok {
+			t.Errorf("%d: expected %s in initramfs-extra", i, file)
+		}
+	}
+}
@@ -6,49 +6,318 @@ package archive
 import (
 	"bytes"
 	"compress/flate"
+	"context"
+	"encoding/hex"
+	"fmt"
 	"github.com/cavaliercoder/go-cpio"
+	"github.com/klauspost/compress/zstd"
 	"github.com/klauspost/pgzip"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/digest"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/misc"
+	"golang.org/x/sys/unix"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// Archive is a compressed cpio archive. Everything in it is owned by root
+// (uid/gid 0), regardless of the owner of the files on the system, so
+// archives built without root (e.g. with fakeroot) are the same. Its methods
+// can be called from multiple goroutines, but Dirs, Files and DirModes must
+// not be changed while other goroutines use the archive.
 type Archive struct {
-	Dirs       misc.StringSet
-	Files      misc.StringSet
-	cpioWriter *cpio.Writer
-	buf        *bytes.Buffer
+	mu     sync.Mutex
+	Dirs   misc.StringSet
+	Files  misc.StringSet
+	format Format
+	// entries to write, in order. The cpio is only written when the archive
+	// is, straight into the compressor, so it's never buffered in memory.
+	entries []pendingEntry
+	// regular files written to the archive, dest path -> source path
+	contents map[string]string
+	// regular files with generated contents, dest path -> contents
+	generated map[string][]byte
+	// index in entries of the entry at each path in the archive (with a
+	// leading /), except for directories, for detecting conflicts
+	dests map[string]int
+	// entries added while this is set replace other entries at the same
+	// path, and aren't replaced by entries added later
+	overriding bool
+	// path in the archive to write the manifest to, if set
+	manifest     string
+	manifestHash digest.Algorithm
+	// the manifest is only added once, when the archive is first written
+	manifestAdded bool
+	// modes of directories that aren't 0755, by path in the archive
+	DirModes map[string]os.FileMode
+	// 0 for no limit
+	memoryLimit int64
+	compression Compression
+	// 0 for the default of the compression
+	compressionLevel int
+	gzipBlockSize    int
+	// timestamp of all entries and of the gzip header, if set
+	modTime  time.Time
+	modTimes ModTimes
+	// written uncompressed in front of the archive, if set
+	early *Archive
 }
 
+// An entry of the archive, the data is either copied from src or given
+type pendingEntry struct {
+	hdr  *cpio.Header
+	src  string
+	data []byte
+	// files that are hardlinks of each other on the system, have the same
+	// (non-zero) link
+	link fileID
+	// the data is the manifest, generated when the entry is written
+	manifest bool
+	// replaced by an entry at the same path added later, not written
+	replaced bool
+	override bool
+}
+
+// Identifies a file on the system, for finding hardlinks
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// Directories that are created with a mode other than 0755 by default
+var defaultDirModes = map[string]os.FileMode{
+	"/proc":    0555,
+	"/root":    0700,
+	"/sys":     0555,
+	"/tmp":     0777 | os.ModeSticky,
+	"/var/tmp": 0777 | os.ModeSticky,
+}
+
+// ErrConflict is returned when entries with different contents are added at
+// the same path in the archive
+var ErrConflict = i18n.NewError(i18n.ArchiveConflict)
+
+// ErrUnsafePath is returned for paths in the archive with ".." elements, and
+// for symlinks pointing outside of the archive
+var ErrUnsafePath = i18n.NewError(i18n.ArchiveUnsafePath)
+
+// Create an archive in the newc format, see NewWithFormat
 func New() (*Archive, error) {
-	buf := new(bytes.Buffer)
+	return NewWithFormat(FormatNewc)
+}
+
+// Create an archive in the given format, e.g. a cpio format for bootloaders
+// or recovery tools that only read one of them, or FormatTar for inspecting
+// the archive
+func NewWithFormat(format Format) (*Archive, error) {
+	if format != FormatTar {
+		if _, err := ParseFormat(format.String()); err != nil {
+			return nil, err
+		}
+	}
+
 	archive := &Archive{
-		cpioWriter: cpio.NewWriter(buf),
-		Files:      make(misc.StringSet),
-		Dirs:       make(misc.StringSet),
-		buf:        buf,
+		format:    format,
+		Files:     make(misc.StringSet),
+		Dirs:      make(misc.StringSet),
+		contents:  make(map[string]string),
+		generated: make(map[string][]byte),
+		dests:     make(map[string]int),
+		DirModes:  make(map[string]os.FileMode),
+	}
+	for dir, mode := range defaultDirModes {
+		archive.DirModes[dir] = mode
 	}
 
 	return archive, nil
 }
 
-func (archive *Archive) Write(path string, mode os.FileMode) error {
+// Set the compression to use for the archive, the default is CompressionGzip
+func (archive *Archive) SetCompression(compression Compression) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.compression = compression
+}
+
+// Set the compression level, e.g. 1 (fastest) to 9 (smallest) for gzip. The
+// default is 0, which uses the fastest level for gzip.
+func (archive *Archive) SetCompressionLevel(level int) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.compressionLevel = level
+}
+
+// Set the size of the blocks that are compressed in parallel with gzip,
+// instead of the pgzip default of 1MiB. Larger blocks compress slightly
+// better, but use more memory.
+func (archive *Archive) SetGzipBlockSize(size int) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.gzipBlockSize = size
+}
+
+// Set the timestamp of all entries in the archive, and of the gzip header,
+// e.g. to SOURCE_DATE_EPOCH for reproducible builds. By default, timestamps
+// are 0.
+func (archive *Archive) SetModTime(t time.Time) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.modTime = t
+}
+
+// ModTimes is how the timestamps of entries are set
+type ModTimes int
+
+const (
+	// All entries get the time set with SetModTime (0 by default), so
+	// archives built from the same files are the same
+	ModTimesFixed ModTimes = iota
+	// Entries of files and symlinks from the system keep their modification
+	// time, e.g. for finding out where they come from when debugging. Other
+	// entries (directories, generated files) get the time set with
+	// SetModTime.
+	ModTimesPreserve
+)
+
+// Set how the timestamps of entries are set, the default is ModTimesFixed
+func (archive *Archive) SetModTimes(mode ModTimes) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.modTimes = mode
+}
+
+// Keep the memory used for compressing the archive below roughly the given
+// limit (in bytes), for devices with little RAM. The compressor uses smaller
+// and fewer blocks.
+func (archive *Archive) LimitMemory(limit int64) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.memoryLimit = limit
+}
+
+// Set an archive that is written uncompressed in front of this one, whatever
+// its compression is set to, e.g. for early microcode or firmware that the
+// kernel has to find without decompressing anything. The kernel unpacks both
+// segments, entries of this archive replace the ones of the early archive at
+// the same paths.
+func (archive *Archive) SetEarly(early *Archive) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.early = early
+}
+
+// WriteTo writes the compressed archive to w, e.g. for streaming it to a
+// pipe. Unlike Write, the written archive isn't verified.
+func (archive *Archive) WriteTo(w io.Writer) (int64, error) {
+	return archive.WriteToContext(context.Background(), w)
+}
+
+// WriteToContext is like WriteTo, but stops writing with the error of the
+// context when it's done
+func (archive *Archive) WriteToContext(ctx context.Context, w io.Writer) (int64, error) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	cw := &countingWriter{w: w}
+	if archive.early != nil && archive.format == FormatTar {
+		return 0, i18n.NewError(i18n.ArchiveTarEarlyArchive)
+	}
+	if archive.early != nil {
+		archive.early.mu.Lock()
+		err := archive.early.writeSegment(ctx, cw, false)
+		archive.early.mu.Unlock()
+		if err != nil {
+			return cw.n, err
+		}
+		// the kernel expects the next segment at a multiple of 4 bytes
+		if pad := (4 - cw.n%4) % 4; pad > 0 {
+			if _, err := cw.Write(make([]byte, pad)); err != nil {
+				return cw.n, err
+			}
+		}
+	}
+	if err := archive.writeSegment(ctx, cw, true); err != nil {
+		return cw.n, err
+	}
+
+	return cw.n, nil
+}
+
+// Write the archive to w, compressed with its compression if compress is set
+func (archive *Archive) writeSegment(ctx context.Context, w io.Writer, compress bool) error {
 	if err := archive.writeCpio(); err != nil {
 		return err
 	}
 
-	if err := archive.cpioWriter.Close(); err != nil {
+	if archive.manifest != "" && !archive.manifestAdded {
+		if err := archive.addManifest(); err != nil {
+			return err
+		}
+		archive.manifestAdded = true
+	}
+
+	var c io.WriteCloser = nopWriteCloser{w}
+	if compress {
+		var err error
+		if c, err = archive.newCompressor(w); err != nil {
+			return err
+		}
+	}
+	if err := archive.writeEntries(ctx, c); err != nil {
+		c.Close()
 		return err
 	}
+	return c.Close()
+}
 
+// Counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Write the archive to the given path. The cpio is streamed into the
+// compressor, so the memory used doesn't depend on the size of the archive.
+// The written archive is read back from the storage and compared with what
+// was written, then decompressed and checked with Verify.
+func (archive *Archive) Write(path string, mode os.FileMode) error {
+	return archive.WriteContext(context.Background(), path, mode)
+}
+
+// WriteContext is like Write, but stops writing with the error of the context
+// when it's done
+func (archive *Archive) WriteContext(ctx context.Context, path string, mode os.FileMode) error {
 	// Write archive to path
-	if err := archive.writeCompressed(path, mode); err != nil {
+	sum, err := archive.writeCompressed(ctx, path, mode)
+	if err != nil {
 		log.Print("Unable to write archive to location: ", path)
 		return err
 	}
+	if err := readBack(path, sum); err != nil {
+		return err
+	}
+
+	verify := Verify
+	if archive.format == FormatTar {
+		verify = verifyTar
+	}
+	if err := verify(path); err != nil {
+		return i18n.Errorf(i18n.ArchiveVerifyFailed, err)
+	}
 
 	if err := os.Chmod(path, mode); err != nil {
 		return err
@@ -58,12 +327,20 @@ func (archive *Archive) Write(path string, mode os.FileMode) error {
 }
 
 func (archive *Archive) AddFile(file string, dest string) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	return archive.addFile(file, dest, nil)
+}
+
+// Add the file, chain is the symlinks followed to get to it
+func (archive *Archive) addFile(file string, dest string, chain []string) error {
 	if err := archive.addDir(filepath.Dir(dest)); err != nil {
 		return err
 	}
 
-	if archive.Files[file] {
-		// Already written to cpio
+	if archive.Files[file] && filepath.Join("/", dest) == filepath.Join("/", file) {
+		// Already written to cpio. Other destinations still get a copy,
+		// queue drops it if it's already there.
 		return nil
 	}
 
@@ -86,14 +363,11 @@ func (archive *Archive) AddFile(file string, dest string) error {
 		hdr := &cpio.Header{
 			Name:     destFilename,
 			Linkname: target,
-			Mode:     0644 | cpio.ModeSymlink,
+			Mode:     symlinkMode,
 			Size:     int64(len(target)),
-			// Checksum: 1,
-		}
-		if err := archive.cpioWriter.WriteHeader(hdr); err != nil {
-			return err
+			ModTime:  fileStat.ModTime(),
 		}
-		if _, err = archive.cpioWriter.Write([]byte(target)); err != nil {
+		if _, err := archive.queue(pendingEntry{hdr: hdr, data: []byte(target)}); err != nil {
 			return err
 		}
 
@@ -108,85 +382,804 @@ func (archive *Archive) AddFile(file string, dest string) error {
 				return err
 			}
 		}
+		chain = append(chain, file)
+		if err := misc.CheckSymlinkChain(chain, target); err != nil {
+			return fmt.Errorf("AddFile: %w", err)
+		}
 		// TODO: add verbose mode, print stuff like this:
 		// log.Printf("symlink: %q, target: %q", file, target)
 		// write symlink target
-		err = archive.AddFile(target, target)
+		err = archive.addFile(target, target, chain)
 		return err
 	}
 
-	// log.Printf("writing file: %q", file)
+	// log.Printf("adding file: %q", file)
 
-	fd, err := os.Open(file)
+	if hasCapabilities(file) {
+		log.Printf("WARNING: AddFile: file capabilities of %q can't be stored in the archive, they are dropped", file)
+	}
+
+	destFilename := strings.TrimPrefix(dest, "/")
+	e := pendingEntry{
+		hdr: &cpio.Header{
+			Name:    destFilename,
+			Mode:    cpioPermMode(fileStat.Mode()),
+			Size:    fileStat.Size(),
+			ModTime: fileStat.ModTime(),
+		},
+		src: file,
+	}
+	if st, ok := fileStat.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		e.link = fileID{uint64(st.Dev), uint64(st.Ino)}
+	}
+	queued, err := archive.queue(e)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
 
-	destFilename := strings.TrimPrefix(dest, "/")
-	hdr := &cpio.Header{
-		Name: destFilename,
-		Mode: cpio.FileMode(fileStat.Mode().Perm()),
-		Size: fileStat.Size(),
-		// Checksum: 1,
+	archive.Files[file] = true
+	if queued {
+		archive.contents[filepath.Join("/", dest)] = file
 	}
-	if err := archive.cpioWriter.WriteHeader(hdr); err != nil {
+
+	return nil
+}
+
+// Add the contents of dir to the root of the archive as they are, with the
+// same modes, e.g. dir/etc/foo is added as /etc/foo. Unlike with AddFile,
+// symlinks are added without their targets. Entries of the overlay replace
+// other entries at the same path, including ones added later. Modes of
+// directories that are already in the archive aren't changed.
+func (archive *Archive) AddOverlay(dir string) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.overriding = true
+	defer func() { archive.overriding = false }()
+	return archive.addDirRecursive(dir, "/", nil)
+}
+
+// Add the contents of the src directory to the dest directory in the archive,
+// with the same modes as on the system. Symlinks are added as they are,
+// without their targets, so relative symlinks within src keep working, device
+// nodes and fifos are added as well.
+// Entries with a name or a path relative to src matching one of the exclude
+// patterns (see filepath.Match, e.g. "*.a" or "share/doc") are skipped,
+// excluded directories are skipped entirely.
+func (archive *Archive) AddDirRecursive(src string, dest string, excludes []string) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	return archive.addDirRecursive(src, dest, excludes)
+}
+
+func (archive *Archive) addDirRecursive(src string, dest string, excludes []string) error {
+	for _, pattern := range excludes {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return i18n.Errorf(i18n.ArchiveInvalidExclude, pattern, err)
+		}
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if excluded(rel, excludes) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join("/", dest, rel)
+
+		switch {
+		case info.IsDir():
+			archive.DirModes[target] = info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			return archive.addDir(target)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := archive.addDir(filepath.Dir(target)); err != nil {
+				return err
+			}
+			err = archive.addEntry(&cpio.Header{
+				Name:     strings.TrimPrefix(target, "/"),
+				Linkname: link,
+				Mode:     symlinkMode,
+				Size:     int64(len(link)),
+				ModTime:  info.ModTime(),
+			}, []byte(link))
+			archive.Files[path] = true
+			return err
+		case info.Mode().IsRegular():
+			return archive.addFile(path, target, nil)
+		case info.Mode()&os.ModeNamedPipe != 0:
+			if err := archive.addDir(filepath.Dir(target)); err != nil {
+				return err
+			}
+			return archive.addEntry(&cpio.Header{
+				Name:    strings.TrimPrefix(target, "/"),
+				Mode:    cpio.ModeNamedPipe | cpioPermMode(info.Mode()),
+				ModTime: info.ModTime(),
+			}, nil)
+		case info.Mode()&os.ModeDevice != 0:
+			st, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return i18n.Errorf(i18n.ArchiveNoDeviceNumber, path)
+			}
+			typ := BlockDevice
+			if info.Mode()&os.ModeCharDevice != 0 {
+				typ = CharDevice
+			}
+			dev := uint64(st.Rdev)
+			return archive.addDevNode(target, typ, unix.Major(dev), unix.Minor(dev), info.Mode())
+		default:
+			return i18n.Errorf(i18n.ArchiveUnsupportedFileType, path)
+		}
+	})
+}
+
+// Returns true if the name or the path match one of the patterns
+func excluded(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a secret file (e.g. a LUKS keyfile for a secondary partition) to the
+// archive. Secrets are always written with 0600 permissions and owned by
+// root, regardless of the permissions of the source file, and are never
+// included in the manifest.
+func (archive *Archive) AddSecret(file string, dest string) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	fileStat, err := os.Stat(file)
+	if err != nil {
 		return err
 	}
+	if !fileStat.Mode().IsRegular() {
+		return i18n.Errorf(i18n.ArchiveSecretNotRegular, file)
+	}
 
-	if _, err = io.Copy(archive.cpioWriter, fd); err != nil {
+	data, err := os.ReadFile(file)
+	if err != nil {
 		return err
 	}
 
+	if err := archive.writeData(dest, data, 0600); err != nil {
+		return err
+	}
 	archive.Files[file] = true
 
 	return nil
 }
 
-func (archive *Archive) writeCompressed(path string, mode os.FileMode) error {
-	// TODO: support other compression formats, based on deviceinfo
-	fd, err := os.Create(path)
+// Add a regular file with the contents read from r to the archive, for
+// generated files (e.g. config snippets) that don't exist on the system. Like
+// files added with AddFile, they are included in the manifest.
+func (archive *Archive) AddFileFromReader(dest string, r io.Reader, mode os.FileMode) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return i18n.Errorf(i18n.ArchiveUnreadableContents, dest, err)
+	}
+
+	if err := archive.addDir(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	queued, err := archive.queue(pendingEntry{
+		hdr: &cpio.Header{
+			Name: strings.TrimPrefix(dest, "/"),
+			Mode: cpioPermMode(mode),
+			Size: int64(len(data)),
+		},
+		data: data,
+	})
+	if err != nil {
+		return err
+	}
+	if queued {
+		archive.generated[filepath.Join("/", dest)] = data
+	}
+
+	return nil
+}
+
+// DevNodeType is the type of a device node
+type DevNodeType int
+
+// Types of device nodes
+const (
+	CharDevice DevNodeType = iota
+	BlockDevice
+)
+
+type devNode struct {
+	path  string
+	typ   DevNodeType
+	major uint32
+	minor uint32
+	mode  os.FileMode
+}
+
+// Character devices that init needs before devtmpfs is mounted, or on kernels
+// without CONFIG_DEVTMPFS_MOUNT
+var standardDevNodes = []devNode{
+	{"/dev/console", CharDevice, 5, 1, 0600},
+	{"/dev/null", CharDevice, 1, 3, 0666},
+	{"/dev/kmsg", CharDevice, 1, 11, 0644},
+}
+
+// Add the standard device nodes (/dev/console, /dev/null and /dev/kmsg) to
+// the archive.
+func (archive *Archive) AddStandardDevNodes() error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	for _, node := range standardDevNodes {
+		if err := archive.addDevNode(node.path, node.typ, node.major, node.minor, node.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add a device node with the given device number to the archive, so that it
+// exists before devtmpfs is mounted
+func (archive *Archive) AddDevNode(dest string, typ DevNodeType, major uint32, minor uint32, mode os.FileMode) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	return archive.addDevNode(dest, typ, major, minor, mode)
+}
+
+func (archive *Archive) addDevNode(dest string, typ DevNodeType, major uint32, minor uint32, mode os.FileMode) error {
+	var devMode cpio.FileMode
+	switch typ {
+	case CharDevice:
+		devMode = cpio.ModeCharDevice
+	case BlockDevice:
+		devMode = cpio.ModeDevice
+	default:
+		return i18n.Errorf(i18n.ArchiveUnknownDevNodeType, typ)
+	}
+
+	if err := archive.addDir(filepath.Dir(dest)); err != nil {
+		return err
+	}
+
+	return archive.addEntry(&cpio.Header{
+		Name:     strings.TrimPrefix(dest, "/"),
+		Mode:     devMode | cpioPermMode(mode),
+		DeviceID: int(unix.Mkdev(major, minor)),
+	}, nil)
+}
+
+// Embed a manifest with the checksum of every regular file in the archive at
+// the given path when the archive is written. The manifest uses the format
+// of 'sha256sum' (or 'b2sum' and 'xxhsum' for the other algorithms), so it
+// can be checked at runtime with e.g. 'sha256sum -c'.
+func (archive *Archive) EmbedManifest(dest string, alg digest.Algorithm) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.manifest = dest
+	archive.manifestHash = alg
+}
+
+// Add the entry for the manifest, after all files. The checksums of files are
+// calculated while they're written to the archive, so they're only read once.
+func (archive *Archive) addManifest() error {
+	if err := archive.addDir(filepath.Dir(archive.manifest)); err != nil {
+		return err
+	}
+
+	_, err := archive.queue(pendingEntry{
+		hdr: &cpio.Header{
+			Name: strings.TrimPrefix(archive.manifest, "/"),
+			Mode: cpioPermMode(0644),
+		},
+		manifest: true,
+	})
 	if err != nil {
 		return err
 	}
+	return nil
+}
+
+// Generate the manifest, with the checksums of the files written so far by
+// source path. Files that weren't written yet are read to checksum them.
+func (archive *Archive) manifestData(sums map[string]string) ([]byte, error) {
+	var dests []string
+	for dest := range archive.contents {
+		dests = append(dests, dest)
+	}
+	for dest := range archive.generated {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
 
-	gz, err := pgzip.NewWriterLevel(fd, flate.BestSpeed)
+	var manifest bytes.Buffer
+	for _, dest := range dests {
+		var sum string
+		var err error
+		if data, ok := archive.generated[dest]; ok {
+			sum, err = archive.manifestHash.Reader(bytes.NewReader(data))
+		} else if sum, ok = sums[archive.contents[dest]]; !ok {
+			sum, err = archive.manifestHash.File(archive.contents[dest])
+		}
+		if err != nil {
+			log.Print("manifestData: unable to checksum file: ", dest)
+			return nil, err
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sum, dest)
+	}
+
+	return manifest.Bytes(), nil
+}
+
+// Write an entry for a regular file with the given contents to the archive
+func (archive *Archive) writeData(dest string, data []byte, mode os.FileMode) error {
+	if err := archive.addDir(filepath.Dir(dest)); err != nil {
+		return err
+	}
+
+	return archive.addEntry(&cpio.Header{
+		Name: strings.TrimPrefix(dest, "/"),
+		Mode: cpioPermMode(mode),
+		Size: int64(len(data)),
+	}, data)
+}
+
+// Add an entry with the given contents (if any) to the archive
+func (archive *Archive) addEntry(hdr *cpio.Header, data []byte) error {
+	_, err := archive.queue(pendingEntry{hdr: hdr, data: data})
+	return err
+}
+
+// Queue an entry to be written, returns false if it isn't because an entry
+// at the same path is already queued. That's only an error if the entries
+// have different contents, unless one of them overrides the other (see
+// AddOverlay).
+func (archive *Archive) queue(e pendingEntry) (bool, error) {
+	dest, err := cleanPath(e.hdr.Name)
 	if err != nil {
+		return false, err
+	}
+	if e.hdr.Name = strings.TrimPrefix(dest, "/"); e.hdr.Name == "" {
+		e.hdr.Name = "."
+	}
+	if e.hdr.Mode&cpio.ModeType == cpio.ModeSymlink && escapesRoot(dest, e.hdr.Linkname) {
+		return false, i18n.Errorf(i18n.ArchiveSymlinkOutside, ErrUnsafePath, dest, e.hdr.Linkname)
+	}
+
+	e.override = archive.overriding
+	if e.hdr.Mode&cpio.ModeType == cpio.ModeDir {
+		archive.entries = append(archive.entries, e)
+		return true, nil
+	}
+	if dest == "/" {
+		return false, i18n.Errorf(i18n.ArchiveRootEntry, ErrUnsafePath, e.hdr.Name)
+	}
+
+	if i, ok := archive.dests[dest]; ok {
+		old := archive.entries[i]
+		switch {
+		case e.override:
+			archive.entries[i].replaced = true
+			delete(archive.contents, dest)
+			delete(archive.generated, dest)
+		case old.override:
+			return false, nil
+		case old.src != "" && old.src == e.src:
+			return false, nil
+		default:
+			same, err := sameContents(old, e)
+			if err != nil {
+				return false, err
+			}
+			if !same {
+				return false, i18n.Errorf(i18n.ArchiveAlreadyAdded, ErrConflict, dest, e.source(), old.source())
+			}
+			return false, nil
+		}
+	}
+
+	archive.dests[dest] = len(archive.entries)
+	archive.entries = append(archive.entries, e)
+	return true, nil
+}
+
+// Clean the path in the archive, with or without the leading /, e.g.
+// "usr//lib/" -> "/usr/lib". Paths with ".." elements are rejected instead of
+// being resolved, since they come from broken or malicious file lists.
+func cleanPath(path string) (string, error) {
+	for _, elem := range strings.Split(path, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%w: %q", ErrUnsafePath, path)
+		}
+	}
+	return filepath.Join("/", path), nil
+}
+
+// Returns true if the relative symlink target of the symlink at path (a clean
+// path in the archive) goes above the root of the archive, e.g. /lib/foo ->
+// ../../etc/foo. Absolute targets are resolved in the archive when booting, so
+// they can't.
+func escapesRoot(path string, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+	depth := strings.Count(filepath.Dir(path), "/")
+	if filepath.Dir(path) == "/" {
+		depth = 0
+	}
+	for _, elem := range strings.Split(target, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// Where the contents of the entry come from, for error messages
+func (e pendingEntry) source() string {
+	if e.src != "" {
+		return e.src
+	}
+	return "generated contents"
+}
+
+// Returns true if both entries have the same type, permissions and contents
+func sameContents(a pendingEntry, b pendingEntry) (bool, error) {
+	if a.hdr.Mode != b.hdr.Mode || a.hdr.Linkname != b.hdr.Linkname || a.hdr.DeviceID != b.hdr.DeviceID {
+		return false, nil
+	}
+	if a.manifest || b.manifest {
+		return false, nil
+	}
+	contents := func(e pendingEntry) ([]byte, error) {
+		if e.src != "" {
+			return os.ReadFile(e.src)
+		}
+		return e.data, nil
+	}
+	aData, err := contents(a)
+	if err != nil {
+		return false, err
+	}
+	bData, err := contents(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aData, bData), nil
+}
+
+// Write the entries of the archive as an uncompressed cpio to w
+func (archive *Archive) writeEntries(ctx context.Context, w io.Writer) error {
+	// hardlinks are written as entries with the same inode, the data is
+	// only in the first one. When unpacking, the kernel links the others
+	// to it.
+	links := make(map[fileID]int)
+	for _, e := range archive.entries {
+		if e.link != (fileID{}) && !e.replaced {
+			links[e.link]++
+		}
+	}
+	inodes := make(map[fileID]int64)
+
+	// manifest checksums of the files written, by source path and link
+	sums := make(map[string]string)
+	linkSums := make(map[fileID]string)
+
+	limit := int64(prefetchSize)
+	if archive.memoryLimit > 0 && archive.memoryLimit/2 < limit {
+		limit = archive.memoryLimit / 2
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	done := make(chan struct{})
+	defer close(done)
+	results, readAhead := archive.prefetch(archive.readAheadEntries(links, limit), limit, done)
+
+	var cw entryWriter = newWriter(w, archive.format)
+	if archive.format == FormatTar {
+		cw = newTarWriter(w)
+	}
+	for i, e := range archive.entries {
+		if e.replaced {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// the writer sets the inode, and the archive may be written more
+		// than once
+		hdr := *e.hdr
+		e.hdr = &hdr
+		if archive.modTimes != ModTimesPreserve || e.hdr.ModTime.IsZero() {
+			e.hdr.ModTime = archive.modTime
+		}
+		src := e.src
+		if n := links[e.link]; n > 1 {
+			e.hdr.Links = n
+			if inode, ok := inodes[e.link]; ok {
+				e.hdr.Inode = inode
+				e.hdr.Size = 0
+				e.src = ""
+				if sum, ok := linkSums[e.link]; ok {
+					sums[src] = sum
+				}
+			}
+		}
+		if e.manifest {
+			data, err := archive.manifestData(sums)
+			if err != nil {
+				return err
+			}
+			e.data = data
+			e.hdr.Size = int64(len(data))
+		}
+
+		if result, ok := results[i]; ok {
+			r := <-result
+			if r.err != nil {
+				return r.err
+			}
+			e.data = r.data
+			e.src = ""
+			if archive.manifest != "" {
+				sums[src] = r.sum
+				if e.link != (fileID{}) {
+					linkSums[e.link] = r.sum
+				}
+			}
+		}
+		var h hash.Hash
+		if archive.manifest != "" && e.src != "" {
+			h = archive.manifestHash.New()
+		}
+		if err := archive.writeEntry(cw, e, h); err != nil {
+			return err
+		}
+		if _, ok := results[i]; ok {
+			readAhead.release(archive.entries[i].hdr.Size)
+		}
+		if h != nil {
+			sums[src] = hex.EncodeToString(h.Sum(nil))
+			if e.link != (fileID{}) {
+				linkSums[e.link] = sums[src]
+			}
+		}
+
+		if n := links[e.link]; n > 1 {
+			if _, ok := inodes[e.link]; !ok {
+				inodes[e.link] = e.hdr.Inode
+			}
+		}
+	}
+	return cw.Close()
+}
+
+// Returns the indexes of the entries with files to read ahead, hardlinks only
+// once. Files that don't fit in the read-ahead limit are streamed from the
+// storage instead, so they're never entirely in memory.
+func (archive *Archive) readAheadEntries(links map[fileID]int, limit int64) []int {
+	var reads []int
+	read := make(map[fileID]bool)
+	for i, e := range archive.entries {
+		if e.replaced || e.src == "" || e.hdr.Size >= limit || (links[e.link] > 1 && read[e.link]) {
+			continue
+		}
+		if links[e.link] > 1 {
+			read[e.link] = true
+		}
+		reads = append(reads, i)
+	}
+	return reads
+}
+
+// Write the entry, files that weren't read ahead are streamed from src, and
+// their data is also written to h if it's set
+func (archive *Archive) writeEntry(cw entryWriter, e pendingEntry, h hash.Hash) error {
+	if e.src == "" {
+		if archive.format == FormatCrc {
+			e.hdr.Checksum = checksum(e.data)
+		}
+		if err := cw.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		_, err := cw.Write(e.data)
 		return err
 	}
 
-	if _, err = io.Copy(gz, archive.buf); err != nil {
+	fd, err := os.Open(e.src)
+	if err != nil {
 		return err
 	}
+	defer fd.Close()
 
-	if err := gz.Close(); err != nil {
+	if archive.format == FormatCrc {
+		// checksum goes in the header, so the file has to be read twice
+		sum, err := checksumReader(fd)
+		if err != nil {
+			return err
+		}
+		e.hdr.Checksum = sum
+		if _, err := fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if err := cw.WriteHeader(e.hdr); err != nil {
 		return err
 	}
+	var dst io.Writer = cw
+	if h != nil {
+		dst = io.MultiWriter(cw, h)
+	}
+	if _, err := io.Copy(dst, fd); err != nil {
+		return i18n.Errorf(i18n.ArchiveWriteFailed, e.src, err)
+	}
+	return nil
+}
+
+// Algorithm of the checksum of written archives, for reading them back.
+// Only for detecting corruption, so the fastest one.
+const readBackHash = digest.XXH64
+
+// Returned (wrapped) by Write when the archive read back from the storage
+// isn't what was written
+var ErrReadBack = i18n.NewError(i18n.ArchiveReadBack)
+
+// Write the archive to path, returns the checksum of the written data (see
+// readBackHash)
+func (archive *Archive) writeCompressed(ctx context.Context, path string, mode os.FileMode) (string, error) {
+	fd, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := readBackHash.New()
+	if _, err := archive.WriteToContext(ctx, io.MultiWriter(fd, h)); err != nil {
+		return "", err
+	}
 
 	// call fsync just to be sure
 	if err := fd.Sync(); err != nil {
-		return err
+		return "", err
 	}
 
 	if err := os.Chmod(path, mode); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Check that the file read back from the storage has the checksum of the
+// data written to it, catching storage that silently corrupts data (e.g.
+// worn out eMMC or SD cards) before the device is unbootable
+func readBack(path string, sum string) error {
+	stored, err := readBackHash.StoredFile(path)
+	if err != nil {
 		return err
 	}
+	if stored != sum {
+		return fmt.Errorf("%w: %s", ErrReadBack, path)
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
 
+func (nopWriteCloser) Close() error {
 	return nil
 }
 
+// Returns a writer compressing to w with the compression and level of the
+// archive, closing it flushes the compressor, but doesn't close w
+func (archive *Archive) newCompressor(w io.Writer) (io.WriteCloser, error) {
+	limited := archive.memoryLimit > 0
+
+	switch archive.compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		level := archive.compressionLevel
+		if level == 0 {
+			level = flate.BestSpeed
+		}
+		gz, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		gz.ModTime = archive.modTime
+		blockSize := archive.gzipBlockSize
+		if blockSize == 0 && limited {
+			blockSize = limitedGzipBlockSize
+		}
+		if blockSize != 0 {
+			blocks := runtime.GOMAXPROCS(0)
+			if limited {
+				blocks = gzipBlocks(archive.memoryLimit, blockSize)
+			}
+			if err := gz.SetConcurrency(blockSize, blocks); err != nil {
+				return nil, err
+			}
+		}
+		return gz, nil
+	case CompressionZstd:
+		var opts []zstd.EOption
+		if archive.compressionLevel != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(archive.compressionLevel)))
+		}
+		if limited {
+			opts = append(opts, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(limitedZstdWindowSize))
+		}
+		return zstd.NewWriter(w, opts...)
+	default:
+		return nil, i18n.Errorf(i18n.ArchiveUnsupportedCompression, archive.compression)
+	}
+}
+
+// Size of the blocks compressed in parallel when the memory is limited and no
+// block size was set, instead of the pgzip default of 1MiB
+const limitedGzipBlockSize = 256 << 10
+
+// Window size for zstd when the memory is limited, instead of the default of
+// 8MiB (or more, for better compression levels)
+const limitedZstdWindowSize = 1 << 20
+
+// Returns how many blocks of the given size can be compressed in parallel
+// within the memory limit. Each block needs buffers for the input and output,
+// and a compressor, which take roughly 4 times the block size.
+func gzipBlocks(limit int64, blockSize int) int {
+	blocks := int(limit / (4 * int64(blockSize)))
+	if blocks > runtime.GOMAXPROCS(0) {
+		blocks = runtime.GOMAXPROCS(0)
+	}
+	if blocks < 1 {
+		blocks = 1
+	}
+	return blocks
+}
+
 func (archive *Archive) writeCpio() error {
-	// Write any dirs added explicitly
-	for dir := range archive.Dirs {
+	// Write any dirs added explicitly. Dirs and files are sorted, so the
+	// archive is the same every time it's generated from the same files.
+	for _, dir := range archive.Dirs.Sorted() {
 		archive.addDir(dir)
 	}
 
 	// Write files and any missing parent dirs
-	for file, imported := range archive.Files {
-		if imported {
+	for _, file := range archive.Files.Sorted() {
+		if archive.Files[file] {
+			// Already written, or added as a symlink target
 			continue
 		}
-		if err := archive.AddFile(file, file); err != nil {
+		if err := archive.addFile(file, file, nil); err != nil {
 			return err
 		}
 	}
@@ -195,6 +1188,10 @@ func (archive *Archive) writeCpio() error {
 }
 
 func (archive *Archive) addDir(dir string) error {
+	dir, err := cleanPath(dir)
+	if err != nil {
+		return err
+	}
 	if archive.Dirs[dir] {
 		// Already imported
 		return nil
@@ -210,16 +1207,38 @@ func (archive *Archive) addDir(dir string) error {
 			// Subdir already imported
 			continue
 		}
-		err := archive.cpioWriter.WriteHeader(&cpio.Header{
+		mode, ok := archive.DirModes[filepath.Join("/", path)]
+		if !ok {
+			mode = 0755
+		}
+		if err := archive.addEntry(&cpio.Header{
 			Name: path,
-			Mode: cpio.ModeDir | 0755,
-		})
-		if err != nil {
+			Mode: cpio.ModeDir | cpioPermMode(mode),
+		}, nil); err != nil {
 			return err
 		}
 		archive.Dirs[path] = true
-		// log.Print("wrote dir: ", path)
 	}
 
 	return nil
 }
+
+// Mode of all symlinks in the archive, the permissions of symlinks aren't used
+// and the kernel creates them with 0777 anyway
+const symlinkMode = cpio.ModeSymlink | 0777
+
+// Convert the permissions and setuid, setgid and sticky bits of the mode to
+// a cpio mode
+func cpioPermMode(mode os.FileMode) cpio.FileMode {
+	m := cpio.FileMode(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= cpio.ModeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= cpio.ModeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= cpio.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,1560 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/cavaliercoder/go-cpio"
+	"github.com/klauspost/pgzip"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/cpioread"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/digest"
+	"golang.org/x/sys/unix"
+)
+
+// Read all entries from a compressed archive, returns map of name -> contents
+func readArchive(t *testing.T, path string) map[string]string {
+	t.Helper()
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	gz, err := pgzip.NewReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	r := cpio.NewReader(gz)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = string(data)
+	}
+	return entries
+}
+
+// Write the entries added to the archive so far as an uncompressed cpio
+func cpioBuffer(t *testing.T, a *Archive) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := a.writeEntries(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "hello")
+	if err := os.WriteFile(src, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(src, "/bin/hello"); err != nil {
+		t.Fatal(err)
+	}
+	// secrets are never in the manifest
+	if err := a.AddSecret(src, "/etc/secret"); err != nil {
+		t.Fatal(err)
+	}
+	a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+	out := filepath.Join(dir, "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readArchive(t, out)
+	manifest, ok := entries["etc/manifest.sha256"]
+	if !ok {
+		t.Fatal("manifest not found in archive")
+	}
+	// sha256sum of "hello\n"
+	expected := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  /bin/hello\n"
+	if manifest != expected {
+		t.Errorf("expected manifest: %q, got: %q", expected, manifest)
+	}
+	if !strings.HasPrefix(entries["bin/hello"], "hello") {
+		t.Errorf("unexpected file contents: %q", entries["bin/hello"])
+	}
+}
+
+func TestManifestHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	busybox := filepath.Join(dir, "busybox")
+	if err := os.WriteFile(busybox, []byte("hello\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "sh")
+	if err := os.Link(busybox, link); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Files[busybox] = false
+	a.Files[link] = false
+	a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+	out := filepath.Join(dir, "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data of the link isn't in the archive, but it's in the manifest
+	// with the checksum of the data of the first entry (sha256sum of
+	// "hello\n")
+	sum := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	expected := fmt.Sprintf("%s  %s\n%s  %s\n", sum, busybox, sum, link)
+	if manifest := readArchive(t, out)["etc/manifest.sha256"]; manifest != expected {
+		t.Errorf("expected manifest: %q, got: %q", expected, manifest)
+	}
+}
+
+func TestAddFileFromReader(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFileFromReader("/etc/hello", strings.NewReader("hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+	out := filepath.Join(t.TempDir(), "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := readArchive(t, out)
+	if contents["etc/hello"] != "hello\n" {
+		t.Errorf("unexpected file contents: %q", contents["etc/hello"])
+	}
+	// sha256sum of "hello\n"
+	expected := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  /etc/hello\n"
+	if contents["etc/manifest.sha256"] != expected {
+		t.Errorf("expected manifest: %q, got: %q", expected, contents["etc/manifest.sha256"])
+	}
+	entries, err := ReadEntries(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := entries["/etc/hello"].Mode; mode != cpio.ModeRegular|0600 {
+		t.Errorf("expected mode %o, got: %o", cpio.ModeRegular|0600, mode)
+	}
+
+	if err := a.AddFileFromReader("/etc/broken", iotest.ErrReader(errors.New("failed")), 0644); err == nil {
+		t.Error("expected error when reading fails")
+	}
+}
+
+func TestSetEarly(t *testing.T) {
+	early, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd sizes, for the padding between the segments
+	if err := early.AddFileFromReader("/kernel/x86/microcode/GenuineIntel.bin", strings.NewReader("ucode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	early.SetCompression(CompressionZstd)
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFileFromReader("/init", strings.NewReader("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	a.SetEarly(early)
+	out := filepath.Join(t.TempDir(), "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("070701")) {
+		t.Errorf("expected uncompressed early segment, got: %q", data[:6])
+	}
+
+	r, err := cpioread.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents := make(map[string]string)
+	err = r.Walk(func(hdr *cpio.Header, data io.Reader) error {
+		if hdr.Mode.IsRegular() {
+			b, err := ioutil.ReadAll(data)
+			contents[hdr.Name] = string(b)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"kernel/x86/microcode/GenuineIntel.bin": "ucode", "init": "#!/bin/sh\n"}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("expected: %q, got: %q", expected, contents)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "hello")
+	if err := os.WriteFile(src, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetModTime(time.Unix(1234, 0))
+	if err := a.AddFile(src, "/bin/hello"); err != nil {
+		t.Fatal(err)
+	}
+	a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+
+	var first, second bytes.Buffer
+	n, err := a.WriteTo(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(first.Len()) {
+		t.Errorf("expected %d bytes written, got: %d", first.Len(), n)
+	}
+	// writing again gives the same archive, with the manifest only once
+	if _, err := a.WriteTo(&second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("expected the same archive when writing it again")
+	}
+
+	r, err := cpioread.New(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	err = r.Walk(func(hdr *cpio.Header, data io.Reader) error {
+		names = append(names, hdr.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"bin", "bin/hello", "etc", "etc/manifest.sha256"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected entries: %q, got: %q", expected, names)
+	}
+}
+
+func TestCrcChecksums(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "hello")
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewWithFormat(FormatCrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(src, "/hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithFormat(Format(42)); err == nil {
+		t.Error("expected error for unknown format")
+	}
+
+	r := cpio.NewReader(cpioBuffer(t, a))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			t.Fatal("file not found in archive")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "hello" {
+			if hdr.Checksum != 0x214 {
+				t.Errorf("expected checksum 0x214, got: %s", hdr.Checksum)
+			}
+			break
+		}
+	}
+}
+
+func TestAddSecret(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "keyfile")
+	if err := os.WriteFile(src, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddSecret(src, "/etc/keyfile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddSecret(dir, "/etc/dir"); err == nil {
+		t.Error("expected error when adding a directory as a secret")
+	}
+
+	r := cpio.NewReader(cpioBuffer(t, a))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			t.Fatal("secret not found in archive")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "etc/keyfile" {
+			if hdr.Mode.Perm() != 0600 || hdr.UID != 0 || hdr.GID != 0 {
+				t.Errorf("unexpected secret mode/owner: %s %d:%d", hdr.Mode, hdr.UID, hdr.GID)
+			}
+			break
+		}
+	}
+}
+
+func TestDirModes(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.DirModes["/run/lock"] = 0775 | os.ModeSetgid
+	for _, dir := range []string{"/tmp", "/root", "/run/lock", "/sysroot"} {
+		a.Dirs[dir] = false
+	}
+	if err := a.writeCpio(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]cpio.FileMode{
+		"tmp":      cpio.ModeDir | cpio.ModeSticky | 0777,
+		"root":     cpio.ModeDir | 0700,
+		"run":      cpio.ModeDir | 0755,
+		"run/lock": cpio.ModeDir | cpio.ModeSetgid | 0775,
+		"sysroot":  cpio.ModeDir | 0755,
+	}
+	r := cpio.NewReader(cpioBuffer(t, a))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode, ok := expected[hdr.Name]; ok {
+			if hdr.Mode != mode {
+				t.Errorf("%s: expected mode %o, got: %o", hdr.Name, mode, hdr.Mode)
+			}
+			delete(expected, hdr.Name)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("dirs not found in archive: %v", expected)
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	dir := t.TempDir()
+	expected := map[string]cpio.FileMode{
+		"unix_chkpwd": cpio.ModeSetuid | 0755,
+		"wall":        cpio.ModeSetgid | 0755,
+		"plain":       0644,
+	}
+	modes := map[string]os.FileMode{
+		"unix_chkpwd": os.ModeSetuid | 0755,
+		"wall":        os.ModeSetgid | 0755,
+		"plain":       0644,
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range modes {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// WriteFile doesn't set the setuid/setgid bits
+		if err := os.Chmod(file, mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddFile(file, "/sbin/"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := cpio.NewReader(cpioBuffer(t, a))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.TrimPrefix(hdr.Name, "sbin/")
+		if mode, ok := expected[name]; ok {
+			if perm := hdr.Mode &^ cpio.ModeType; perm != mode {
+				t.Errorf("%s: expected mode %o, got: %o", hdr.Name, mode, perm)
+			}
+			delete(expected, name)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("files not found in archive: %v", expected)
+	}
+}
+
+func TestAddDevNodes(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddStandardDevNodes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDevNode("/dev/mmcblk0", BlockDevice, 179, 0, 0660); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDevNode("/dev/fifo", DevNodeType(42), 0, 0, 0600); err == nil {
+		t.Error("expected error for unknown device node type")
+	}
+	out := cpioBuffer(t, a).String()
+
+	// go-cpio doesn't parse rdev, so check the newc header fields directly:
+	// mode, then rdev major/minor after uid, gid, nlink, mtime, size and dev
+	expected := map[string][3]string{
+		"dev/console": {"00002180", "00000005", "00000001"},
+		"dev/null":    {"000021B6", "00000001", "00000003"},
+		"dev/kmsg":    {"000021A4", "00000001", "0000000B"},
+		"dev/mmcblk0": {"000061B0", "000000B3", "00000000"},
+	}
+	for name, fields := range expected {
+		i := strings.Index(out, name+"\x00")
+		if i < 0 {
+			t.Errorf("%s: not found in archive", name)
+			continue
+		}
+		hdr := out[i-110 : i]
+		if mode := hdr[14:22]; mode != fields[0] {
+			t.Errorf("%s: expected mode %s, got: %s", name, fields[0], mode)
+		}
+		if major, minor := hdr[78:86], hdr[86:94]; major != fields[1] || minor != fields[2] {
+			t.Errorf("%s: expected rdev %s:%s, got: %s:%s", name, fields[1], fields[2], major, minor)
+		}
+	}
+	if !strings.Contains(out, "dev\x00") {
+		t.Error("/dev not found in archive")
+	}
+}
+
+func TestLimitMemory(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte(strings.Repeat("hello\n", 100000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		a, err := NewWithFormat(FormatCrc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.LimitMemory(1 << 20)
+		a.SetCompression(compression)
+		a.Files[file] = false
+		out := filepath.Join(dir, "archive-"+compression.String())
+		if err := a.Write(out, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := ReadEntries(out)
+		if err != nil {
+			t.Fatalf("%s: %s", compression, err)
+		}
+		if e := entries[file]; e.Size != int64(len("hello\n"))*100000 {
+			t.Errorf("%s: unexpected file in archive: %+v", compression, e)
+		}
+	}
+}
+
+func TestWriteStreams(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(file, "/hello"); err != nil {
+		t.Fatal(err)
+	}
+	// contents are only read when writing the archive
+	if err := os.WriteFile(file, []byte("world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readArchive(t, out); entries["hello"] != "world\n" {
+		t.Errorf("unexpected file contents: %q", entries["hello"])
+	}
+
+	// a file that changed size since it was added
+	b, _ := New()
+	if err := b.AddFile(file, "/hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Write(out, 0644); err == nil {
+		t.Error("expected error for file that grew after adding it")
+	}
+}
+
+func TestGzipBlocks(t *testing.T) {
+	if blocks := gzipBlocks(0, limitedGzipBlockSize); blocks != 1 {
+		t.Errorf("expected at least 1 block, got: %d", blocks)
+	}
+	if blocks := gzipBlocks(1<<40, limitedGzipBlockSize); blocks != runtime.GOMAXPROCS(0) {
+		t.Errorf("expected at most GOMAXPROCS blocks, got: %d", blocks)
+	}
+	if blocks := gzipBlocks(4*limitedGzipBlockSize, limitedGzipBlockSize); blocks != 1 {
+		t.Errorf("expected 1 block, got: %d", blocks)
+	}
+}
+
+func TestCompressionNone(t *testing.T) {
+	if c, err := ParseCompression("none"); err != nil || c != CompressionNone {
+		t.Errorf("unexpected compression: %s, %v", c, err)
+	}
+	if _, err := ParseCompression("bzip3"); err == nil || errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("expected error for unknown compression, got: %v", err)
+	}
+	if _, err := ParseCompression("lz4"); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("expected ErrUnsupportedCompression, got: %v", err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetCompression(CompressionNone)
+	a.Dirs["/foo"] = false
+	out := filepath.Join(t.TempDir(), "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	hdr, err := cpio.NewReader(fd).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "foo" || !hdr.Mode.IsDir() {
+		t.Errorf("unexpected entry: %q, %s", hdr.Name, hdr.Mode)
+	}
+}
+
+func TestReadEntries(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []Compression{CompressionGzip, CompressionNone, CompressionZstd} {
+		a, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.SetCompression(compression)
+		if err := a.AddFile(file, "/init"); err != nil {
+			t.Fatal(err)
+		}
+		a.Files[link] = false
+		out := filepath.Join(dir, "archive-"+compression.String())
+		if err := a.Write(out, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := ReadEntries(out)
+		if err != nil {
+			t.Fatalf("%s: %s", compression, err)
+		}
+		if e := entries["/init"]; e.Mode != cpio.ModeRegular|0755 {
+			t.Errorf("%s: unexpected /init: %o", compression, e.Mode)
+		}
+		if e := entries[link]; !e.IsSymlink() || e.Linkname != "file" {
+			t.Errorf("%s: unexpected symlink: %o -> %q", compression, e.Mode, e.Linkname)
+		}
+		if e, ok := entries["/"]; !ok || !e.Mode.IsDir() {
+			t.Errorf("%s: expected root dir entry, got: %v", compression, entries)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFileFromReader("/init", strings.NewReader("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDevNode("/dev/console", CharDevice, 5, 1, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := List(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	modes := make(map[string]string)
+	for _, e := range entries {
+		names = append(names, e.Name)
+		modes[e.Name] = e.FileMode().String()
+	}
+	expected := []string{"/", "/init", "/dev", "/dev/console"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected: %q, got: %q", expected, names)
+	}
+	for name, mode := range map[string]string{
+		"/dev":         "drwxr-xr-x",
+		"/dev/console": "Dcrw-------",
+		"/init":        "-rwxr-xr-x",
+	} {
+		if modes[name] != mode {
+			t.Errorf("%s: expected mode %s, got: %s", name, mode, modes[name])
+		}
+	}
+
+	if _, err := List(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected error for missing archive, got: %v", err)
+	}
+}
+
+func TestParseCompressionLevel(t *testing.T) {
+	tables := []struct {
+		spec        string
+		compression Compression
+		level       int
+		valid       bool
+	}{
+		{"gzip", CompressionGzip, 0, true},
+		{"gzip:9", CompressionGzip, 9, true},
+		{"gzip:0", CompressionGzip, 0, false},
+		{"gzip:fast", CompressionGzip, 1, true},
+		{"gzip:fastest", CompressionGzip, 0, false},
+		{"none", CompressionNone, 0, true},
+		{"none:1", CompressionNone, 0, false},
+		{"gzip:best", CompressionGzip, 9, true},
+		{"gzip:default", CompressionGzip, 0, true},
+		{"zstd:fast", CompressionZstd, 1, true},
+		{"zstd:22", CompressionZstd, 22, true},
+		{"zstd:23", CompressionZstd, 0, false},
+		{"xz:6", CompressionGzip, 0, false},
+	}
+	for _, table := range tables {
+		c, level, err := ParseCompressionLevel(table.spec)
+		if (err == nil) != table.valid {
+			t.Errorf("%q: unexpected error: %v", table.spec, err)
+			continue
+		}
+		if table.valid && (c != table.compression || level != table.level) {
+			t.Errorf("%q: expected %s:%d, got: %s:%d", table.spec, table.compression, table.level, c, level)
+		}
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte(strings.Repeat("hello\n", 100000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetCompressionLevel(9)
+	a.SetGzipBlockSize(64 << 10)
+	a.Files[file] = false
+	out := filepath.Join(dir, "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if readArchive(t, out)[strings.TrimPrefix(file, "/")] != strings.Repeat("hello\n", 100000) {
+		t.Error("unexpected file contents in archive")
+	}
+
+	b, _ := New()
+	b.SetCompressionLevel(42)
+	if err := b.Write(filepath.Join(dir, "invalid"), 0644); err == nil {
+		t.Error("expected error for invalid compression level")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(format Format, compression Compression) string {
+		a, err := NewWithFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.SetCompression(compression)
+		if err := a.AddStandardDevNodes(); err != nil {
+			t.Fatal(err)
+		}
+		a.Files[link] = false
+		out := filepath.Join(dir, fmt.Sprintf("archive-%s-%s", format, compression))
+		if err := a.Write(out, 0644); err != nil {
+			t.Fatalf("%s, %s: %s", format, compression, err)
+		}
+		return out
+	}
+
+	for _, format := range []Format{FormatNewc, FormatCrc, FormatOdc} {
+		for _, compression := range []Compression{CompressionGzip, CompressionNone, CompressionZstd} {
+			if err := Verify(write(format, compression)); err != nil {
+				t.Errorf("%s, %s: unexpected error: %s", format, compression, err)
+			}
+		}
+	}
+
+	corrupt := func(path string, f func(data []byte) []byte) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, f(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, format := range []Format{FormatNewc, FormatOdc} {
+		out := write(format, CompressionNone)
+		corrupt(out, func(data []byte) []byte {
+			return data[:bytes.Index(data, []byte(trailerName))-20]
+		})
+		if err := Verify(out); err == nil || !strings.Contains(err.Error(), "truncated") {
+			t.Errorf("%s: expected error for truncated archive, got: %v", format, err)
+		}
+	}
+
+	out := write(FormatCrc, CompressionNone)
+	corrupt(out, func(data []byte) []byte {
+		return bytes.Replace(data, []byte("hello world"), []byte("hello WORLD"), 1)
+	})
+	if err := Verify(out); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum error, got: %v", err)
+	}
+
+	out = write(FormatNewc, CompressionGzip)
+	corrupt(out, func(data []byte) []byte {
+		data[len(data)-6] ^= 0xff
+		return data
+	})
+	if err := Verify(out); err == nil {
+		t.Error("expected error for corrupt gzip stream")
+	}
+}
+
+func TestSetModTime(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Unix(1630000000, 0)
+
+	write := func(name string) []byte {
+		a, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.SetModTime(epoch)
+		if err := a.AddFile(file, "/hello"); err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(dir, name)
+		if err := a.Write(out, 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	first := write("first")
+	if !bytes.Equal(first, write("second")) {
+		t.Error("expected identical archives")
+	}
+
+	gz, err := pgzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gz.ModTime.Equal(epoch) {
+		t.Errorf("expected gzip header time %s, got: %s", epoch, gz.ModTime)
+	}
+	r := cpio.NewReader(gz)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.ModTime.Equal(epoch) {
+			t.Errorf("%s: expected time %s, got: %s", hdr.Name, epoch, hdr.ModTime)
+		}
+	}
+}
+
+func TestSetModTimes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 0)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Unix(1630000000, 0)
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetModTime(epoch)
+	a.SetModTimes(ModTimesPreserve)
+	if err := a.AddFile(file, "/usr/share/hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFileFromReader("/etc/generated", strings.NewReader("generated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := cpioread.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	err = r.Walk(func(hdr *cpio.Header, data io.Reader) error {
+		expected := epoch
+		if hdr.Name == "usr/share/hello" {
+			expected = mtime
+		}
+		if !hdr.ModTime.Equal(expected) {
+			t.Errorf("%s: expected time %s, got: %s", hdr.Name, expected, hdr.ModTime)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for _, name := range []string{"c", "a", "d", "b", "e/f", "e/a"} {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, file)
+	}
+
+	write := func() *bytes.Buffer {
+		a, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{"/usr", "/bin", "/sys"} {
+			a.Dirs[dir] = false
+		}
+		for _, name := range names {
+			a.Files[name] = false
+		}
+		if err := a.writeCpio(); err != nil {
+			t.Fatal(err)
+		}
+		return cpioBuffer(t, a)
+	}
+
+	first := write()
+	var order []string
+	r := cpio.NewReader(bytes.NewReader(first.Bytes()))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Mode.IsRegular() {
+			order = append(order, filepath.Base(hdr.Name))
+		}
+	}
+	if expected := []string{"a", "b", "c", "d", "a", "f"}; strings.Join(order, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected files in order: %q, got: %q", expected, order)
+	}
+
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(first.Bytes(), write().Bytes()) {
+			t.Fatal("expected identical archives")
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"hook": "hook\n", "same": "hook\n", "builtin": "builtin\n"}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(filepath.Join(dir, "hook"), "/init"); err != nil {
+		t.Fatal(err)
+	}
+	// same contents, only written once
+	if err := a.AddFile(filepath.Join(dir, "same"), "/init"); err != nil {
+		t.Errorf("unexpected error for the same contents: %s", err)
+	}
+	if err := a.AddFile(filepath.Join(dir, "builtin"), "/init"); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected conflict, got: %v", err)
+	}
+	if err := a.AddFileFromReader("/init", strings.NewReader("generated\n"), 0644); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected conflict for generated contents, got: %v", err)
+	}
+
+	out := filepath.Join(dir, "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := cpioread.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	count := 0
+	err = r.Walk(func(hdr *cpio.Header, data io.Reader) error {
+		if hdr.Name == "init" {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected /init once in the archive, got: %d", count)
+	}
+}
+
+func TestAddFileSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	if err := os.Symlink("b", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("symlink loop: %s -> %s -> %s", a, b, a)
+	if err := archive.AddFile(a, "/a"); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error with %q, got: %v", expected, err)
+	}
+}
+
+func TestUnsafePaths(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{"/../etc/shadow", "/lib/../../etc/shadow", "../init", "/"} {
+		if err := a.AddFileFromReader(dest, strings.NewReader("hello\n"), 0644); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%q: expected unsafe path error, got: %v", dest, err)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, table := range []struct {
+		target string
+		dest   string
+		unsafe bool
+	}{
+		{"../../lib/libfoo.so.1", "/usr/lib/libfoo.so", false},
+		{"/bin/busybox", "/bin/sh", false},
+		{"../../../etc/shadow", "/usr/lib/libbar.so", true},
+		{"../etc/shadow", "/shadow", true},
+	} {
+		link := filepath.Join(dir, filepath.Base(table.dest))
+		if err := os.Symlink(table.target, link); err != nil {
+			t.Fatal(err)
+		}
+		err := a.AddDirRecursive(dir, filepath.Dir(table.dest), nil)
+		if table.unsafe != errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s -> %s: unexpected error result: %v", table.dest, table.target, err)
+		}
+		os.Remove(link)
+	}
+
+	// duplicate slashes are normalized
+	if err := a.AddFileFromReader("//etc//hello", strings.NewReader("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadEntries(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["/etc/hello"]; !ok {
+		t.Errorf("expected /etc/hello in the archive, got: %v", entries)
+	}
+}
+
+func TestOverlayOverrides(t *testing.T) {
+	dir := t.TempDir()
+	overlay := filepath.Join(dir, "overlay")
+	if err := os.MkdirAll(filepath.Join(overlay, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, contents := range map[string]string{
+		"overlay/etc/before": "overlay\n",
+		"overlay/etc/after":  "overlay\n",
+		"before":             "system\n",
+		"after":              "system\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+	if err := a.AddFile(filepath.Join(dir, "before"), "/etc/before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddOverlay(overlay); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(filepath.Join(dir, "after"), "/etc/after"); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := readArchive(t, out)
+	for _, name := range []string{"etc/before", "etc/after"} {
+		if contents[name] != "overlay\n" {
+			t.Errorf("%s: expected the overlay contents, got: %q", name, contents[name])
+		}
+	}
+	if manifest := contents["etc/manifest.sha256"]; strings.Contains(manifest, filepath.Join(dir, "before")) || strings.Count(manifest, "\n") != 2 {
+		t.Errorf("unexpected manifest: %q", manifest)
+	}
+}
+
+func TestAddOverlay(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"etc/foo", "root"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "root"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc/foo/foo.conf"), []byte("foo=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "root/debug.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// target isn't in the overlay, and isn't added
+	if err := os.Symlink("/usr/share/foo/default.conf", filepath.Join(dir, "etc/foo/default.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddOverlay(dir); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadEntries(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]cpio.FileMode{
+		"/etc/foo":              cpio.ModeDir | 0755,
+		"/etc/foo/foo.conf":     cpio.ModeRegular | 0600,
+		"/etc/foo/default.conf": cpio.ModeSymlink | 0777,
+		"/root":                 cpio.ModeDir | 0750,
+		"/root/debug.sh":        cpio.ModeRegular | 0755,
+	}
+	for name, mode := range expected {
+		if e, ok := entries[name]; !ok || e.Mode != mode {
+			t.Errorf("%s: expected mode %o, got: %o (found: %t)", name, mode, e.Mode, ok)
+		}
+	}
+	if e := entries["/etc/foo/default.conf"]; e.Linkname != "/usr/share/foo/default.conf" {
+		t.Errorf("unexpected symlink target: %q", e.Linkname)
+	}
+	if _, ok := entries["/usr/share/foo/default.conf"]; ok {
+		t.Error("expected symlink target to not be added")
+	}
+
+	if err := a.AddOverlay(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for missing overlay")
+	}
+}
+
+func TestAddDirRecursive(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"lib/foo", "share/doc/foo", "share/foo"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"lib/foo/libfoo.so.1", "lib/foo/libfoo.a", "share/doc/foo/README", "share/foo/data"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("libfoo.so.1", filepath.Join(dir, "lib/foo/libfoo.so")); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(filepath.Join(dir, "share/foo/fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDirRecursive(dir, "/usr", []string{"*.a", "share/doc"}); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadEntries(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/usr/lib/foo/libfoo.so.1", "/usr/lib/foo/libfoo.so", "/usr/share/foo/data"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("%s: not found in archive", name)
+		}
+	}
+	for _, name := range []string{"/usr/lib/foo/libfoo.a", "/usr/share/doc", "/usr/share/doc/foo/README"} {
+		if _, ok := entries[name]; ok {
+			t.Errorf("%s: expected to be excluded", name)
+		}
+	}
+	if e := entries["/usr/lib/foo/libfoo.so"]; e.Linkname != "libfoo.so.1" {
+		t.Errorf("unexpected symlink target: %q", e.Linkname)
+	}
+	if e := entries["/usr/share/foo/fifo"]; e.Mode != cpio.ModeNamedPipe|0600 {
+		t.Errorf("unexpected fifo: %v", e.Mode)
+	}
+
+	if err := a.AddDirRecursive(dir, "/usr", []string{"[lib"}); err == nil {
+		t.Error("expected error for invalid exclude pattern")
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	busybox := filepath.Join(dir, "busybox")
+	if err := os.WriteFile(busybox, []byte(strings.Repeat("busybox", 1000)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := []string{filepath.Join(dir, "ls"), filepath.Join(dir, "mount")}
+	for _, link := range links {
+		if err := os.Link(busybox, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only one path of this one is added, so it's a regular entry
+	single := filepath.Join(dir, "single")
+	if err := os.WriteFile(single, []byte("single"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(single, filepath.Join(dir, "other")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []Format{FormatNewc, FormatCrc} {
+		a, err := NewWithFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range append([]string{busybox, single}, links...) {
+			a.Files[file] = false
+		}
+		out := filepath.Join(dir, "archive-"+format.String())
+		if err := a.Write(out, 0644); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		fd, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := pgzip.NewReader(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := cpio.NewReader(gz)
+		inodes := make(map[int64]int)
+		var dataSize int64
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch filepath.Base(hdr.Name) {
+			case "busybox", "ls", "mount":
+				if hdr.Links != 3 {
+					t.Errorf("%s, %s: expected 3 links, got: %d", format, hdr.Name, hdr.Links)
+				}
+				inodes[hdr.Inode]++
+				dataSize += hdr.Size
+			case "single":
+				if hdr.Links != 1 || hdr.Size != 6 {
+					t.Errorf("%s, %s: expected a regular entry, got: %+v", format, hdr.Name, hdr)
+				}
+			}
+		}
+		fd.Close()
+		if len(inodes) != 1 {
+			t.Errorf("%s: expected hardlinks to have the same inode, got: %v", format, inodes)
+		}
+		if dataSize != 7000 {
+			t.Errorf("%s: expected the data to only be in the archive once, got: %d bytes", format, dataSize)
+		}
+	}
+}
+
+func TestConcurrentAddFile(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 50; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+		if err := os.WriteFile(file, []byte(strings.Repeat(fmt.Sprint(i), i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only a few files are read ahead at a time
+	a.LimitMemory(64)
+	errs := make(chan error, len(files))
+	for _, file := range files {
+		go func(file string) {
+			errs <- a.AddFile(file, file)
+		}(file)
+	}
+	for range files {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+	out := filepath.Join(dir, "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readArchive(t, out)
+	var manifest strings.Builder
+	for i, file := range files {
+		expected := strings.Repeat(fmt.Sprint(i), i)
+		if got := entries[strings.TrimPrefix(file, "/")]; got != expected {
+			t.Errorf("%s: expected: %q, got: %q", file, expected, got)
+		}
+		sum, err := digest.SHA256.File(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sum, file)
+	}
+	if got := entries["etc/manifest.sha256"]; got != manifest.String() {
+		t.Errorf("expected manifest: %q, got: %q", manifest.String(), got)
+	}
+
+	// files are read when writing, errors stop the writer
+	if err := os.Remove(files[10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write(out, 0644); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error for missing file, got: %v", err)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(file, "/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.WriteContext(ctx, filepath.Join(dir, "out"), 0644); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected: %v, got: %v", context.Canceled, err)
+	}
+	if _, err := a.WriteToContext(ctx, ioutil.Discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected: %v, got: %v", context.Canceled, err)
+	}
+
+	// the archive can still be written after a canceled write
+	if err := a.WriteContext(context.Background(), filepath.Join(dir, "out"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "initramfs")
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := a.writeCompressed(context.Background(), path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readBack(path, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit, like failing storage would
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := readBack(path, sum); !errors.Is(err, ErrReadBack) {
+		t.Errorf("expected: %v, got: %v", ErrReadBack, err)
+	}
+}
+
+func TestStreamLargeFiles(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small")
+	if err := os.WriteFile(small, []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	large := filepath.Join(dir, "large")
+	data := []byte(strings.Repeat("large", 1000))
+	if err := os.WriteFile(large, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []Format{FormatNewc, FormatCrc} {
+		a, err := NewWithFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// read ahead at most 1K
+		a.LimitMemory(2048)
+		a.Files[small] = false
+		a.Files[large] = false
+		a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+		out := filepath.Join(dir, "archive-"+format.String())
+		if err := a.Write(out, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var reads []string
+		for _, i := range a.readAheadEntries(nil, 1024) {
+			reads = append(reads, a.entries[i].src)
+		}
+		if !reflect.DeepEqual(reads, []string{small}) {
+			t.Errorf("%s: expected only the small file to be read ahead, got: %q", format, reads)
+		}
+
+		entries := readArchive(t, out)
+		if entries[strings.TrimPrefix(large, "/")] != string(data) || entries[strings.TrimPrefix(small, "/")] != "small" {
+			t.Errorf("%s: unexpected contents: %q", format, entries)
+		}
+		sum, err := digest.SHA256.Reader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(entries["etc/manifest.sha256"], sum+"  "+large+"\n") {
+			t.Errorf("%s: expected the checksum of the streamed file in the manifest, got: %q", format, entries["etc/manifest.sha256"])
+		}
+	}
+}
+
+func TestSymlinkAddedTwice(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "busybox"), []byte("busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sh := filepath.Join(dir, "bin", "sh")
+	if err := os.Symlink("busybox", sh); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. from a hook and from the overlay
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(sh, "/bin/sh"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDirRecursive(dir, "/", nil); err != nil {
+		t.Fatalf("expected the same symlink to be added without a conflict, got: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "archive")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadEntries(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entries["/bin/sh"]; e.Mode != cpio.ModeSymlink|0777 || e.Linkname != "busybox" {
+		t.Errorf("unexpected symlink: %o -> %q", e.Mode, e.Linkname)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Compression is the compression used for the archive
+type Compression int
+
+const (
+	CompressionGzip Compression = iota
+	// uncompressed cpio, for bootloaders that can't decompress the
+	// initramfs and for debugging
+	CompressionNone
+	// needs CONFIG_RD_ZSTD (Linux 5.9+)
+	CompressionZstd
+)
+
+var compressionNames = map[string]Compression{
+	"gzip": CompressionGzip,
+	"none": CompressionNone,
+	"zstd": CompressionZstd,
+}
+
+// Formats the kernel can decompress, but that can't be written (yet)
+var unsupportedCompressions = []string{"bzip2", "lz4", "lzma", "lzo", "xz"}
+
+// Returned (wrapped) by ParseCompressionLevel for compression formats that
+// are valid, but can't be written
+var ErrUnsupportedCompression = i18n.NewError(i18n.ArchiveCompressionNotSupported)
+
+// Levels of each compression, by the names that can be used instead of
+// numbers. 0 is the default of the compression.
+var compressionLevels = map[Compression]struct {
+	min, max   int
+	fast, best int
+}{
+	CompressionGzip: {min: 1, max: 9, fast: 1, best: 9},
+	CompressionZstd: {min: 1, max: 22, fast: 1, best: 19},
+}
+
+func (c Compression) String() string {
+	for name, compression := range compressionNames {
+		if compression == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// Get the Compression with the given name, one of: gzip, none, zstd
+func ParseCompression(name string) (Compression, error) {
+	c, ok := compressionNames[name]
+	if !ok {
+		for _, unsupported := range unsupportedCompressions {
+			if name == unsupported {
+				return c, fmt.Errorf("%w: %q", ErrUnsupportedCompression, name)
+			}
+		}
+		return c, i18n.Errorf(i18n.ArchiveUnknownCompression, name)
+	}
+	return c, nil
+}
+
+// Parse a compression with an optional level, in the format of
+// deviceinfo_initfs_compression: <format>[:<level>], e.g. "gzip:9" or
+// "zstd:best". The level is a number, or one of: fast, default, best. It's 0
+// when it isn't given (or is "default"), for the default level of the
+// compression.
+func ParseCompressionLevel(spec string) (Compression, int, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	c, err := ParseCompression(parts[0])
+	if err != nil || len(parts) == 1 {
+		return c, 0, err
+	}
+
+	levels, ok := compressionLevels[c]
+	if !ok {
+		return c, 0, i18n.Errorf(i18n.ArchiveNoCompressionLevels, c)
+	}
+	switch parts[1] {
+	case "default":
+		return c, 0, nil
+	case "fast":
+		return c, levels.fast, nil
+	case "best":
+		return c, levels.best, nil
+	}
+
+	level, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return c, 0, i18n.Errorf(i18n.ArchiveInvalidCompressionLevel, spec)
+	}
+	if level < levels.min || level > levels.max {
+		return c, 0, i18n.Errorf(i18n.ArchiveCompressionLevelRange, c, levels.min, levels.max, level)
+	}
+
+	return c, level, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Bytes of file contents read ahead of the cpio writer by default, see
+// prefetch
+const prefetchSize = 32 << 20
+
+// Contents of a file read ahead of the cpio writer
+type prefetched struct {
+	data []byte
+	// manifest checksum of the data, if the archive has a manifest
+	sum string
+	err error
+}
+
+// Read the files of the entries at the given indexes in parallel, with a
+// worker per CPU, so the writer doesn't wait for the storage (slow on eMMC) or
+// checksumming. Files are read in order, the writer gets the contents of each
+// entry from the returned channels. At most limit bytes are read ahead, so
+// only files smaller than that are given (see readAheadEntries), the writer
+// has to release the size of each file in the header after writing it.
+// Reading stops when done is closed.
+func (archive *Archive) prefetch(indexes []int, limit int64, done <-chan struct{}) (map[int]chan prefetched, *budget) {
+	results := make(map[int]chan prefetched, len(indexes))
+	for _, i := range indexes {
+		results[i] = make(chan prefetched, 1)
+	}
+	b := newBudget(limit)
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for _, i := range indexes {
+			if !b.acquire(archive.entries[i].hdr.Size) {
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				e := archive.entries[i]
+				var r prefetched
+				r.data, r.err = os.ReadFile(e.src)
+				if r.err == nil && archive.manifest != "" {
+					r.sum, r.err = archive.manifestHash.Reader(bytes.NewReader(r.data))
+				}
+				results[i] <- r
+			}
+		}()
+	}
+	go func() {
+		<-done
+		b.close()
+		wg.Wait()
+	}()
+
+	return results, b
+}
+
+// budget limits the bytes read ahead by prefetch
+type budget struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	free   int64
+	limit  int64
+	closed bool
+}
+
+func newBudget(limit int64) *budget {
+	b := &budget{free: limit, limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Wait until n bytes are free and take them, returns false if the budget was
+// closed
+func (b *budget) acquire(n int64) bool {
+	if n > b.limit {
+		n = b.limit
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.free < n && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	b.free -= n
+	return true
+}
+
+func (b *budget) release(n int64) {
+	if n > b.limit {
+		n = b.limit
+	}
+	b.mu.Lock()
+	b.free += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Wake up and fail all waiting and future calls to acquire
+func (b *budget) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
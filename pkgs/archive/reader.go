@@ -0,0 +1,236 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cavaliercoder/go-cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/cpioread"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Entry is the path, type, permissions and size of an entry read back from
+// an archive
+type Entry struct {
+	// path in the archive, with a leading /
+	Name string
+	Mode cpio.FileMode
+	// target, for symlinks
+	Linkname string
+	Size     int64
+}
+
+func (e Entry) IsSymlink() bool {
+	return e.Mode&cpio.ModeType == cpio.ModeSymlink
+}
+
+// FileMode returns the type and permissions of the entry as an os.FileMode,
+// e.g. for printing them like ls does
+func (e Entry) FileMode() os.FileMode {
+	mode := fileMode(e.Mode)
+	switch e.Mode & cpio.ModeType {
+	case cpio.ModeDir:
+		mode |= os.ModeDir
+	case cpio.ModeSymlink:
+		mode |= os.ModeSymlink
+	case cpio.ModeCharDevice:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case cpio.ModeDevice:
+		mode |= os.ModeDevice
+	case cpio.ModeNamedPipe:
+		mode |= os.ModeNamedPipe
+	case cpio.ModeSocket:
+		mode |= os.ModeSocket
+	}
+	return mode
+}
+
+// List the entries of an archive written by Archive.Write (or of any other
+// initramfs), in the order they are in the archive. See cpioread.New for the
+// supported compression and formats.
+func List(path string) ([]Entry, error) {
+	r, err := cpioread.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var entries []Entry
+	err = r.Walk(func(hdr *cpio.Header, data io.Reader) error {
+		entries = append(entries, Entry{
+			Name:     filepath.Join("/", hdr.Name),
+			Mode:     hdr.Mode,
+			Linkname: hdr.Linkname,
+			Size:     hdr.Size,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Read the entries of an archive written by Archive.Write, by path in the
+// archive (with a leading /), see List
+func ReadEntries(path string) (map[string]Entry, error) {
+	list, err := List(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]Entry, len(list))
+	for _, e := range list {
+		entries[e.Name] = e
+	}
+	return entries, nil
+}
+
+// Verify that the archive at the given path is intact: it's decompressed
+// with the matching decoder, and all cpio headers and data are read up to the
+// trailer, checking the checksums of entries in the crc format. Unlike
+// ReadEntries, this works with all formats. All segments of archives made of
+// several (see Archive.SetEarly) are verified.
+func Verify(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	br := bufio.NewReader(fd)
+	for i := 0; ; i++ {
+		r, compressed, err := cpioread.NextSegment(br)
+		if err == io.EOF && i > 0 {
+			return nil
+		}
+		if err == io.EOF {
+			return i18n.Errorf(i18n.ArchiveEmpty, path)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !compressed {
+			if err := verifyCpio(br); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			continue
+		}
+
+		defer r.Close()
+		dr := bufio.NewReader(r)
+		if err := verifyCpio(dr); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		// reading the padding after the trailer gets the decoder to the end
+		// of the stream, where it checks the checksum of the compression
+		if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+}
+
+// Read all entries of an uncompressed cpio in any of the supported formats,
+// up to the trailer
+func verifyCpio(r io.Reader) error {
+	// offset in the archive, for the padding of the newc and crc formats
+	var offset int64
+	read := func(n int64) ([]byte, error) {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, i18n.Errorf(i18n.ArchiveTruncated, err)
+		}
+		offset += n
+		return buf, nil
+	}
+	field := func(hdr []byte, start int, length int, base int) (int64, error) {
+		value, err := strconv.ParseInt(string(hdr[start:start+length]), base, 64)
+		if err != nil || value < 0 {
+			return 0, i18n.Errorf(i18n.ArchiveInvalidHeader, offset-int64(len(hdr)))
+		}
+		return value, nil
+	}
+
+	for {
+		magic, err := read(6)
+		if err != nil {
+			return err
+		}
+
+		var nameSize, size, sum int64
+		var hdr []byte
+		switch string(magic) {
+		case "070701", "070702":
+			if hdr, err = read(104); err != nil {
+				return err
+			}
+			if size, err = field(hdr, 48, 8, 16); err != nil {
+				return err
+			}
+			if nameSize, err = field(hdr, 88, 8, 16); err != nil {
+				return err
+			}
+			if sum, err = field(hdr, 96, 8, 16); err != nil {
+				return err
+			}
+		case "070707":
+			if hdr, err = read(70); err != nil {
+				return err
+			}
+			if nameSize, err = field(hdr, 53, 6, 8); err != nil {
+				return err
+			}
+			if size, err = field(hdr, 59, 11, 8); err != nil {
+				return err
+			}
+		default:
+			return i18n.Errorf(i18n.ArchiveInvalidMagic, offset-6, magic)
+		}
+		// only newc and crc pad to 4 bytes
+		align := func() error {
+			if magic[5] == '7' {
+				return nil
+			}
+			_, err := read((4 - offset%4) % 4)
+			return err
+		}
+
+		name, err := read(nameSize)
+		if err != nil {
+			return err
+		}
+		if err := align(); err != nil {
+			return err
+		}
+		entry := strings.TrimSuffix(string(name), "\x00")
+		if entry == trailerName {
+			return nil
+		}
+
+		h := cpio.NewHash()
+		if _, err := io.CopyN(h, r, size); err != nil {
+			return i18n.Errorf(i18n.ArchiveTruncatedEntry, entry, err)
+		}
+		offset += size
+		if magic[5] == '2' && int64(h.Sum32()) != sum {
+			return i18n.Errorf(i18n.ArchiveChecksumMismatch, entry, sum, h.Sum32())
+		}
+		if err := align(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/cavaliercoder/go-cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+	"golang.org/x/sys/unix"
+)
+
+// Stage writes the contents of the archive as a directory tree to dir, which
+// must not exist yet, e.g. for inspecting it or for testing hooks in it with
+// chroot. The archive is then written from the staged tree, so it has exactly
+// what's in there (files can be edited, but not resized). Owners aren't
+// kept, and device nodes are skipped if they can't be created (without
+// root), they're still written to the archive. Entries added later are
+// written from where they are.
+func (archive *Archive) Stage(dir string) error {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+
+	if err := archive.writeCpio(); err != nil {
+		return err
+	}
+	if archive.manifest != "" && !archive.manifestAdded {
+		if err := archive.addManifest(); err != nil {
+			return err
+		}
+		archive.manifestAdded = true
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	// path in dir of the first entry of each set of hardlinks
+	links := make(map[fileID]string)
+	// modes of dirs are set last, so read-only ones can be filled
+	dirModes := make(map[string]os.FileMode)
+	for i := range archive.entries {
+		e := &archive.entries[i]
+		if e.replaced {
+			continue
+		}
+		path := filepath.Join(dir, e.hdr.Name)
+		mode := fileMode(e.hdr.Mode)
+
+		switch e.hdr.Mode & cpio.ModeType {
+		case cpio.ModeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			dirModes[path] = mode
+		case cpio.ModeSymlink:
+			if err := os.Symlink(e.hdr.Linkname, path); err != nil {
+				return err
+			}
+		case cpio.ModeCharDevice, cpio.ModeDevice, cpio.ModeNamedPipe:
+			typ := uint32(unix.S_IFIFO)
+			switch e.hdr.Mode & cpio.ModeType {
+			case cpio.ModeCharDevice:
+				typ = unix.S_IFCHR
+			case cpio.ModeDevice:
+				typ = unix.S_IFBLK
+			}
+			err := unix.Mknod(path, typ|uint32(mode.Perm()), int(e.hdr.DeviceID))
+			if errors.Is(err, os.ErrPermission) {
+				log.Print("Stage: unable to create device node, skipping it: ", path)
+				continue
+			}
+			if err != nil {
+				return i18n.Errorf(i18n.ArchiveStageFailed, path, err)
+			}
+		default:
+			if first, ok := links[e.link]; ok && e.link != (fileID{}) {
+				if err := os.Link(first, path); err != nil {
+					return err
+				}
+			} else {
+				if err := archive.stageFile(path, *e, mode); err != nil {
+					return err
+				}
+				links[e.link] = path
+			}
+			if e.manifest {
+				continue
+			}
+			// the manifest has the checksums of the staged files
+			dest := "/" + e.hdr.Name
+			if _, ok := archive.generated[dest]; ok {
+				delete(archive.generated, dest)
+				archive.contents[dest] = path
+			} else if _, ok := archive.contents[dest]; ok {
+				archive.contents[dest] = path
+			}
+			e.src = path
+			e.data = nil
+		}
+	}
+
+	for path, mode := range dirModes {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the contents of the entry to path, the manifest is generated from the
+// files staged so far
+func (archive *Archive) stageFile(path string, e pendingEntry, mode os.FileMode) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	switch {
+	case e.manifest:
+		data, err := archive.manifestData(nil)
+		if err != nil {
+			return err
+		}
+		_, err = fd.Write(data)
+		if err != nil {
+			return err
+		}
+	case e.src != "":
+		src, err := os.Open(e.src)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if _, err := io.Copy(fd, src); err != nil {
+			return err
+		}
+	default:
+		if _, err := fd.Write(e.data); err != nil {
+			return err
+		}
+	}
+
+	// after writing, for files without write permission
+	if err := fd.Chmod(mode); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// Convert the permissions and special bits of an entry to an os.FileMode
+func fileMode(m cpio.FileMode) os.FileMode {
+	mode := os.FileMode(m.Perm())
+	if m&cpio.ModeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&cpio.ModeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&cpio.ModeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/digest"
+)
+
+func TestStage(t *testing.T) {
+	dir := t.TempDir()
+	busybox := filepath.Join(dir, "busybox")
+	if err := os.WriteFile(busybox, []byte("busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "ls")
+	if err := os.Link(busybox, link); err != nil {
+		t.Fatal(err)
+	}
+	sh := filepath.Join(dir, "sh")
+	if err := os.Symlink("busybox", sh); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Files[busybox] = false
+	a.Files[link] = false
+	if err := a.AddFile(sh, "/bin/sh"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddSecret(secret, "/etc/secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFileFromReader("/etc/hooks", strings.NewReader("hooks\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDevNode("/dev/null", CharDevice, 1, 3, 0666); err != nil {
+		t.Fatal(err)
+	}
+	a.EmbedManifest("/etc/manifest.sha256", digest.SHA256)
+
+	stage := filepath.Join(dir, "stage")
+	if err := a.Stage(stage); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{
+		busybox:       "busybox",
+		link:          "busybox",
+		"/etc/secret": "secret",
+		"/etc/hooks":  "hooks\n",
+	} {
+		if data, err := os.ReadFile(filepath.Join(stage, path)); err != nil || string(data) != expected {
+			t.Errorf("%s: expected: %q, got: %q, %v", path, expected, data, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(stage, "/bin/sh")); err != nil || target != "busybox" {
+		t.Errorf("unexpected symlink: %q, %v", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(stage, "/etc/secret")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected secret: %v, %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(stage, "/tmp")); err != nil || info.Mode()&os.ModeSticky == 0 {
+		t.Errorf("unexpected /tmp: %v, %v", info, err)
+	}
+	a1, err1 := os.Stat(filepath.Join(stage, busybox))
+	a2, err2 := os.Stat(filepath.Join(stage, link))
+	if err1 != nil || err2 != nil || !os.SameFile(a1, a2) {
+		t.Errorf("expected hardlinks: %v, %v", err1, err2)
+	}
+	manifest, err := os.ReadFile(filepath.Join(stage, "/etc/manifest.sha256"))
+	if err != nil || !strings.Contains(string(manifest), busybox) || strings.Contains(string(manifest), "secret") {
+		t.Errorf("unexpected manifest: %q, %v", manifest, err)
+	}
+
+	// the archive is written from the staged files (their size can't
+	// change, like files added with AddFile)
+	if err := os.WriteFile(filepath.Join(stage, "/etc/hooks"), []byte("hookz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries := readArchive(t, out)
+	if entries["etc/hooks"] != "hookz\n" || entries["etc/secret"] != "secret" {
+		t.Errorf("unexpected archive: %q", entries)
+	}
+	if entries[strings.TrimPrefix(busybox, "/")]+entries[strings.TrimPrefix(link, "/")] != "busybox" {
+		t.Errorf("expected the data of the hardlinks once, got: %q", entries)
+	}
+	sum, err := digest.SHA256.Reader(strings.NewReader("hookz\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(entries["etc/manifest.sha256"], sum+"  /etc/hooks\n") {
+		t.Errorf("expected the checksum of the staged file in the manifest, got: %q", entries["etc/manifest.sha256"])
+	}
+
+	if err := a.Stage(stage); !os.IsExist(err) {
+		t.Errorf("expected error for existing dir, got: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cavaliercoder/go-cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/cpioread"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+	"golang.org/x/sys/unix"
+)
+
+// Writes the entries as a tar archive instead, for FormatTar. It takes the
+// same headers as writer, so the archive is written the same way in both
+// formats.
+type tarWriter struct {
+	tw *tar.Writer
+	// name of the first entry written with each inode, for hardlinks
+	names map[int64]string
+	inode int64
+	// data of the current entry that isn't written to the tar archive,
+	// e.g. the target of symlinks
+	skip int64
+}
+
+func newTarWriter(w io.Writer) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w), names: make(map[int64]string)}
+}
+
+func (w *tarWriter) WriteHeader(hdr *cpio.Header) error {
+	// the inodes are only used for finding hardlinks, but are set like
+	// writer does, since they're read back after the header is written
+	w.inode++
+	if hdr.Inode == 0 {
+		hdr.Inode = w.inode
+	}
+	if hdr.Links < 1 {
+		hdr.Links = 1
+	}
+
+	th := &tar.Header{
+		Name:    hdr.Name,
+		Mode:    int64(hdr.Mode &^ cpio.ModeType),
+		Uid:     hdr.UID,
+		Gid:     hdr.GID,
+		Size:    hdr.Size,
+		ModTime: hdr.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	if th.ModTime.IsZero() {
+		th.ModTime = time.Unix(0, 0)
+	}
+	w.skip = 0
+
+	switch hdr.Mode & cpio.ModeType {
+	case 0, cpio.ModeRegular:
+		th.Typeflag = tar.TypeReg
+		if name, ok := w.names[hdr.Inode]; ok {
+			th.Typeflag = tar.TypeLink
+			th.Linkname = name
+			th.Size = 0
+		} else if hdr.Links > 1 {
+			w.names[hdr.Inode] = hdr.Name
+		}
+	case cpio.ModeDir:
+		th.Typeflag = tar.TypeDir
+		th.Name += "/"
+	case cpio.ModeSymlink:
+		th.Typeflag = tar.TypeSymlink
+		th.Linkname = hdr.Linkname
+		th.Size = 0
+		w.skip = hdr.Size
+	case cpio.ModeCharDevice, cpio.ModeDevice:
+		th.Typeflag = tar.TypeChar
+		if hdr.Mode&cpio.ModeType == cpio.ModeDevice {
+			th.Typeflag = tar.TypeBlock
+		}
+		dev := uint64(hdr.DeviceID)
+		th.Devmajor = int64(unix.Major(dev))
+		th.Devminor = int64(unix.Minor(dev))
+	case cpio.ModeNamedPipe:
+		th.Typeflag = tar.TypeFifo
+	default:
+		return i18n.Errorf(i18n.ArchiveTarUnsupportedType, hdr.Name)
+	}
+
+	return w.tw.WriteHeader(th)
+}
+
+func (w *tarWriter) Write(p []byte) (int, error) {
+	if w.skip > 0 {
+		n := int64(len(p))
+		if n > w.skip {
+			n = w.skip
+		}
+		w.skip -= n
+		if n == int64(len(p)) {
+			return len(p), nil
+		}
+		written, err := w.tw.Write(p[n:])
+		return int(n) + written, err
+	}
+	return w.tw.Write(p)
+}
+
+// Close writes the end of the archive, but doesn't close the underlying
+// writer
+func (w *tarWriter) Close() error {
+	return w.tw.Close()
+}
+
+// Check that the tar archive at the given path is intact, the tar equivalent
+// of Verify
+func verifyTar(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	rc, _, err := cpioread.NextSegment(bufio.NewReader(fd))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
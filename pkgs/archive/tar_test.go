@@ -0,0 +1,104 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/pgzip"
+)
+
+func TestFormatTar(t *testing.T) {
+	dir := t.TempDir()
+	busybox := filepath.Join(dir, "busybox")
+	if err := os.WriteFile(busybox, []byte("busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "ls")
+	if err := os.Link(busybox, link); err != nil {
+		t.Fatal(err)
+	}
+	sh := filepath.Join(dir, "sh")
+	if err := os.Symlink("busybox", sh); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewWithFormat(FormatTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Files[busybox] = false
+	a.Files[link] = false
+	if err := a.AddFile(sh, sh); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDevNode("/dev/console", CharDevice, 5, 1, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "initramfs.tar.gz")
+	if err := a.Write(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	gz, err := pgzip.NewReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			entries[hdr.Name] = "file " + string(data)
+		case tar.TypeLink:
+			entries[hdr.Name] = "link " + hdr.Linkname
+		case tar.TypeSymlink:
+			entries[hdr.Name] = "symlink " + hdr.Linkname
+		case tar.TypeChar:
+			if hdr.Devmajor == 5 && hdr.Devminor == 1 && hdr.Mode == 0600 {
+				entries[hdr.Name] = "char"
+			}
+		case tar.TypeDir:
+		default:
+			t.Errorf("unexpected entry: %+v", hdr)
+		}
+	}
+
+	rel := dir[1:]
+	expected := map[string]string{
+		rel + "/busybox": "file busybox",
+		rel + "/ls":      "link " + rel + "/busybox",
+		rel + "/sh":      "symlink busybox",
+		"dev/console":    "char",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected: %q, got: %q", expected, entries)
+	}
+
+	if _, err := ParseFormat("tar"); err == nil {
+		t.Error("expected tar not to be a cpio format")
+	}
+}
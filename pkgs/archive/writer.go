@@ -0,0 +1,271 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cavaliercoder/go-cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+	"golang.org/x/sys/unix"
+)
+
+// Format is the archive format to write
+type Format int
+
+const (
+	// SVR4 "new ascii" format, without checksums (070701)
+	FormatNewc Format = iota
+	// SVR4 "new ascii" format, with checksums (070702)
+	FormatCrc
+	// POSIX.1 portable "old character" format (070707)
+	FormatOdc
+	// POSIX.1-2001 (pax) tar, with the same entries as the cpio formats.
+	// The kernel can't unpack it, it's for inspecting the archive with
+	// common tools, e.g. for comparing builds in CI. Not a cpio format, so
+	// it's not accepted by ParseFormat.
+	FormatTar
+)
+
+var formatNames = map[string]Format{
+	"newc": FormatNewc,
+	"crc":  FormatCrc,
+	"odc":  FormatOdc,
+}
+
+func (f Format) String() string {
+	if f == FormatTar {
+		return "tar"
+	}
+	for name, format := range formatNames {
+		if format == f {
+			return name
+		}
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Get the Format with the given name, one of: newc, crc, odc
+func ParseFormat(name string) (Format, error) {
+	f, ok := formatNames[name]
+	if !ok {
+		return f, i18n.Errorf(i18n.ArchiveUnknownFormat, name)
+	}
+	return f, nil
+}
+
+const (
+	odcMaxField6  = 0777777
+	odcMaxField11 = 077777777777
+	trailerName   = "TRAILER!!!"
+)
+
+var errWriteTooLong = i18n.NewError(i18n.ArchiveWriteTooLong)
+
+// Writes the entries of an archive, in one of the formats
+type entryWriter interface {
+	// Start writing an entry, the inode is set if it isn't
+	WriteHeader(hdr *cpio.Header) error
+	io.Writer
+	io.Closer
+}
+
+// writer writes cpio archives in any of the supported formats. It works like
+// cpio.Writer, which only supports writing the newc format.
+type writer struct {
+	w      io.Writer
+	format Format
+	nb     int64 // number of unwritten bytes for current file entry
+	pad    int64 // amount of padding to write after current file entry
+	inode  int64
+	closed bool
+}
+
+func newWriter(w io.Writer, format Format) *writer {
+	return &writer{w: w, format: format}
+}
+
+// Finish writing the current entry
+func (w *writer) flush() error {
+	if w.nb > 0 {
+		return i18n.Errorf(i18n.ArchiveMissedWriting, w.nb)
+	}
+	if _, err := w.w.Write(make([]byte, w.pad)); err != nil {
+		return err
+	}
+	w.pad = 0
+	return nil
+}
+
+func (w *writer) WriteHeader(hdr *cpio.Header) error {
+	if w.closed {
+		return cpio.ErrWriteAfterClose
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	if hdr.Name != trailerName {
+		// ensure all inodes are unique
+		w.inode++
+		if hdr.Inode == 0 {
+			hdr.Inode = w.inode
+		}
+		if hdr.Mode&cpio.ModeType == 0 {
+			hdr.Mode |= cpio.ModeRegular
+		}
+		if hdr.Links < 1 {
+			hdr.Links = 1
+		}
+	}
+
+	var err error
+	switch w.format {
+	case FormatNewc, FormatCrc:
+		err = w.writeNewcHeader(hdr)
+	case FormatOdc:
+		err = w.writeOdcHeader(hdr)
+	default:
+		err = i18n.Errorf(i18n.ArchiveUnsupportedFormat, w.format)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.nb = hdr.Size
+	return nil
+}
+
+func (w *writer) writeNewcHeader(hdr *cpio.Header) error {
+	magic := "070701"
+	var checksum int64
+	if w.format == FormatCrc {
+		magic = "070702"
+		checksum = int64(hdr.Checksum)
+	}
+	var mtime int64
+	if !hdr.ModTime.IsZero() {
+		mtime = hdr.ModTime.Unix()
+	}
+	rdevMajor, rdevMinor := rdev(hdr)
+
+	s := fmt.Sprintf("%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+		magic,
+		hdr.Inode,
+		int64(hdr.Mode),
+		hdr.UID,
+		hdr.GID,
+		hdr.Links,
+		mtime,
+		hdr.Size,
+		0, 0, // dev major/minor
+		rdevMajor, rdevMinor,
+		len(hdr.Name)+1,
+		checksum,
+		hdr.Name)
+	// header + name, and file data, are padded to a multiple of 4 bytes
+	s += string(make([]byte, (4-len(s)%4)%4))
+	if _, err := io.WriteString(w.w, s); err != nil {
+		return err
+	}
+	w.pad = (4 - hdr.Size%4) % 4
+
+	return nil
+}
+
+func (w *writer) writeOdcHeader(hdr *cpio.Header) error {
+	var mtime int64
+	if !hdr.ModTime.IsZero() {
+		mtime = hdr.ModTime.Unix()
+	}
+	if hdr.Size > odcMaxField11 {
+		return i18n.Errorf(i18n.ArchiveOdcFileTooLarge, hdr.Name)
+	}
+	// odc only has 6 octal digits for the inode, so wrap around
+	ino := hdr.Inode % (odcMaxField6 + 1)
+	// ... and uses the old 8-bit major/minor encoding for rdev
+	rdevMajor, rdevMinor := rdev(hdr)
+	if rdevMajor > 0xff || rdevMinor > 0xff {
+		return i18n.Errorf(i18n.ArchiveOdcDeviceTooLarge, hdr.Name)
+	}
+
+	s := fmt.Sprintf("070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o%s\x00",
+		0, // dev
+		ino,
+		int64(hdr.Mode),
+		hdr.UID,
+		hdr.GID,
+		hdr.Links,
+		rdevMajor<<8|rdevMinor,
+		mtime,
+		len(hdr.Name)+1,
+		hdr.Size,
+		hdr.Name)
+	if _, err := io.WriteString(w.w, s); err != nil {
+		return err
+	}
+	w.pad = 0
+
+	return nil
+}
+
+// Returns the major and minor device numbers for device entries. For these,
+// hdr.DeviceID is the device number of the device itself (as returned by
+// unix.Mkdev), since cpio.Header has no separate field for it.
+func rdev(hdr *cpio.Header) (uint32, uint32) {
+	switch hdr.Mode & cpio.ModeType {
+	case cpio.ModeCharDevice, cpio.ModeDevice:
+		dev := uint64(hdr.DeviceID)
+		return unix.Major(dev), unix.Minor(dev)
+	}
+	return 0, 0
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, cpio.ErrWriteAfterClose
+	}
+	tooLong := false
+	if int64(len(p)) > w.nb {
+		p = p[:w.nb]
+		tooLong = true
+	}
+	n, err := w.w.Write(p)
+	w.nb -= int64(n)
+	if err == nil && tooLong {
+		err = errWriteTooLong
+	}
+	return n, err
+}
+
+// Write the trailer and any remaining padding
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if err := w.WriteHeader(&cpio.Header{Name: trailerName, Links: 1}); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.closed = true
+	return nil
+}
+
+// Calculate the checksum used in FormatCrc entries for the given data
+func checksum(data []byte) cpio.Checksum {
+	h := cpio.NewHash()
+	h.Write(data)
+	return cpio.Checksum(h.Sum32())
+}
+
+func checksumReader(r io.Reader) (cpio.Checksum, error) {
+	h := cpio.NewHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return 0, err
+	}
+	return cpio.Checksum(h.Sum32()), nil
+}
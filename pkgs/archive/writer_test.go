@@ -0,0 +1,101 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cavaliercoder/go-cpio"
+)
+
+func TestParseFormat(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected Format
+		err      bool
+	}{
+		{"newc", FormatNewc, false},
+		{"crc", FormatCrc, false},
+		{"odc", FormatOdc, false},
+		{"tar", FormatNewc, true},
+	}
+	for _, table := range tables {
+		out, err := ParseFormat(table.in)
+		if table.err != (err != nil) {
+			t.Errorf("unexpected error result for %q: %v", table.in, err)
+		}
+		if out != table.expected {
+			t.Errorf("expected: %s, got: %s", table.expected, out)
+		}
+	}
+}
+
+func writeTestArchive(t *testing.T, format Format) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := newWriter(&buf, format)
+	data := []byte("hello")
+	hdr := &cpio.Header{Name: "foo", Mode: 0644, Size: int64(len(data)), Checksum: 0x1f4}
+	if err := w.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriterNewc(t *testing.T) {
+	for _, format := range []Format{FormatNewc, FormatCrc} {
+		out := writeTestArchive(t, format)
+		if len(out)%4 != 0 {
+			t.Errorf("%s: archive not padded to 4 bytes", format)
+		}
+
+		r := cpio.NewReader(bytes.NewReader(out))
+		hdr, err := r.Next()
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		if hdr.Name != "foo" || string(data) != "hello" || !hdr.Mode.IsRegular() {
+			t.Errorf("%s: unexpected entry: %q, %q, %s", format, hdr.Name, data, hdr.Mode)
+		}
+		if format == FormatCrc && hdr.Checksum != 0x1f4 {
+			t.Errorf("%s: unexpected checksum: %s", format, hdr.Checksum)
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("%s: expected EOF after last entry, got: %v", format, err)
+		}
+	}
+}
+
+func TestWriterOdc(t *testing.T) {
+	out := writeTestArchive(t, FormatOdc)
+	expected := "070707" + "000000" + "000001" + "100644" + "000000" + "000000" +
+		"000001" + "000000" + "00000000000" + "000004" + "00000000005" + "foo\x00" + "hello"
+	if !bytes.HasPrefix(out, []byte(expected)) {
+		t.Errorf("expected odc entry: %q, got: %q", expected, out[:len(expected)])
+	}
+	if !bytes.Contains(out, []byte("TRAILER!!!\x00")) {
+		t.Error("trailer not found")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// sum of all bytes: 'h' + 'e' + 'l' + 'l' + 'o'
+	if sum := checksum([]byte("hello")); sum != 0x214 {
+		t.Errorf("expected checksum 0x214, got: %s", sum)
+	}
+	sum, err := checksumReader(bytes.NewReader([]byte("hello")))
+	if err != nil || sum != 0x214 {
+		t.Errorf("expected checksum 0x214, got: %s (%v)", sum, err)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Extended attribute that file capabilities are stored in
+const capabilityXattr = "security.capability"
+
+// Check if the file has file capabilities set. The cpio formats the kernel
+// extracts initramfs archives from have no way to store extended attributes,
+// so these are lost when the file is archived.
+func hasCapabilities(file string) bool {
+	// only the size is needed, errors (e.g. ENODATA, or ENOTSUP on
+	// filesystems without xattrs) mean there are none
+	size, err := unix.Lgetxattr(file, capabilityXattr, nil)
+	return err == nil && size > 0
+}
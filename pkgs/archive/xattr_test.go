@@ -0,0 +1,39 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestHasCapabilities(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ping")
+	if err := os.WriteFile(file, []byte("ping"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if hasCapabilities(file) {
+		t.Error("expected no capabilities")
+	}
+
+	// vfs_cap_data revision 2 with cap_net_raw (13) permitted
+	caps := []byte{
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	if err := unix.Setxattr(file, capabilityXattr, caps, 0); err != nil {
+		t.Skip("unable to set file capabilities: ", err)
+	}
+	if !hasCapabilities(file) {
+		t.Error("expected capabilities")
+	}
+
+	if hasCapabilities(filepath.Join(t.TempDir(), "missing")) {
+		t.Error("expected no capabilities for missing file")
+	}
+}
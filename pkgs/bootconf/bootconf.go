@@ -0,0 +1,62 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bootconf
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+)
+
+// Paths of the generated configs, relative to the boot partition, where
+// U-Boot's distro boot (and Tow-Boot) and GRUB look for them
+const (
+	ExtlinuxPath = "extlinux/extlinux.conf"
+	GrubPath     = "grub/postmarketos.cfg"
+)
+
+// The kernel is installed with this name by boot-deploy
+const kernelName = "vmlinuz"
+
+const header = "# Generated by postmarketos-mkinitfs, do not edit!\n"
+
+// Generate an extlinux.conf for booting the kernel with the given initramfs
+// (e.g. "initramfs") from the boot partition.
+func Extlinux(devinfo deviceinfo.DeviceInfo, initfs string) string {
+	var s strings.Builder
+	s.WriteString(header)
+	fmt.Fprintf(&s, "default postmarketos\n")
+	fmt.Fprintf(&s, "menu title postmarketOS\n\n")
+	fmt.Fprintf(&s, "label postmarketos\n")
+	fmt.Fprintf(&s, "\tkernel /%s\n", kernelName)
+	fmt.Fprintf(&s, "\tinitrd /%s\n", initfs)
+	if dtbs := strings.Fields(devinfo.Dtb); len(dtbs) > 0 {
+		fmt.Fprintf(&s, "\tfdt /%s.dtb\n", filepath.Base(dtbs[0]))
+	}
+	if cmdline := strings.TrimSpace(devinfo.KernelCmdline); cmdline != "" {
+		fmt.Fprintf(&s, "\tappend %s\n", cmdline)
+	}
+
+	return s.String()
+}
+
+// Generate a GRUB config snippet with a menu entry for booting the kernel
+// with the given initramfs, for including from grub.cfg (e.g. with
+// "source /grub/postmarketos.cfg") or a /etc/grub.d script.
+func Grub(devinfo deviceinfo.DeviceInfo, initfs string) string {
+	var s strings.Builder
+	s.WriteString(header)
+	fmt.Fprintf(&s, "menuentry 'postmarketOS' {\n")
+	fmt.Fprintf(&s, "\tsearch --no-floppy --set=root --file /%s\n", initfs)
+	fmt.Fprintf(&s, "\tlinux /%s %s\n", kernelName, strings.TrimSpace(devinfo.KernelCmdline))
+	fmt.Fprintf(&s, "\tinitrd /%s\n", initfs)
+	if dtbs := strings.Fields(devinfo.Dtb); len(dtbs) > 0 {
+		fmt.Fprintf(&s, "\tdevicetree /%s.dtb\n", filepath.Base(dtbs[0]))
+	}
+	fmt.Fprintf(&s, "}\n")
+
+	return s.String()
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bootconf
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+)
+
+func TestExtlinux(t *testing.T) {
+	devinfo := deviceinfo.DeviceInfo{
+		Dtb:           "allwinner/sun50i-a64-pinephone-1.2",
+		KernelCmdline: " console=ttyS0,115200 PMOS_NO_OUTPUT_REDIRECT ",
+	}
+	expected := header + `default postmarketos
+menu title postmarketOS
+
+label postmarketos
+	kernel /vmlinuz
+	initrd /initramfs-6.1.0-postmarketos-allwinner
+	fdt /sun50i-a64-pinephone-1.2.dtb
+	append console=ttyS0,115200 PMOS_NO_OUTPUT_REDIRECT
+`
+	if out := Extlinux(devinfo, "initramfs-6.1.0-postmarketos-allwinner"); out != expected {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+
+	out := Extlinux(deviceinfo.DeviceInfo{}, "initramfs")
+	if strings.Contains(out, "fdt") || strings.Contains(out, "append") {
+		t.Errorf("expected no fdt or append without dtb and cmdline: %q", out)
+	}
+}
+
+func TestGrub(t *testing.T) {
+	devinfo := deviceinfo.DeviceInfo{KernelCmdline: "quiet"}
+	expected := header + `menuentry 'postmarketOS' {
+	search --no-floppy --set=root --file /initramfs
+	linux /vmlinuz quiet
+	initrd /initramfs
+}
+`
+	if out := Grub(devinfo, "initramfs"); out != expected {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+
+	devinfo.Dtb = "qcom/sc8280xp-lenovo-thinkpad-x13s"
+	if out := Grub(devinfo, "initramfs"); !strings.Contains(out, "\tdevicetree /sc8280xp-lenovo-thinkpad-x13s.dtb\n") {
+		t.Errorf("expected devicetree in: %q", out)
+	}
+}
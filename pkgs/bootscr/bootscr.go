@@ -0,0 +1,109 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bootscr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Values used in the legacy U-Boot image header, see include/image.h in the
+// U-Boot source
+const (
+	imageMagic      = 0x27051956
+	imageHeaderSize = 64
+	imageNameLen    = 32
+	osLinux         = 5
+	typeScript      = 6
+	compNone        = 0
+)
+
+var ubootArch = map[string]uint8{
+	"armhf":   2,
+	"armv7":   2,
+	"aarch64": 22,
+	"x86":     3,
+	"x86_64":  24,
+	"riscv64": 26,
+}
+
+// Generate a U-Boot boot.cmd script from the given deviceinfo. The script
+// loads artifacts with the default names used by boot-deploy from the
+// partition U-Boot's distro boot found the script on.
+func Generate(devinfo deviceinfo.DeviceInfo) (string, error) {
+	var bootCmd string
+	switch devinfo.Arch {
+	case "aarch64", "riscv64":
+		bootCmd = "booti"
+	case "armhf", "armv7":
+		bootCmd = "bootz"
+	default:
+		return "", i18n.Errorf(i18n.BootscrUnsupportedArch, devinfo.Arch)
+	}
+
+	fdtFile := "${fdtfile}"
+	if dtbs := strings.Fields(devinfo.Dtb); len(dtbs) > 0 {
+		fdtFile = filepath.Base(dtbs[0]) + ".dtb"
+	}
+
+	load := "load ${devtype} ${devnum}:${distro_bootpart}"
+
+	var s strings.Builder
+	fmt.Fprintf(&s, "# Generated by postmarketos-mkinitfs, do not edit!\n")
+	fmt.Fprintf(&s, "setenv bootargs %s\n", strings.TrimSpace(devinfo.KernelCmdline))
+	fmt.Fprintf(&s, "echo Loading DTB\n")
+	fmt.Fprintf(&s, "%s ${fdt_addr_r} %s\n", load, fdtFile)
+	fmt.Fprintf(&s, "echo Loading kernel\n")
+	fmt.Fprintf(&s, "%s ${kernel_addr_r} vmlinuz\n", load)
+	// initramfs must be loaded last, since ${filesize} is used when booting
+	fmt.Fprintf(&s, "echo Loading initramfs\n")
+	fmt.Fprintf(&s, "%s ${ramdisk_addr_r} initramfs\n", load)
+	fmt.Fprintf(&s, "echo Booting kernel\n")
+	fmt.Fprintf(&s, "%s ${kernel_addr_r} ${ramdisk_addr_r}:${filesize} ${fdt_addr_r}\n", bootCmd)
+
+	return s.String(), nil
+}
+
+// Wrap a boot script in a legacy U-Boot image header, producing the same
+// output as 'mkimage -A <arch> -O linux -T script -C none -n <name>'
+func Wrap(script []byte, name string, arch string, timestamp time.Time) ([]byte, error) {
+	archID, ok := ubootArch[arch]
+	if !ok {
+		return nil, i18n.Errorf(i18n.BootscrUnsupportedImageArch, arch)
+	}
+
+	// Script images use the "multi" image layout: a zero-terminated list
+	// of image sizes followed by the image(s)
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.BigEndian, uint32(len(script)))
+	binary.Write(data, binary.BigEndian, uint32(0))
+	data.Write(script)
+
+	hdr := make([]byte, imageHeaderSize)
+	binary.BigEndian.PutUint32(hdr[0:4], imageMagic)
+	// hdr[4:8] is the header crc, calculated last
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(timestamp.Unix()))
+	binary.BigEndian.PutUint32(hdr[12:16], uint32(data.Len()))
+	// hdr[16:24] are the load + entry addresses, unused for scripts
+	binary.BigEndian.PutUint32(hdr[24:28], crc32.ChecksumIEEE(data.Bytes()))
+	hdr[28] = osLinux
+	hdr[29] = archID
+	hdr[30] = typeScript
+	hdr[31] = compNone
+	if len(name) > imageNameLen {
+		name = name[:imageNameLen]
+	}
+	copy(hdr[32:], name)
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(hdr))
+
+	return append(hdr, data.Bytes()...), nil
+}
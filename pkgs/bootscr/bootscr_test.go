@@ -0,0 +1,99 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bootscr
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+)
+
+func TestGenerate(t *testing.T) {
+	tables := []struct {
+		arch     string
+		dtb      string
+		expected []string
+	}{
+		{"aarch64", "allwinner/sun50i-a64-pinephone-1.2", []string{
+			"booti ${kernel_addr_r}",
+			"${fdt_addr_r} sun50i-a64-pinephone-1.2.dtb",
+		}},
+		{"armv7", "", []string{
+			"bootz ${kernel_addr_r}",
+			"${fdt_addr_r} ${fdtfile}",
+		}},
+	}
+	for _, table := range tables {
+		devinfo := deviceinfo.DeviceInfo{
+			Arch:          table.arch,
+			Dtb:           table.dtb,
+			KernelCmdline: "console=ttyS0,115200 PMOS_NO_OUTPUT_REDIRECT",
+		}
+		out, err := Generate(devinfo)
+		if err != nil {
+			t.Errorf("unexpected error for arch %q: %s", table.arch, err)
+		}
+		if !strings.Contains(out, "setenv bootargs console=ttyS0,115200 PMOS_NO_OUTPUT_REDIRECT\n") {
+			t.Errorf("bootargs missing from script: %q", out)
+		}
+		for _, e := range table.expected {
+			if !strings.Contains(out, e) {
+				t.Errorf("expected %q in script: %q", e, out)
+			}
+		}
+	}
+
+	if _, err := Generate(deviceinfo.DeviceInfo{Arch: "ppc64le"}); err == nil {
+		t.Error("expected error for unsupported arch")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	script := []byte("echo hello\n")
+	img, err := Wrap(script, "test", "aarch64", time.Unix(1234, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(img) != imageHeaderSize+8+len(script) {
+		t.Fatalf("unexpected image size: %d", len(img))
+	}
+	if binary.BigEndian.Uint32(img[0:4]) != imageMagic {
+		t.Error("bad magic")
+	}
+	if binary.BigEndian.Uint32(img[8:12]) != 1234 {
+		t.Error("bad timestamp")
+	}
+	if binary.BigEndian.Uint32(img[12:16]) != uint32(8+len(script)) {
+		t.Error("bad data size")
+	}
+
+	data := img[imageHeaderSize:]
+	if binary.BigEndian.Uint32(img[24:28]) != crc32.ChecksumIEEE(data) {
+		t.Error("bad data crc")
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != uint32(len(script)) {
+		t.Error("bad script length")
+	}
+
+	hdr := make([]byte, imageHeaderSize)
+	copy(hdr, img)
+	hcrc := binary.BigEndian.Uint32(hdr[4:8])
+	binary.BigEndian.PutUint32(hdr[4:8], 0)
+	if hcrc != crc32.ChecksumIEEE(hdr) {
+		t.Error("bad header crc")
+	}
+
+	if img[29] != 22 || img[30] != typeScript {
+		t.Errorf("bad arch/type: %d/%d", img[29], img[30])
+	}
+
+	if _, err := Wrap(script, "test", "mips", time.Now()); err == nil {
+		t.Error("expected error for unsupported arch")
+	}
+}
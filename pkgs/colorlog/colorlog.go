@@ -0,0 +1,75 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package colorlog
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	reset  = "\x1b[0m"
+	bold   = "\x1b[1m"
+	red    = "\x1b[31m"
+	yellow = "\x1b[33m"
+)
+
+var (
+	// stage headers, e.g. "== Generating initramfs =="
+	headerRe  = regexp.MustCompile(`(^|\s)== .* ==$`)
+	warningRe = regexp.MustCompile(`(^|\s)WARNING: `)
+	errorRe   = regexp.MustCompile(`(^|\s)ERROR: `)
+)
+
+// Writer colors log lines written to it, for use with log.SetOutput. Stage
+// headers are bold, warnings are yellow and errors are red.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	line := bytes.TrimSuffix(p, []byte("\n"))
+	var color string
+	switch {
+	case errorRe.Match(line):
+		color = red
+	case warningRe.Match(line):
+		color = yellow
+	case headerRe.Match(line):
+		color = bold
+	default:
+		return w.w.Write(p)
+	}
+
+	colored := make([]byte, 0, len(p)+len(color)+len(reset))
+	colored = append(colored, color...)
+	colored = append(colored, line...)
+	colored = append(colored, reset...)
+	colored = append(colored, p[len(line):]...)
+	if _, err := w.w.Write(colored); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Returns true if output to the file should be colored: it is a terminal, and
+// colors aren't disabled with NO_COLOR (https://no-color.org) or TERM=dumb
+func Enabled(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package colorlog
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected string
+	}{
+		{"== Generating initramfs ==", "\x1b[1m2021/01/01 == Generating initramfs ==\x1b[0m\n"},
+		{"WARNING: something", "\x1b[33m2021/01/01 WARNING: something\x1b[0m\n"},
+		{"ERROR: generateInitfs: it broke", "\x1b[31m2021/01/01 ERROR: generateInitfs: it broke\x1b[0m\n"},
+		{"- Including kernel modules", "2021/01/01 - Including kernel modules\n"},
+		{"- file with WARNING", "2021/01/01 - file with WARNING\n"},
+	}
+	for _, table := range tables {
+		var buf bytes.Buffer
+		logger := log.New(NewWriter(&buf), "2021/01/01 ", 0)
+		logger.Print(table.in)
+		if buf.String() != table.expected {
+			t.Errorf("expected: %q, got: %q", table.expected, buf.String())
+		}
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if Enabled(f) {
+		t.Errorf("expected colors to be disabled for a regular file")
+	}
+}
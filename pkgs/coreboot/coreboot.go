@@ -0,0 +1,38 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package coreboot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// CheckArch returns an error if coreboot's Linux payload doesn't support the
+// given deviceinfo_arch. The payload is a bzImage, so it only exists on x86,
+// ARM coreboot boards load FIT images (see pkgs/fit) instead.
+func CheckArch(arch string) error {
+	switch arch {
+	case "x86", "x86_64":
+		return nil
+	}
+	return i18n.Errorf(i18n.CorebootUnsupportedArch, arch)
+}
+
+// Config generates a coreboot config fragment that makes the kernel,
+// initramfs and cmdline the Linux payload of the ROM, for appending to the
+// .config of the board before building coreboot. Heads builds its ROMs the
+// same way, and boots the system from the GRUB config (see pkgs/bootconf)
+// afterwards.
+func Config(kernel string, initramfs string, cmdline string) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "# Generated by postmarketos-mkinitfs, do not edit!\n")
+	fmt.Fprintf(&s, "CONFIG_PAYLOAD_LINUX=y\n")
+	fmt.Fprintf(&s, "CONFIG_PAYLOAD_FILE=%s\n", strconv.Quote(kernel))
+	fmt.Fprintf(&s, "CONFIG_LINUX_INITRD=%s\n", strconv.Quote(initramfs))
+	fmt.Fprintf(&s, "CONFIG_LINUX_COMMAND_LINE=%s\n", strconv.Quote(strings.TrimSpace(cmdline)))
+	return s.String()
+}
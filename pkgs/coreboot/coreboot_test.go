@@ -0,0 +1,32 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package coreboot
+
+import (
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	out := Config("/boot/vmlinuz-lts", "/boot/initramfs", " console=tty0 quiet \"splash\"\n")
+	expected := `# Generated by postmarketos-mkinitfs, do not edit!
+CONFIG_PAYLOAD_LINUX=y
+CONFIG_PAYLOAD_FILE="/boot/vmlinuz-lts"
+CONFIG_LINUX_INITRD="/boot/initramfs"
+CONFIG_LINUX_COMMAND_LINE="console=tty0 quiet \"splash\""
+`
+	if out != expected {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+func TestCheckArch(t *testing.T) {
+	for _, arch := range []string{"x86", "x86_64"} {
+		if err := CheckArch(arch); err != nil {
+			t.Errorf("unexpected error for %q: %s", arch, err)
+		}
+	}
+	if err := CheckArch("aarch64"); err == nil {
+		t.Error("expected error for aarch64")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cpioread
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cavaliercoder/go-cpio"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// ErrUnsupportedCompression is returned for archives compressed with an
+// algorithm that can't be decompressed
+var ErrUnsupportedCompression = i18n.NewError(i18n.CpioreadUnsupportedCompression)
+
+// Magic bytes of compression formats that aren't supported, to report what
+// the archive is compressed with instead of failing to read it as a cpio
+var unsupportedMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"bzip2", []byte("BZh")},
+	{"lzo", []byte{0x89, 'L', 'Z', 'O'}},
+	{"lzma", []byte{0x5d, 0x00, 0x00}},
+}
+
+// Reader iterates over the entries of an archive
+type Reader struct {
+	cr *cpio.Reader
+	// the archive, for reading the segment after an uncompressed one
+	br         *bufio.Reader
+	compressed bool
+	// closes the decompressor, and the file for readers from Open
+	closers []io.Closer
+}
+
+// Open the archive at the given path, see New
+func Open(path string) (*Reader, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := New(fd)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.closers = append(r.closers, fd)
+
+	return r, nil
+}
+
+// New returns a reader for the archive read from r. It may be gzip, zstd or
+// lz4 compressed, or uncompressed. Only the newc and crc cpio formats can be
+// read. The archive may be made of several concatenated segments, like the
+// kernel accepts (see NextSegment), their entries are read in order.
+func New(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	dr, compressed, err := decompress(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{cr: cpio.NewReader(dr), br: br, compressed: compressed, closers: []io.Closer{dr}}, nil
+}
+
+// Next returns the header of the next entry, and a reader for its data that
+// is valid until the following call to Next. At the end of the archive, the
+// error is io.EOF.
+func (r *Reader) Next() (*cpio.Header, io.Reader, error) {
+	for {
+		hdr, err := r.cr.Next()
+		if err != io.EOF || r.compressed {
+			if err != nil {
+				return nil, nil, err
+			}
+			return hdr, r.cr, nil
+		}
+
+		// end of an uncompressed segment, there may be another one
+		dr, compressed, err := NextSegment(r.br)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.cr = cpio.NewReader(dr)
+		r.compressed = compressed
+		r.closers = append(r.closers, dr)
+	}
+}
+
+// Walk calls fn for every entry of the archive, stopping at the first error
+func (r *Reader) Walk(fn func(hdr *cpio.Header, data io.Reader) error) error {
+	for {
+		hdr, data, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, data); err != nil {
+			return err
+		}
+	}
+}
+
+// Close the decompressor, and the file for readers returned by Open
+func (r *Reader) Close() error {
+	var first error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Decompress returns a reader decompressing r, the compression is detected
+// from the magic bytes at the start. Uncompressed data is read as is.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	dr, _, err := decompress(bufio.NewReader(r))
+	return dr, err
+}
+
+// NextSegment returns a reader for the next segment of an archive made of
+// concatenated cpio archives, e.g. an uncompressed one with early microcode
+// followed by the compressed initramfs. The zero padding before the segment is
+// skipped, at the end of the archive the error is io.EOF. Unlike uncompressed
+// segments, compressed ones last until the end of the archive, so br can only
+// be read further after an uncompressed segment.
+func NextSegment(br *bufio.Reader) (r io.ReadCloser, compressed bool, err error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, false, err
+		}
+		if b[0] != 0 {
+			break
+		}
+		br.Discard(1)
+	}
+	return decompress(br)
+}
+
+// Returns a reader decompressing br, and whether it's compressed
+func decompress(br *bufio.Reader) (io.ReadCloser, bool, error) {
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := pgzip.NewReader(br)
+		if err != nil {
+			return nil, true, err
+		}
+		return zr, true, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, true, err
+		}
+		return zr.IOReadCloser(), true, nil
+	case bytes.HasPrefix(magic, []byte{0x02, 0x21, 0x4c, 0x18}), bytes.HasPrefix(magic, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return newLz4Reader(br), true, nil
+	}
+	for _, u := range unsupportedMagics {
+		if bytes.HasPrefix(magic, u.magic) {
+			return nil, true, fmt.Errorf("%w: %s", ErrUnsupportedCompression, u.name)
+		}
+	}
+	return ioutil.NopCloser(br), false, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cpioread
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cavaliercoder/go-cpio"
+	"github.com/klauspost/compress/zstd"
+)
+
+func newCpio(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := cpio.NewWriter(&buf)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data := files[name]
+		if err := w.WriteHeader(&cpio.Header{Name: name, Mode: cpio.ModeRegular | 0755, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Encode data as a single lz4 block of only literals
+func lz4Literals(data []byte) []byte {
+	block := []byte{0xf0}
+	n := len(data) - 15
+	for ; n >= 255; n -= 255 {
+		block = append(block, 255)
+	}
+	block = append(block, byte(n))
+	return append(block, data...)
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func TestReader(t *testing.T) {
+	files := map[string]string{"bin/sh": "#!/bin/busybox\n", "init": "#!/bin/sh\necho hello\n"}
+	raw := newCpio(t, files)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(raw)
+	gw.Close()
+
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(raw)
+	zw.Close()
+
+	block := lz4Literals(raw)
+	lz4Legacy := append(le32(lz4LegacyMagic), le32(uint32(len(block)))...)
+	lz4Legacy = append(lz4Legacy, block...)
+	// frame with independent blocks, no checksums, and the header checksum
+	lz4Frame := append(le32(lz4FrameMagic), 0x60, 0x70, 0x00)
+	lz4Frame = append(lz4Frame, le32(uint32(len(block)))...)
+	lz4Frame = append(lz4Frame, block...)
+	lz4Frame = append(lz4Frame, le32(0)...)
+
+	tables := []struct {
+		name string
+		data []byte
+	}{
+		{"none", raw},
+		{"gzip", gz.Bytes()},
+		{"zstd", zs.Bytes()},
+		{"lz4 legacy", lz4Legacy},
+		{"lz4 frame", lz4Frame},
+	}
+	for _, table := range tables {
+		r, err := New(bytes.NewReader(table.data))
+		if err != nil {
+			t.Errorf("%s: %s", table.name, err)
+			continue
+		}
+		got := map[string]string{}
+		err = r.Walk(func(hdr *cpio.Header, data io.Reader) error {
+			contents, err := ioutil.ReadAll(data)
+			got[hdr.Name] = string(contents)
+			return err
+		})
+		if err != nil {
+			t.Errorf("%s: %s", table.name, err)
+		}
+		if !reflect.DeepEqual(got, files) {
+			t.Errorf("%s: expected: %q, got: %q", table.name, files, got)
+		}
+		r.Close()
+	}
+
+	if _, err := New(bytes.NewReader([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00})); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("expected unsupported compression error for xz, got: %v", err)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(newCpio(t, map[string]string{"init": "hello"}))
+	gw.Close()
+
+	// uncompressed segment, padding, compressed segment
+	data := newCpio(t, map[string]string{"kernel/x86/microcode/AuthenticAMD.bin": "ucode"})
+	data = append(data, make([]byte, 512)...)
+	data = append(data, gz.Bytes()...)
+
+	r, err := New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	if err := r.Walk(func(hdr *cpio.Header, data io.Reader) error {
+		names = append(names, hdr.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"kernel/x86/microcode/AuthenticAMD.bin", "init"}) {
+		t.Errorf("unexpected entries: %q", names)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "initramfs")
+	if err := os.WriteFile(path, newCpio(t, map[string]string{"init": "hello", "bin/sh": ""}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var names []string
+	for {
+		hdr, _, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"bin/sh", "init"}) {
+		t.Errorf("unexpected entries: %q", names)
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing archive")
+	}
+}
+
+func TestLz4DecodeBlock(t *testing.T) {
+	tables := []struct {
+		history  string
+		block    []byte
+		expected string
+	}{
+		// "abc", then a match of 9 bytes at offset 3 and the last literal
+		{"", []byte{0x35, 'a', 'b', 'c', 0x03, 0x00, 0x10, '!'}, "abcabcabcabc!"},
+		// a match with an extended length, from the history
+		{"xy", []byte{0x0f, 0x02, 0x00, 0x02, 0x10, '!'}, "xyxyxyxyxyxyxyxyxyxyxyx!"},
+	}
+	for _, table := range tables {
+		out, err := lz4DecodeBlock([]byte(table.history), table.block)
+		if err != nil {
+			t.Errorf("%q: %s", table.block, err)
+			continue
+		}
+		if string(out) != table.expected {
+			t.Errorf("%q: expected: %q, got: %q", table.block, table.expected, out)
+		}
+	}
+
+	for _, block := range [][]byte{
+		// literals past the end
+		{0x50, 'a'},
+		// offset before the start of the output
+		{0x10, 'a', 0x02, 0x00},
+		// truncated offset
+		{0x10, 'a', 0x01},
+	} {
+		if _, err := lz4DecodeBlock(nil, block); err == nil {
+			t.Errorf("%q: expected error", block)
+		}
+	}
+}
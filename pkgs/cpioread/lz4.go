@@ -0,0 +1,262 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cpioread
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Magic numbers of the lz4 formats. The kernel's initramfs decompressor only
+// supports the legacy format ('lz4 -l'), lz4 writes the frame format by
+// default.
+const (
+	lz4LegacyMagic       = 0x184c2102
+	lz4FrameMagic        = 0x184d2204
+	lz4SkippableMagic    = 0x184d2a50
+	lz4SkippableMask     = 0xfffffff0
+	lz4LegacyBlockSize   = 8 << 20
+	lz4MaxFrameBlockSize = 4 << 20
+	// matches can reference this much of the previous output
+	lz4WindowSize = 64 << 10
+)
+
+var errLz4Corrupt = i18n.NewError(i18n.CpioreadLz4Corrupt)
+
+// Decompresses a stream of lz4 legacy or frame format data, including
+// concatenated streams. Checksums in the frame format are skipped, not
+// checked.
+type lz4Reader struct {
+	r *bufio.Reader
+	// magic of the current stream, 0 before the first one and at the end of
+	// a frame
+	magic   uint32
+	pending []byte
+	// the last lz4WindowSize bytes of output, for linked blocks
+	history []byte
+	// flags of the current frame
+	blockChecksum   bool
+	contentChecksum bool
+}
+
+func newLz4Reader(r *bufio.Reader) *lz4Reader {
+	return &lz4Reader{r: r}
+}
+
+func (z *lz4Reader) Read(p []byte) (int, error) {
+	for len(z.pending) == 0 {
+		if err := z.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.pending)
+	z.pending = z.pending[n:]
+	return n, nil
+}
+
+func (z *lz4Reader) Close() error {
+	return nil
+}
+
+func (z *lz4Reader) readUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(z.r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+// Start the next stream, returns io.EOF at the end of the input
+func (z *lz4Reader) nextStream() error {
+	for {
+		magic, err := z.readUint32()
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return errLz4Corrupt
+			}
+			return err
+		}
+		switch {
+		case magic == lz4LegacyMagic:
+			z.magic = magic
+			return nil
+		case magic == lz4FrameMagic:
+			z.magic = magic
+			return z.readFrameDescriptor()
+		case magic&lz4SkippableMask == lz4SkippableMagic:
+			size, err := z.readUint32()
+			if err != nil {
+				return errLz4Corrupt
+			}
+			if _, err := z.r.Discard(int(size)); err != nil {
+				return errLz4Corrupt
+			}
+		default:
+			return i18n.Errorf(i18n.CpioreadLz4UnknownMagic, magic)
+		}
+	}
+}
+
+func (z *lz4Reader) readFrameDescriptor() error {
+	var desc [2]byte
+	if _, err := io.ReadFull(z.r, desc[:]); err != nil {
+		return errLz4Corrupt
+	}
+	flg := desc[0]
+	if flg>>6 != 1 {
+		return i18n.Errorf(i18n.CpioreadLz4UnsupportedVersion, flg>>6)
+	}
+	z.blockChecksum = flg&0x10 != 0
+	z.contentChecksum = flg&0x04 != 0
+	// content size, dictionary ID and the header checksum
+	skip := 1
+	if flg&0x08 != 0 {
+		skip += 8
+	}
+	if flg&0x01 != 0 {
+		return i18n.NewError(i18n.CpioreadLz4Dictionary)
+	}
+	if _, err := z.r.Discard(skip); err != nil {
+		return errLz4Corrupt
+	}
+	z.history = nil
+	return nil
+}
+
+// Decompress the next block into z.pending
+func (z *lz4Reader) nextBlock() error {
+	if z.magic == 0 {
+		if err := z.nextStream(); err != nil {
+			return err
+		}
+	}
+
+	size, err := z.readUint32()
+	if err == io.EOF && z.magic == lz4LegacyMagic {
+		return io.EOF
+	}
+	if err != nil {
+		return errLz4Corrupt
+	}
+
+	uncompressed := false
+	switch z.magic {
+	case lz4LegacyMagic:
+		// legacy streams have no end mark, another stream may follow
+		if size == lz4LegacyMagic {
+			return nil
+		}
+		if size > lz4LegacyBlockSize {
+			return errLz4Corrupt
+		}
+		z.history = nil
+	case lz4FrameMagic:
+		if size == 0 {
+			// end mark
+			if z.contentChecksum {
+				if _, err := z.r.Discard(4); err != nil {
+					return errLz4Corrupt
+				}
+			}
+			z.magic = 0
+			return nil
+		}
+		uncompressed = size&0x80000000 != 0
+		size &^= 0x80000000
+		if size > lz4MaxFrameBlockSize {
+			return errLz4Corrupt
+		}
+	}
+
+	block := make([]byte, size)
+	if _, err := io.ReadFull(z.r, block); err != nil {
+		return errLz4Corrupt
+	}
+	if z.magic == lz4FrameMagic && z.blockChecksum {
+		if _, err := z.r.Discard(4); err != nil {
+			return errLz4Corrupt
+		}
+	}
+
+	if uncompressed {
+		z.pending = block
+	} else {
+		out, err := lz4DecodeBlock(append([]byte(nil), z.history...), block)
+		if err != nil {
+			return err
+		}
+		z.pending = out[len(z.history):]
+	}
+
+	z.history = append(z.history, z.pending...)
+	if len(z.history) > lz4WindowSize {
+		z.history = append([]byte(nil), z.history[len(z.history)-lz4WindowSize:]...)
+	}
+	return nil
+}
+
+// Decode an lz4 block, appending the output to dst. Matches may reference
+// the data already in dst.
+func lz4DecodeBlock(dst []byte, src []byte) ([]byte, error) {
+	i := 0
+	// literal and match lengths of 15 are continued in the following bytes
+	length := func(n int) (int, error) {
+		if n != 15 {
+			return n, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, errLz4Corrupt
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		litLen, err := length(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if i+litLen > len(src) {
+			return nil, errLz4Corrupt
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		// the last sequence only has literals
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, errLz4Corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errLz4Corrupt
+		}
+		matchLen, err := length(int(token & 0xf))
+		if err != nil {
+			return nil, err
+		}
+		// matches may overlap the output they produce, so copy bytewise
+		start := len(dst) - offset
+		for j := 0; j < matchLen+4; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package depthcharge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/executor"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Developer keys from vboot-utils, which Chromebooks in developer mode boot
+// kernels signed with
+const (
+	DefaultKeyblock    = "/usr/share/vboot/devkeys/kernel.keyblock"
+	DefaultSignPrivate = "/usr/share/vboot/devkeys/kernel_data_key.vbprivk"
+)
+
+// Architecture names used by mkimage and futility, by deviceinfo_arch.
+// depthcharge only boots kernels with an initramfs from FIT images, which it
+// only supports on ARM.
+var archNames = map[string][2]string{
+	"aarch64": {"arm64", "aarch64"},
+	"armv7":   {"arm", "arm"},
+}
+
+// Image is what goes in a ChromeOS kernel partition
+type Image struct {
+	// deviceinfo_arch
+	Arch      string
+	Kernel    string
+	Initramfs string
+	Dtbs      []string
+	Cmdline   string
+	// vboot keys the image is signed with
+	Keyblock    string
+	SignPrivate string
+}
+
+// CheckArch returns an error if images can't be packed for the given
+// deviceinfo_arch
+func CheckArch(arch string) error {
+	if _, ok := archNames[arch]; !ok {
+		return i18n.Errorf(i18n.DepthchargeUnsupportedArch, arch)
+	}
+	return nil
+}
+
+// Pack the image into a signed kernel partition image at out, like
+// depthcharge expects it: the kernel, initramfs and dtbs in a FIT image, with
+// the cmdline, signed with futility. Intermediate files are written to
+// workDir.
+func Pack(ctx context.Context, e executor.Executor, img Image, workDir string, out string) error {
+	if err := CheckArch(img.Arch); err != nil {
+		return err
+	}
+	arch := archNames[img.Arch]
+	if img.Keyblock == "" {
+		img.Keyblock = DefaultKeyblock
+	}
+	if img.SignPrivate == "" {
+		img.SignPrivate = DefaultSignPrivate
+	}
+
+	cmdline := filepath.Join(workDir, "cmdline")
+	if err := os.WriteFile(cmdline, []byte(img.Cmdline+"\n"), 0644); err != nil {
+		return err
+	}
+	// unused on ARM, but futility requires it
+	bootloader := filepath.Join(workDir, "bootloader.bin")
+	if err := os.WriteFile(bootloader, make([]byte, 512), 0644); err != nil {
+		return err
+	}
+
+	fit := filepath.Join(workDir, "kernel.itb")
+	args := []string{
+		"-D", "-I dts -O dtb -p 2048",
+		"-f", "auto",
+		"-A", arch[0],
+		"-O", "linux",
+		"-T", "kernel",
+		"-C", "none",
+		"-a", "0",
+		"-d", img.Kernel,
+		"-i", img.Initramfs,
+	}
+	for _, dtb := range img.Dtbs {
+		args = append(args, "-b", dtb)
+	}
+	if err := e.Run(ctx, "mkimage", append(args, fit)...); err != nil {
+		return i18n.Errorf(i18n.DepthchargeFitFailed, err)
+	}
+
+	if err := e.Run(ctx, "futility", "vbutil_kernel",
+		"--pack", out,
+		"--version", "1",
+		"--keyblock", img.Keyblock,
+		"--signprivate", img.SignPrivate,
+		"--config", cmdline,
+		"--bootloader", bootloader,
+		"--vmlinuz", fit,
+		"--arch", arch[1],
+	); err != nil {
+		return i18n.Errorf(i18n.DepthchargeSignFailed, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package depthcharge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/executor"
+)
+
+func TestPack(t *testing.T) {
+	workDir := t.TempDir()
+	img := Image{
+		Arch:      "aarch64",
+		Kernel:    "/boot/vmlinuz",
+		Initramfs: "/tmp/initramfs",
+		Dtbs:      []string{"/boot/dtbs/rockchip/rk3399-gru-kevin.dtb"},
+		Cmdline:   "console=tty1 quiet",
+	}
+
+	r := &executor.Recorder{}
+	if err := Pack(context.Background(), r, img, workDir, "/tmp/vmlinuz.kpart"); err != nil {
+		t.Fatal(err)
+	}
+	fit := filepath.Join(workDir, "kernel.itb")
+	expected := [][]string{
+		{"mkimage", "-D", "-I dts -O dtb -p 2048", "-f", "auto", "-A", "arm64", "-O", "linux", "-T", "kernel",
+			"-C", "none", "-a", "0", "-d", "/boot/vmlinuz", "-i", "/tmp/initramfs",
+			"-b", "/boot/dtbs/rockchip/rk3399-gru-kevin.dtb", fit},
+		{"futility", "vbutil_kernel", "--pack", "/tmp/vmlinuz.kpart", "--version", "1",
+			"--keyblock", DefaultKeyblock, "--signprivate", DefaultSignPrivate,
+			"--config", filepath.Join(workDir, "cmdline"), "--bootloader", filepath.Join(workDir, "bootloader.bin"),
+			"--vmlinuz", fit, "--arch", "aarch64"},
+	}
+	if !reflect.DeepEqual(r.Commands, expected) {
+		t.Errorf("expected: %q, got: %q", expected, r.Commands)
+	}
+
+	if cmdline, err := os.ReadFile(filepath.Join(workDir, "cmdline")); err != nil || string(cmdline) != "console=tty1 quiet\n" {
+		t.Errorf("unexpected cmdline: %q, %v", cmdline, err)
+	}
+
+	img.Arch = "x86_64"
+	if err := Pack(context.Background(), r, img, workDir, "/tmp/vmlinuz.kpart"); err == nil {
+		t.Error("expected error for unsupported arch")
+	}
+
+	img.Arch = "armv7"
+	r = &executor.Recorder{Err: errors.New("failed")}
+	if err := Pack(context.Background(), r, img, workDir, "/tmp/vmlinuz.kpart"); err == nil {
+		t.Error("expected error when mkimage fails")
+	}
+}
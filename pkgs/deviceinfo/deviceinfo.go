@@ -5,14 +5,22 @@ package deviceinfo
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"unicode"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
 )
 
+// DeviceInfo has the deviceinfo variables that mkinitfs (and boot-deploy)
+// use, see File for all of them
 type DeviceInfo struct {
 	AppendDtb                     string
 	Arch                          string
@@ -22,7 +30,12 @@ type DeviceInfo struct {
 	BootimgMtkMkimage             string
 	BootimgPxa                    string
 	BootimgQcdt                   string
+	DepthchargeKeyblock           string
+	DepthchargeSignprivate        string
 	Dtb                           string
+	FitHash                       string
+	FitKeyNameHint                string
+	FitSigningKey                 string
 	FlashKernelOnUpdate           string
 	FlashOffsetBase               string
 	FlashOffsetKernel             string
@@ -31,13 +44,33 @@ type DeviceInfo struct {
 	FlashOffsetTags               string
 	FlashPagesize                 string
 	GenerateBootimg               string
+	GenerateCorebootPayload       string
+	GenerateDepthchargeImage      string
+	GenerateExtlinuxConfig        string
+	GenerateFitImage              string
+	GenerateGrubConfig            string
 	GenerateLegacyUbootInitfs     string
+	GenerateUbootBootscr          string
 	InitfsCompression             string
+	InitfsCryptoAlgorithms        string
+	InitfsCpioFormat              string
+	InitfsExtraVerity             string
+	InitfsMaxSize                 string
 	KernelCmdline                 string
+	Keymaps                       string
 	LegacyUbootLoadAddress        string
 	MesaDriver                    string
+	MkinitfsAccessibility         string
+	MkinitfsChecksum              string
+	MkinitfsLocale                string
 	MkinitfsPostprocess           string
+	MkinitfsProfile               string
+	MkinitfsSplash                string
+	MkinitfsSplashes              string
+	MkinitfsTts                   string
+	ModulesAudio                  string
 	ModulesInitfs                 string
+	ModulesInitfsDirs             string
 }
 
 func ReadDeviceinfo(file string) (DeviceInfo, error) {
@@ -56,59 +89,135 @@ func ReadDeviceinfo(file string) (DeviceInfo, error) {
 	return deviceinfo, nil
 }
 
-// Unmarshals a deviceinfo into a DeviceInfo struct
-func unmarshal(r io.Reader, devinfo *DeviceInfo) error {
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-		line := s.Text()
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
+// Write the deviceinfo to the given file. If the file exists, the values of
+// the variables in it are replaced and everything else (comments, variables
+// DeviceInfo doesn't have) is kept, so it can be used to edit a deviceinfo.
+func WriteDeviceinfo(file string, d DeviceInfo) error {
+	orig, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
 
-		// line isn't setting anything, so just ignore it
-		if !strings.Contains(line, "=") {
-			continue
-		}
+	var buf bytes.Buffer
+	if err := marshal(bytes.NewReader(orig), &buf, d); err != nil {
+		return err
+	}
 
-		// sometimes line has a comment at the end after setting an option
-		line = strings.SplitN(line, "#", 2)[0]
-		line = strings.TrimSpace(line)
+	tmp := file + ".new"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
 
-		// must support having '=' in the value (e.g. kernel cmdline)
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("error parsing deviceinfo line, invalid format: %s", line)
-		}
+// Get the value of the deviceinfo variable with the given name, with or
+// without the "deviceinfo_" prefix (e.g. "deviceinfo_arch" or "arch").
+// Returns false if the variable isn't one that DeviceInfo supports.
+func (d DeviceInfo) Get(name string) (string, bool) {
+	field := reflect.ValueOf(d).FieldByName(nameToField(name))
+	if !field.IsValid() {
+		return "", false
+	}
+	return field.String(), true
+}
 
-		name, val := parts[0], parts[1]
-		val = strings.ReplaceAll(val, "\"", "")
+// Returns all DeviceInfo fields, as a map of deviceinfo variable name
+// (e.g. "deviceinfo_arch") -> value
+func (d DeviceInfo) Fields() map[string]string {
+	fields := make(map[string]string)
+	v := reflect.ValueOf(d)
+	for i := 0; i < v.NumField(); i++ {
+		fields[fieldToName(v.Type().Field(i).Name)] = v.Field(i).String()
+	}
+	return fields
+}
 
-		if name == "deviceinfo_format_version" && val != "0" {
-			return fmt.Errorf("deviceinfo format version %q is not supported", val)
-		}
+// Unmarshals a deviceinfo into a DeviceInfo struct
+func unmarshal(r io.Reader, devinfo *DeviceInfo) error {
+	f, err := Parse(r)
+	if err != nil {
+		log.Print("unable to parse deviceinfo: ", err)
+		return err
+	}
+	for name, val := range f.Values {
+		devinfo.set(name, val)
+	}
 
-		fieldName := nameToField(name)
+	return nil
+}
 
-		if fieldName == "" {
-			return fmt.Errorf("error parsing deviceinfo line, invalid format: %s", line)
+// Marshals a DeviceInfo struct into deviceinfo syntax, the inverse of
+// unmarshal. The lines of the deviceinfo in r are copied to w, with the values
+// of DeviceInfo variables replaced and any comment at the end kept. Variables
+// not already in r are appended, if they are set.
+func marshal(r io.Reader, w io.Writer, d DeviceInfo) error {
+	fields := d.Fields()
+	for name, val := range fields {
+		// these can't be parsed back
+		if strings.ContainsAny(val, "\"#\n") {
+			return i18n.Errorf(i18n.DeviceinfoInvalidValue, name, val)
 		}
+	}
 
-		field := reflect.ValueOf(devinfo).Elem().FieldByName(fieldName)
-		if !field.IsValid() {
-			// an option that meets the deviceinfo "specification", but isn't
-			// one we care about in this module
-			continue
+	written := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if name, comment, ok := assignment(line); ok {
+			if _, isField := fields[name]; isField {
+				line = fmt.Sprintf("%s=\"%s\"%s", name, fields[name], comment)
+				written[name] = true
+			}
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
 		}
-		field.SetString(val)
 	}
 	if err := s.Err(); err != nil {
-		log.Print("unable to parse deviceinfo: ", err)
 		return err
 	}
 
+	var names []string
+	for name, val := range fields {
+		if !written[name] && val != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s=\"%s\"\n", name, fields[name]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Returns the name of the variable the line sets, and the comment at the end
+// of it (with the whitespace before it), false if the line doesn't set one
+func assignment(line string) (name string, comment string, ok bool) {
+	if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+		return "", "", false
+	}
+	if i := strings.Index(line, "#"); i >= 0 {
+		comment = line[len(strings.TrimRight(line[:i], " \t")):]
+		line = line[:i]
+	}
+	name = strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+	return name, comment, name != ""
+}
+
+// Set the field for the deviceinfo variable, if DeviceInfo has one
+func (d *DeviceInfo) set(name string, val string) {
+	field := reflect.ValueOf(d).Elem().FieldByName(nameToField(name))
+	if !field.IsValid() {
+		// an option that meets the deviceinfo "specification", but isn't
+		// one we care about in this module
+		return
+	}
+	field.SetString(val)
+}
+
 // Convert string into the string format used for DeviceInfo fields.
 // Note: does not test that the resulting field name is a valid field in the
 // DeviceInfo struct!
@@ -124,3 +233,18 @@ func nameToField(name string) string {
 
 	return field
 }
+
+// Convert a DeviceInfo field name into the deviceinfo variable name, e.g.
+// "ModulesInitfs" -> "deviceinfo_modules_initfs". Consecutive uppercase
+// letters are kept together.
+func fieldToName(field string) string {
+	name := "deviceinfo"
+	for i, r := range field {
+		if unicode.IsUpper(r) && (i == 0 || !unicode.IsUpper(rune(field[i-1]))) {
+			name += "_"
+		}
+		name += string(unicode.ToLower(r))
+	}
+
+	return name
+}
@@ -5,6 +5,7 @@ package deviceinfo
 
 import (
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -46,6 +47,7 @@ func TestUnmarshal(t *testing.T) {
 		{"KernelCmdline",
 			"deviceinfo_kernel_cmdline=\"PMOS_NO_OUTPUT_REDIRECT fw_devlink=off nvme_core.default_ps_max_latency_us=5500 pcie_aspm.policy=performance\"\n",
 			"PMOS_NO_OUTPUT_REDIRECT fw_devlink=off nvme_core.default_ps_max_latency_us=5500 pcie_aspm.policy=performance"},
+		{"ModulesInitfsDirs", "deviceinfo_modules_initfs_dirs=\"kernel/drivers/gpu/drm/msm/ extra/\"\n", "kernel/drivers/gpu/drm/msm/ extra/"},
 		// empty option
 		{"ModulesInitfs", "deviceinfo_modules_initfs=\"\"\n", ""},
 		{"Dtb", "deviceinfo_dtb=\"freescale/imx8mq-librem5-r2 freescale/imx8mq-librem5-r3 freescale/imx8mq-librem5-r4\"\n",
@@ -79,3 +81,118 @@ func TestUnmarshal(t *testing.T) {
 	}
 
 }
+
+func TestGet(t *testing.T) {
+	d := DeviceInfo{Arch: "aarch64", MesaDriver: "panfrost"}
+	tables := []struct {
+		in       string
+		expected string
+		ok       bool
+	}{
+		{"deviceinfo_arch", "aarch64", true},
+		{"arch", "aarch64", true},
+		{"deviceinfo_mesa_driver", "panfrost", true},
+		{"dtb", "", true},
+		{"deviceinfo_not_a_field", "", false},
+		{"", "", false},
+	}
+	for _, table := range tables {
+		out, ok := d.Get(table.in)
+		if out != table.expected || ok != table.ok {
+			t.Errorf("%q: expected: %q, %t, got: %q, %t", table.in, table.expected, table.ok, out, ok)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	d := DeviceInfo{Arch: "aarch64", MesaDriver: "panfrost"}
+	fields := d.Fields()
+	if len(fields) != reflect.TypeOf(d).NumField() {
+		t.Errorf("expected %d fields, got: %d", reflect.TypeOf(d).NumField(), len(fields))
+	}
+	if fields["deviceinfo_arch"] != "aarch64" || fields["deviceinfo_mesa_driver"] != "panfrost" || fields["deviceinfo_dtb"] != "" {
+		t.Errorf("unexpected fields: %q", fields)
+	}
+}
+
+func TestFieldToName(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected string
+	}{
+		{"Arch", "deviceinfo_arch"},
+		{"ModulesInitfs", "deviceinfo_modules_initfs"},
+		{"BootimgAppendSEAndroidEnforce", "deviceinfo_bootimg_append_seandroid_enforce"},
+	}
+	for _, table := range tables {
+		if out := fieldToName(table.in); out != table.expected {
+			t.Errorf("expected: %q, got: %q", table.expected, out)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	in := `# Reference: <https://postmarketos.org/deviceinfo>
+deviceinfo_format_version="0"
+deviceinfo_arch="armv7"  # an old one
+deviceinfo_codename="pine64-pinebookpro"
+
+deviceinfo_dtb="rockchip/rk3399-pinebook-pro"
+`
+	d := DeviceInfo{
+		Arch:          "aarch64",
+		MesaDriver:    "panfrost",
+		ModulesInitfs: "panfrost foo",
+	}
+	expected := `# Reference: <https://postmarketos.org/deviceinfo>
+deviceinfo_format_version="0"
+deviceinfo_arch="aarch64"  # an old one
+deviceinfo_codename="pine64-pinebookpro"
+
+deviceinfo_dtb=""
+deviceinfo_mesa_driver="panfrost"
+deviceinfo_modules_initfs="panfrost foo"
+`
+	var out strings.Builder
+	if err := marshal(strings.NewReader(in), &out, d); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("expected: %q, got: %q", expected, out.String())
+	}
+
+	// reading it back gives the same values
+	var got DeviceInfo
+	if err := unmarshal(strings.NewReader(out.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, d) {
+		t.Errorf("expected: %+v, got: %+v", d, got)
+	}
+
+	for _, val := range []string{"a\"b", "a # b", "a\nb"} {
+		if err := marshal(strings.NewReader(""), &out, DeviceInfo{KernelCmdline: val}); err == nil {
+			t.Errorf("expected error for value: %q", val)
+		}
+	}
+}
+
+func TestWriteDeviceinfo(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deviceinfo")
+	d := DeviceInfo{Arch: "aarch64"}
+	if err := WriteDeviceinfo(file, d); err != nil {
+		t.Fatal(err)
+	}
+	d.MesaDriver = "panfrost"
+	if err := WriteDeviceinfo(file, d); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadDeviceinfo(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, d) {
+		t.Errorf("expected: %+v, got: %+v", d, got)
+	}
+}
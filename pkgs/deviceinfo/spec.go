@@ -0,0 +1,313 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package deviceinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// FormatVersion is the version of the deviceinfo format that can be parsed
+const FormatVersion = 0
+
+// Type of the value of a deviceinfo variable
+type Type int
+
+const (
+	String Type = iota
+	// "true" or "false"
+	Bool
+	// decimal or hexadecimal (0x...) integer
+	Int
+	// whitespace separated values
+	List
+)
+
+func (t Type) String() string {
+	switch t {
+	case Bool:
+		return "bool"
+	case Int:
+		return "int"
+	case List:
+		return "list"
+	}
+	return "string"
+}
+
+// Spec is all variables of the deviceinfo format, by name. DeviceInfo only
+// has the ones mkinitfs uses.
+var Spec = map[string]Type{
+	"deviceinfo_format_version":                    Int,
+	"deviceinfo_name":                              String,
+	"deviceinfo_manufacturer":                      String,
+	"deviceinfo_codename":                          String,
+	"deviceinfo_year":                              Int,
+	"deviceinfo_chassis":                           String,
+	"deviceinfo_arch":                              String,
+	"deviceinfo_dtb":                               List,
+	"deviceinfo_append_dtb":                        Bool,
+	"deviceinfo_keyboard":                          Bool,
+	"deviceinfo_external_storage":                  Bool,
+	"deviceinfo_gpu_accelerated":                   Bool,
+	"deviceinfo_screen_width":                      Int,
+	"deviceinfo_screen_height":                     Int,
+	"deviceinfo_getty":                             String,
+	"deviceinfo_no_framebuffer":                    Bool,
+	"deviceinfo_disable_dhcpd":                     Bool,
+	"deviceinfo_swap_size_recommended":             Int,
+	"deviceinfo_tmp_as_tmpfs_size":                 String,
+	"deviceinfo_dev_internal_storage":              String,
+	"deviceinfo_dev_internal_storage_repartition":  Bool,
+	"deviceinfo_dev_touchscreen":                   String,
+	"deviceinfo_dev_touchscreen_calibration":       String,
+	"deviceinfo_dev_keyboard":                      String,
+	"deviceinfo_mesa_driver":                       String,
+	"deviceinfo_keymaps":                           List,
+	"deviceinfo_kernel_cmdline":                    String,
+	"deviceinfo_kernel_cmdline_append":             String,
+	"deviceinfo_modules_initfs":                    List,
+	"deviceinfo_modules_audio":                     List,
+	"deviceinfo_modules_initfs_dirs":               List,
+	"deviceinfo_mkinitfs_postprocess":              String,
+	"deviceinfo_mkinitfs_profile":                  String,
+	"deviceinfo_mkinitfs_splash":                   Bool,
+	"deviceinfo_mkinitfs_splashes":                 List,
+	"deviceinfo_mkinitfs_accessibility":            Bool,
+	"deviceinfo_mkinitfs_tts":                      String,
+	"deviceinfo_mkinitfs_locale":                   Bool,
+	"deviceinfo_mkinitfs_checksum":                 String,
+	"deviceinfo_initfs_compression":                String,
+	"deviceinfo_initfs_cpio_format":                String,
+	"deviceinfo_initfs_crypto_algorithms":          List,
+	"deviceinfo_initfs_extra_verity":               Bool,
+	"deviceinfo_initfs_max_size":                   String,
+	"deviceinfo_flash_method":                      String,
+	"deviceinfo_flash_kernel_on_update":            Bool,
+	"deviceinfo_flash_offset_base":                 Int,
+	"deviceinfo_flash_offset_kernel":               Int,
+	"deviceinfo_flash_offset_ramdisk":              Int,
+	"deviceinfo_flash_offset_second":               Int,
+	"deviceinfo_flash_offset_tags":                 Int,
+	"deviceinfo_flash_offset_dtb":                  Int,
+	"deviceinfo_flash_pagesize":                    Int,
+	"deviceinfo_flash_sparse":                      Bool,
+	"deviceinfo_flash_sparse_samsung_format":       Bool,
+	"deviceinfo_flash_fastboot_partition_kernel":   String,
+	"deviceinfo_flash_fastboot_partition_rootfs":   String,
+	"deviceinfo_flash_fastboot_partition_vbmeta":   String,
+	"deviceinfo_flash_fastboot_partition_dtbo":     String,
+	"deviceinfo_flash_fastboot_max_size":           Int,
+	"deviceinfo_flash_heimdall_partition_kernel":   String,
+	"deviceinfo_flash_heimdall_partition_initfs":   String,
+	"deviceinfo_flash_heimdall_partition_rootfs":   String,
+	"deviceinfo_flash_heimdall_partition_vbmeta":   String,
+	"deviceinfo_flash_rk_partition_kernel":         String,
+	"deviceinfo_flash_rk_partition_rootfs":         String,
+	"deviceinfo_flash_mtkclient_partition_kernel":  String,
+	"deviceinfo_flash_mtkclient_partition_rootfs":  String,
+	"deviceinfo_flash_mtkclient_partition_vbmeta":  String,
+	"deviceinfo_generate_bootimg":                  Bool,
+	"deviceinfo_generate_coreboot_payload":         Bool,
+	"deviceinfo_generate_depthcharge_image":        Bool,
+	"deviceinfo_generate_extlinux_config":          Bool,
+	"deviceinfo_generate_fit_image":                Bool,
+	"deviceinfo_generate_grub_config":              Bool,
+	"deviceinfo_generate_legacy_uboot_initfs":      Bool,
+	"deviceinfo_generate_uboot_bootscr":            Bool,
+	"deviceinfo_bootimg_append_seandroid_enforce":  Bool,
+	"deviceinfo_bootimg_blobpack":                  String,
+	"deviceinfo_bootimg_custom_args":               String,
+	"deviceinfo_bootimg_dtb_second":                Bool,
+	"deviceinfo_bootimg_header_version":            Int,
+	"deviceinfo_bootimg_mtk_mkimage":               Bool,
+	"deviceinfo_bootimg_pxa":                       Bool,
+	"deviceinfo_bootimg_qcdt":                      Bool,
+	"deviceinfo_bootimg_qcdt_type":                 String,
+	"deviceinfo_bootimg_vendor_dependent":          Bool,
+	"deviceinfo_bootimg_vendor_android_boot_image": String,
+	"deviceinfo_bootimg_vendor_device_tree":        String,
+	"deviceinfo_legacy_uboot_load_address":         Int,
+	"deviceinfo_depthcharge_board":                 String,
+	"deviceinfo_depthcharge_keyblock":              String,
+	"deviceinfo_depthcharge_signprivate":           String,
+	"deviceinfo_cgpt_kpart":                        String,
+	"deviceinfo_cgpt_kpart_start":                  Int,
+	"deviceinfo_cgpt_kpart_size":                   Int,
+	"deviceinfo_fit_hash":                          String,
+	"deviceinfo_fit_key_name_hint":                 String,
+	"deviceinfo_fit_signing_key":                   String,
+	"deviceinfo_sd_embed_firmware":                 String,
+	"deviceinfo_sd_embed_firmware_step_size":       Int,
+	"deviceinfo_partition_blacklist":               List,
+	"deviceinfo_boot_filesystem":                   String,
+	"deviceinfo_boot_part_start":                   Int,
+	"deviceinfo_root_filesystem":                   String,
+	"deviceinfo_rootfs_image_sector_size":          Int,
+	"deviceinfo_usb_idVendor":                      Int,
+	"deviceinfo_usb_idProduct":                     Int,
+	"deviceinfo_usb_network_function":              String,
+	"deviceinfo_usb_network_udc":                   String,
+	"deviceinfo_usb_serialnumber":                  String,
+}
+
+// File is a parsed deviceinfo, with the values of all variables set in it
+type File struct {
+	FormatVersion int
+	// all variables set in the file, by name (e.g. "deviceinfo_arch")
+	Values map[string]string
+}
+
+// Read and parse the deviceinfo at the given path
+func Read(path string) (*File, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	f, err := Parse(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Parse a deviceinfo. Values of the variables aren't checked against their
+// types, see Validate.
+func Parse(r io.Reader) (*File, error) {
+	f := &File{Values: make(map[string]string)}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// line isn't setting anything, so just ignore it
+		if !strings.Contains(line, "=") {
+			continue
+		}
+
+		// sometimes line has a comment at the end after setting an option
+		line = strings.SplitN(line, "#", 2)[0]
+		line = strings.TrimSpace(line)
+
+		// must support having '=' in the value (e.g. kernel cmdline)
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, i18n.Errorf(i18n.DeviceinfoInvalidLine, line)
+		}
+
+		name, val := parts[0], parts[1]
+		val = strings.ReplaceAll(val, "\"", "")
+
+		if name == "deviceinfo_format_version" && val != strconv.Itoa(FormatVersion) {
+			return nil, i18n.Errorf(i18n.DeviceinfoUnsupportedVersion, val)
+		}
+
+		if nameToField(name) == "" {
+			return nil, i18n.Errorf(i18n.DeviceinfoInvalidLine, line)
+		}
+
+		f.Values[name] = val
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Unknown returns the variables that aren't in the spec, e.g. ones specific
+// to a device or a newer version of the spec
+func (f *File) Unknown() map[string]string {
+	unknown := make(map[string]string)
+	for name, val := range f.Values {
+		if _, ok := Spec[name]; !ok {
+			unknown[name] = val
+		}
+	}
+	return unknown
+}
+
+// Validate checks the values of all variables in the spec against their
+// types, returns a problem for each one that doesn't match, sorted by name
+func (f *File) Validate() []string {
+	var names []string
+	for name := range f.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		typ, ok := Spec[name]
+		if !ok || f.Values[name] == "" {
+			continue
+		}
+		var err error
+		switch typ {
+		case Bool:
+			_, err = f.Bool(name)
+		case Int:
+			_, err = f.Int(name)
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// String returns the value of the variable, "" if it isn't set
+func (f *File) String(name string) string {
+	return f.Values[name]
+}
+
+// Bool returns the value of a boolean variable, false if it isn't set
+func (f *File) Bool(name string) (bool, error) {
+	switch val := f.Values[name]; val {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, i18n.Errorf(i18n.DeviceinfoInvalidBool, name, val)
+	}
+}
+
+// Int returns the value of an integer variable, 0 if it isn't set
+func (f *File) Int(name string) (int64, error) {
+	val := f.Values[name]
+	if val == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(val, 0, 64)
+	if err != nil {
+		return 0, i18n.Errorf(i18n.DeviceinfoInvalidInt, name, val)
+	}
+	return i, nil
+}
+
+// List returns the values of a list variable, nil if it isn't set
+func (f *File) List(name string) []string {
+	return strings.Fields(f.Values[name])
+}
+
+// DeviceInfo returns the variables that mkinitfs uses, see DeviceInfo
+func (f *File) DeviceInfo() DeviceInfo {
+	var devinfo DeviceInfo
+	for name, val := range f.Values {
+		devinfo.set(name, val)
+	}
+	return devinfo
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package deviceinfo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSpecHasAllFields(t *testing.T) {
+	for name := range (DeviceInfo{}).Fields() {
+		if _, ok := Spec[name]; !ok {
+			t.Errorf("DeviceInfo field missing from the spec: %s", name)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	in := `
+# Reference: <https://postmarketos.org/deviceinfo>
+deviceinfo_format_version="0"
+deviceinfo_name="PINE64 PinePhone"
+deviceinfo_year="2020"
+deviceinfo_arch="aarch64"
+deviceinfo_keyboard="false"
+deviceinfo_dtb="allwinner/sun50i-a64-pinephone-1.1 allwinner/sun50i-a64-pinephone-1.2"
+deviceinfo_flash_offset_base="0x10000000"
+deviceinfo_pinephone_modem="eg25" # not in the spec
+`
+	f, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.String("deviceinfo_name") != "PINE64 PinePhone" {
+		t.Errorf("unexpected name: %q", f.String("deviceinfo_name"))
+	}
+	if year, err := f.Int("deviceinfo_year"); err != nil || year != 2020 {
+		t.Errorf("unexpected year: %d, %v", year, err)
+	}
+	if base, err := f.Int("deviceinfo_flash_offset_base"); err != nil || base != 0x10000000 {
+		t.Errorf("unexpected flash offset base: %#x, %v", base, err)
+	}
+	if keyboard, err := f.Bool("deviceinfo_keyboard"); err != nil || keyboard {
+		t.Errorf("unexpected keyboard: %t, %v", keyboard, err)
+	}
+	if external, err := f.Bool("deviceinfo_external_storage"); err != nil || external {
+		t.Errorf("expected unset bool to be false, got: %t, %v", external, err)
+	}
+	dtbs := []string{"allwinner/sun50i-a64-pinephone-1.1", "allwinner/sun50i-a64-pinephone-1.2"}
+	if !reflect.DeepEqual(f.List("deviceinfo_dtb"), dtbs) {
+		t.Errorf("unexpected dtbs: %q", f.List("deviceinfo_dtb"))
+	}
+
+	expected := map[string]string{"deviceinfo_pinephone_modem": "eg25"}
+	if unknown := f.Unknown(); !reflect.DeepEqual(unknown, expected) {
+		t.Errorf("expected unknown: %q, got: %q", expected, unknown)
+	}
+
+	devinfo := f.DeviceInfo()
+	if devinfo.Arch != "aarch64" || devinfo.Dtb != f.String("deviceinfo_dtb") {
+		t.Errorf("unexpected DeviceInfo: %+v", devinfo)
+	}
+
+	if problems := f.Validate(); len(problems) != 0 {
+		t.Errorf("unexpected problems: %q", problems)
+	}
+
+	if _, err := Parse(strings.NewReader("deviceinfo_format_version=\"1\"\n")); err == nil {
+		t.Error("expected error for unsupported format version")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	in := `
+deviceinfo_year="last year"
+deviceinfo_keyboard="yes"
+deviceinfo_screen_width="720"
+deviceinfo_not_in_spec="anything"
+`
+	f, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`deviceinfo_keyboard must be "true" or "false", got: "yes"`,
+		`deviceinfo_year must be an integer, got: "last year"`,
+	}
+	if problems := f.Validate(); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected: %q, got: %q", expected, problems)
+	}
+}
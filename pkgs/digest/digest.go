@@ -0,0 +1,97 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+	"golang.org/x/sys/unix"
+)
+
+// Algorithm is a hash algorithm used for checksums of files
+type Algorithm string
+
+const (
+	// Default for checksums that are used for security, e.g. the manifest
+	// that is checked at boot. It's also the only one busybox can check.
+	SHA256 Algorithm = "sha256"
+	// Faster than sha256 on 64-bit CPUs without sha256 instructions.
+	// Checksums are compatible with 'sha512sum'.
+	SHA512 Algorithm = "sha512"
+	// Faster than sha256 on most CPUs without sha256 instructions, and as
+	// secure. Checksums are compatible with 'b2sum'.
+	BLAKE2b Algorithm = "blake2b"
+	// Much faster, but not cryptographically secure, so only suitable for
+	// detecting changes (e.g. to build inputs). Checksums are compatible with
+	// 'xxhsum -H64'.
+	XXH64 Algorithm = "xxh64"
+)
+
+var algorithms = map[Algorithm]func() hash.Hash{
+	SHA256:  sha256.New,
+	SHA512:  sha512.New,
+	BLAKE2b: newBlake2b,
+	XXH64:   newXXH64,
+}
+
+// Parse the name of an algorithm
+func Parse(name string) (Algorithm, error) {
+	a := Algorithm(name)
+	if _, ok := algorithms[a]; !ok {
+		return "", i18n.Errorf(i18n.DigestUnsupported, name)
+	}
+	return a, nil
+}
+
+// Returns a new hash for the algorithm
+func (a Algorithm) New() hash.Hash {
+	newHash, ok := algorithms[a]
+	if !ok {
+		panic("digest: unsupported algorithm: " + string(a))
+	}
+	return newHash()
+}
+
+// Returns the checksum of the data read from r, hex encoded
+func (a Algorithm) Reader(r io.Reader) (string, error) {
+	h := a.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the checksum of the file, hex encoded
+func (a Algorithm) File(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	return a.Reader(fd)
+}
+
+// Returns the checksum of the file like File, but read from the storage
+// instead of the page cache where the kernel allows it, e.g. for checking that
+// data written to flaky storage can be read back intact. The file has to be
+// synced first, or there is nothing to drop from the cache.
+func (a Algorithm) StoredFile(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	// only advice, the data is read from the cache if it fails
+	unix.Fadvise(int(fd.Fd()), 0, 0, unix.FADV_DONTNEED)
+
+	return a.Reader(fd)
+}
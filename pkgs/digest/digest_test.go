@@ -0,0 +1,79 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package digest
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAlgorithms(t *testing.T) {
+	long := strings.Repeat("a", 1000)
+	tables := []struct {
+		alg      Algorithm
+		in       string
+		expected string
+	}{
+		{SHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{SHA512, "abc", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{BLAKE2b, "", "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{BLAKE2b, "abc", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{BLAKE2b, long, "d6a69459fe93fc6b9537ed4336e5099e0dcca3e97290a412500ed7a0daffb03d80cf3650a20e0591f748e10c3c534945ee83d5f2c9722f1a68d98b8c01af23fd"},
+		{XXH64, "", "ef46db3751d8e999"},
+		{XXH64, "abc", "44bc2cf5ad770999"},
+		{XXH64, long, "56e43b712eda4223"},
+	}
+	for _, table := range tables {
+		sum, err := table.alg.Reader(strings.NewReader(table.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != table.expected {
+			t.Errorf("%s(%.10q): expected %s, got: %s", table.alg, table.in, table.expected, sum)
+		}
+
+		// the result must not depend on how the data is split up
+		h := table.alg.New()
+		for i := 0; i < len(table.in); i += 7 {
+			end := i + 7
+			if end > len(table.in) {
+				end = len(table.in)
+			}
+			h.Write([]byte(table.in[i:end]))
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != table.expected {
+			t.Errorf("%s(%.10q) in chunks: expected %s, got: %s", table.alg, table.in, table.expected, sum)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, name := range []string{"sha256", "sha512", "blake2b", "xxh64"} {
+		if a, err := Parse(name); err != nil || string(a) != name {
+			t.Errorf("%s: unexpected result: %q, %v", name, a, err)
+		}
+	}
+	if _, err := Parse("md5"); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := XXH64.File(path); err != nil || sum != "44bc2cf5ad770999" {
+		t.Errorf("unexpected checksum: %q, %v", sum, err)
+	}
+	if _, err := XXH64.File(path + ".missing"); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if sum, err := XXH64.StoredFile(path); err != nil || sum != "44bc2cf5ad770999" {
+		t.Errorf("unexpected checksum read from the storage: %q, %v", sum, err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package digest
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH64, with a seed of 0
+
+// vars instead of consts, since the initial state overflows with consts
+var (
+	xxh64Prime1 uint64 = 11400714785074694791
+	xxh64Prime2 uint64 = 14029467366897019727
+	xxh64Prime3 uint64 = 1609587929392839161
+	xxh64Prime4 uint64 = 9650029242287828579
+	xxh64Prime5 uint64 = 2870177450012600261
+)
+
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+func newXXH64() hash.Hash {
+	d := &xxh64{}
+	d.Reset()
+	return d
+}
+
+func (d *xxh64) Reset() {
+	d.v = [4]uint64{xxh64Prime1 + xxh64Prime2, xxh64Prime2, 0, -xxh64Prime1}
+	d.total = 0
+	d.n = 0
+}
+
+func (d *xxh64) Size() int { return 8 }
+
+func (d *xxh64) BlockSize() int { return 32 }
+
+func xxh64Round(acc, input uint64) uint64 {
+	acc += input * xxh64Prime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxh64Prime1
+}
+
+func xxh64MergeRound(acc, val uint64) uint64 {
+	acc ^= xxh64Round(0, val)
+	return acc*xxh64Prime1 + xxh64Prime4
+}
+
+func (d *xxh64) Write(p []byte) (int, error) {
+	written := len(p)
+	d.total += uint64(len(p))
+	for len(p) > 0 {
+		c := copy(d.buf[d.n:], p)
+		d.n += c
+		p = p[c:]
+		if d.n == len(d.buf) {
+			for i := range d.v {
+				d.v[i] = xxh64Round(d.v[i], binary.LittleEndian.Uint64(d.buf[i*8:]))
+			}
+			d.n = 0
+		}
+	}
+	return written, nil
+}
+
+func (d *xxh64) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		h = bits.RotateLeft64(d.v[0], 1) + bits.RotateLeft64(d.v[1], 7) +
+			bits.RotateLeft64(d.v[2], 12) + bits.RotateLeft64(d.v[3], 18)
+		for _, v := range d.v {
+			h = xxh64MergeRound(h, v)
+		}
+	} else {
+		h = xxh64Prime5
+	}
+	h += d.total
+
+	p := d.buf[:d.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxh64Round(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxh64Prime1 + xxh64Prime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxh64Prime1
+		h = bits.RotateLeft64(h, 23)*xxh64Prime2 + xxh64Prime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * xxh64Prime5
+		h = bits.RotateLeft64(h, 11) * xxh64Prime1
+	}
+
+	h ^= h >> 33
+	h *= xxh64Prime2
+	h ^= h >> 29
+	h *= xxh64Prime3
+	h ^= h >> 32
+	return h
+}
+
+// The checksum is big endian, like xxhsum prints it
+func (d *xxh64) Sum(b []byte) []byte {
+	var out [8]byte
+	binary.BigEndian.PutUint64(out[:], d.Sum64())
+	return append(b, out[:]...)
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package elfutil
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Target is the ELF machine and class that binaries for an architecture are
+// expected to have
+type Target struct {
+	Machine elf.Machine
+	Class   elf.Class
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s (%s)", t.Machine, t.Class)
+}
+
+// Map of postmarketOS/Alpine arch names, as used in deviceinfo_arch, to ELF
+// targets
+var archTargets = map[string]Target{
+	"aarch64": {elf.EM_AARCH64, elf.ELFCLASS64},
+	"armhf":   {elf.EM_ARM, elf.ELFCLASS32},
+	"armv7":   {elf.EM_ARM, elf.ELFCLASS32},
+	"ppc64le": {elf.EM_PPC64, elf.ELFCLASS64},
+	"riscv64": {elf.EM_RISCV, elf.ELFCLASS64},
+	"s390x":   {elf.EM_S390, elf.ELFCLASS64},
+	"x86":     {elf.EM_386, elf.ELFCLASS32},
+	"x86_64":  {elf.EM_X86_64, elf.ELFCLASS64},
+}
+
+// Get the ELF target for the given arch name
+func TargetForArch(arch string) (Target, error) {
+	t, ok := archTargets[arch]
+	if !ok {
+		return t, i18n.Errorf(i18n.ElfutilUnknownArch, arch)
+	}
+	return t, nil
+}
+
+// Returns true if the given ELF file was built for the target
+func (t Target) Matches(f *elf.File) bool {
+	return f.Machine == t.Machine && f.Class == t.Class
+}
+
+// Returns true if the file starts with the ELF magic number. Unlike elf.Open,
+// this doesn't fail if the rest of the file is corrupt, so it can be used to
+// tell non-ELF files apart from damaged ones.
+func IsELF(path string) (bool, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(fd, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return bytes.Equal(magic, []byte(elf.ELFMAG)), nil
+}
+
+// Returns true if the ELF file is a statically linked executable, i.e. it has
+// no interpreter and doesn't need any shared libraries. Shared libraries
+// without dependencies (e.g. libc) are not considered static. This only looks
+// at the program headers in the common case, so it's cheap to call before
+// resolving dependencies.
+func IsStatic(f *elf.File) bool {
+	hasDynamic := false
+	for _, p := range f.Progs {
+		switch p.Type {
+		case elf.PT_INTERP:
+			return false
+		case elf.PT_DYNAMIC:
+			hasDynamic = true
+		}
+	}
+	if !hasDynamic {
+		return f.Type == elf.ET_EXEC || f.Type == elf.ET_DYN
+	}
+
+	// static-pie executables have a dynamic section, but no DT_NEEDED
+	needed, err := f.DynString(elf.DT_NEEDED)
+	if err != nil || len(needed) > 0 {
+		return false
+	}
+	soname, err := f.DynString(elf.DT_SONAME)
+	if err != nil || len(soname) > 0 {
+		return false
+	}
+	return true
+}
+
+// Get the library search paths set in the ELF file's DT_RUNPATH, or DT_RPATH
+// if it has no DT_RUNPATH, with $ORIGIN replaced by origin (the directory
+// the file is in)
+func RunPaths(f *elf.File, origin string) []string {
+	paths, err := f.DynString(elf.DT_RUNPATH)
+	if err != nil || len(paths) == 0 {
+		paths, err = f.DynString(elf.DT_RPATH)
+		if err != nil {
+			return nil
+		}
+	}
+
+	return splitRunPaths(paths, origin)
+}
+
+// Split the colon-separated lists of directories in DT_RUNPATH/DT_RPATH
+func splitRunPaths(paths []string, origin string) []string {
+	var dirs []string
+	for _, p := range paths {
+		for _, dir := range strings.Split(p, ":") {
+			if dir == "" {
+				continue
+			}
+			dir = strings.ReplaceAll(dir, "${ORIGIN}", origin)
+			dir = strings.ReplaceAll(dir, "$ORIGIN", origin)
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+
+	return dirs
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package elfutil
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTargetForArch(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected Target
+		err      bool
+	}{
+		{"aarch64", Target{elf.EM_AARCH64, elf.ELFCLASS64}, false},
+		{"armv7", Target{elf.EM_ARM, elf.ELFCLASS32}, false},
+		{"armhf", Target{elf.EM_ARM, elf.ELFCLASS32}, false},
+		{"x86_64", Target{elf.EM_X86_64, elf.ELFCLASS64}, false},
+		{"mips", Target{}, true},
+		{"", Target{}, true},
+	}
+	for _, table := range tables {
+		out, err := TargetForArch(table.in)
+		if table.err != (err != nil) {
+			t.Errorf("unexpected error result for %q: %v", table.in, err)
+		}
+		if out != table.expected {
+			t.Errorf("expected: %s, got: %s", table.expected, out)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	target := Target{elf.EM_AARCH64, elf.ELFCLASS64}
+	f := &elf.File{FileHeader: elf.FileHeader{Machine: elf.EM_AARCH64, Class: elf.ELFCLASS64}}
+	if !target.Matches(f) {
+		t.Error("expected match")
+	}
+	f.Class = elf.ELFCLASS32
+	if target.Matches(f) {
+		t.Error("expected mismatch for class")
+	}
+}
+
+func TestIsELF(t *testing.T) {
+	dir := t.TempDir()
+	tables := []struct {
+		contents string
+		expected bool
+	}{
+		{"\x7fELF", true},
+		// corrupt/truncated ELF is still an ELF
+		{"\x7fELF\x02\x01garbage", true},
+		{"#!/bin/sh\n", false},
+		{"\x7fEL", false},
+		{"", false},
+	}
+	for i, table := range tables {
+		path := filepath.Join(dir, "file")
+		if err := os.WriteFile(path, []byte(table.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := IsELF(path)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+		}
+		if out != table.expected {
+			t.Errorf("%d: expected: %t, got: %t", i, table.expected, out)
+		}
+	}
+
+	if _, err := IsELF(filepath.Join(dir, "does-not-exist")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestIsStatic(t *testing.T) {
+	tables := []struct {
+		typ      elf.Type
+		progs    []elf.ProgType
+		expected bool
+	}{
+		// static executable, no dynamic section
+		{elf.ET_EXEC, []elf.ProgType{elf.PT_LOAD}, true},
+		// dynamically linked executable
+		{elf.ET_EXEC, []elf.ProgType{elf.PT_LOAD, elf.PT_INTERP, elf.PT_DYNAMIC}, false},
+		{elf.ET_DYN, []elf.ProgType{elf.PT_INTERP}, false},
+		// relocatable objects (e.g. kernel modules) aren't executables
+		{elf.ET_REL, []elf.ProgType{}, false},
+	}
+	for i, table := range tables {
+		f := &elf.File{FileHeader: elf.FileHeader{Type: table.typ}}
+		for _, p := range table.progs {
+			f.Progs = append(f.Progs, &elf.Prog{ProgHeader: elf.ProgHeader{Type: p}})
+		}
+		if out := IsStatic(f); out != table.expected {
+			t.Errorf("%d: expected: %t, got: %t", i, table.expected, out)
+		}
+	}
+
+	// the test binary is usually static (Go, without cgo), but check
+	// that a real binary can be inspected without errors
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Skip("test binary is not an ELF")
+	}
+	defer f.Close()
+	IsStatic(f)
+}
+
+func TestSplitRunPaths(t *testing.T) {
+	tables := []struct {
+		paths    []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{""}, nil},
+		{[]string{"/usr/lib/foo"}, []string{"/usr/lib/foo"}},
+		{[]string{"/usr/lib/foo::/opt/lib/"}, []string{"/usr/lib/foo", "/opt/lib"}},
+		{[]string{"$ORIGIN/../lib", "${ORIGIN}"}, []string{"/usr/lib", "/usr/bin"}},
+	}
+
+	for _, table := range tables {
+		if got := splitRunPaths(table.paths, "/usr/bin"); !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.paths, table.expected, got)
+		}
+	}
+}
+
+func TestRunPaths(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("cc is required for building the test binaries")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	if err := os.WriteFile(src, []byte("int main(void) { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		ldflags  []string
+		expected []string
+	}{
+		{nil, nil},
+		// DT_RUNPATH
+		{[]string{"-Wl,-rpath,$ORIGIN/../lib:/opt/lib", "-Wl,--enable-new-dtags"}, []string{filepath.Join(filepath.Dir(dir), "lib"), "/opt/lib"}},
+		// DT_RPATH
+		{[]string{"-Wl,-rpath,/opt/lib", "-Wl,--disable-new-dtags"}, []string{"/opt/lib"}},
+	}
+
+	for i, table := range tables {
+		bin := filepath.Join(dir, "main")
+		args := append([]string{"-o", bin, src}, table.ldflags...)
+		if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+			t.Skipf("unable to build the test binary: %s: %s", err, out)
+		}
+		f, err := elf.Open(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := RunPaths(f, dir)
+		f.Close()
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%d: expected: %q, got: %q", i, table.expected, got)
+		}
+	}
+}
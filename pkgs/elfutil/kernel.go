@@ -0,0 +1,103 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package elfutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Only the start of the image is needed for finding the architecture
+const kernelHeaderSize = 4096
+
+// Get the target that the kernel image at the given path was built for. This
+// supports ELF (vmlinux), arm64 and riscv Image, arm zImage and x86 bzImage
+// kernels, optionally gzip compressed (e.g. Image.gz). Kernels are not
+// decompressed otherwise, so other formats return an error.
+func KernelTarget(path string) (Target, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return Target{}, err
+	}
+	defer fd.Close()
+
+	return kernelTarget(fd)
+}
+
+func kernelTarget(r io.Reader) (Target, error) {
+	header := make([]byte, kernelHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return Target{}, err
+	}
+	header = header[:n]
+
+	if len(header) > 2 && header[0] == 0x1f && header[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(header))
+		if err != nil {
+			return Target{}, err
+		}
+		// the header is only part of the compressed stream
+		header, err = io.ReadAll(io.LimitReader(gz, kernelHeaderSize))
+		if len(header) == 0 {
+			return Target{}, err
+		}
+	}
+
+	if bytes.HasPrefix(header, []byte(elf.ELFMAG)) {
+		return elfHeaderTarget(header)
+	}
+
+	if len(header) < 0x240 {
+		return Target{}, i18n.NewError(i18n.ElfutilUnknownKernelFormat)
+	}
+	switch {
+	case bytes.Equal(header[56:60], []byte("ARM\x64")):
+		return Target{elf.EM_AARCH64, elf.ELFCLASS64}, nil
+	case bytes.Equal(header[56:60], []byte("RSC\x05")):
+		return Target{elf.EM_RISCV, elf.ELFCLASS64}, nil
+	case binary.LittleEndian.Uint32(header[0x24:]) == 0x016f2818:
+		return Target{elf.EM_ARM, elf.ELFCLASS32}, nil
+	case bytes.Equal(header[0x202:0x206], []byte("HdrS")):
+		// XLF_KERNEL_64 in xloadflags
+		if binary.LittleEndian.Uint16(header[0x236:])&1 != 0 {
+			return Target{elf.EM_X86_64, elf.ELFCLASS64}, nil
+		}
+		return Target{elf.EM_386, elf.ELFCLASS32}, nil
+	}
+
+	return Target{}, i18n.NewError(i18n.ElfutilUnknownKernelFormat)
+}
+
+// Get the target from the ELF header at the start of the file. Only the
+// identification and e_machine are read (the same in Elf32_Ehdr and
+// Elf64_Ehdr), since the section and program headers are usually further in
+// the file than the start that is read.
+func elfHeaderTarget(header []byte) (Target, error) {
+	// e_ident, e_type and e_machine
+	if len(header) < elf.EI_NIDENT+4 {
+		return Target{}, i18n.NewError(i18n.ElfutilTruncatedHeader)
+	}
+	class := elf.Class(header[elf.EI_CLASS])
+	if class != elf.ELFCLASS32 && class != elf.ELFCLASS64 {
+		return Target{}, i18n.Errorf(i18n.ElfutilUnknownClass, class)
+	}
+	var order binary.ByteOrder
+	switch elf.Data(header[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		order = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		order = binary.BigEndian
+	default:
+		return Target{}, i18n.Errorf(i18n.ElfutilUnknownEncoding, elf.Data(header[elf.EI_DATA]))
+	}
+	machine := elf.Machine(order.Uint16(header[elf.EI_NIDENT+2:]))
+	return Target{machine, class}, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package elfutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestKernelTarget(t *testing.T) {
+	arm64 := make([]byte, 8192)
+	copy(arm64[56:], "ARM\x64")
+
+	riscv := make([]byte, 8192)
+	copy(riscv[56:], "RSC\x05")
+
+	zImage := make([]byte, 8192)
+	binary.LittleEndian.PutUint32(zImage[0x24:], 0x016f2818)
+
+	bzImage := make([]byte, 8192)
+	copy(bzImage[0x202:], "HdrS")
+	bzImage64 := append([]byte{}, bzImage...)
+	binary.LittleEndian.PutUint16(bzImage64[0x236:], 0x7f)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(arm64)
+	w.Close()
+
+	tables := []struct {
+		name     string
+		in       []byte
+		expected Target
+		err      bool
+	}{
+		{"arm64 Image", arm64, Target{elf.EM_AARCH64, elf.ELFCLASS64}, false},
+		{"arm64 Image.gz", gz.Bytes(), Target{elf.EM_AARCH64, elf.ELFCLASS64}, false},
+		{"riscv Image", riscv, Target{elf.EM_RISCV, elf.ELFCLASS64}, false},
+		{"zImage", zImage, Target{elf.EM_ARM, elf.ELFCLASS32}, false},
+		{"bzImage", bzImage, Target{elf.EM_386, elf.ELFCLASS32}, false},
+		{"bzImage 64-bit", bzImage64, Target{elf.EM_X86_64, elf.ELFCLASS64}, false},
+		{"unknown", make([]byte, 8192), Target{}, true},
+		{"short", []byte("ARM"), Target{}, true},
+	}
+	for _, table := range tables {
+		out, err := kernelTarget(bytes.NewReader(table.in))
+		if (err != nil) != table.err {
+			t.Errorf("%s: unexpected error: %v", table.name, err)
+		}
+		if out != table.expected {
+			t.Errorf("%s: expected: %s, got: %s", table.name, table.expected, out)
+		}
+	}
+}
+
+func TestKernelTargetELF(t *testing.T) {
+	// a real ELF file (like vmlinux), its section and program headers are
+	// past the start that is read
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Skip("test binary is not an ELF")
+	}
+	expected := Target{f.Machine, f.Class}
+	f.Close()
+
+	out, err := KernelTarget(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != expected {
+		t.Errorf("expected: %s, got: %s", expected, out)
+	}
+
+	// gzip compressed, e.g. vmlinux.gz
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	w.Close()
+	if out, err := kernelTarget(&gz); err != nil || out != expected {
+		t.Errorf("gzip: expected: %s, got: %s, %v", expected, out, err)
+	}
+
+	if _, err := kernelTarget(bytes.NewReader(data[:elf.EI_NIDENT])); err == nil {
+		t.Error("expected error for truncated ELF header")
+	}
+}
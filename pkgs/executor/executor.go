@@ -0,0 +1,92 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Executor runs external commands, so that they can be replaced in tests or
+// run in a different environment (e.g. a chroot or fakeroot)
+type Executor interface {
+	// Run the command and wait for it to finish, it's killed when the
+	// context is done
+	Run(ctx context.Context, name string, args ...string) error
+}
+
+// Host runs commands directly on the host
+type Host struct {
+	Stdout io.Writer
+	Stderr io.Writer
+	// working directory of the commands, the current one if empty
+	Dir string
+}
+
+// Returns a Host executor with the output of commands going to the output
+// of this process
+func NewHost() Host {
+	return Host{Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+func (h Host) Run(ctx context.Context, name string, args ...string) error {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return i18n.Errorf(i18n.ExecutorNotFound, name)
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = h.Stdout
+	cmd.Stderr = h.Stderr
+	cmd.Dir = h.Dir
+	if err := cmd.Run(); err != nil {
+		// the error of a killed command is only "signal: killed"
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: %w", name, ctx.Err())
+		}
+		return err
+	}
+	return nil
+}
+
+// Wrapped runs commands with another executor, prefixed with a wrapper
+// command, e.g. "fakeroot" or "chroot /mnt"
+type Wrapped struct {
+	Executor Executor
+	Wrapper  []string
+}
+
+func (w Wrapped) Run(ctx context.Context, name string, args ...string) error {
+	if len(w.Wrapper) == 0 {
+		return w.Executor.Run(ctx, name, args...)
+	}
+	wrapperArgs := append(append(append([]string{}, w.Wrapper[1:]...), name), args...)
+	return w.Executor.Run(ctx, w.Wrapper[0], wrapperArgs...)
+}
+
+// Recorder records the commands it is asked to run instead of running them,
+// and returns Err for each, for use in tests
+type Recorder struct {
+	Commands [][]string
+	Err      error
+}
+
+func (r *Recorder) Run(ctx context.Context, name string, args ...string) error {
+	r.Commands = append(r.Commands, append([]string{name}, args...))
+	return r.Err
+}
+
+// Returns the recorded commands, one per line
+func (r *Recorder) String() string {
+	var lines []string
+	for _, c := range r.Commands {
+		lines = append(lines, strings.Join(c, " "))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHost(t *testing.T) {
+	var stdout bytes.Buffer
+	h := Host{Stdout: &stdout}
+	if err := h.Run(context.Background(), "sh", "-c", "echo hello"); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "hello\n" {
+		t.Errorf("expected: %q, got: %q", "hello\n", stdout.String())
+	}
+	if err := h.Run(context.Background(), "sh", "-c", "exit 1"); err == nil {
+		t.Error("expected error for failing command")
+	}
+	if err := h.Run(context.Background(), "not-a-command-that-exists"); err == nil {
+		t.Error("expected error for missing command")
+	}
+
+	stdout.Reset()
+	dir := t.TempDir()
+	h.Dir = dir
+	if err := h.Run(context.Background(), "pwd"); err != nil || stdout.String() != dir+"\n" {
+		t.Errorf("expected to run in %s, got: %q, %v", dir, stdout.String(), err)
+	}
+}
+
+func TestHostCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if err := (Host{}).Run(ctx, "sleep", "10"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected: %v, got: %v", context.Canceled, err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("command wasn't killed when the context was canceled")
+	}
+}
+
+func TestWrapped(t *testing.T) {
+	r := &Recorder{}
+	w := Wrapped{Executor: r, Wrapper: []string{"chroot", "/mnt"}}
+	if err := w.Run(context.Background(), "boot-deploy", "-i", "initramfs"); err != nil {
+		t.Fatal(err)
+	}
+	w.Wrapper = nil
+	if err := w.Run(context.Background(), "true"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "chroot /mnt boot-deploy -i initramfs\ntrue"
+	if r.String() != expected {
+		t.Errorf("expected: %q, got: %q", expected, r.String())
+	}
+}
+
+func TestRecorderErr(t *testing.T) {
+	errFailed := errors.New("failed")
+	r := &Recorder{Err: errFailed}
+	if err := r.Run(context.Background(), "boot-deploy"); !errors.Is(err, errFailed) {
+		t.Errorf("expected: %v, got: %v", errFailed, err)
+	}
+}
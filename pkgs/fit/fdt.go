@@ -0,0 +1,131 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Values used in flattened device tree blobs, see the devicetree
+// specification
+const (
+	fdtMagic          = 0xd00dfeed
+	fdtVersion        = 17
+	fdtLastCompatible = 16
+	fdtHeaderSize     = 40
+	fdtBeginNode      = 0x1
+	fdtEndNode        = 0x2
+	fdtProp           = 0x3
+	fdtEnd            = 0x9
+)
+
+type property struct {
+	name  string
+	value []byte
+}
+
+// A node of a device tree, properties and children are written in the order
+// they are added
+type node struct {
+	name     string
+	props    []property
+	children []*node
+}
+
+func newNode(name string) *node {
+	return &node{name: name}
+}
+
+func (n *node) addChild(name string) *node {
+	c := newNode(name)
+	n.children = append(n.children, c)
+	return c
+}
+
+func (n *node) setBytes(name string, value []byte) {
+	n.props = append(n.props, property{name, value})
+}
+
+func (n *node) setString(name string, value string) {
+	n.setBytes(name, append([]byte(value), 0))
+}
+
+func (n *node) setU32(name string, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	n.setBytes(name, b)
+}
+
+// Encode the tree with n as the root node into a flattened device tree blob
+func (n *node) encode() []byte {
+	var dtStruct bytes.Buffer
+	var dtStrings bytes.Buffer
+	nameOffsets := map[string]uint32{}
+	n.encodeNode(&dtStruct, &dtStrings, nameOffsets)
+	binary.Write(&dtStruct, binary.BigEndian, uint32(fdtEnd))
+
+	// The memory reservation block is only the terminating empty entry,
+	// right after the (8 byte aligned) header
+	rsvmapOff := uint32(fdtHeaderSize)
+	structOff := rsvmapOff + 16
+	stringsOff := structOff + uint32(dtStruct.Len())
+	totalSize := stringsOff + uint32(dtStrings.Len())
+
+	var out bytes.Buffer
+	for _, v := range []uint32{
+		fdtMagic,
+		totalSize,
+		structOff,
+		stringsOff,
+		rsvmapOff,
+		fdtVersion,
+		fdtLastCompatible,
+		0, // boot_cpuid_phys
+		uint32(dtStrings.Len()),
+		uint32(dtStruct.Len()),
+	} {
+		binary.Write(&out, binary.BigEndian, v)
+	}
+	out.Write(make([]byte, 16))
+	out.Write(dtStruct.Bytes())
+	out.Write(dtStrings.Bytes())
+
+	return out.Bytes()
+}
+
+func (n *node) encodeNode(dtStruct *bytes.Buffer, dtStrings *bytes.Buffer, nameOffsets map[string]uint32) {
+	binary.Write(dtStruct, binary.BigEndian, uint32(fdtBeginNode))
+	dtStruct.WriteString(n.name)
+	dtStruct.WriteByte(0)
+	pad(dtStruct)
+
+	for _, p := range n.props {
+		off, ok := nameOffsets[p.name]
+		if !ok {
+			off = uint32(dtStrings.Len())
+			nameOffsets[p.name] = off
+			dtStrings.WriteString(p.name)
+			dtStrings.WriteByte(0)
+		}
+		binary.Write(dtStruct, binary.BigEndian, uint32(fdtProp))
+		binary.Write(dtStruct, binary.BigEndian, uint32(len(p.value)))
+		binary.Write(dtStruct, binary.BigEndian, off)
+		dtStruct.Write(p.value)
+		pad(dtStruct)
+	}
+
+	for _, c := range n.children {
+		c.encodeNode(dtStruct, dtStrings, nameOffsets)
+	}
+
+	binary.Write(dtStruct, binary.BigEndian, uint32(fdtEndNode))
+}
+
+// Pad the buffer to a multiple of 4 bytes
+func pad(b *bytes.Buffer) {
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
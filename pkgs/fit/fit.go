@@ -0,0 +1,230 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package fit
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Hash algorithms for the hash nodes of the images
+const (
+	HashNone   = "none"
+	HashCrc32  = "crc32"
+	HashSha1   = "sha1"
+	HashSha256 = "sha256"
+)
+
+// U-Boot names of the architectures, by deviceinfo_arch
+var ubootArch = map[string]string{
+	"armhf":   "arm",
+	"armv7":   "arm",
+	"aarch64": "arm64",
+	"x86":     "x86",
+	"x86_64":  "x86_64",
+	"riscv64": "riscv",
+}
+
+// Dtb is a device tree blob to include in the FIT image, each gets its own
+// configuration
+type Dtb struct {
+	// Used as the description of the dtb and its configuration
+	Name string
+	Data []byte
+}
+
+// Image is the contents of a FIT image
+type Image struct {
+	Description string
+	// deviceinfo_arch
+	Arch      string
+	Kernel    []byte
+	Initramfs []byte
+	Dtbs      []Dtb
+	// One of the Hash* constants, "" is the same as HashSha256. Signed
+	// images use sha256 unless this is sha1.
+	Hash string
+	// Images are signed with the key if it's set, with U-Boot's
+	// <hash>,rsa<bits> algorithm. The key name hint tells U-Boot which
+	// public key in its control FDT to verify the signatures with.
+	Key         *rsa.PrivateKey
+	KeyNameHint string
+	Timestamp   time.Time
+}
+
+// ParseHash checks that the hash algorithm is supported, "" means the default
+// (sha256)
+func ParseHash(s string) (string, error) {
+	switch s {
+	case "":
+		return HashSha256, nil
+	case HashNone, HashCrc32, HashSha1, HashSha256:
+		return s, nil
+	}
+	return "", i18n.Errorf(i18n.FitUnsupportedHash, s)
+}
+
+// CheckArch returns an error if FIT images can't be built for the given
+// deviceinfo_arch
+func CheckArch(arch string) error {
+	if _, ok := ubootArch[arch]; !ok {
+		return i18n.Errorf(i18n.FitUnsupportedArch, arch)
+	}
+	return nil
+}
+
+// ReadKey reads a PEM encoded RSA private key (PKCS #1 or #8), like the
+// ones mkimage signs with
+func ReadKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, i18n.Errorf(i18n.FitNoPEMData, path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, i18n.Errorf(i18n.FitNotRSAKey, path)
+	}
+	return rsaKey, nil
+}
+
+// Build the FIT image, producing the same structure as 'mkimage -f auto'
+// with a kernel_noload kernel (U-Boot boots it where it was loaded to), and
+// a configuration per dtb
+func Build(img Image) ([]byte, error) {
+	if err := CheckArch(img.Arch); err != nil {
+		return nil, err
+	}
+	arch := ubootArch[img.Arch]
+	hash, err := ParseHash(img.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if img.Key != nil && (hash == HashNone || hash == HashCrc32) {
+		hash = HashSha256
+	}
+
+	root := newNode("")
+	root.setU32("timestamp", uint32(img.Timestamp.Unix()))
+	root.setString("description", img.Description)
+	root.setU32("#address-cells", 1)
+
+	images := root.addChild("images")
+	addImage := func(name string, description string, typ string, data []byte) error {
+		n := images.addChild(name)
+		n.setString("description", description)
+		n.setBytes("data", data)
+		n.setString("type", typ)
+		n.setString("arch", arch)
+		if typ != "flat_dt" {
+			n.setString("os", "linux")
+		}
+		n.setString("compression", "none")
+		if typ == "kernel_noload" {
+			n.setU32("load", 0)
+			n.setU32("entry", 0)
+		}
+		if hash != HashNone {
+			h := n.addChild("hash-1")
+			h.setString("algo", hash)
+			h.setBytes("value", checksum(hash, data))
+		}
+		if img.Key != nil {
+			sig, err := sign(img.Key, hash, data)
+			if err != nil {
+				return i18n.Errorf(i18n.FitSignFailed, name, err)
+			}
+			s := n.addChild("signature-1")
+			s.setString("algo", fmt.Sprintf("%s,rsa%d", hash, img.Key.N.BitLen()))
+			s.setString("key-name-hint", img.KeyNameHint)
+			s.setBytes("value", sig)
+		}
+		return nil
+	}
+
+	if len(img.Kernel) == 0 {
+		return nil, i18n.NewError(i18n.FitNoKernel)
+	}
+	if err := addImage("kernel", "Linux kernel", "kernel_noload", img.Kernel); err != nil {
+		return nil, err
+	}
+	if len(img.Initramfs) > 0 {
+		if err := addImage("ramdisk", "Ramdisk", "ramdisk", img.Initramfs); err != nil {
+			return nil, err
+		}
+	}
+	for i, dtb := range img.Dtbs {
+		if err := addImage(fmt.Sprintf("fdt-%d", i+1), dtb.Name, "flat_dt", dtb.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	configs := root.addChild("configurations")
+	configs.setString("default", "conf-1")
+	addConfig := func(name string, description string, fdt string) {
+		n := configs.addChild(name)
+		n.setString("description", description)
+		n.setString("kernel", "kernel")
+		if len(img.Initramfs) > 0 {
+			n.setString("ramdisk", "ramdisk")
+		}
+		if fdt != "" {
+			n.setString("fdt", fdt)
+		}
+	}
+	if len(img.Dtbs) == 0 {
+		addConfig("conf-1", img.Description, "")
+	}
+	for i, dtb := range img.Dtbs {
+		addConfig(fmt.Sprintf("conf-%d", i+1), dtb.Name, fmt.Sprintf("fdt-%d", i+1))
+	}
+
+	return root.encode(), nil
+}
+
+func checksum(hash string, data []byte) []byte {
+	switch hash {
+	case HashCrc32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, crc32.ChecksumIEEE(data))
+		return b
+	case HashSha1:
+		sum := sha1.Sum(data)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+}
+
+// Sign the data of an image (U-Boot verifies image signatures over only the
+// data property) with PKCS #1 v1.5 padding, U-Boot's default
+func sign(key *rsa.PrivateKey, hash string, data []byte) ([]byte, error) {
+	h := crypto.SHA256
+	if hash == HashSha1 {
+		h = crypto.SHA1
+	}
+	return rsa.SignPKCS1v15(nil, key, h, checksum(hash, data))
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package fit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Decode a flattened device tree blob into a map of property paths (e.g.
+// /images/kernel/data) to values
+func decode(t *testing.T, blob []byte) map[string][]byte {
+	t.Helper()
+	if binary.BigEndian.Uint32(blob[0:4]) != fdtMagic {
+		t.Fatal("bad magic")
+	}
+	if int(binary.BigEndian.Uint32(blob[4:8])) != len(blob) {
+		t.Fatalf("totalsize %d doesn't match blob size %d", binary.BigEndian.Uint32(blob[4:8]), len(blob))
+	}
+	structOff := binary.BigEndian.Uint32(blob[8:12])
+	stringsOff := binary.BigEndian.Uint32(blob[12:16])
+
+	props := map[string][]byte{}
+	var path []string
+	off := structOff
+	u32 := func() uint32 {
+		v := binary.BigEndian.Uint32(blob[off : off+4])
+		off += 4
+		return v
+	}
+	align := func() {
+		off = (off + 3) &^ 3
+	}
+	for {
+		switch token := u32(); token {
+		case fdtBeginNode:
+			end := off + uint32(bytes.IndexByte(blob[off:], 0))
+			path = append(path, string(blob[off:end]))
+			off = end + 1
+			align()
+		case fdtEndNode:
+			path = path[:len(path)-1]
+		case fdtProp:
+			size := u32()
+			nameOff := stringsOff + u32()
+			name := string(blob[nameOff : nameOff+uint32(bytes.IndexByte(blob[nameOff:], 0))])
+			props[strings.Join(append(path, name), "/")] = blob[off : off+size]
+			off += size
+			align()
+		case fdtEnd:
+			if len(path) != 0 {
+				t.Fatalf("unterminated nodes: %q", path)
+			}
+			return props
+		default:
+			t.Fatalf("unexpected token %x at %d", token, off-4)
+		}
+	}
+}
+
+func str(s string) string {
+	return s + "\x00"
+}
+
+func TestBuild(t *testing.T) {
+	img := Image{
+		Description: "postmarketOS",
+		Arch:        "aarch64",
+		Kernel:      []byte("kernel"),
+		Initramfs:   []byte("initramfs"),
+		Dtbs: []Dtb{
+			{Name: "sun50i-a64-pinephone-1.1", Data: []byte("dtb1")},
+			{Name: "sun50i-a64-pinephone-1.2", Data: []byte("dtb2")},
+		},
+		Timestamp: time.Unix(1234, 0),
+	}
+	blob, err := Build(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := decode(t, blob)
+
+	kernelSum := sha256.Sum256(img.Kernel)
+	expected := map[string]string{
+		"/timestamp":                         "\x00\x00\x04\xd2",
+		"/description":                       str("postmarketOS"),
+		"/images/kernel/data":                "kernel",
+		"/images/kernel/type":                str("kernel_noload"),
+		"/images/kernel/arch":                str("arm64"),
+		"/images/kernel/os":                  str("linux"),
+		"/images/kernel/hash-1/algo":         str("sha256"),
+		"/images/kernel/hash-1/value":        string(kernelSum[:]),
+		"/images/ramdisk/data":               "initramfs",
+		"/images/ramdisk/type":               str("ramdisk"),
+		"/images/fdt-2/data":                 "dtb2",
+		"/images/fdt-2/type":                 str("flat_dt"),
+		"/configurations/default":            str("conf-1"),
+		"/configurations/conf-1/fdt":         str("fdt-1"),
+		"/configurations/conf-2/description": str("sun50i-a64-pinephone-1.2"),
+		"/configurations/conf-2/kernel":      str("kernel"),
+		"/configurations/conf-2/ramdisk":     str("ramdisk"),
+		"/configurations/conf-2/fdt":         str("fdt-2"),
+	}
+	for path, value := range expected {
+		if got, ok := props[path]; !ok || string(got) != value {
+			t.Errorf("%s: expected: %q, got: %q", path, value, got)
+		}
+	}
+	if _, ok := props["/images/fdt-1/os"]; ok {
+		t.Error("unexpected os property for dtb")
+	}
+	if _, ok := props["/images/kernel/signature-1/value"]; ok {
+		t.Error("unexpected signature without a key")
+	}
+
+	img.Hash = HashNone
+	img.Dtbs = nil
+	img.Initramfs = nil
+	if blob, err = Build(img); err != nil {
+		t.Fatal(err)
+	}
+	props = decode(t, blob)
+	for _, path := range []string{"/images/kernel/hash-1/algo", "/images/ramdisk/data", "/configurations/conf-1/fdt", "/configurations/conf-1/ramdisk"} {
+		if _, ok := props[path]; ok {
+			t.Errorf("unexpected property: %s", path)
+		}
+	}
+	if string(props["/configurations/conf-1/kernel"]) != str("kernel") {
+		t.Errorf("expected a configuration for the kernel, got: %q", props)
+	}
+
+	if _, err := Build(Image{Arch: "ppc64le", Kernel: []byte("kernel")}); err == nil {
+		t.Error("expected error for unsupported arch")
+	}
+	if _, err := Build(Image{Arch: "aarch64"}); err == nil {
+		t.Error("expected error without a kernel")
+	}
+	if _, err := Build(Image{Arch: "aarch64", Kernel: []byte("kernel"), Hash: "md5"}); err == nil {
+		t.Error("expected error for unsupported hash")
+	}
+}
+
+func TestBuildSigned(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "dev.key")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key, err = ReadKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	img := Image{
+		Arch:        "armv7",
+		Kernel:      []byte("kernel"),
+		Initramfs:   []byte("initramfs"),
+		Hash:        HashCrc32,
+		Key:         key,
+		KeyNameHint: "dev",
+	}
+	blob, err := Build(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := decode(t, blob)
+
+	for name, data := range map[string][]byte{"kernel": img.Kernel, "ramdisk": img.Initramfs} {
+		prefix := "/images/" + name + "/signature-1/"
+		if algo := string(props[prefix+"algo"]); algo != str("sha256,rsa2048") {
+			t.Errorf("%s: unexpected algo: %q", name, algo)
+		}
+		if hint := string(props[prefix+"key-name-hint"]); hint != str("dev") {
+			t.Errorf("%s: unexpected key name hint: %q", name, hint)
+		}
+		sum := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], props[prefix+"value"]); err != nil {
+			t.Errorf("%s: invalid signature: %s", name, err)
+		}
+	}
+
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadKey(keyFile); err == nil {
+		t.Error("expected error for invalid key")
+	}
+}
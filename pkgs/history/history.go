@@ -0,0 +1,215 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/misc"
+)
+
+// Default location of the history file, which records statistics of past
+// builds
+const DefaultPath = "/var/lib/mkinitfs/history.json"
+
+// Number of builds kept in the history, older ones are dropped
+const MaxBuilds = 100
+
+// Build is the statistics of a successful build
+type Build struct {
+	Time          time.Time `json:"time"`
+	KernelVersion string    `json:"kernel_version"`
+	// how long generating and deploying the archives took, in seconds
+	Duration float64   `json:"duration"`
+	Archives []Archive `json:"archives"`
+}
+
+// Archive is the statistics of an archive generated by a build
+type Archive struct {
+	Name string `json:"name"`
+	// in bytes
+	Size int64 `json:"size"`
+	// number of files from the system in the archive
+	Files int `json:"files"`
+}
+
+// Read the builds in the history at the given path, oldest first. A missing
+// history file is not an error, and returns no builds.
+func Read(path string) ([]Build, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var builds []Build
+	if err := json.Unmarshal(data, &builds); err != nil {
+		return nil, i18n.Errorf(i18n.HistoryInvalidFile, path, err)
+	}
+	return builds, nil
+}
+
+// Add the build to the history at the given path, dropping the oldest builds
+// when there are more than MaxBuilds. The file is replaced atomically.
+func Append(path string, b Build) error {
+	builds, err := Read(path)
+	if err != nil {
+		return err
+	}
+	builds = append(builds, b)
+	if len(builds) > MaxBuilds {
+		builds = builds[len(builds)-MaxBuilds:]
+	}
+
+	data, err := json.MarshalIndent(builds, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Last returns the statistics of the archive with the given name in the last
+// build that has it, false if no build has it
+func Last(builds []Build, name string) (Build, Archive, bool) {
+	for i := len(builds) - 1; i >= 0; i-- {
+		for _, a := range builds[i].Archives {
+			if a.Name == name {
+				return builds[i], a, true
+			}
+		}
+	}
+	return Build{}, Archive{}, false
+}
+
+// Threshold is how much an archive may grow from one build to the next, either
+// in percent of the old size or in bytes. The zero value disables the check.
+type Threshold struct {
+	Percent float64
+	Size    int64
+}
+
+// Parse a threshold, a percentage (e.g. "10%") or a size (e.g. "512K"). An
+// empty string or 0 disables the check.
+func ParseThreshold(s string) (Threshold, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent < 0 {
+			return Threshold{}, i18n.Errorf(i18n.HistoryInvalidPercentage, s)
+		}
+		return Threshold{Percent: percent}, nil
+	}
+	if s == "" {
+		return Threshold{}, nil
+	}
+	size, err := misc.ParseSize(s)
+	if err != nil {
+		return Threshold{}, err
+	}
+	return Threshold{Size: size}, nil
+}
+
+// Exceeded returns true if growing from the old size to the new one is more
+// than the threshold
+func (t Threshold) Exceeded(old int64, new int64) bool {
+	growth := new - old
+	switch {
+	case growth <= 0:
+		return false
+	case t.Percent > 0:
+		return old == 0 || float64(growth)*100/float64(old) > t.Percent
+	case t.Size > 0:
+		return growth > t.Size
+	}
+	return false
+}
+
+func (t Threshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return misc.FormatSize(t.Size)
+}
+
+// Width of the longest bar in Plot
+const barWidth = 40
+
+// Plot the sizes of each archive over the last builds (up to n, all if n is
+// 0) as a bar chart, with the change from the first to the last build, e.g.:
+//
+//	initramfs
+//	  2021-09-01 12:00  5.10.0   4.0M    3419 files  ##################
+//	  2021-10-01 12:00  5.14.0   4.5M    3631 files  ####################
+//	  4.0M -> 4.5M (+12.5%) over 2 builds
+func Plot(w io.Writer, builds []Build, n int) {
+	if n > 0 && len(builds) > n {
+		builds = builds[len(builds)-n:]
+	}
+	if len(builds) == 0 {
+		fmt.Fprintln(w, "No builds recorded yet")
+		return
+	}
+
+	names := make(misc.StringSet)
+	for _, b := range builds {
+		for _, a := range b.Archives {
+			names[a.Name] = false
+		}
+	}
+
+	for _, name := range names.Sorted() {
+		type point struct {
+			build   Build
+			archive Archive
+		}
+		var points []point
+		var max int64
+		for _, b := range builds {
+			for _, a := range b.Archives {
+				if a.Name == name {
+					points = append(points, point{b, a})
+					if a.Size > max {
+						max = a.Size
+					}
+				}
+			}
+		}
+
+		fmt.Fprintln(w, name)
+		for _, p := range points {
+			bar := 0
+			if max > 0 {
+				bar = int(p.archive.Size * barWidth / max)
+			}
+			fmt.Fprintf(w, "  %s  %-24s %6s %7d files  %s\n", p.build.Time.Local().Format("2006-01-02 15:04"),
+				p.build.KernelVersion, misc.FormatSize(p.archive.Size), p.archive.Files, strings.Repeat("#", bar))
+		}
+
+		first, last := points[0].archive.Size, points[len(points)-1].archive.Size
+		change := ""
+		if first > 0 {
+			change = fmt.Sprintf(" (%+.1f%%)", float64(last-first)*100/float64(first))
+		}
+		fmt.Fprintf(w, "  %s -> %s%s over %d builds\n", misc.FormatSize(first), misc.FormatSize(last), change, len(points))
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package history
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mkinitfs", "history.json")
+	if builds, err := Read(path); err != nil || builds != nil {
+		t.Errorf("expected no builds and no error, got: %+v, %v", builds, err)
+	}
+
+	var expected []Build
+	for i := 0; i < MaxBuilds+2; i++ {
+		b := Build{
+			Time:          time.Unix(int64(1630000000+i), 0).UTC(),
+			KernelVersion: fmt.Sprintf("5.14.%d", i),
+			Duration:      1.5,
+			Archives:      []Archive{{Name: "initramfs", Size: int64(1000 + i), Files: 10}},
+		}
+		if err := Append(path, b); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, b)
+	}
+
+	builds, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(builds, expected[2:]) {
+		t.Errorf("expected the last %d builds, got: %+v", MaxBuilds, builds)
+	}
+}
+
+func TestPlot(t *testing.T) {
+	builds := []Build{
+		{Time: time.Unix(1630000000, 0), KernelVersion: "5.10.0", Archives: []Archive{
+			{Name: "initramfs", Size: 4 << 20, Files: 3419},
+			{Name: "initramfs-extra", Size: 8 << 20, Files: 1200},
+		}},
+		{Time: time.Unix(1632000000, 0), KernelVersion: "5.14.0", Archives: []Archive{
+			{Name: "initramfs", Size: 5 << 20, Files: 3631},
+		}},
+	}
+
+	var out strings.Builder
+	Plot(&out, builds, 0)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 7 || lines[0] != "initramfs" || lines[4] != "initramfs-extra" {
+		t.Fatalf("unexpected plot:\n%s", out.String())
+	}
+	if !strings.HasSuffix(lines[1], " "+strings.Repeat("#", barWidth*4/5)) || !strings.HasSuffix(lines[2], " "+strings.Repeat("#", barWidth)) {
+		t.Errorf("unexpected bars:\n%s", out.String())
+	}
+	if expected := "  4.0M -> 5.0M (+25.0%) over 2 builds"; lines[3] != expected {
+		t.Errorf("expected: %q, got: %q", expected, lines[3])
+	}
+
+	out.Reset()
+	Plot(&out, builds, 1)
+	if strings.Contains(out.String(), "5.10.0") {
+		t.Errorf("expected only the last build, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	Plot(&out, nil, 0)
+	if out.String() != "No builds recorded yet\n" {
+		t.Errorf("unexpected output for no builds: %q", out.String())
+	}
+}
+
+func TestLast(t *testing.T) {
+	builds := []Build{
+		{KernelVersion: "5.10.0", Archives: []Archive{{Name: "initramfs", Size: 1}, {Name: "initramfs-extra", Size: 2}}},
+		{KernelVersion: "5.14.0", Archives: []Archive{{Name: "initramfs", Size: 3}}},
+	}
+	if b, a, ok := Last(builds, "initramfs"); !ok || b.KernelVersion != "5.14.0" || a.Size != 3 {
+		t.Errorf("unexpected last initramfs: %+v, %+v, %v", b, a, ok)
+	}
+	if b, a, ok := Last(builds, "initramfs-extra"); !ok || b.KernelVersion != "5.10.0" || a.Size != 2 {
+		t.Errorf("unexpected last initramfs-extra: %+v, %+v, %v", b, a, ok)
+	}
+	if _, _, ok := Last(builds, "boot.img"); ok {
+		t.Error("expected no boot.img")
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	tables := []struct {
+		in       string
+		old      int64
+		new      int64
+		exceeded bool
+	}{
+		{"10%", 1000, 1100, false},
+		{"10%", 1000, 1101, true},
+		{"10%", 1000, 500, false},
+		{"10%", 0, 1, true},
+		{"2.5%", 1000, 1030, true},
+		{"1K", 1000, 2024, false},
+		{"1K", 1000, 2025, true},
+		{"", 1000, 1 << 30, false},
+		{"0", 1000, 1 << 30, false},
+		{"0%", 1000, 1 << 30, false},
+	}
+	for _, table := range tables {
+		th, err := ParseThreshold(table.in)
+		if err != nil {
+			t.Errorf("%q: %s", table.in, err)
+			continue
+		}
+		if got := th.Exceeded(table.old, table.new); got != table.exceeded {
+			t.Errorf("%q: %d -> %d: expected exceeded: %v, got: %v", table.in, table.old, table.new, table.exceeded, got)
+		}
+	}
+
+	for _, in := range []string{"ten%", "-1%", "big", "-1K"} {
+		if _, err := ParseThreshold(in); err == nil {
+			t.Errorf("expected error for: %q", in)
+		}
+	}
+}
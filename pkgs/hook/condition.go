@@ -0,0 +1,205 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hook
+
+import (
+	"strings"
+	"unicode"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// LookupFunc returns the value of the variable with the given name, and false
+// if it isn't a known variable
+type LookupFunc func(name string) (string, bool)
+
+// EvalCondition evaluates a hook condition. Conditions compare variables
+// (typically deviceinfo keys) with quoted strings, and can be combined:
+//
+//	deviceinfo_mesa_driver == "panfrost"
+//	arch == "aarch64" && !(codename == "foo" || codename == "bar")
+//
+// An empty condition is always true.
+func EvalCondition(condition string, lookup LookupFunc) (bool, error) {
+	if strings.TrimSpace(condition) == "" {
+		return true, nil
+	}
+
+	tokens, err := tokenize(condition)
+	if err != nil {
+		return false, err
+	}
+
+	p := &condParser{tokens: tokens, lookup: lookup}
+	result, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if p.pos != len(p.tokens) {
+		return false, i18n.Errorf(i18n.HookConditionUnexpected, p.tokens[p.pos].val, condition)
+	}
+
+	return result, nil
+}
+
+type tokenType int
+
+const (
+	tokIdent tokenType = iota
+	tokString
+	tokOp
+)
+
+type token struct {
+	typ tokenType
+	val string
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, i18n.Errorf(i18n.HookConditionUnterminated, s)
+			}
+			tokens = append(tokens, token{tokString, s[i+1 : i+1+end]})
+			i += end + 2
+		case c == '(' || c == ')':
+			tokens = append(tokens, token{tokOp, string(c)})
+			i++
+		case strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, token{tokOp, s[i : i+2]})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, token{tokOp, "!"})
+			i++
+		case c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			start := i
+			for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, s[start:i]})
+		default:
+			return nil, i18n.Errorf(i18n.HookConditionUnexpectedChar, c, s)
+		}
+	}
+
+	return tokens, nil
+}
+
+type condParser struct {
+	tokens []token
+	pos    int
+	lookup LookupFunc
+}
+
+func (p *condParser) peekOp(op string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].typ == tokOp && p.tokens[p.pos].val == op
+}
+
+func (p *condParser) next() (token, error) {
+	if p.pos >= len(p.tokens) {
+		return token{}, i18n.Errorf(i18n.HookConditionEnd)
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+// or := and ('||' and)*
+func (p *condParser) parseOr() (bool, error) {
+	result, err := p.parseAnd()
+	if err != nil {
+		return false, err
+	}
+	for p.peekOp("||") {
+		p.pos++
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return false, err
+		}
+		result = result || rhs
+	}
+	return result, nil
+}
+
+// and := unary ('&&' unary)*
+func (p *condParser) parseAnd() (bool, error) {
+	result, err := p.parseUnary()
+	if err != nil {
+		return false, err
+	}
+	for p.peekOp("&&") {
+		p.pos++
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return false, err
+		}
+		result = result && rhs
+	}
+	return result, nil
+}
+
+// unary := '!' unary | '(' or ')' | comparison
+func (p *condParser) parseUnary() (bool, error) {
+	if p.peekOp("!") {
+		p.pos++
+		result, err := p.parseUnary()
+		return !result, err
+	}
+	if p.peekOp("(") {
+		p.pos++
+		result, err := p.parseOr()
+		if err != nil {
+			return false, err
+		}
+		if !p.peekOp(")") {
+			return false, i18n.Errorf(i18n.HookConditionMissingParen)
+		}
+		p.pos++
+		return result, nil
+	}
+	return p.parseComparison()
+}
+
+// comparison := ident ('==' | '!=') string
+func (p *condParser) parseComparison() (bool, error) {
+	ident, err := p.next()
+	if err != nil {
+		return false, err
+	}
+	if ident.typ != tokIdent {
+		return false, i18n.Errorf(i18n.HookConditionNoVariable, ident.val)
+	}
+	op, err := p.next()
+	if err != nil {
+		return false, err
+	}
+	if op.typ != tokOp || (op.val != "==" && op.val != "!=") {
+		return false, i18n.Errorf(i18n.HookConditionNoOperator, ident.val, op.val)
+	}
+	val, err := p.next()
+	if err != nil {
+		return false, err
+	}
+	if val.typ != tokString {
+		return false, i18n.Errorf(i18n.HookConditionNoString, op.val, val.val)
+	}
+
+	actual, ok := p.lookup(ident.val)
+	if !ok {
+		return false, i18n.Errorf(i18n.HookConditionUnknownVariable, ident.val)
+	}
+
+	if op.val == "==" {
+		return actual == val.val, nil
+	}
+	return actual != val.val, nil
+}
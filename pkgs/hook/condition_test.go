@@ -0,0 +1,56 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hook
+
+import (
+	"testing"
+)
+
+func TestEvalCondition(t *testing.T) {
+	vars := map[string]string{
+		"arch":                   "aarch64",
+		"deviceinfo_mesa_driver": "panfrost",
+		"codename":               "pine64-pinephone",
+		"empty":                  "",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+
+	tables := []struct {
+		in       string
+		expected bool
+		err      bool
+	}{
+		{"", true, false},
+		{`arch == "aarch64"`, true, false},
+		{`arch=="aarch64"`, true, false},
+		{`arch != "aarch64"`, false, false},
+		{`deviceinfo_mesa_driver == "panfrost"`, true, false},
+		{`empty == ""`, true, false},
+		{`arch == "aarch64" && codename == "foo"`, false, false},
+		{`arch == "x86_64" || codename == "pine64-pinephone"`, true, false},
+		{`!(arch == "x86_64")`, true, false},
+		{`arch == "aarch64" && !(codename == "foo" || codename == "bar")`, true, false},
+		// && binds tighter than ||
+		{`arch == "x86_64" && codename == "foo" || empty == ""`, true, false},
+		{`unknown == "foo"`, false, true},
+		{`arch == aarch64`, false, true},
+		{`arch = "aarch64"`, false, true},
+		{`arch == "aarch64`, false, true},
+		{`(arch == "aarch64"`, false, true},
+		{`arch == "aarch64" codename`, false, true},
+		{`arch ==`, false, true},
+	}
+	for _, table := range tables {
+		out, err := EvalCondition(table.in, lookup)
+		if table.err != (err != nil) {
+			t.Errorf("unexpected error result for %q: %v", table.in, err)
+		}
+		if out != table.expected {
+			t.Errorf("%q: expected: %t, got: %t", table.in, table.expected, out)
+		}
+	}
+}
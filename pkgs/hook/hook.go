@@ -0,0 +1,184 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hook
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Archives that a hook can target
+const (
+	ArchiveInitfs      = "initramfs"
+	ArchiveInitfsExtra = "initramfs-extra"
+)
+
+// Priority of hooks that don't set one
+const DefaultPriority = 50
+
+// Hook is a declarative hook, listing everything a hook package needs in the
+// initramfs in one file. Two formats are supported:
+//
+// The flat format (<name>.hook), where each line is "<type> <value>", e.g.:
+//
+//	# comments and empty lines are ignored
+//	file /usr/bin/foo
+//	module dm-verity
+//	firmware qcom/a630_sqe.fw
+//
+// The manifest format (<name>.toml), which also supports metadata:
+//
+//	description = "Support for foo"
+//	priority = 20
+//	archive = "initramfs-extra"
+//	condition = 'deviceinfo_mesa_driver == "panfrost"'
+//	files = ["/usr/bin/foo"]
+//	modules = ["dm-verity"]
+//	firmware = ["qcom/a630_sqe.fw"]
+type Hook struct {
+	// Path to the hook file
+	Path        string `toml:"-"`
+	Description string `toml:"description"`
+	// Hooks are processed in order of priority, lowest first
+	Priority int `toml:"priority"`
+	// Archive the hook contents go in, ArchiveInitfs by default
+	Archive string `toml:"archive"`
+	// Hook is only used if the condition is true, see EvalCondition
+	Condition string `toml:"condition"`
+	// Files to include, with their dependencies
+	Files []string `toml:"files"`
+	// Kernel modules to include, by name, with their dependencies
+	Modules []string `toml:"modules"`
+	// Firmware files to include, relative to /lib/firmware
+	Firmware []string `toml:"firmware"`
+}
+
+// Read the declarative hook at the given path, the format is selected by the
+// file extension.
+func Read(path string) (Hook, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return Hook{Path: path}, err
+	}
+	defer fd.Close()
+
+	var h Hook
+	switch filepath.Ext(path) {
+	case ".toml":
+		h, err = ParseManifest(fd)
+	default:
+		h, err = Parse(fd)
+	}
+	h.Path = path
+	if err != nil {
+		return h, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return h, nil
+}
+
+// Read all declarative hooks (*.hook, *.toml) in the given directory, sorted
+// by priority and then by path
+func ReadDir(dir string) ([]Hook, error) {
+	var hooks []Hook
+	for _, pattern := range []string{"*.hook", "*.toml"} {
+		paths, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range paths {
+			h, err := Read(path)
+			if err != nil {
+				return nil, err
+			}
+			hooks = append(hooks, h)
+		}
+	}
+
+	sort.SliceStable(hooks, func(i, j int) bool {
+		if hooks[i].Priority != hooks[j].Priority {
+			return hooks[i].Priority < hooks[j].Priority
+		}
+		return hooks[i].Path < hooks[j].Path
+	})
+
+	return hooks, nil
+}
+
+// Parse a hook in the manifest (TOML) format
+func ParseManifest(r io.Reader) (Hook, error) {
+	h := Hook{
+		Priority: DefaultPriority,
+		Archive:  ArchiveInitfs,
+	}
+	md, err := toml.NewDecoder(r).Decode(&h)
+	if err != nil {
+		return h, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return h, i18n.Errorf(i18n.HookUnknownKeys, undecoded)
+	}
+
+	if h.Archive != ArchiveInitfs && h.Archive != ArchiveInitfsExtra {
+		return h, i18n.Errorf(i18n.HookUnknownArchive, h.Archive)
+	}
+	// modules.dep and the modules are in the initramfs, and are needed
+	// before initramfs-extra is mounted
+	if h.Archive != ArchiveInitfs && len(h.Modules) > 0 {
+		return h, i18n.Errorf(i18n.HookModulesArchive, ArchiveInitfs)
+	}
+	for _, file := range h.Files {
+		if !filepath.IsAbs(file) {
+			return h, i18n.Errorf(i18n.HookRelativePath, file)
+		}
+	}
+
+	return h, nil
+}
+
+// Parse a hook in the flat format
+func Parse(r io.Reader) (Hook, error) {
+	h := Hook{
+		Priority: DefaultPriority,
+		Archive:  ArchiveInitfs,
+	}
+	s := bufio.NewScanner(r)
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return h, i18n.Errorf(i18n.HookInvalidLine, lineNum, line)
+		}
+
+		switch fields[0] {
+		case "file":
+			if !filepath.IsAbs(fields[1]) {
+				return h, i18n.Errorf(i18n.HookRelativePathLine, lineNum, fields[1])
+			}
+			h.Files = append(h.Files, fields[1])
+		case "module":
+			h.Modules = append(h.Modules, fields[1])
+		case "firmware":
+			h.Firmware = append(h.Firmware, fields[1])
+		default:
+			return h, i18n.Errorf(i18n.HookUnknownType, lineNum, fields[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
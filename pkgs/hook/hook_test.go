@@ -0,0 +1,130 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hook
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	in := `
+# a comment
+file /usr/bin/foo
+  module   dm-verity
+firmware qcom/a630_sqe.fw
+
+file /etc/foo.conf
+`
+	h, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Hook{
+		Priority: DefaultPriority,
+		Archive:  ArchiveInitfs,
+		Files:    []string{"/usr/bin/foo", "/etc/foo.conf"},
+		Modules:  []string{"dm-verity"},
+		Firmware: []string{"qcom/a630_sqe.fw"},
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, h)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tables := []string{
+		"file",
+		"file /usr/bin/foo /usr/bin/bar",
+		"file usr/bin/foo",
+		"binary /usr/bin/foo",
+	}
+	for _, table := range tables {
+		if _, err := Parse(strings.NewReader(table)); err == nil {
+			t.Errorf("expected error for: %q", table)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	in := `
+description = "Support for foo"
+priority = 20
+archive = "initramfs-extra"
+condition = 'arch == "aarch64"'
+files = ["/usr/bin/foo"]
+firmware = ["qcom/a630_sqe.fw"]
+`
+	h, err := ParseManifest(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Hook{
+		Description: "Support for foo",
+		Priority:    20,
+		Archive:     ArchiveInitfsExtra,
+		Condition:   `arch == "aarch64"`,
+		Files:       []string{"/usr/bin/foo"},
+		Firmware:    []string{"qcom/a630_sqe.fw"},
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, h)
+	}
+
+	// defaults
+	h, err = ParseManifest(strings.NewReader(`files = ["/usr/bin/foo"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Priority != DefaultPriority || h.Archive != ArchiveInitfs {
+		t.Errorf("unexpected defaults: %+v", h)
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tables := []string{
+		`files = "/usr/bin/foo"`,
+		`files = ["usr/bin/foo"]`,
+		`archive = "initramfs-foo"`,
+		"archive = \"initramfs-extra\"\nmodules = [\"loop\"]",
+		`unknown = true`,
+		`files = [`,
+	}
+	for _, table := range tables {
+		if _, err := ParseManifest(strings.NewReader(table)); err == nil {
+			t.Errorf("expected error for: %q", table)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	dir := t.TempDir()
+	hooks := map[string]string{
+		"b.hook": "file /usr/bin/b",
+		"a.toml": `files = ["/usr/bin/a"]`,
+		"c.toml": "priority = 10\nfiles = [\"/usr/bin/c\"]",
+		"d.sh":   "not a declarative hook",
+	}
+	for name, contents := range hooks {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, h := range out {
+		names = append(names, filepath.Base(h.Path))
+	}
+	expected := []string{"c.toml", "a.toml", "b.hook"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected order: %q, got: %q", expected, names)
+	}
+}
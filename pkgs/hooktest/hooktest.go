@@ -0,0 +1,338 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hooktest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/executor"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Names of the qemu-user emulators for postmarketOS/Alpine arch names, as
+// used in deviceinfo_arch
+var qemuArchs = map[string]string{
+	"aarch64": "aarch64",
+	"armhf":   "arm",
+	"armv7":   "arm",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+	"x86":     "i386",
+	"x86_64":  "x86_64",
+}
+
+// Names of the qemu-user emulators for GOARCH values, for the host
+var hostQemuArchs = map[string]string{
+	"386":     "i386",
+	"amd64":   "x86_64",
+	"arm":     "arm",
+	"arm64":   "aarch64",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// Tester checks the scripts in the tree of an initramfs (e.g. staged with
+// archive.Archive.Stage) by running a shell from the tree
+type Tester struct {
+	// the tree, and the working directory of the commands
+	Root string
+	// command that runs the rest of its arguments with the tree as /, e.g.
+	// "proot -r <tree> -w /". Commands are run on the host if empty.
+	Wrapper []string
+}
+
+// New returns a Tester for the tree of an initramfs for the given arch (the
+// host's one if empty). It uses proot if it's installed, with qemu-user for
+// other archs, otherwise qemu-user by itself (with -L, which falls back to
+// the host for paths not in the tree, so missing files may not be noticed).
+func New(root string, arch string) (*Tester, error) {
+	return newTester(root, arch, runtime.GOARCH, exec.LookPath)
+}
+
+func newTester(root string, arch string, goarch string, lookPath func(string) (string, error)) (*Tester, error) {
+	host, ok := hostQemuArchs[goarch]
+	if !ok {
+		return nil, i18n.Errorf(i18n.HooktestUnsupportedHostArch, goarch)
+	}
+	qemu := host
+	if arch != "" {
+		if qemu, ok = qemuArchs[arch]; !ok {
+			return nil, i18n.Errorf(i18n.HooktestUnknownArch, arch)
+		}
+	}
+
+	if _, err := lookPath("proot"); err == nil {
+		wrapper := []string{"proot", "-r", root, "-w", "/"}
+		if qemu != host {
+			wrapper = append(wrapper, "-q", "qemu-"+qemu)
+		}
+		return &Tester{Root: root, Wrapper: wrapper}, nil
+	}
+	if _, err := lookPath("qemu-" + qemu); err == nil {
+		// the commands run are all busybox applets
+		return &Tester{Root: root, Wrapper: []string{"qemu-" + qemu, "-L", root, filepath.Join(root, "bin", "busybox")}}, nil
+	}
+	return nil, i18n.Errorf(i18n.HooktestNoEmulator, qemu)
+}
+
+// Problem is something found wrong with a script
+type Problem struct {
+	// path in the tree
+	Script  string
+	Message string
+}
+
+func (p Problem) String() string {
+	return p.Script + ": " + p.Message
+}
+
+// Prints the commands given as arguments that aren't builtins or executables
+// in PATH (the one of init)
+const checkCommands = `PATH=/usr/bin:/bin:/usr/sbin:/sbin
+for c; do
+	command -v "$c" >/dev/null 2>&1 || echo "$c"
+done`
+
+// Check the scripts at the given paths in the tree (e.g. /init): that they
+// can be parsed by the shell in the tree, and that the commands they run are
+// there, apart from functions defined in any of the scripts (like the ones in
+// init_functions.sh used by the hooks). Scripts that are sourced by init
+// (initFunctions, if not empty) are sourced as well, so they aren't expected to
+// do anything in their top level but define functions and variables.
+func (t *Tester) Check(ctx context.Context, scripts []string, initFunctions string) ([]Problem, error) {
+	contents := make(map[string]string)
+	defined := make(map[string]bool)
+	for _, script := range scripts {
+		data, err := os.ReadFile(filepath.Join(t.Root, script))
+		if err != nil {
+			return nil, err
+		}
+		contents[script] = string(data)
+		for _, f := range Functions(string(data)) {
+			defined[f] = true
+		}
+	}
+
+	var problems []Problem
+	for _, script := range scripts {
+		// relative to the working directory, since qemu-user only finds
+		// absolute paths in the tree if they aren't on the host
+		rel := "." + filepath.Join("/", script)
+		if _, stderr, err := t.run(ctx, "sh", "-n", rel); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			problems = append(problems, Problem{Script: script, Message: "unable to parse it: " + errorMessage(stderr, err)})
+			continue
+		}
+
+		var commands []string
+		for _, c := range Commands(contents[script]) {
+			if !defined[c] {
+				commands = append(commands, c)
+			}
+		}
+		if len(commands) > 0 {
+			stdout, stderr, err := t.run(ctx, "sh", append([]string{"-c", checkCommands, "sh"}, commands...)...)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				return nil, i18n.Errorf(i18n.HooktestCheckFailed, script, errorMessage(stderr, err))
+			}
+			for _, c := range strings.Fields(stdout) {
+				problems = append(problems, Problem{Script: script, Message: "command not found: " + c})
+			}
+		}
+
+		if script == initFunctions {
+			if _, stderr, err := t.run(ctx, "sh", "-c", ". "+rel); err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				problems = append(problems, Problem{Script: script, Message: "unable to source it: " + errorMessage(stderr, err)})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Run the command in the tree, returns its output
+func (t *Tester) run(ctx context.Context, name string, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	e := executor.Wrapped{
+		Executor: executor.Host{Stdout: &stdout, Stderr: &stderr, Dir: t.Root},
+		Wrapper:  t.Wrapper,
+	}
+	err := e.Run(ctx, name, args...)
+	return stdout.String(), stderr.String(), err
+}
+
+// The error output of a command, or the error if there is none
+func errorMessage(stderr string, err error) string {
+	if msg := strings.TrimSpace(stderr); msg != "" {
+		return msg
+	}
+	return err.Error()
+}
+
+var functionDef = regexp.MustCompile(`(?m)^[ \t]*(?:function[ \t]+)?([A-Za-z_][A-Za-z0-9_]*)[ \t]*\(\)`)
+
+// Functions returns the names of the functions defined in the script
+func Functions(script string) []string {
+	var names []string
+	for _, m := range functionDef.FindAllStringSubmatch(script, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// Words that start or continue a command without being one
+var shellKeywords = map[string]bool{
+	"!": true, "{": true, "}": true, "case": true, "do": true, "done": true,
+	"elif": true, "else": true, "esac": true, "fi": true, "for": true,
+	"function": true, "if": true, "in": true, "then": true, "until": true,
+	"while": true,
+}
+
+var (
+	commandName = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_.+-]*|/[A-Za-z0-9_./+-]+)$`)
+	assignment  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+	// the pattern at the start of a line in a case statement, e.g. "a|b)"
+	casePattern = regexp.MustCompile(`^\s*\(?[^()$]*\)`)
+	heredoc     = regexp.MustCompile(`<<(-?)\s*["']?([A-Za-z0-9_]+)["']?`)
+)
+
+// Commands returns the names of the commands run by the script, sorted: the
+// first word of each simple command that isn't a keyword, an assignment or an
+// expansion. This is a rough approximation of the shell's parser (e.g.
+// commands in strings other than command substitutions aren't found), good
+// enough for finding commands that are missing.
+func Commands(script string) []string {
+	found := make(map[string]bool)
+	lines := strings.Split(script, "\n")
+	inCase := 0
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + " " + lines[i]
+		}
+
+		// the contents of here-documents is data
+		if m := heredoc.FindStringSubmatch(line); m != nil {
+			for i+1 < len(lines) {
+				i++
+				end := lines[i]
+				if m[1] == "-" {
+					end = strings.TrimLeft(end, "\t")
+				}
+				if end == m[2] {
+					break
+				}
+			}
+		}
+
+		code := unquote(line)
+		if inCase > 0 {
+			code = casePattern.ReplaceAllString(code, "")
+		}
+		for _, segment := range strings.FieldsFunc(code, func(r rune) bool {
+			return r == ';' || r == '|' || r == '&' || r == '('
+		}) {
+			words := strings.Fields(segment)
+			for len(words) > 0 && (shellKeywords[words[0]] || assignment.MatchString(words[0])) {
+				switch words[0] {
+				case "case":
+					inCase++
+				case "esac":
+					inCase--
+				}
+				// the word list of for loops isn't a command
+				if words[0] == "for" {
+					words = nil
+					break
+				}
+				words = words[1:]
+			}
+			if len(words) > 0 && commandName.MatchString(words[0]) {
+				found[words[0]] = true
+			}
+		}
+	}
+
+	var commands []string
+	for c := range found {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// Replace the quoted strings and comments of a line of shell code with
+// placeholders, keeping the commands in command substitutions, which are
+// moved to separate commands (e.g. `echo "$(cat file)"` -> `echo "";cat file`)
+func unquote(line string) string {
+	var out, subst strings.Builder
+	// open quote, if any
+	var quote rune
+	// depth of the command substitutions in double quotes
+	depth := 0
+	prev := ' '
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			}
+		case quote == '"' && depth == 0:
+			switch {
+			case r == '\\':
+				i++
+			case r == '"':
+				quote = 0
+			case r == '$' && i+1 < len(runes) && runes[i+1] == '(':
+				depth++
+				i++
+				subst.WriteRune(';')
+			}
+		case quote == '"':
+			// in a command substitution in double quotes
+			switch r {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if depth > 0 {
+				subst.WriteRune(r)
+			}
+		case r == '\\':
+			i++
+		case r == '\'' || r == '"':
+			quote = r
+			out.WriteString(`""`)
+		case r == '#' && (prev == ' ' || prev == '\t' || prev == ';'):
+			i = len(runes)
+		case r == '`':
+			out.WriteRune(';')
+		default:
+			out.WriteRune(r)
+		}
+		prev = r
+	}
+	return out.String() + subst.String()
+}
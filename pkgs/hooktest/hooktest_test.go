@@ -0,0 +1,151 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hooktest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	tables := []struct {
+		script   string
+		expected []string
+	}{
+		{"mount -t proc proc /proc", []string{"mount"}},
+		{"# mount is needed\n\tmount /proc # for /proc/cmdline", []string{"mount"}},
+		{"if [ -e /dev/foo ]; then\n\tmodprobe foo && echo ok\nfi", []string{"echo", "modprobe"}},
+		{"cat /proc/cmdline | grep -q quiet || setup_log", []string{"cat", "grep", "setup_log"}},
+		{"LANG=C sort file", []string{"sort"}},
+		{"x=$(blkid -o value)\necho \"$(uname -r) is running\"", []string{"blkid", "echo", "uname"}},
+		{"echo 'a; b' \"c && d\" `hostname`", []string{"echo", "hostname"}},
+		{"for i in a b c; do\n\tsleep 1\ndone", []string{"sleep"}},
+		{"case \"$x\" in\n\ta|b)\n\t\tfoo ;;\n\t*) bar ;;\nesac", []string{"bar", "foo"}},
+		{"cat <<-EOF\n\ta | b\n\tEOF\nls", []string{"cat", "ls"}},
+		{"/sbin/kpartx -a \\\n\t/dev/foo", []string{"/sbin/kpartx"}},
+		{"setup() {\n\t$cmd\n}", []string{"setup"}},
+	}
+
+	for _, table := range tables {
+		if got := Commands(table.script); !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.script, table.expected, got)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	script := "setup_log() {\n\techo\n}\nfunction mount_root() {\n}\n  other () { :; }\nfoo\n"
+	expected := []string{"setup_log", "mount_root", "other"}
+	if got := Functions(script); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %q, got: %q", expected, got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	found := func(names ...string) func(string) (string, error) {
+		return func(name string) (string, error) {
+			for _, n := range names {
+				if n == name {
+					return "/usr/bin/" + name, nil
+				}
+			}
+			return "", errors.New("not found")
+		}
+	}
+
+	tables := []struct {
+		arch     string
+		goarch   string
+		lookPath func(string) (string, error)
+		expected []string
+	}{
+		{"", "amd64", found("proot"), []string{"proot", "-r", "/tree", "-w", "/"}},
+		{"x86_64", "amd64", found("proot"), []string{"proot", "-r", "/tree", "-w", "/"}},
+		{"aarch64", "amd64", found("proot"), []string{"proot", "-r", "/tree", "-w", "/", "-q", "qemu-aarch64"}},
+		{"armv7", "amd64", found("qemu-arm"), []string{"qemu-arm", "-L", "/tree", "/tree/bin/busybox"}},
+		{"armhf", "arm", found("proot"), []string{"proot", "-r", "/tree", "-w", "/"}},
+		{"aarch64", "amd64", found(), nil},
+		{"sparc", "amd64", found("proot"), nil},
+	}
+
+	for _, table := range tables {
+		tester, err := newTester("/tree", table.arch, table.goarch, table.lookPath)
+		if table.expected == nil {
+			if err == nil {
+				t.Errorf("%s on %s: expected error", table.arch, table.goarch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s on %s: %s", table.arch, table.goarch, err)
+			continue
+		}
+		if !reflect.DeepEqual(tester.Wrapper, table.expected) {
+			t.Errorf("%s on %s: expected: %q, got: %q", table.arch, table.goarch, table.expected, tester.Wrapper)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	// run with the shell of the host in the tree
+	dir := t.TempDir()
+	for path, script := range map[string]string{
+		"/init_functions.sh":  "setup_log() {\n\techo log\n}\n",
+		"/hooks/10-good.sh":   "setup_log\necho good | cat\n",
+		"/hooks/20-broken.sh": "if true; then\n\techo\n",
+		"/hooks/30-missing.sh": "not-a-command-that-exists --help\n" +
+			"echo \"$(another-missing-command)\"\n",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tester := &Tester{Root: dir}
+	scripts := []string{"/init_functions.sh", "/hooks/10-good.sh", "/hooks/20-broken.sh", "/hooks/30-missing.sh"}
+	problems, err := tester.Check(context.Background(), scripts, "/init_functions.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	if len(got) != 3 || !strings.HasPrefix(got[0], "/hooks/20-broken.sh: unable to parse it: ") {
+		t.Fatalf("unexpected problems: %q", got)
+	}
+	expected := []string{
+		"/hooks/30-missing.sh: command not found: another-missing-command",
+		"/hooks/30-missing.sh: command not found: not-a-command-that-exists",
+	}
+	if !reflect.DeepEqual(got[1:], expected) {
+		t.Errorf("expected: %q, got: %q", expected, got[1:])
+	}
+
+	// sourcing init_functions.sh fails
+	if err := os.WriteFile(filepath.Join(dir, "init_functions.sh"), []byte("exit 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = tester.Check(context.Background(), []string{"/init_functions.sh"}, "/init_functions.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "unable to source it") {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	if _, err := tester.Check(context.Background(), []string{"/missing.sh"}, ""); !os.IsNotExist(err) {
+		t.Errorf("expected error for missing script, got: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package i18n
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Default location of the message catalogs, named <language>.toml (e.g.
+// de.toml or pt_BR.toml), with one "<key> = <message>" entry per message
+const DefaultDir = "/usr/share/postmarketos-mkinitfs/i18n"
+
+// Translated messages, by key. Load replaces them while messages may be
+// formatted by other goroutines, e.g. a frontend changing the language.
+var (
+	translationsMu sync.RWMutex
+	translations   = map[string]string{}
+)
+
+// Matches the formatting verbs in a message
+var verbRe = regexp.MustCompile(`%[-+# 0]*[0-9]*(\.[0-9]+)?[a-zA-Z%]`)
+
+// Get the language for messages from the environment, in the order used by
+// gettext. Returns an empty string for the C/POSIX locale.
+func Language() string {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		lang := os.Getenv(env)
+		if lang == "" {
+			continue
+		}
+		// e.g. de_DE.UTF-8@euro -> de_DE
+		lang = strings.SplitN(lang, ".", 2)[0]
+		lang = strings.SplitN(lang, "@", 2)[0]
+		if lang == "C" || lang == "POSIX" {
+			return ""
+		}
+		return lang
+	}
+	return ""
+}
+
+// Load the catalog for the language from dir, falling back to the catalog for
+// the language without the territory (e.g. "de" for "de_AT"). Without a
+// catalog, the English messages are used. Translations that don't have the
+// same formatting verbs as the English message are skipped, so a broken
+// translation can't garble the arguments. Messages formatted before Load is
+// called are in English.
+func Load(dir string, lang string) error {
+	loaded := map[string]string{}
+	defer func() {
+		translationsMu.Lock()
+		translations = loaded
+		translationsMu.Unlock()
+	}()
+	if lang == "" {
+		return nil
+	}
+
+	candidates := []string{lang}
+	if i := strings.Index(lang, "_"); i > 0 {
+		candidates = append(candidates, lang[:i])
+	}
+	for _, l := range candidates {
+		var catalog map[string]string
+		_, err := toml.DecodeFile(filepath.Join(dir, l+".toml"), &catalog)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to load message catalog for %q: %w", l, err)
+		}
+		for key, msg := range catalog {
+			en, ok := english[key]
+			if !ok {
+				log.Printf("Unknown message %q in catalog for %q", key, l)
+				continue
+			}
+			if !reflect.DeepEqual(verbRe.FindAllString(en, -1), verbRe.FindAllString(msg, -1)) {
+				log.Printf("Translation of message %q for %q doesn't match the original, ignoring it", key, l)
+				continue
+			}
+			loaded[key] = msg
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// Get the message for the key, in the loaded language or English
+func message(key string) string {
+	translationsMu.RLock()
+	msg, ok := translations[key]
+	translationsMu.RUnlock()
+	if ok {
+		return msg
+	}
+	if msg, ok := english[key]; ok {
+		return msg
+	}
+	return key
+}
+
+// Format the message with the given key, like fmt.Sprintf
+func Sprintf(key string, a ...interface{}) string {
+	return fmt.Sprintf(message(key), a...)
+}
+
+// Create an error with the message with the given key, like fmt.Errorf
+func Errorf(key string, a ...interface{}) error {
+	return fmt.Errorf(message(key), a...)
+}
+
+// An error with a message that is looked up when it is formatted, so that it
+// is translated even when it was created before Load was called
+type keyedError struct {
+	key string
+}
+
+func (e *keyedError) Error() string {
+	return message(e.key)
+}
+
+// Create an error with the message with the given key, for sentinel errors
+// (package level variables compared with errors.Is). Like errors.New, each
+// call returns a distinct error.
+func NewError(key string) error {
+	return &keyedError{key: key}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package i18n
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLanguage(t *testing.T) {
+	tables := []struct {
+		lcAll    string
+		lang     string
+		expected string
+	}{
+		{"", "de_DE.UTF-8", "de_DE"},
+		{"", "sr_RS@latin", "sr_RS"},
+		{"pt_BR.UTF-8", "de_DE.UTF-8", "pt_BR"},
+		{"C", "de_DE.UTF-8", ""},
+		{"", "POSIX", ""},
+		{"", "", ""},
+	}
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	for _, table := range tables {
+		os.Setenv("LC_ALL", table.lcAll)
+		os.Setenv("LC_MESSAGES", "")
+		os.Setenv("LANG", table.lang)
+		if out := Language(); out != table.expected {
+			t.Errorf("LC_ALL=%q LANG=%q: expected: %q, got: %q", table.lcAll, table.lang, table.expected, out)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	catalog := `
+unknown-profile = "Unbekanntes Build-Profil: %q"
+unknown-trigger = "Unbekannter Auslöser"
+not-a-message = "foo"
+`
+	if err := os.WriteFile(filepath.Join(dir, "de.toml"), []byte(catalog), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer Load(dir, "")
+
+	if err := Load(dir, "de_AT"); err != nil {
+		t.Fatal(err)
+	}
+	tables := []struct {
+		key      string
+		expected string
+	}{
+		{UnknownProfile, `Unbekanntes Build-Profil: "kiosk"`},
+		// translation is missing the verb, so English is used
+		{UnknownTrigger, `Unknown trigger: "kiosk"`},
+		{UnknownColorMode, `Unknown color mode: "kiosk"`},
+	}
+	for _, table := range tables {
+		if out := Sprintf(table.key, "kiosk"); out != table.expected {
+			t.Errorf("expected: %q, got: %q", table.expected, out)
+		}
+	}
+
+	// no catalog for the language
+	if err := Load(dir, "fr_FR"); err != nil {
+		t.Fatal(err)
+	}
+	if out := Errorf(UnknownProfile, "kiosk").Error(); out != `Unknown build profile: "kiosk"` {
+		t.Errorf("expected English message, got: %q", out)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	dir := t.TempDir()
+	catalog := `archive-conflict = "widersprüchliche Einträge"` + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "de.toml"), []byte(catalog), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer Load(dir, "")
+
+	// created before the catalog is loaded, like sentinel errors
+	errConflict := NewError(ArchiveConflict)
+	if out := errConflict.Error(); out != "conflicting entries" {
+		t.Errorf("expected English message, got: %q", out)
+	}
+
+	if err := Load(dir, "de_DE"); err != nil {
+		t.Fatal(err)
+	}
+	wrapped := fmt.Errorf("%w: /etc/fstab", errConflict)
+	if out := wrapped.Error(); out != "widersprüchliche Einträge: /etc/fstab" {
+		t.Errorf("expected translated message, got: %q", out)
+	}
+	if !errors.Is(wrapped, errConflict) {
+		t.Error("expected the wrapped error to match")
+	}
+	if errors.Is(wrapped, NewError(ArchiveConflict)) {
+		t.Error("expected errors with the same key to be distinct")
+	}
+}
+
+func TestLoadConcurrent(t *testing.T) {
+	defer Load("", "")
+
+	// run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				Sprintf(UnknownProfile, "kiosk")
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		if err := Load(t.TempDir(), "de_DE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,342 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package i18n
+
+// Keys of the messages of the mkinitfs command that can be translated: errors
+// about its options, the checks of the system and the state of the last build.
+// Its logs about the progress of a build are only in English.
+const (
+	ArchMismatch          = "arch-mismatch"
+	DoctorFailed          = "doctor-failed"
+	InvalidMaxMemory      = "invalid-max-memory"
+	InvalidMaxSize        = "invalid-max-size"
+	MaxSizeExceeded       = "max-size-exceeded"
+	MissingModules        = "missing-modules"
+	NoPreviousBuild       = "no-previous-build"
+	NoRebuildNeeded       = "no-rebuild-needed"
+	RebuildNeeded         = "rebuild-needed"
+	UnknownCleanStaleMode = "unknown-clean-stale-mode"
+	UnknownColorMode      = "unknown-color-mode"
+	UnknownProfile        = "unknown-profile"
+	UnknownTrigger        = "unknown-trigger"
+	UnreadableState       = "unreadable-state"
+	UnsavedBuildState     = "unsaved-build-state"
+)
+
+// English messages, used when there is no translation
+var english = map[string]string{
+	ArchMismatch:          "deviceinfo_arch is %q (%s), but %s. Is mkinitfs running in a chroot for the wrong architecture?",
+	DoctorFailed:          "%d check(s) failed",
+	InvalidMaxMemory:      "Invalid max memory: %s",
+	InvalidMaxSize:        "Invalid max size: %s",
+	MaxSizeExceeded:       "%s is %s, which exceeds the max size of %s by %s",
+	MissingModules:        "module(s) in deviceinfo_modules_initfs not found as a module file, alias or builtin in %q: %s",
+	NoPreviousBuild:       "No previous build recorded, rebuilding",
+	NoRebuildNeeded:       "No changes to inputs used by mkinitfs since the last build, not rebuilding",
+	RebuildNeeded:         "Inputs changed since the last build, rebuilding:",
+	UnknownCleanStaleMode: "Unknown stale artifact cleanup mode: %q",
+	UnknownColorMode:      "Unknown color mode: %q",
+	UnknownProfile:        "Unknown build profile: %q",
+	UnknownTrigger:        "Unknown trigger: %q",
+	UnreadableState:       "Unable to read state of the last build: %s",
+	UnsavedBuildState:     "WARNING: unable to save state of this build: %s",
+
+	// archive
+	ArchiveAlreadyAdded:            "%w: %s from %s, already added from %s",
+	ArchiveChecksumMismatch:        "%s: checksum mismatch, expected %08x, got: %08x",
+	ArchiveCompressionLevelRange:   "%s compression level must be %d-%d, got: %d",
+	ArchiveCompressionNotSupported: "compression format is not supported",
+	ArchiveConflict:                "conflicting entries",
+	ArchiveEmpty:                   "%s: empty archive",
+	ArchiveInvalidCompressionLevel: "invalid compression level in %q, must be a number or one of: fast, default, best",
+	ArchiveInvalidExclude:          "AddDirRecursive: invalid exclude pattern %q: %w",
+	ArchiveInvalidHeader:           "invalid cpio header at offset %d",
+	ArchiveInvalidMagic:            "invalid cpio header magic at offset %d: %q",
+	ArchiveMissedWriting:           "cpio: missed writing %d bytes",
+	ArchiveNoCompressionLevels:     "compression %s doesn't have levels",
+	ArchiveNoDeviceNumber:          "AddDirRecursive: unable to get the device number of %s",
+	ArchiveOdcDeviceTooLarge:       "cpio: device number too large for odc format: %s",
+	ArchiveOdcFileTooLarge:         "cpio: file too large for odc format: %s",
+	ArchiveReadBack:                "data read back from the storage differs from the written data",
+	ArchiveRootEntry:               "%w: %q is the root of the archive",
+	ArchiveSecretNotRegular:        "AddSecret: secret is not a regular file: %s",
+	ArchiveStageFailed:             "Stage: unable to create %s: %w",
+	ArchiveSymlinkOutside:          "%w: symlink %s -> %s points outside of the archive",
+	ArchiveTarEarlyArchive:         "tar archives can't have an early archive in front",
+	ArchiveTarUnsupportedType:      "tar: unsupported type of entry: %s",
+	ArchiveTruncated:               "truncated archive: %w",
+	ArchiveTruncatedEntry:          "%s: truncated archive: %w",
+	ArchiveUnknownCompression:      "unknown compression: %q",
+	ArchiveUnknownDevNodeType:      "AddDevNode: unknown device node type: %d",
+	ArchiveUnknownFormat:           "unsupported cpio format: %q",
+	ArchiveUnreadableContents:      "AddFileFromReader: unable to read contents of %s: %w",
+	ArchiveUnsafePath:              "unsafe path",
+	ArchiveUnsupportedCompression:  "unsupported compression: %s",
+	ArchiveUnsupportedFileType:     "AddDirRecursive: unsupported file type: %s",
+	ArchiveUnsupportedFormat:       "unsupported cpio format: %s",
+	ArchiveVerifyFailed:            "unable to verify written archive: %w",
+	ArchiveWriteFailed:             "unable to write %s to archive: %w",
+	ArchiveWriteTooLong:            "cpio: write too long",
+
+	// bootscr
+	BootscrUnsupportedArch:      "boot.scr generation not supported for arch: %q",
+	BootscrUnsupportedImageArch: "unsupported arch for U-Boot image: %q",
+
+	// coreboot
+	CorebootUnsupportedArch: "coreboot Linux payloads not supported for arch: %q",
+
+	// cpioread
+	CpioreadLz4Corrupt:             "lz4: corrupt input",
+	CpioreadLz4Dictionary:          "lz4: frames with a dictionary are not supported",
+	CpioreadLz4UnknownMagic:        "lz4: unknown magic: %#x",
+	CpioreadLz4UnsupportedVersion:  "lz4: unsupported frame version: %d",
+	CpioreadUnsupportedCompression: "unsupported compression",
+
+	// depthcharge
+	DepthchargeFitFailed:       "unable to create FIT image: %w",
+	DepthchargeSignFailed:      "unable to sign kernel partition image: %w",
+	DepthchargeUnsupportedArch: "ChromeOS kernel partition images not supported for arch: %q",
+
+	// deviceinfo
+	DeviceinfoInvalidBool:        "%s must be \"true\" or \"false\", got: %q",
+	DeviceinfoInvalidInt:         "%s must be an integer, got: %q",
+	DeviceinfoInvalidLine:        "error parsing deviceinfo line, invalid format: %s",
+	DeviceinfoInvalidValue:       "unable to write %s, value can't contain '\"', '#' or newlines: %q",
+	DeviceinfoUnsupportedVersion: "deviceinfo format version %q is not supported",
+
+	// digest
+	DigestUnsupported: "unsupported checksum algorithm: %q",
+
+	// elfutil
+	ElfutilTruncatedHeader:     "truncated ELF header",
+	ElfutilUnknownArch:         "unknown arch: %q",
+	ElfutilUnknownClass:        "unknown ELF class: %s",
+	ElfutilUnknownEncoding:     "unknown ELF data encoding: %s",
+	ElfutilUnknownKernelFormat: "unknown kernel image format",
+
+	// executor
+	ExecutorNotFound: "%s command not found",
+
+	// fit
+	FitNoKernel:        "FIT image needs a kernel",
+	FitNoPEMData:       "%s: no PEM data found",
+	FitNotRSAKey:       "%s: not an RSA key",
+	FitSignFailed:      "unable to sign %s: %w",
+	FitUnsupportedArch: "FIT images not supported for arch: %q",
+	FitUnsupportedHash: "unsupported FIT hash algorithm: %q",
+
+	// history
+	HistoryInvalidFile:       "invalid history file %q: %w",
+	HistoryInvalidPercentage: "invalid percentage: %q",
+
+	// hook
+	HookConditionEnd:             "unexpected end of condition",
+	HookConditionMissingParen:    "missing ')' in condition",
+	HookConditionNoOperator:      "expected '==' or '!=' after %q, got: %q",
+	HookConditionNoString:        "expected a quoted string after '%s', got: %q",
+	HookConditionNoVariable:      "expected a variable name, got: %q",
+	HookConditionUnexpected:      "unexpected %q in condition: %s",
+	HookConditionUnexpectedChar:  "unexpected character %q in condition: %s",
+	HookConditionUnknownVariable: "unknown variable in condition: %q",
+	HookConditionUnterminated:    "unterminated string in condition: %s",
+	HookInvalidLine:              "line %d: expected \"<type> <value>\", got: %q",
+	HookModulesArchive:           "modules can only be included in the %s archive",
+	HookRelativePath:             "file path must be absolute: %q",
+	HookRelativePathLine:         "line %d: file path must be absolute: %q",
+	HookUnknownArchive:           "unknown archive: %q",
+	HookUnknownKeys:              "unknown key(s) in hook manifest: %q",
+	HookUnknownType:              "line %d: unknown type: %q",
+
+	// hooktest
+	HooktestCheckFailed:         "%s: unable to check commands: %s",
+	HooktestNoEmulator:          "proot or qemu-%s is required for running the scripts",
+	HooktestUnknownArch:         "unknown arch: %q",
+	HooktestUnsupportedHostArch: "unsupported host arch: %q",
+
+	// luks
+	LuksInvalidHeaderSize:     "invalid LUKS2 header size: %d",
+	LuksInvalidMetadata:       "unable to parse LUKS2 metadata: %w",
+	LuksNoDataSegment:         "LUKS2 metadata has no data segment",
+	LuksNotLuks:               "not a LUKS header",
+	LuksUnreadableHeader:      "unable to read LUKS header: %w",
+	LuksUnreadableLuks1Header: "unable to read LUKS1 header: %w",
+	LuksUnreadableLuks2Header: "unable to read LUKS2 header: %w",
+	LuksUnreadableMetadata:    "unable to read LUKS2 metadata: %w",
+	LuksUnsupportedVersion:    "unsupported LUKS version: %d",
+
+	// misc
+	MiscInvalidSize:     "invalid size: %q",
+	MiscSymlinkLoop:     "symlink loop: %s",
+	MiscTooManySymlinks: "too many levels of symlinks (more than %d): %s",
+
+	// owner
+	OwnerInvalidLine: "%s: expected \"<path> <package>\", got: %q",
+
+	// policy
+	PolicyInvalidArchive:   "line %d: expected \"archive %s|%s\", got: %q",
+	PolicyInvalidArguments: "line %d: invalid arguments for %s: %q",
+	PolicyInvalidPattern:   "line %d: invalid pattern %q: %w",
+	PolicyInvalidRule:      "line %d: expected \"<type> <pattern> [<argument>]\", got: %q",
+	PolicyRelativePattern:  "line %d: pattern must be absolute: %q",
+	PolicyUnknownType:      "line %d: unknown type: %q",
+
+	// snapshot
+	SnapshotExists:    "snapshot already exists: %s",
+	SnapshotInvalid:   "not a snapshot: %s",
+	SnapshotNoneFound: "no snapshots found in %s",
+
+	// state
+	StateInvalidLine: "invalid line in state file %q: %q",
+}
+
+// Keys of the messages of errors returned by the packages in pkgs/, which
+// frontends using them as a library may show to users
+const (
+	// archive
+	ArchiveAlreadyAdded            = "archive-already-added"
+	ArchiveChecksumMismatch        = "archive-checksum-mismatch"
+	ArchiveCompressionLevelRange   = "archive-compression-level-range"
+	ArchiveCompressionNotSupported = "archive-compression-not-supported"
+	ArchiveConflict                = "archive-conflict"
+	ArchiveEmpty                   = "archive-empty"
+	ArchiveInvalidCompressionLevel = "archive-invalid-compression-level"
+	ArchiveInvalidExclude          = "archive-invalid-exclude"
+	ArchiveInvalidHeader           = "archive-invalid-header"
+	ArchiveInvalidMagic            = "archive-invalid-magic"
+	ArchiveMissedWriting           = "archive-missed-writing"
+	ArchiveNoCompressionLevels     = "archive-no-compression-levels"
+	ArchiveNoDeviceNumber          = "archive-no-device-number"
+	ArchiveOdcDeviceTooLarge       = "archive-odc-device-too-large"
+	ArchiveOdcFileTooLarge         = "archive-odc-file-too-large"
+	ArchiveReadBack                = "archive-read-back"
+	ArchiveRootEntry               = "archive-root-entry"
+	ArchiveSecretNotRegular        = "archive-secret-not-regular"
+	ArchiveStageFailed             = "archive-stage-failed"
+	ArchiveSymlinkOutside          = "archive-symlink-outside"
+	ArchiveTarEarlyArchive         = "archive-tar-early-archive"
+	ArchiveTarUnsupportedType      = "archive-tar-unsupported-type"
+	ArchiveTruncated               = "archive-truncated"
+	ArchiveTruncatedEntry          = "archive-truncated-entry"
+	ArchiveUnknownCompression      = "archive-unknown-compression"
+	ArchiveUnknownDevNodeType      = "archive-unknown-dev-node-type"
+	ArchiveUnknownFormat           = "archive-unknown-format"
+	ArchiveUnreadableContents      = "archive-unreadable-contents"
+	ArchiveUnsafePath              = "archive-unsafe-path"
+	ArchiveUnsupportedCompression  = "archive-unsupported-compression"
+	ArchiveUnsupportedFileType     = "archive-unsupported-file-type"
+	ArchiveUnsupportedFormat       = "archive-unsupported-format"
+	ArchiveVerifyFailed            = "archive-verify-failed"
+	ArchiveWriteFailed             = "archive-write-failed"
+	ArchiveWriteTooLong            = "archive-write-too-long"
+
+	// bootscr
+	BootscrUnsupportedArch      = "bootscr-unsupported-arch"
+	BootscrUnsupportedImageArch = "bootscr-unsupported-image-arch"
+
+	// coreboot
+	CorebootUnsupportedArch = "coreboot-unsupported-arch"
+
+	// cpioread
+	CpioreadLz4Corrupt             = "cpioread-lz4-corrupt"
+	CpioreadLz4Dictionary          = "cpioread-lz4-dictionary"
+	CpioreadLz4UnknownMagic        = "cpioread-lz4-unknown-magic"
+	CpioreadLz4UnsupportedVersion  = "cpioread-lz4-unsupported-version"
+	CpioreadUnsupportedCompression = "cpioread-unsupported-compression"
+
+	// depthcharge
+	DepthchargeFitFailed       = "depthcharge-fit-failed"
+	DepthchargeSignFailed      = "depthcharge-sign-failed"
+	DepthchargeUnsupportedArch = "depthcharge-unsupported-arch"
+
+	// deviceinfo
+	DeviceinfoInvalidBool        = "deviceinfo-invalid-bool"
+	DeviceinfoInvalidInt         = "deviceinfo-invalid-int"
+	DeviceinfoInvalidLine        = "deviceinfo-invalid-line"
+	DeviceinfoInvalidValue       = "deviceinfo-invalid-value"
+	DeviceinfoUnsupportedVersion = "deviceinfo-unsupported-version"
+
+	// digest
+	DigestUnsupported = "digest-unsupported"
+
+	// elfutil
+	ElfutilTruncatedHeader     = "elfutil-truncated-header"
+	ElfutilUnknownArch         = "elfutil-unknown-arch"
+	ElfutilUnknownClass        = "elfutil-unknown-class"
+	ElfutilUnknownEncoding     = "elfutil-unknown-encoding"
+	ElfutilUnknownKernelFormat = "elfutil-unknown-kernel-format"
+
+	// executor
+	ExecutorNotFound = "executor-not-found"
+
+	// fit
+	FitNoKernel        = "fit-no-kernel"
+	FitNoPEMData       = "fit-no-pem-data"
+	FitNotRSAKey       = "fit-not-rsa-key"
+	FitSignFailed      = "fit-sign-failed"
+	FitUnsupportedArch = "fit-unsupported-arch"
+	FitUnsupportedHash = "fit-unsupported-hash"
+
+	// history
+	HistoryInvalidFile       = "history-invalid-file"
+	HistoryInvalidPercentage = "history-invalid-percentage"
+
+	// hook
+	HookConditionEnd             = "hook-condition-end"
+	HookConditionMissingParen    = "hook-condition-missing-paren"
+	HookConditionNoOperator      = "hook-condition-no-operator"
+	HookConditionNoString        = "hook-condition-no-string"
+	HookConditionNoVariable      = "hook-condition-no-variable"
+	HookConditionUnexpected      = "hook-condition-unexpected"
+	HookConditionUnexpectedChar  = "hook-condition-unexpected-char"
+	HookConditionUnknownVariable = "hook-condition-unknown-variable"
+	HookConditionUnterminated    = "hook-condition-unterminated"
+	HookInvalidLine              = "hook-invalid-line"
+	HookModulesArchive           = "hook-modules-archive"
+	HookRelativePath             = "hook-relative-path"
+	HookRelativePathLine         = "hook-relative-path-line"
+	HookUnknownArchive           = "hook-unknown-archive"
+	HookUnknownKeys              = "hook-unknown-keys"
+	HookUnknownType              = "hook-unknown-type"
+
+	// hooktest
+	HooktestCheckFailed         = "hooktest-check-failed"
+	HooktestNoEmulator          = "hooktest-no-emulator"
+	HooktestUnknownArch         = "hooktest-unknown-arch"
+	HooktestUnsupportedHostArch = "hooktest-unsupported-host-arch"
+
+	// luks
+	LuksInvalidHeaderSize     = "luks-invalid-header-size"
+	LuksInvalidMetadata       = "luks-invalid-metadata"
+	LuksNoDataSegment         = "luks-no-data-segment"
+	LuksNotLuks               = "luks-not-luks"
+	LuksUnreadableHeader      = "luks-unreadable-header"
+	LuksUnreadableLuks1Header = "luks-unreadable-luks1-header"
+	LuksUnreadableLuks2Header = "luks-unreadable-luks2-header"
+	LuksUnreadableMetadata    = "luks-unreadable-metadata"
+	LuksUnsupportedVersion    = "luks-unsupported-version"
+
+	// misc
+	MiscInvalidSize     = "misc-invalid-size"
+	MiscSymlinkLoop     = "misc-symlink-loop"
+	MiscTooManySymlinks = "misc-too-many-symlinks"
+
+	// owner
+	OwnerInvalidLine = "owner-invalid-line"
+
+	// policy
+	PolicyInvalidArchive   = "policy-invalid-archive"
+	PolicyInvalidArguments = "policy-invalid-arguments"
+	PolicyInvalidPattern   = "policy-invalid-pattern"
+	PolicyInvalidRule      = "policy-invalid-rule"
+	PolicyRelativePattern  = "policy-relative-pattern"
+	PolicyUnknownType      = "policy-unknown-type"
+
+	// snapshot
+	SnapshotExists    = "snapshot-exists"
+	SnapshotInvalid   = "snapshot-invalid"
+	SnapshotNoneFound = "snapshot-none-found"
+
+	// state
+	StateInvalidLine = "state-invalid-line"
+)
@@ -0,0 +1,263 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+var magic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// Size of the binary part of the LUKS2 header, the JSON metadata follows it
+const luks2BinaryHeaderSize = 4096
+
+// Header has the information from a LUKS header that determines what is
+// needed for unlocking the device
+type Header struct {
+	Version int
+	// cipher used for the data, in cryptsetup format (e.g. "aes-xts-plain64")
+	Cipher string
+	// ciphers used for the keyslots, usually the same as Cipher
+	KeyslotCiphers []string
+	// hashes used for key derivation and digests (e.g. "sha256")
+	Hashes []string
+	// key derivation functions used by the keyslots (e.g. "pbkdf2",
+	// "argon2id")
+	KDFs []string
+	// integrity algorithm of the data segment (e.g. "hmac(sha256)"), if any.
+	// LUKS2 only.
+	Integrity string
+}
+
+// Read the LUKS header from the given file, which is either the encrypted
+// device or a header backup made with cryptsetup luksHeaderBackup
+func Read(path string) (Header, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return Header{}, err
+	}
+	defer fd.Close()
+
+	return Parse(fd)
+}
+
+// Parse a LUKS1 or LUKS2 header
+func Parse(r io.Reader) (Header, error) {
+	var h Header
+
+	var start struct {
+		Magic   [6]byte
+		Version uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &start); err != nil {
+		return h, i18n.Errorf(i18n.LuksUnreadableHeader, err)
+	}
+	if !bytes.Equal(start.Magic[:], magic) {
+		return h, i18n.NewError(i18n.LuksNotLuks)
+	}
+	h.Version = int(start.Version)
+
+	switch h.Version {
+	case 1:
+		return h, parseLuks1(r, &h)
+	case 2:
+		return h, parseLuks2(r, &h)
+	}
+
+	return h, i18n.Errorf(i18n.LuksUnsupportedVersion, h.Version)
+}
+
+func parseLuks1(r io.Reader, h *Header) error {
+	var hdr struct {
+		CipherName [32]byte
+		CipherMode [32]byte
+		HashSpec   [32]byte
+	}
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return i18n.Errorf(i18n.LuksUnreadableLuks1Header, err)
+	}
+
+	h.Cipher = cString(hdr.CipherName[:]) + "-" + cString(hdr.CipherMode[:])
+	h.KeyslotCiphers = []string{h.Cipher}
+	h.Hashes = []string{cString(hdr.HashSpec[:])}
+	h.KDFs = []string{"pbkdf2"}
+
+	return nil
+}
+
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		KDF struct {
+			Type string `json:"type"`
+			Hash string `json:"hash"`
+		} `json:"kdf"`
+		AF struct {
+			Hash string `json:"hash"`
+		} `json:"af"`
+		Area struct {
+			Encryption string `json:"encryption"`
+		} `json:"area"`
+	} `json:"keyslots"`
+	Segments map[string]struct {
+		Encryption string `json:"encryption"`
+		Integrity  *struct {
+			Type string `json:"type"`
+		} `json:"integrity"`
+	} `json:"segments"`
+	Digests map[string]struct {
+		Hash string `json:"hash"`
+	} `json:"digests"`
+}
+
+func parseLuks2(r io.Reader, h *Header) error {
+	var hdrSize uint64
+	if err := binary.Read(r, binary.BigEndian, &hdrSize); err != nil {
+		return i18n.Errorf(i18n.LuksUnreadableLuks2Header, err)
+	}
+	if hdrSize <= luks2BinaryHeaderSize {
+		return i18n.Errorf(i18n.LuksInvalidHeaderSize, hdrSize)
+	}
+
+	// skip the rest of the binary header, magic + version + size were read
+	if _, err := io.CopyN(io.Discard, r, luks2BinaryHeaderSize-16); err != nil {
+		return i18n.Errorf(i18n.LuksUnreadableLuks2Header, err)
+	}
+	area := make([]byte, hdrSize-luks2BinaryHeaderSize)
+	if _, err := io.ReadFull(r, area); err != nil {
+		return i18n.Errorf(i18n.LuksUnreadableMetadata, err)
+	}
+
+	var meta luks2Metadata
+	if err := json.Unmarshal([]byte(cString(area)), &meta); err != nil {
+		return i18n.Errorf(i18n.LuksInvalidMetadata, err)
+	}
+
+	hashes := make(map[string]bool)
+	kdfs := make(map[string]bool)
+	ciphers := make(map[string]bool)
+	for _, k := range meta.Keyslots {
+		kdfs[k.KDF.Type] = true
+		hashes[k.KDF.Hash] = true
+		hashes[k.AF.Hash] = true
+		ciphers[k.Area.Encryption] = true
+	}
+	for _, d := range meta.Digests {
+		hashes[d.Hash] = true
+	}
+	h.Hashes = sortedKeys(hashes)
+	h.KDFs = sortedKeys(kdfs)
+	h.KeyslotCiphers = sortedKeys(ciphers)
+
+	// the data segment, a device only has more than one while it is being
+	// re-encrypted
+	ids := sortedSegmentIDs(meta)
+	if len(ids) == 0 {
+		return i18n.NewError(i18n.LuksNoDataSegment)
+	}
+	seg := meta.Segments[ids[0]]
+	h.Cipher = seg.Encryption
+	if seg.Integrity != nil {
+		h.Integrity = seg.Integrity.Type
+	}
+
+	return nil
+}
+
+// Get the kernel crypto algorithms used by the device, e.g. "aes" and "xts"
+// for "aes-xts-plain64", so that only the modules for these need to be
+// included
+func (h Header) Algorithms() []string {
+	algs := make(map[string]bool)
+	for _, cipher := range append([]string{h.Cipher}, h.KeyslotCiphers...) {
+		for _, alg := range cipherAlgorithms(cipher) {
+			algs[alg] = true
+		}
+	}
+	for _, hash := range h.Hashes {
+		algs[hash] = true
+	}
+	for _, alg := range integrityAlgorithms(h.Integrity) {
+		algs[alg] = true
+	}
+	delete(algs, "")
+
+	return sortedKeys(algs)
+}
+
+// Get the algorithms from a cryptsetup cipher spec, in the format
+// <cipher>-<mode>-<iv>[:<iv hash>], e.g. "aes-cbc-essiv:sha256"
+func cipherAlgorithms(spec string) []string {
+	if spec == "" || spec == "cipher_null-ecb" || strings.HasPrefix(spec, "capi:") {
+		return nil
+	}
+	parts := strings.SplitN(spec, "-", 3)
+	// some modes use several ciphers, e.g. "xchacha12,aes-adiantum-plain64"
+	algs := strings.Split(parts[0], ",")
+	if len(parts) > 1 {
+		algs = append(algs, parts[1])
+	}
+	if len(parts) > 2 {
+		iv := strings.SplitN(parts[2], ":", 2)
+		switch iv[0] {
+		case "plain", "plain64", "plain64be", "null", "benbi":
+			// generated by dm-crypt itself
+		default:
+			algs = append(algs, iv[0])
+		}
+		if len(iv) == 2 {
+			algs = append(algs, iv[1])
+		}
+	}
+
+	return algs
+}
+
+// Get the algorithms from a dm-integrity algorithm, e.g. "hmac(sha256)"
+func integrityAlgorithms(spec string) []string {
+	var algs []string
+	for _, alg := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == '(' || r == ')' || r == ','
+	}) {
+		// aead integrity is provided by the cipher mode
+		if alg != "aead" && alg != "none" {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedSegmentIDs(meta luks2Metadata) []string {
+	var ids []string
+	for id := range meta.Segments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
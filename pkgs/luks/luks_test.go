@@ -0,0 +1,136 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func luks1Header(cipher string, mode string, hash string) []byte {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	for _, s := range []string{cipher, mode, hash} {
+		field := make([]byte, 32)
+		copy(field, s)
+		buf.Write(field)
+	}
+	// rest of the header isn't used
+	buf.Write(make([]byte, 512))
+	return buf.Bytes()
+}
+
+func luks2Header(metadata string) []byte {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(2))
+	binary.Write(&buf, binary.BigEndian, uint64(16384))
+	buf.Write(make([]byte, luks2BinaryHeaderSize-buf.Len()))
+	area := make([]byte, 16384-luks2BinaryHeaderSize)
+	copy(area, metadata)
+	buf.Write(area)
+	return buf.Bytes()
+}
+
+func TestParseLuks1(t *testing.T) {
+	h, err := Parse(bytes.NewReader(luks1Header("aes", "cbc-essiv:sha256", "sha1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Header{
+		Version:        1,
+		Cipher:         "aes-cbc-essiv:sha256",
+		KeyslotCiphers: []string{"aes-cbc-essiv:sha256"},
+		Hashes:         []string{"sha1"},
+		KDFs:           []string{"pbkdf2"},
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, h)
+	}
+	algs := []string{"aes", "cbc", "essiv", "sha1", "sha256"}
+	if out := h.Algorithms(); !reflect.DeepEqual(out, algs) {
+		t.Errorf("expected: %q, got: %q", algs, out)
+	}
+}
+
+func TestParseLuks2(t *testing.T) {
+	metadata := `{
+		"keyslots": {
+			"0": {
+				"type": "luks2",
+				"kdf": {"type": "argon2id", "time": 4, "memory": 1048576},
+				"af": {"type": "luks1", "hash": "sha256"},
+				"area": {"type": "raw", "encryption": "aes-xts-plain64"}
+			}
+		},
+		"segments": {
+			"0": {
+				"type": "crypt",
+				"encryption": "aes-xts-plain64",
+				"integrity": {"type": "hmac(sha256)"}
+			}
+		},
+		"digests": {
+			"0": {"type": "pbkdf2", "hash": "sha256"}
+		},
+		"config": {"json_size": "12288"}
+	}`
+	h, err := Parse(bytes.NewReader(luks2Header(metadata)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Header{
+		Version:        2,
+		Cipher:         "aes-xts-plain64",
+		KeyslotCiphers: []string{"aes-xts-plain64"},
+		Hashes:         []string{"sha256"},
+		KDFs:           []string{"argon2id"},
+		Integrity:      "hmac(sha256)",
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, h)
+	}
+	algs := []string{"aes", "hmac", "sha256", "xts"}
+	if out := h.Algorithms(); !reflect.DeepEqual(out, algs) {
+		t.Errorf("expected: %q, got: %q", algs, out)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tables := [][]byte{
+		[]byte("not a luks header at all, but long enough"),
+		[]byte("LUK"),
+		append(append([]byte{}, magic...), 0, 3),
+		luks2Header("{not json"),
+		luks2Header(`{"segments": {}}`),
+	}
+	for _, in := range tables {
+		if _, err := Parse(bytes.NewReader(in)); err == nil {
+			t.Errorf("expected error for: %q", in)
+		}
+	}
+}
+
+func TestCipherAlgorithms(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected []string
+	}{
+		{"aes-xts-plain64", []string{"aes", "xts"}},
+		{"serpent-cbc-essiv:sha256", []string{"serpent", "cbc", "essiv", "sha256"}},
+		{"xchacha12,aes-adiantum-plain64", []string{"xchacha12", "aes", "adiantum"}},
+		{"twofish-ecb", []string{"twofish", "ecb"}},
+		{"cipher_null-ecb", nil},
+		{"capi:cbc(aes)-essiv:sha256", nil},
+		{"", nil},
+	}
+	for _, table := range tables {
+		if out := cipherAlgorithms(table.in); !reflect.DeepEqual(out, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.in, table.expected, out)
+		}
+	}
+}
@@ -4,14 +4,30 @@
 package misc
 
 import (
+	"fmt"
 	"golang.org/x/sys/unix"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
 )
 
 type StringSet map[string]bool
 
+// Returns the strings in the set, sorted
+func (s StringSet) Sorted() []string {
+	sorted := make([]string, 0, len(s))
+	for str := range s {
+		sorted = append(sorted, str)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
 // Converts a relative symlink target path (e.g. ../../lib/foo.so), that is
 // absolute path
 func RelativeSymlinkTargetToDir(symPath string, dir string) (string, error) {
@@ -42,9 +58,69 @@ func RelativeSymlinkTargetToDir(symPath string, dir string) (string, error) {
 	return path, nil
 }
 
+// Maximum number of symlinks followed when resolving a path, the same limit
+// as in Linux (MAXSYMLINKS)
+const MaxSymlinks = 40
+
+// Checks that following the last symlink in chain (the symlinks followed so
+// far, in order) to target doesn't loop back to one of them, and that the
+// chain isn't longer than MaxSymlinks. The error names the whole chain.
+func CheckSymlinkChain(chain []string, target string) error {
+	links := strings.Join(append(append([]string{}, chain...), target), " -> ")
+	for _, link := range chain {
+		if filepath.Clean(link) == filepath.Clean(target) {
+			return i18n.Errorf(i18n.MiscSymlinkLoop, links)
+		}
+	}
+	if len(chain) > MaxSymlinks {
+		return i18n.Errorf(i18n.MiscTooManySymlinks, MaxSymlinks, links)
+	}
+	return nil
+}
+
 func FreeSpace(path string) (uint64, error) {
 	var stat unix.Statfs_t
 	unix.Statfs(path, &stat)
 	size := stat.Bavail * uint64(stat.Bsize)
 	return size, nil
 }
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// Parse a size in bytes with an optional K, M or G suffix (powers of 1024),
+// e.g. "8M"
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSuffix(str, u.suffix)
+			multiplier = u.size
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || size < 0 {
+		return 0, i18n.Errorf(i18n.MiscInvalidSize, s)
+	}
+
+	return size * multiplier, nil
+}
+
+// Format a size in bytes as a human readable string, e.g. "4.2M"
+func FormatSize(size int64) string {
+	for _, u := range sizeUnits {
+		if size >= u.size {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(u.size), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package misc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected int64
+		err      bool
+	}{
+		{"1024", 1024, false},
+		{"8M", 8 * 1024 * 1024, false},
+		{"8m", 8 * 1024 * 1024, false},
+		{"16K", 16 * 1024, false},
+		{"1G", 1024 * 1024 * 1024, false},
+		{" 4M ", 4 * 1024 * 1024, false},
+		{"M", 0, true},
+		{"-1", 0, true},
+		{"8MB", 0, true},
+	}
+	for _, table := range tables {
+		out, err := ParseSize(table.in)
+		if table.err != (err != nil) {
+			t.Errorf("unexpected error result for %q: %v", table.in, err)
+		}
+		if out != table.expected {
+			t.Errorf("expected: %d, got: %d", table.expected, out)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tables := []struct {
+		in       int64
+		expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0K"},
+		{1536, "1.5K"},
+		{4 * 1024 * 1024, "4.0M"},
+		{3 * 1024 * 1024 * 1024, "3.0G"},
+	}
+	for _, table := range tables {
+		if out := FormatSize(table.in); out != table.expected {
+			t.Errorf("expected: %q, got: %q", table.expected, out)
+		}
+	}
+}
+
+func TestStringSetSorted(t *testing.T) {
+	s := StringSet{"/usr/bin/foo": false, "/bin/sh": true, "/etc/deviceinfo": false}
+	expected := []string{"/bin/sh", "/etc/deviceinfo", "/usr/bin/foo"}
+	if sorted := s.Sorted(); !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("expected: %q, got: %q", expected, sorted)
+	}
+	if sorted := (StringSet{}).Sorted(); len(sorted) != 0 {
+		t.Errorf("expected no strings, got: %q", sorted)
+	}
+}
+
+func TestCheckSymlinkChain(t *testing.T) {
+	var long []string
+	for i := 0; i <= MaxSymlinks; i++ {
+		long = append(long, fmt.Sprintf("/link%d", i))
+	}
+
+	tables := []struct {
+		chain    []string
+		target   string
+		expected string
+	}{
+		{[]string{"/lib/libfoo.so"}, "/lib/libfoo.so.1", ""},
+		{[]string{"/a", "/b"}, "/c", ""},
+		{[]string{"/a"}, "/a", "symlink loop: /a -> /a"},
+		{[]string{"/a", "/b"}, "/a/", "symlink loop: /a -> /b -> /a/"},
+		{long[:MaxSymlinks], "/target", ""},
+		{long, "/target", fmt.Sprintf("too many levels of symlinks (more than %d): ", MaxSymlinks)},
+	}
+	for _, table := range tables {
+		err := CheckSymlinkChain(table.chain, table.target)
+		switch {
+		case table.expected == "" && err != nil:
+			t.Errorf("%q -> %q: unexpected error: %v", table.chain, table.target, err)
+		case table.expected != "" && (err == nil || !strings.HasPrefix(err.Error(), table.expected)):
+			t.Errorf("%q -> %q: expected error: %q, got: %v", table.chain, table.target, table.expected, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package owner
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Default location of the apk database of installed packages
+const ApkDb = "/lib/apk/db/installed"
+
+// Map of absolute file paths to the name of the package that owns them
+type Map map[string]string
+
+// Get the package that owns the given file, or "unknown"
+func (m Map) Owner(path string) string {
+	if pkg, ok := m[path]; ok {
+		return pkg
+	}
+	return "unknown"
+}
+
+// Read file ownership from the apk database of installed packages
+func ReadApkDb(path string) (Map, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return ParseApkDb(fd)
+}
+
+// Parse file ownership from an apk database. Each package in the database is
+// a block of "<key>:<value>" lines, where P is the package name, F is a
+// directory (relative to /) and R is a file in the last F directory.
+func ParseApkDb(r io.Reader) (Map, error) {
+	m := make(Map)
+	var pkg, dir string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			// end of package
+			pkg, dir = "", ""
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		val := line[2:]
+		switch line[0] {
+		case 'P':
+			pkg = val
+		case 'F':
+			dir = val
+		case 'R':
+			if pkg != "" {
+				m[filepath.Join("/", dir, val)] = pkg
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Read a file ownership map, where each line is "<path> <package>", for
+// systems that don't use apk
+func ReadMap(path string) (Map, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	m := make(Map)
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, i18n.Errorf(i18n.OwnerInvalidLine, path, line)
+		}
+		m[fields[0]] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package owner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testApkDb = `C:Q1abc=
+P:postmarketos-mkinitfs-hook-debug-shell
+V:0.6-r0
+F:etc
+F:etc/postmarketos-mkinitfs/files
+R:20-debug-shell.files
+F:etc/postmarketos-mkinitfs/hooks
+R:20-debug-shell.sh
+Z:Q1def=
+
+P:busybox
+V:1.33.1-r3
+F:bin
+R:busybox
+`
+
+func TestParseApkDb(t *testing.T) {
+	m, err := ParseApkDb(strings.NewReader(testApkDb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Map{
+		"/etc/postmarketos-mkinitfs/files/20-debug-shell.files": "postmarketos-mkinitfs-hook-debug-shell",
+		"/etc/postmarketos-mkinitfs/hooks/20-debug-shell.sh":    "postmarketos-mkinitfs-hook-debug-shell",
+		"/bin/busybox": "busybox",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected: %q, got: %q", expected, m)
+	}
+	if m.Owner("/bin/sh") != "unknown" {
+		t.Errorf("expected unknown owner for /bin/sh")
+	}
+}
+
+func TestReadMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners")
+	if err := os.WriteFile(path, []byte("# comment\n/bin/busybox busybox\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Owner("/bin/busybox") != "busybox" {
+		t.Errorf("unexpected owner: %q", m.Owner("/bin/busybox"))
+	}
+
+	if err := os.WriteFile(path, []byte("/bin/busybox\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMap(path); err == nil {
+		t.Error("expected error for invalid line")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package plan
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Plan is everything that would be generated and deployed, resolved without
+// building any archives. Frontends can use it for showing a preview, and
+// tests for checking what would be included.
+type Plan struct {
+	KernelVersion string    `json:"kernel_version"`
+	Flavor        string    `json:"flavor"`
+	Archives      []Archive `json:"archives"`
+	Deploy        Deploy    `json:"deploy"`
+}
+
+// Archive is the content of one archive
+type Archive struct {
+	Name string `json:"name"`
+	// files included at the same path as on the system, except for kernel
+	// modules
+	Files []string `json:"files"`
+	// kernel modules, and the files used by modprobe
+	Modules []string `json:"modules"`
+	// files included at a different path, as a map of path in the archive ->
+	// path on the system
+	Entries map[string]string `json:"entries,omitempty"`
+	// paths in the archive of files generated by mkinitfs
+	Generated []string `json:"generated,omitempty"`
+	Secrets   []string `json:"secrets,omitempty"`
+}
+
+// Deploy is what is passed to boot-deploy
+type Deploy struct {
+	OutDir string   `json:"out_dir"`
+	Files  []string `json:"files"`
+}
+
+// Create an Archive from the set of files to include, files under
+// /lib/modules are listed as modules
+func NewArchive(name string, files map[string]bool) Archive {
+	a := Archive{Name: name, Files: []string{}, Modules: []string{}}
+	for file := range files {
+		if strings.HasPrefix(file, "/lib/modules/") {
+			a.Modules = append(a.Modules, file)
+		} else {
+			a.Files = append(a.Files, file)
+		}
+	}
+	sort.Strings(a.Files)
+	sort.Strings(a.Modules)
+
+	return a
+}
+
+// Write the plan as JSON
+func (p Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNewArchive(t *testing.T) {
+	a := NewArchive("initramfs", map[string]bool{
+		"/usr/bin/unudhcpd":                          false,
+		"/lib/modules/5.14.0/modules.dep":            false,
+		"/bin/busybox":                               false,
+		"/lib/modules/5.14.0/kernel/drivers/loop.ko": false,
+		"/lib/libc.musl-aarch64.so.1":                false,
+	})
+	expected := Archive{
+		Name:    "initramfs",
+		Files:   []string{"/bin/busybox", "/lib/libc.musl-aarch64.so.1", "/usr/bin/unudhcpd"},
+		Modules: []string{"/lib/modules/5.14.0/kernel/drivers/loop.ko", "/lib/modules/5.14.0/modules.dep"},
+	}
+	if !reflect.DeepEqual(a, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, a)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	p := Plan{
+		KernelVersion: "5.14.0",
+		Flavor:        "postmarketos-allwinner",
+		Archives: []Archive{
+			NewArchive("initramfs", map[string]bool{"/bin/busybox": false}),
+		},
+		Deploy: Deploy{OutDir: "/boot", Files: []string{"initramfs-extra"}},
+	}
+	p.Archives[0].Entries = map[string]string{"/init": "/usr/share/postmarketos-mkinitfs/init.sh"}
+
+	var buf bytes.Buffer
+	if err := p.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var out Plan
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, p) {
+		t.Errorf("expected: %+v, got: %+v", p, out)
+	}
+}
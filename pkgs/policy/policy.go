@@ -0,0 +1,250 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/archive"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/misc"
+)
+
+// Archives that a policy can apply to
+const (
+	ArchiveInitfs      = "initramfs"
+	ArchiveInitfsExtra = "initramfs-extra"
+)
+
+// Types of rules
+const (
+	// At least one entry matching the pattern must be in the archive, as a
+	// regular file (or a symlink to one)
+	Require = "require"
+	// No entry matching the pattern may be in the archive
+	Forbid = "forbid"
+	// Entries matching the pattern may not be larger than the size
+	MaxSize = "max-size"
+)
+
+// Rule is a single rule of a policy
+type Rule struct {
+	Type string
+	// Path in the archive, may contain wildcards (see filepath.Match)
+	Pattern string
+	// For Require rules, all matching entries must be executable
+	Executable bool
+	// For MaxSize rules, in bytes
+	Size int64
+	// Where the rule comes from (<file>:<line>), for reporting violations
+	Source string
+}
+
+// Policy is a list of rules that an archive has to satisfy, checked after
+// writing it, so that distributions can encode what their archives need to
+// boot. Policy files (<name>.policy) have one rule per line, e.g.:
+//
+//	# comments and empty lines are ignored
+//	# the archive the rules apply to, initramfs by default
+//	archive initramfs
+//	require /init executable
+//	require /lib/firmware/qcom/*
+//	forbid /etc/shadow
+//	max-size /lib/firmware/* 4M
+type Policy struct {
+	// Path to the policy file
+	Path    string
+	Archive string
+	Rules   []Rule
+}
+
+// Violation is a rule that an archive doesn't satisfy
+type Violation struct {
+	Rule Rule
+	// The entry violating the rule, or the pattern if nothing matched a
+	// Require rule
+	Path    string
+	Problem string
+}
+
+func (v Violation) String() string {
+	if v.Rule.Source == "" {
+		return fmt.Sprintf("%s: %s", v.Path, v.Problem)
+	}
+	return fmt.Sprintf("%s: %s (%s)", v.Path, v.Problem, v.Rule.Source)
+}
+
+// Read the policy at the given path
+func Read(path string) (Policy, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return Policy{Path: path}, err
+	}
+	defer fd.Close()
+
+	p, err := Parse(fd, path)
+	if err != nil {
+		return p, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// Read all policies (*.policy) in the given directory, sorted by path. The
+// directory not existing is not an error.
+func ReadDir(dir string) ([]Policy, error) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.policy"))
+	sort.Strings(paths)
+
+	var policies []Policy
+	for _, path := range paths {
+		p, err := Read(path)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
+
+// Parse a policy, the name is used in the sources of the rules
+func Parse(r io.Reader, name string) (Policy, error) {
+	p := Policy{Path: name, Archive: ArchiveInitfs}
+	s := bufio.NewScanner(r)
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if fields[0] == "archive" {
+			if len(fields) != 2 || (fields[1] != ArchiveInitfs && fields[1] != ArchiveInitfsExtra) {
+				return p, i18n.Errorf(i18n.PolicyInvalidArchive, lineNum, ArchiveInitfs, ArchiveInitfsExtra, line)
+			}
+			p.Archive = fields[1]
+			continue
+		}
+
+		if len(fields) < 2 {
+			return p, i18n.Errorf(i18n.PolicyInvalidRule, lineNum, line)
+		}
+		rule := Rule{
+			Type:    fields[0],
+			Pattern: fields[1],
+			Source:  fmt.Sprintf("%s:%d", name, lineNum),
+		}
+		if !filepath.IsAbs(rule.Pattern) {
+			return p, i18n.Errorf(i18n.PolicyRelativePattern, lineNum, rule.Pattern)
+		}
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+			return p, i18n.Errorf(i18n.PolicyInvalidPattern, lineNum, rule.Pattern, err)
+		}
+
+		switch {
+		case rule.Type == Require && len(fields) == 2:
+		case rule.Type == Require && len(fields) == 3 && fields[2] == "executable":
+			rule.Executable = true
+		case rule.Type == Forbid && len(fields) == 2:
+		case rule.Type == MaxSize && len(fields) == 3:
+			size, err := misc.ParseSize(fields[2])
+			if err != nil {
+				return p, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			rule.Size = size
+		case rule.Type == Require || rule.Type == Forbid || rule.Type == MaxSize:
+			return p, i18n.Errorf(i18n.PolicyInvalidArguments, lineNum, rule.Type, line)
+		default:
+			return p, i18n.Errorf(i18n.PolicyUnknownType, lineNum, rule.Type)
+		}
+		p.Rules = append(p.Rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// Check the entries of an archive (see archive.ReadEntries) against the rules
+// of the policy, returns the violations sorted by path
+func (p Policy) Check(entries map[string]archive.Entry) []Violation {
+	var violations []Violation
+	for _, rule := range p.Rules {
+		violations = append(violations, rule.check(entries)...)
+	}
+
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Path < violations[j].Path
+	})
+	return violations
+}
+
+func (r Rule) check(entries map[string]archive.Entry) []Violation {
+	var matches []string
+	for name := range entries {
+		if ok, _ := filepath.Match(r.Pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+
+	var violations []Violation
+	violation := func(path string, format string, a ...interface{}) {
+		violations = append(violations, Violation{Rule: r, Path: path, Problem: fmt.Sprintf(format, a...)})
+	}
+
+	switch r.Type {
+	case Require:
+		if len(matches) == 0 {
+			violation(r.Pattern, "missing")
+		}
+		for _, name := range matches {
+			entry, ok := resolve(entries, name)
+			switch {
+			case !ok:
+				violation(name, "broken symlink")
+			case !entry.Mode.IsRegular():
+				violation(name, "not a regular file (mode %o)", entry.Mode)
+			case r.Executable && entry.Mode&0111 == 0:
+				violation(name, "not executable")
+			}
+		}
+	case Forbid:
+		for _, name := range matches {
+			violation(name, "forbidden")
+		}
+	case MaxSize:
+		for _, name := range matches {
+			if size := entries[name].Size; size > r.Size {
+				violation(name, "too large (%s, the limit is %s)", misc.FormatSize(size), misc.FormatSize(r.Size))
+			}
+		}
+	}
+
+	return violations
+}
+
+// Follow symlinks in the archive, with a limit in case of loops
+func resolve(entries map[string]archive.Entry, name string) (archive.Entry, bool) {
+	entry, ok := entries[name]
+	for i := 0; ok && entry.IsSymlink() && i < 10; i++ {
+		target := entry.Linkname
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		name = target
+		entry, ok = entries[name]
+	}
+	return entry, ok
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cavaliercoder/go-cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/archive"
+)
+
+func TestParse(t *testing.T) {
+	in := `
+# a comment
+archive initramfs-extra
+require /init executable
+  require   /lib/firmware/qcom/*
+forbid /etc/shadow
+
+max-size /lib/firmware/* 4M
+`
+	p, err := Parse(strings.NewReader(in), "foo.policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Policy{
+		Path:    "foo.policy",
+		Archive: ArchiveInitfsExtra,
+		Rules: []Rule{
+			{Type: Require, Pattern: "/init", Executable: true, Source: "foo.policy:4"},
+			{Type: Require, Pattern: "/lib/firmware/qcom/*", Source: "foo.policy:5"},
+			{Type: Forbid, Pattern: "/etc/shadow", Source: "foo.policy:6"},
+			{Type: MaxSize, Pattern: "/lib/firmware/*", Size: 4 << 20, Source: "foo.policy:8"},
+		},
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, p)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tables := []string{
+		"require",
+		"require init",
+		"require /init setuid",
+		"require /lib/[firmware",
+		"forbid /etc/shadow /etc/passwd",
+		"max-size /lib/firmware/*",
+		"max-size /lib/firmware/* big",
+		"archive boot",
+		"allow /etc/shadow",
+	}
+	for _, table := range tables {
+		if _, err := Parse(strings.NewReader(table), "foo.policy"); err == nil {
+			t.Errorf("expected error for: %q", table)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"b.policy": "forbid /etc/shadow\n",
+		"a.policy": "require /init\n",
+		"c.txt":    "not a policy\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policies, err := ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || filepath.Base(policies[0].Path) != "a.policy" || filepath.Base(policies[1].Path) != "b.policy" {
+		t.Errorf("unexpected policies: %+v", policies)
+	}
+
+	if policies, err := ReadDir(filepath.Join(dir, "missing")); err != nil || len(policies) != 0 {
+		t.Errorf("expected no policies and no error, got: %+v, %v", policies, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "d.policy"), []byte("require\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDir(dir); err == nil || !strings.Contains(err.Error(), "d.policy") {
+		t.Errorf("expected error for d.policy, got: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	entries := map[string]archive.Entry{
+		"/init":                   {Mode: cpio.ModeRegular | 0755, Size: 100},
+		"/bin/sh":                 {Mode: cpio.ModeSymlink | 0777, Linkname: "busybox"},
+		"/bin/busybox":            {Mode: cpio.ModeRegular | 0755, Size: 1 << 20},
+		"/bin/broken":             {Mode: cpio.ModeSymlink | 0777, Linkname: "/bin/missing"},
+		"/etc/shadow":             {Mode: cpio.ModeRegular | 0600, Size: 10},
+		"/etc/deviceinfo":         {Mode: cpio.ModeRegular | 0644, Size: 10},
+		"/lib/firmware/small.bin": {Mode: cpio.ModeRegular | 0644, Size: 1 << 10},
+		"/lib/firmware/large.bin": {Mode: cpio.ModeRegular | 0644, Size: 8 << 20},
+	}
+
+	tables := []struct {
+		rule     Rule
+		expected []string
+	}{
+		{Rule{Type: Require, Pattern: "/init", Executable: true}, nil},
+		{Rule{Type: Require, Pattern: "/bin/sh", Executable: true}, nil},
+		{Rule{Type: Require, Pattern: "/sbin/init"}, []string{"/sbin/init: missing"}},
+		{Rule{Type: Require, Pattern: "/bin/broken"}, []string{"/bin/broken: broken symlink"}},
+		{Rule{Type: Require, Pattern: "/etc/*", Executable: true}, []string{"/etc/deviceinfo: not executable", "/etc/shadow: not executable"}},
+		{Rule{Type: Require, Pattern: "/lib/firmware/*.bin"}, nil},
+		{Rule{Type: Forbid, Pattern: "/etc/shadow", Source: "foo.policy:1"}, []string{"/etc/shadow: forbidden (foo.policy:1)"}},
+		{Rule{Type: Forbid, Pattern: "/etc/passwd"}, nil},
+		{Rule{Type: MaxSize, Pattern: "/lib/firmware/*", Size: 4 << 20}, []string{"/lib/firmware/large.bin: too large (8.0M, the limit is 4.0M)"}},
+	}
+	for _, table := range tables {
+		var got []string
+		for _, v := range (Policy{Rules: []Rule{table.rule}}).Check(entries) {
+			got = append(got, v.String())
+		}
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%+v: expected: %q, got: %q", table.rule, table.expected, got)
+		}
+	}
+}
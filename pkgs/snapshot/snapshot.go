@@ -0,0 +1,157 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package snapshot
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Default location for snapshots of the output dir
+const DefaultDir = "/var/lib/postmarketos-mkinitfs/snapshots"
+
+// Snapshots are named after the time they were created, so sorting them by
+// name sorts them by age
+const nameFormat = "20060102-150405"
+
+// Copy the regular files in srcDir (e.g. /boot) to a new snapshot in dir,
+// named after the given time, and return the path to it. Subdirectories of
+// srcDir are not included. The snapshot is only moved into place after all
+// files were copied, so an interrupted snapshot is never restored.
+func Create(srcDir string, dir string, t time.Time) (string, error) {
+	snapshot := filepath.Join(dir, t.UTC().Format(nameFormat))
+	if _, err := os.Stat(snapshot); err == nil {
+		return "", i18n.Errorf(i18n.SnapshotExists, snapshot)
+	}
+
+	tmp := snapshot + ".new"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return "", err
+	}
+	if err := copyFiles(srcDir, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, snapshot); err != nil {
+		return "", err
+	}
+
+	return snapshot, nil
+}
+
+// Returns the names of the snapshots in dir, oldest first
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(nameFormat, e.Name()); err != nil {
+			// e.g. an incomplete snapshot
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Returns the name of the newest snapshot in dir
+func Latest(dir string) (string, error) {
+	names, err := List(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", i18n.Errorf(i18n.SnapshotNoneFound, dir)
+	}
+
+	return names[len(names)-1], nil
+}
+
+// Copy the files in the snapshot with the given name back to destDir. Each
+// file is replaced atomically, files in destDir that aren't in the snapshot
+// are left alone.
+func Restore(dir string, name string, destDir string) error {
+	snapshot := filepath.Join(dir, name)
+	if stat, err := os.Stat(snapshot); err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return i18n.Errorf(i18n.SnapshotInvalid, snapshot)
+	}
+
+	return copyFiles(snapshot, destDir)
+}
+
+// Copy the regular files in src to dest, keeping their permissions
+func copyFiles(src string, dest string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, e.Name()), filepath.Join(dest, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dest + ".new"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// call fsync, since these are boot files
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dest)
+}
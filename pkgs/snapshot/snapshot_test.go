@@ -0,0 +1,80 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	boot := t.TempDir()
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	if err := os.WriteFile(filepath.Join(boot, "initramfs"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(boot, "vmlinuz"), []byte("kernel"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(boot, "dtbs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	first := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	snapshot, err := Create(boot, dir, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(snapshot) != "20210601-120000" {
+		t.Errorf("unexpected snapshot name: %s", snapshot)
+	}
+	if _, err := os.Stat(filepath.Join(snapshot, "dtbs")); err == nil {
+		t.Error("expected dirs to not be included in the snapshot")
+	}
+	if _, err := Create(boot, dir, first); err == nil {
+		t.Error("expected error when the snapshot already exists")
+	}
+	if _, err := Create(boot, dir, first.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// incomplete snapshots are ignored
+	if err := os.Mkdir(filepath.Join(dir, "20210601-140000.new"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "20210601-120000" || names[1] != "20210601-130000" {
+		t.Errorf("unexpected snapshots: %q", names)
+	}
+	if latest, err := Latest(dir); err != nil || latest != "20210601-130000" {
+		t.Errorf("unexpected latest snapshot: %q, %v", latest, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(boot, "initramfs"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(dir, "20210601-120000", boot); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := os.ReadFile(filepath.Join(boot, "initramfs")); err != nil || string(contents) != "old" {
+		t.Errorf("expected initramfs to be restored, got: %q, %v", contents, err)
+	}
+	if stat, err := os.Stat(filepath.Join(boot, "vmlinuz")); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("expected vmlinuz to keep its mode, got: %v, %v", stat, err)
+	}
+	if err := Restore(dir, "missing", boot); err == nil {
+		t.Error("expected error for a missing snapshot")
+	}
+}
+
+func TestLatestWithoutSnapshots(t *testing.T) {
+	if _, err := Latest(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error without snapshots")
+	}
+}
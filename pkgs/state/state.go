@@ -0,0 +1,125 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package state
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/digest"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/i18n"
+)
+
+// Default location of the state file, which records the inputs of the last
+// successful build
+const DefaultPath = "/var/lib/postmarketos-mkinitfs/state"
+
+// State is the set of inputs used for generating the initramfs, as a map of
+// input name -> value.
+type State map[string]string
+
+// Read the state from the given path. A missing state file is not an error,
+// and returns an empty state.
+func Read(path string) (State, error) {
+	s := make(State)
+	fd, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return s, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			return s, i18n.Errorf(i18n.StateInvalidLine, path, scanner.Text())
+		}
+		s[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// Write the state to the given path, replacing it atomically
+func (s State) Write(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	var keys []string
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var contents strings.Builder
+	for _, k := range keys {
+		// keep everything on one line
+		fmt.Fprintf(&contents, "%s=%s\n", k, strings.ReplaceAll(s[k], "\n", " "))
+	}
+
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, []byte(contents.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Returns true if both states have the same inputs with the same values
+func (s State) Equal(other State) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for k, v := range s {
+		if ov, ok := other[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Change is an input that differs between two states. Old is empty if the
+// input was added, New is empty if it was removed.
+type Change struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// Returns the inputs that changed from old to s, sorted by name
+func (s State) Diff(old State) []Change {
+	var changes []Change
+	for k, v := range s {
+		if ov, ok := old[k]; !ok || ov != v {
+			changes = append(changes, Change{Name: k, Old: old[k], New: v})
+		}
+	}
+	for k, ov := range old {
+		if _, ok := s[k]; !ok {
+			changes = append(changes, Change{Name: k, Old: ov})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes
+}
+
+// Returns the sha256 of the given file, for recording the contents of input
+// files in the state
+func HashFile(path string) (string, error) {
+	return digest.SHA256.File(path)
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir", "state")
+
+	s, err := Read(path)
+	if err != nil {
+		t.Fatal("unexpected error reading missing state: ", err)
+	}
+	if len(s) != 0 {
+		t.Errorf("expected empty state, got: %q", s)
+	}
+
+	s = State{
+		"kernel_version":            "5.14.0",
+		"deviceinfo_kernel_cmdline": "console=ttyS0 foo=bar",
+		"deviceinfo_modules_initfs": "",
+		"deviceinfo_mesa_driver":    "panfrost",
+	}
+	if err := s.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.Equal(s) {
+		t.Errorf("expected: %q, got: %q", s, out)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := State{"a": "1", "b": "2"}
+	tables := []struct {
+		b        State
+		expected bool
+	}{
+		{State{"a": "1", "b": "2"}, true},
+		{State{"a": "1", "b": "3"}, false},
+		{State{"a": "1"}, false},
+		{State{"a": "1", "c": "2"}, false},
+		{State{"a": "1", "b": "2", "c": "3"}, false},
+	}
+	for _, table := range tables {
+		if out := a.Equal(table.b); out != table.expected {
+			t.Errorf("%q == %q: expected %t, got: %t", a, table.b, table.expected, out)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := State{"a": "1", "b": "2", "c": "3"}
+	s := State{"a": "1", "b": "4", "d": "5"}
+
+	expected := []Change{
+		{Name: "b", Old: "2", New: "4"},
+		{Name: "c", Old: "3"},
+		{Name: "d", New: "5"},
+	}
+	if out := s.Diff(old); !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, out)
+	}
+	if out := s.Diff(s); len(out) != 0 {
+		t.Errorf("expected no changes, got: %+v", out)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	if out != expected {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
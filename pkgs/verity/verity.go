@@ -0,0 +1,178 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package verity
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// Parameters used for the hash tree, these match the defaults used by
+// 'veritysetup format'
+const (
+	BlockSize      = 4096
+	saltSize       = 32
+	hashType       = 1
+	sbVersion      = 1
+	algorithm      = "sha256"
+	digestSize     = sha256.Size
+	hashesPerBlock = BlockSize / digestSize
+)
+
+// Superblock written at the start of the hash device, see 'struct verity_sb'
+// in cryptsetup's lib/verity/verity.c
+type superblock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [256]byte
+	_             [168]byte
+}
+
+type Params struct {
+	// Root hash of the tree, hex encoded
+	RootHash string
+	// Size of the data, before it was padded
+	DataSize int64
+}
+
+// Create a dm-verity hash tree (with superblock) for the data file at
+// dataPath, and write it to hashPath. The data file is padded with zeroes to
+// a multiple of BlockSize, since the kernel can only map whole blocks.
+func Create(dataPath string, hashPath string) (Params, error) {
+	var params Params
+
+	data, err := os.OpenFile(dataPath, os.O_RDWR, 0)
+	if err != nil {
+		return params, err
+	}
+	defer data.Close()
+
+	stat, err := data.Stat()
+	if err != nil {
+		return params, err
+	}
+	params.DataSize = stat.Size()
+	dataBlocks := (params.DataSize + BlockSize - 1) / BlockSize
+	if dataBlocks == 0 {
+		dataBlocks = 1
+	}
+	if err := data.Truncate(dataBlocks * BlockSize); err != nil {
+		return params, err
+	}
+
+	var salt [saltSize]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return params, err
+	}
+
+	root, levels, err := hashTree(data, dataBlocks, salt[:])
+	if err != nil {
+		return params, err
+	}
+	params.RootHash = hex.EncodeToString(root)
+
+	if err := data.Sync(); err != nil {
+		return params, err
+	}
+
+	sb := superblock{
+		Version:       sbVersion,
+		HashType:      hashType,
+		DataBlockSize: BlockSize,
+		HashBlockSize: BlockSize,
+		DataBlocks:    uint64(dataBlocks),
+		SaltSize:      saltSize,
+	}
+	copy(sb.Signature[:], "verity")
+	copy(sb.Algorithm[:], algorithm)
+	copy(sb.Salt[:], salt[:])
+	if _, err := rand.Read(sb.UUID[:]); err != nil {
+		return params, err
+	}
+
+	fd, err := os.Create(hashPath)
+	if err != nil {
+		return params, err
+	}
+	defer fd.Close()
+
+	sbBuf := make([]byte, BlockSize)
+	w := bytes.NewBuffer(sbBuf[:0])
+	if err := binary.Write(w, binary.LittleEndian, &sb); err != nil {
+		return params, err
+	}
+	if _, err := fd.Write(sbBuf); err != nil {
+		return params, err
+	}
+
+	// the top-most level is first in the hash device
+	for i := len(levels) - 1; i >= 0; i-- {
+		if _, err := fd.Write(levels[i]); err != nil {
+			return params, err
+		}
+	}
+
+	if err := fd.Sync(); err != nil {
+		return params, err
+	}
+
+	return params, nil
+}
+
+// Calculate the hash tree for the given data, returns the root hash and the
+// hash blocks for each level, starting with the level that hashes the data
+func hashTree(data io.ReaderAt, dataBlocks int64, salt []byte) ([]byte, [][]byte, error) {
+	// number of levels is calculated the same way veritysetup does
+	var numLevels int
+	for numLevels*7 < 64 && (dataBlocks-1)>>(7*numLevels) != 0 {
+		numLevels++
+	}
+
+	block := make([]byte, BlockSize)
+	if numLevels == 0 {
+		if _, err := data.ReadAt(block, 0); err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		return hashBlock(salt, block), nil, nil
+	}
+
+	var levels [][]byte
+	src := data
+	srcBlocks := dataBlocks
+	for l := 0; l < numLevels; l++ {
+		blocks := (srcBlocks + hashesPerBlock - 1) / hashesPerBlock
+		level := make([]byte, blocks*BlockSize)
+		for i := int64(0); i < srcBlocks; i++ {
+			if _, err := src.ReadAt(block, i*BlockSize); err != nil && err != io.EOF {
+				return nil, nil, err
+			}
+			copy(level[i*digestSize:], hashBlock(salt, block))
+		}
+		levels = append(levels, level)
+		src = bytes.NewReader(level)
+		srcBlocks = blocks
+	}
+
+	return hashBlock(salt, levels[numLevels-1][:BlockSize]), levels, nil
+}
+
+func hashBlock(salt []byte, block []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(block)
+	return h.Sum(nil)
+}
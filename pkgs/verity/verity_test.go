@@ -0,0 +1,98 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package verity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSuperblockSize(t *testing.T) {
+	if size := binary.Size(superblock{}); size != 512 {
+		t.Errorf("expected superblock size of 512, got: %d", size)
+	}
+}
+
+func TestHashTree(t *testing.T) {
+	salt := []byte("salt")
+
+	// single block: no hash levels, root is the hash of the data block
+	data := bytes.Repeat([]byte{1}, BlockSize)
+	root, levels, err := hashTree(bytes.NewReader(data), 1, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 0 || !bytes.Equal(root, hashBlock(salt, data)) {
+		t.Errorf("unexpected tree for single block")
+	}
+
+	// two blocks: one level, holding the hashes of both blocks
+	data = append(data, bytes.Repeat([]byte{2}, BlockSize)...)
+	root, levels, err = hashTree(bytes.NewReader(data), 2, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 1 || len(levels[0]) != BlockSize {
+		t.Fatalf("unexpected levels for two blocks: %d", len(levels))
+	}
+	expected := make([]byte, BlockSize)
+	copy(expected, hashBlock(salt, data[:BlockSize]))
+	copy(expected[digestSize:], hashBlock(salt, data[BlockSize:]))
+	if !bytes.Equal(levels[0], expected) {
+		t.Error("unexpected level 0 contents")
+	}
+	if !bytes.Equal(root, hashBlock(salt, expected)) {
+		t.Error("unexpected root hash")
+	}
+
+	// more blocks than fit in a hash block needs a second level
+	_, levels, err = hashTree(bytes.NewReader(make([]byte, 129*BlockSize)), 129, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || len(levels[0]) != 2*BlockSize || len(levels[1]) != BlockSize {
+		t.Errorf("unexpected levels for 129 blocks")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "data")
+	hashPath := filepath.Join(dir, "hash")
+	if err := os.WriteFile(dataPath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := Create(dataPath, hashPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.DataSize != 5 {
+		t.Errorf("expected data size 5, got: %d", params.DataSize)
+	}
+	if root, err := hex.DecodeString(params.RootHash); err != nil || len(root) != digestSize {
+		t.Errorf("invalid root hash: %q", params.RootHash)
+	}
+
+	stat, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != BlockSize {
+		t.Errorf("data not padded to block size, size is: %d", stat.Size())
+	}
+
+	hash, err := os.ReadFile(hashPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// superblock only, since there is a single data block
+	if len(hash) != BlockSize || !bytes.HasPrefix(hash, []byte("verity\x00\x00")) {
+		t.Errorf("unexpected hash device contents")
+	}
+}